@@ -0,0 +1,43 @@
+package atomicfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	err := Write(path, 0644, func(w io.Writer) error {
+		_, err := io.WriteString(w, "first")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unable to write: %s", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected mode: %s", info.Mode())
+	}
+
+	// a failing write leaves the previous file
+	err = Write(path, 0644, func(w io.Writer) error {
+		io.WriteString(w, "half")
+		return fmt.Errorf("disk full")
+	})
+	if err == nil {
+		t.Fatalf("failing write was not reported")
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "first" {
+		t.Fatalf("previous file was replaced: %s", data)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("temporary files were left: %v", entries)
+	}
+}
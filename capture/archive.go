@@ -0,0 +1,96 @@
+// Package capture records what is read from conntrack and the dnsmasq leases into a
+// single archive, and replays archives in their place at real or accelerated speed
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fasmide/routerlogin/conntrack"
+)
+
+// Kinds of entries
+const (
+	// KindListing is the output of conntrack -L
+	KindListing = "listing"
+	// KindEvents is output of conntrack -E, as it was read
+	KindEvents = "events"
+	// KindLeases is the content of the leases file
+	KindLeases = "leases"
+)
+
+// Entry is something read at a point in time
+type Entry struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+
+	// Format is the conntrack output format of listings and events
+	Format conntrack.Format `json:"format,omitempty"`
+
+	// Stream tells apart the events of followers, as each follows its own stream of
+	// events. Streams are numbered from 1, archives recorded before them have stream 0
+	Stream int `json:"stream,omitempty"`
+
+	Data string `json:"data"`
+}
+
+// Writer writes entries as gzipped json lines
+type Writer struct {
+	lock    sync.Mutex
+	gz      *gzip.Writer
+	encoder *json.Encoder
+}
+
+// NewWriter returns a writer of an archive to w
+func NewWriter(w io.Writer) *Writer {
+	gz := gzip.NewWriter(w)
+	return &Writer{gz: gz, encoder: json.NewEncoder(gz)}
+}
+
+// Write writes an entry, entries are flushed as they are written so the archive of
+// a crashed daemon can be read up to the crash
+func (w *Writer) Write(e Entry) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := w.encoder.Encode(e)
+	if err != nil {
+		return err
+	}
+	return w.gz.Flush()
+}
+
+// Close ends the archive, the underlying writer is left open
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.gz.Close()
+}
+
+// ReadArchive reads every entry of an archive, archives cut short are read up to where they end
+func ReadArchive(r io.Reader) ([]Entry, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	decoder := json.NewDecoder(gz)
+	for {
+		var e Entry
+		err = decoder.Decode(&e)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
@@ -0,0 +1,220 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasmide/routerlogin/conntrack"
+	"github.com/fasmide/routerlogin/dnsmasq"
+)
+
+// live stands in for conntrack and the leases file
+type live struct {
+	listing string
+	events  string
+	leases  string
+}
+
+func (l *live) List(format conntrack.Format) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(l.listing)), nil
+}
+
+func (l *live) Events(ctx context.Context, format conntrack.Format) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(l.events)), nil
+}
+
+func (l *live) Leases() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(l.leases)), nil
+}
+
+const (
+	flow157 = "tcp      6 431999 ESTABLISHED src=192.168.1.157 dst=52.85.250.243 sport=54376 dport=443 src=52.85.250.243 dst=85.191.222.130 sport=443 dport=54376 [ASSURED] mark=0 use=1\n"
+	flow76  = "udp      17 29 src=192.168.1.76 dst=1.1.1.1 sport=53211 dport=53 src=1.1.1.1 dst=85.191.222.130 sport=53 dport=53211 mark=0 use=1\n"
+	event76 = "[NEW] udp      17 30 src=192.168.1.76 dst=1.1.1.1 sport=53211 dport=53 [UNREPLIED] src=1.1.1.1 dst=85.191.222.130 sport=53 dport=53211\n"
+	lease   = "1900000000 aa:bb:cc:00:00:01 192.168.1.157 laptop *\n"
+)
+
+// addresses returns the sorted addresses of a store
+func addresses(t *testing.T, s interface{ Addresses() ([]net.IP, error) }) []string {
+	ips, err := s.Addresses()
+	if err != nil {
+		t.Fatalf("unable to read addresses: %s", err)
+	}
+	var res []string
+	for _, ip := range ips {
+		res = append(res, ip.String())
+	}
+	sort.Strings(res)
+	return res
+}
+
+// follow returns the hosts of the events followed until ctx is done
+func follow(ctx context.Context, states *conntrack.StateStore) []string {
+	var hosts []string
+	states.Follow(ctx, func(u *conntrack.FlowUpdate) {
+		hosts = append(hosts, u.Flow.Original.Layer3.Source.String())
+	})
+	return hosts
+}
+
+func TestRecordReplay(t *testing.T) {
+	var archive bytes.Buffer
+	source := &live{listing: flow157, events: event76, leases: lease}
+	recorder := &Recorder{Conntrack: source, Dnsmasq: source, Writer: NewWriter(&archive)}
+
+	// the daemon reads its sources through the recorder
+	states := &conntrack.StateStore{Source: recorder}
+	leases := &dnsmasq.Store{Source: recorder}
+	addresses(t, states)
+	addresses(t, leases)
+	follow(context.Background(), states)
+
+	// the router moves on, a while later
+	time.Sleep(10 * time.Millisecond)
+	source.listing = flow157 + flow76
+	states.Reload()
+	addresses(t, states)
+
+	err := recorder.Writer.Close()
+	if err != nil {
+		t.Fatalf("unable to close archive: %s", err)
+	}
+
+	entries, err := ReadArchive(&archive)
+	if err != nil {
+		t.Fatalf("unable to read archive: %s", err)
+	}
+	var kinds []string
+	for _, e := range entries {
+		kinds = append(kinds, e.Kind)
+	}
+	if strings.Join(kinds, " ") != "listing leases events listing" {
+		t.Fatalf("unexpected entries: %s", kinds)
+	}
+
+	// replaying starts out as recorded
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	player := NewPlayer(entries)
+	player.now = func() time.Time { return now }
+
+	states = &conntrack.StateStore{Source: player}
+	if ips := addresses(t, states); strings.Join(ips, " ") != "192.168.1.157" {
+		t.Fatalf("unexpected replayed flows: %s", ips)
+	}
+	leases = &dnsmasq.Store{Source: player}
+	if lease, err := leases.LeaseByIP("192.168.1.157"); err != nil || lease.Hostname != "laptop" {
+		t.Fatalf("unexpected replayed lease: %+v, %v", lease, err)
+	}
+
+	// and catches up as time goes by
+	now = now.Add(time.Minute)
+	states.Reload()
+	if ips := addresses(t, states); strings.Join(ips, " ") != "192.168.1.157 192.168.1.76" {
+		t.Fatalf("unexpected later replayed flows: %s", ips)
+	}
+
+	// events recorded before the clock are in the past
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if hosts := follow(ctx, states); len(hosts) != 0 {
+		t.Fatalf("past events were replayed: %s", hosts)
+	}
+}
+
+func TestReplayEvents(t *testing.T) {
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	player := NewPlayer([]Entry{
+		{Time: start.Add(time.Hour), Kind: KindEvents, Data: event76},
+		{Time: start, Kind: KindListing, Data: flow157},
+		{Time: start.Add(2 * time.Hour), Kind: KindEvents, Data: strings.Replace(event76, "192.168.1.76", "192.168.1.77", 1)},
+	})
+
+	// two hours of events in about 20ms
+	player.Speed = 360000
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	began := time.Now()
+	hosts := follow(ctx, &conntrack.StateStore{Source: player})
+	if strings.Join(hosts, " ") != "192.168.1.76 192.168.1.77" {
+		t.Fatalf("unexpected replayed events: %s", hosts)
+	}
+	if time.Since(began) < 400*time.Millisecond {
+		t.Fatalf("events ended before ctx was done")
+	}
+
+	// the archive is in text, not xml
+	if _, err := player.List(conntrack.XML); err == nil {
+		t.Fatalf("listing of another format was replayed")
+	}
+}
+
+func TestRecordStreams(t *testing.T) {
+	var archive bytes.Buffer
+	recorder := &Recorder{Conntrack: &live{events: event76}, Writer: NewWriter(&archive)}
+
+	// two followers, e.g. the store and the exporter, reading their events in turns
+	first, _ := recorder.Events(context.Background(), conntrack.Text)
+	second, _ := recorder.Events(context.Background(), conntrack.Text)
+	buf := make([]byte, 10)
+	for _, r := range []io.Reader{first, second, first, second} {
+		r.Read(buf)
+	}
+	recorder.Writer.Close()
+
+	entries, err := ReadArchive(&archive)
+	if err != nil {
+		t.Fatalf("unable to read archive: %s", err)
+	}
+	var streams []int
+	for _, e := range entries {
+		streams = append(streams, e.Stream)
+	}
+	if len(streams) != 4 || streams[0] != 1 || streams[1] != 2 || streams[2] != 1 {
+		t.Fatalf("unexpected streams: %v", streams)
+	}
+
+	// each follower replays a stream of its own, as read by one follower, with the
+	// clock stopped at the start of the recording
+	player := NewPlayer(entries)
+	now := time.Now()
+	player.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		events, err := player.Events(ctx, conntrack.Text)
+		if err != nil {
+			t.Fatalf("unable to replay events: %s", err)
+		}
+		data, _ := io.ReadAll(events)
+		cancel()
+		if string(data) != event76[:20] {
+			t.Fatalf("follower %d replayed %q", i, data)
+		}
+	}
+}
+
+func TestReadArchiveCutShort(t *testing.T) {
+	var archive bytes.Buffer
+	w := NewWriter(&archive)
+	w.Write(Entry{Time: time.Now(), Kind: KindLeases, Data: lease})
+	first := archive.Len()
+	w.Write(Entry{Time: time.Now(), Kind: KindListing, Data: flow157})
+
+	// as if the daemon was killed while writing the second entry, without closing the archive
+	b := archive.Bytes()[:first+(archive.Len()-first)/2]
+
+	entries, err := ReadArchive(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unable to read archive: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Data != lease {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+}
@@ -0,0 +1,128 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fasmide/routerlogin/conntrack"
+	"github.com/fasmide/routerlogin/dnsmasq"
+)
+
+// Recorder is a conntrack and leases source, passing on what its sources return while
+// recording it. Only what is read is recorded, listings and leases are read as the
+// stores need them and events while they are followed
+type Recorder struct {
+	Conntrack conntrack.Source
+	Dnsmasq   dnsmasq.LeaseSource
+	Writer    *Writer
+
+	lock    sync.Mutex
+	failed  bool
+	streams int
+}
+
+// record writes an entry, the daemon keeps working if the archive does not
+func (r *Recorder) record(e Entry) {
+	err := r.Writer.Write(e)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil && !r.failed {
+		log.Printf("capture: unable to record, further entries may be lost: %s", err)
+	}
+	r.failed = err != nil
+}
+
+// List returns and records a listing, listings ending with an error are not recorded
+func (r *Recorder) List(format conntrack.Format) (io.ReadCloser, error) {
+	now := time.Now()
+	input, err := r.Conntrack.List(format)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readAll(input)
+	if err != nil {
+		return nil, err
+	}
+	if data.err == nil {
+		r.record(Entry{Time: now, Kind: KindListing, Format: format, Data: data.String()})
+	}
+	return data, nil
+}
+
+// Events returns events, recording them as they are read in a stream of their own
+func (r *Recorder) Events(ctx context.Context, format conntrack.Format) (io.ReadCloser, error) {
+	input, err := r.Conntrack.Events(ctx, format)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	r.streams++
+	stream := r.streams
+	r.lock.Unlock()
+
+	return &eventRecorder{ReadCloser: input, recorder: r, format: format, stream: stream}, nil
+}
+
+// Leases returns and records the leases
+func (r *Recorder) Leases() (io.ReadCloser, error) {
+	now := time.Now()
+	input, err := r.Dnsmasq.Leases()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readAll(input)
+	if err != nil {
+		return nil, err
+	}
+	if data.err == nil {
+		r.record(Entry{Time: now, Kind: KindLeases, Data: data.String()})
+	}
+	return data, nil
+}
+
+// eventRecorder records events as they are read
+type eventRecorder struct {
+	io.ReadCloser
+	recorder *Recorder
+	format   conntrack.Format
+	stream   int
+}
+
+// Read reads and records events
+func (e *eventRecorder) Read(p []byte) (int, error) {
+	n, err := e.ReadCloser.Read(p)
+	if n > 0 {
+		e.recorder.record(Entry{Time: time.Now(), Kind: KindEvents, Format: e.format, Stream: e.stream, Data: string(p[:n])})
+	}
+	return n, err
+}
+
+// buffered is output read in full, closing it returns the error closing the source did
+type buffered struct {
+	bytes.Buffer
+	err error
+}
+
+// readAll reads and closes input
+func readAll(input io.ReadCloser) (*buffered, error) {
+	b := &buffered{}
+	_, err := b.ReadFrom(input)
+	b.err = input.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close returns the error of the source
+func (b *buffered) Close() error {
+	return b.err
+}
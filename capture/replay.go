@@ -0,0 +1,205 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasmide/routerlogin/conntrack"
+)
+
+// Player is a conntrack and leases source replaying an archive. The replay starts at
+// the first entry when the player is first read from, listings and leases are the last
+// ones recorded by then and events are passed on as their time comes. Followers replay
+// the event streams in the order they were recorded, one stream each
+type Player struct {
+	// Speed is how many times faster than recorded the archive is replayed, defaults to 1
+	Speed float64
+
+	entries map[string][]Entry
+	first   time.Time
+
+	once    sync.Once
+	started time.Time
+	now     func() time.Time
+
+	lock      sync.Mutex
+	followers int
+}
+
+// NewPlayer returns a player of entries
+func NewPlayer(entries []Entry) *Player {
+	p := &Player{entries: make(map[string][]Entry), now: time.Now}
+
+	sorted := append([]Entry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+	for _, e := range sorted {
+		p.entries[e.Kind] = append(p.entries[e.Kind], e)
+	}
+	if len(sorted) > 0 {
+		p.first = sorted[0].Time
+	}
+	return p
+}
+
+// Open returns a player of the archive at path
+func Open(path string) (*Player, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	entries, err := ReadArchive(fd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %s", path, err)
+	}
+	return NewPlayer(entries), nil
+}
+
+// speed returns Speed or its default
+func (p *Player) speed() float64 {
+	if p.Speed <= 0 {
+		return 1
+	}
+	return p.Speed
+}
+
+// Clock returns the recorded time being replayed
+func (p *Player) Clock() time.Time {
+	p.once.Do(func() { p.started = p.now() })
+
+	elapsed := p.now().Sub(p.started)
+	return p.first.Add(time.Duration(float64(elapsed) * p.speed()))
+}
+
+// until returns how long it is until t is replayed
+func (p *Player) until(t time.Time) time.Duration {
+	return time.Duration(float64(t.Sub(p.Clock())) / p.speed())
+}
+
+// latest returns the last entry of a kind and format replayed by now, the first one
+// is used until then
+func (p *Player) latest(kind string, format conntrack.Format) (Entry, error) {
+	clock := p.Clock()
+
+	var found *Entry
+	for i, e := range p.entries[kind] {
+		if e.Format != format {
+			continue
+		}
+		if found != nil && e.Time.After(clock) {
+			break
+		}
+		found = &p.entries[kind][i]
+	}
+	if found == nil {
+		return Entry{}, p.missing(kind, format)
+	}
+	return *found, nil
+}
+
+// missing returns the error of an archive without entries of a kind and format
+func (p *Player) missing(kind string, format conntrack.Format) error {
+	if len(p.entries[kind]) > 0 {
+		return fmt.Errorf("archive has %s in format \"%s\", not \"%s\"", kind, p.entries[kind][0].Format, format)
+	}
+	return fmt.Errorf("archive has no %s", kind)
+}
+
+// List returns the listing recorded last
+func (p *Player) List(format conntrack.Format) (io.ReadCloser, error) {
+	e, err := p.latest(KindListing, format)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(e.Data)), nil
+}
+
+// streamOf returns the stream a follower replays, followers beyond the streams
+// recorded replay the first one
+func streamOf(events []Entry, follower int) int {
+	var streams []int
+	seen := make(map[int]bool)
+	for _, e := range events {
+		if !seen[e.Stream] {
+			seen[e.Stream] = true
+			streams = append(streams, e.Stream)
+		}
+	}
+	sort.Ints(streams)
+
+	if len(streams) == 0 {
+		return 0
+	}
+	if follower < len(streams) {
+		return streams[follower]
+	}
+	return streams[0]
+}
+
+// Leases returns the leases recorded last
+func (p *Player) Leases() (io.ReadCloser, error) {
+	e, err := p.latest(KindLeases, "")
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(e.Data)), nil
+}
+
+// Events returns the events recorded from now on, as their time comes. Like a quiet
+// conntrack, nothing more is read after the last event until ctx is done
+func (p *Player) Events(ctx context.Context, format conntrack.Format) (io.ReadCloser, error) {
+	var all []Entry
+	for _, e := range p.entries[KindEvents] {
+		if e.Format == format {
+			all = append(all, e)
+		}
+	}
+	if len(all) == 0 && len(p.entries[KindEvents]) > 0 {
+		return nil, p.missing(KindEvents, format)
+	}
+
+	p.lock.Lock()
+	follower := p.followers
+	p.followers++
+	p.lock.Unlock()
+
+	stream := streamOf(all, follower)
+	var events []Entry
+	for _, e := range all {
+		if e.Stream == stream {
+			events = append(events, e)
+		}
+	}
+
+	from := p.Clock()
+	r, w := io.Pipe()
+	go func() {
+		defer w.Close()
+
+		for _, e := range events {
+			if e.Time.Before(from) {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.until(e.Time)):
+			}
+
+			_, err := io.WriteString(w, e.Data)
+			if err != nil {
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return r, nil
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasmide/routerlogin/conntrack"
+	"github.com/fasmide/routerlogin/daemon"
+	"github.com/fasmide/routerlogin/dnsmasq"
+	"github.com/fasmide/routerlogin/federation"
+	"github.com/fasmide/routerlogin/netflow"
+	"github.com/fasmide/routerlogin/quota"
+	"github.com/fasmide/routerlogin/runner"
+)
+
+// Config is read from the json file given with -config
+type Config struct {
+	Socket SocketConfig
+
+	// Router is where conntrack and the leases are read, this host by default
+	Router RouterConfig
+
+	// Read and Admin are the users and groups allowed to connect, root is always admin
+	Read  AccessConfig
+	Admin AccessConfig
+
+	// TLS serves the daemon over tcp as well, when its Listen address is set
+	TLS TLSConfig
+
+	// HTTP serves the dashboard, its api, /healthz and /readyz when its Listen address is set,
+	// without any authentication so keep it on an address only trusted clients can reach
+	HTTP HTTPConfig
+
+	Health HealthConfig
+
+	History HistoryConfig
+
+	Quota QuotaConfig
+
+	Portal PortalConfig
+
+	Devices DevicesConfig
+
+	Reservations ReservationsConfig
+
+	Queries QueriesConfig
+
+	Export ExportConfig
+
+	Federation FederationConfig
+}
+
+// FederationConfig makes the daemon show the hosts of its Peers instead of its own,
+// peers are read with Timeout, as a duration. Devices, Reservations, Queries, Quota,
+// Portal and Export are about the hosts of this router and cannot be configured along
+// with Peers
+type FederationConfig struct {
+	Peers   []federation.Peer
+	Timeout string
+}
+
+// RouterConfig describes how conntrack is run and the Leases file is read. Runner is
+// local, netns to run inside Namespace, or ssh to run on Host as a router which cannot
+// run routerlogin itself, logging in with IdentityFile and ssh Options
+type RouterConfig struct {
+	Runner    string
+	Namespace string
+
+	Host         string
+	Port         int
+	IdentityFile string
+	Options      []string
+
+	Leases string
+
+	// WANs are the uplinks of the router, the host table shows which ones hosts use when set
+	WANs []WANConfig
+}
+
+// WANConfig is an uplink by the Addresses flows are translated to when leaving through
+// it, or the Interface holding them. Hosts lists the lan hosts and prefixes expected to
+// use it, every host when empty
+type WANConfig struct {
+	Name      string
+	Addresses []string
+	Interface string
+	Hosts     []string
+}
+
+// ExportConfig sends IPFIX or netflow v9 records of flows to Collectors, running flows
+// are exported every ActiveTimeout and templates every TemplateRefresh, as durations
+type ExportConfig struct {
+	Collectors      []CollectorConfig
+	Domain          uint32
+	ActiveTimeout   string
+	TemplateRefresh string
+}
+
+// CollectorConfig is a collector by host:port, with a version of ipfix or netflow9
+type CollectorConfig struct {
+	Address string
+	Version string
+}
+
+// DevicesConfig enables the device registry when Path is set, devices are persisted to it
+type DevicesConfig struct {
+	Path string
+}
+
+// ReservationsConfig enables static dhcp reservations when Path is set, they are written
+// to it as a dnsmasq dhcp-hostsfile. dnsmasq is reloaded by running the Reload command
+// when given, or by sending SIGHUP to the pid of PIDFile
+type ReservationsConfig struct {
+	Path    string
+	PIDFile string
+	Reload  []string
+}
+
+// QueriesConfig enables dns query statistics from the log dnsmasq writes with log-queries,
+// read from the Log file or received from a syslog daemon on Syslog, as unixgram:path or
+// udp:host:port. Queries per minute are averaged over Window, as a duration
+type QueriesConfig struct {
+	Log    string
+	Syslog string
+	Window string
+}
+
+// PortalConfig describes the login page, served on Listen to the lan when set. Users
+// are read from the Htpasswd file, and sessions lasting Duration are persisted to Path
+type PortalConfig struct {
+	Listen   string
+	Htpasswd string
+	Duration string
+	Path     string
+}
+
+// QuotaConfig describes byte quotas of devices, counted every Interval and persisted
+// to Path. Hooks are fired when devices cross thresholds, exceeded devices are added
+// to the NFT set when its Set is given
+type QuotaConfig struct {
+	Interval string
+	Path     string
+	Rules    []QuotaRuleConfig
+
+	// Command is run and Webhook is posted to with every event
+	Command []string
+	Webhook string
+
+	NFT NFTConfig
+}
+
+// QuotaRuleConfig is a quota of the devices listed by mac address, every device when none are
+type QuotaRuleConfig struct {
+	Name    string
+	Devices []string
+	Shared  bool
+
+	// Limit is a size e.g. "10G", and Warning a fraction of it e.g. 0.8
+	Limit   string
+	Warning float64
+
+	// Period is daily, weekly or monthly, starting at Hour on Day
+	Period string
+	Day    int
+	Hour   int
+}
+
+// NFTConfig names an nftables set of type ether_addr
+type NFTConfig struct {
+	Family string
+	Table  string
+	Set    string
+}
+
+// HistoryConfig sets how often metrics of every host are sampled, an empty Interval
+// disables history, and Path persists it across restarts
+type HistoryConfig struct {
+	Interval string
+	Path     string
+}
+
+// HTTPConfig describes the http listener
+type HTTPConfig struct {
+	Listen string
+}
+
+// HealthConfig sets how old the data of stores may get, as durations e.g. "1m30s"
+type HealthConfig struct {
+	MaxAge string
+
+	// MaxAges overrides MaxAge by store name e.g. dnsmasq.Store
+	MaxAges map[string]string
+}
+
+// SocketConfig describes the unix sockets clients connect to, clients of Path are sent
+// the table right away while clients of CommandPath may send a command first. Both
+// sockets have the same Owner, Group and Mode
+type SocketConfig struct {
+	Path        string
+	CommandPath string
+	Owner       string
+	Group       string
+
+	// Mode is written in octal e.g. "0660"
+	Mode string
+
+	// SystemdName and CommandSystemdName are the FileDescriptorNames of the sockets when
+	// socket activated by systemd, which names them after their socket units unless the
+	// units set FileDescriptorName=
+	SystemdName        string
+	CommandSystemdName string
+}
+
+// TLSConfig describes the tls listener
+type TLSConfig struct {
+	Listen       string
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	// Roles maps client certificate common names to read or admin
+	Roles map[string]string
+
+	// DefaultRole is given to clients not found in Roles, defaults to none
+	DefaultRole string
+
+	// SystemdName is the FileDescriptorName of the tcp socket when socket activated by systemd,
+	// its socket unit name unless the unit sets FileDescriptorName=
+	SystemdName string
+}
+
+// AccessConfig lists users and groups by name or id
+type AccessConfig struct {
+	Users  []string
+	Groups []string
+}
+
+// defaultConfig is used for anything missing in the config file
+func defaultConfig() Config {
+	return Config{
+		Router: RouterConfig{
+			Runner: "local",
+			Leases: "/var/lib/misc/dnsmasq.leases",
+		},
+		Socket: SocketConfig{
+			Path:               "/run/routerlogin/routerlogin.sock",
+			CommandPath:        "/run/routerlogin/command.sock",
+			Mode:               "0660",
+			SystemdName:        "routerlogin.socket",
+			CommandSystemdName: "routerlogin-command.socket",
+		},
+		TLS: TLSConfig{
+			SystemdName: "routerlogin-tls.socket",
+		},
+		History: HistoryConfig{
+			Interval: "10s",
+		},
+		Quota: QuotaConfig{
+			Interval: "1m",
+		},
+		Portal: PortalConfig{
+			Duration: "12h",
+		},
+		Federation: FederationConfig{
+			Timeout: "5s",
+		},
+		Reservations: ReservationsConfig{
+			PIDFile: "/run/dnsmasq/dnsmasq.pid",
+		},
+		Queries: QueriesConfig{
+			Window: "5m",
+		},
+		Export: ExportConfig{
+			ActiveTimeout:   "1m",
+			TemplateRefresh: "10m",
+		},
+	}
+}
+
+// loadConfig reads a config file, an empty path gives the default config
+func loadConfig(path string) (Config, error) {
+	config := defaultConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("unable to parse %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+// Runner returns the runner of conntrack
+func (c Config) Runner() (runner.Runner, error) {
+	switch c.Router.Runner {
+	case "local", "":
+		return runner.Local{}, nil
+	case "netns":
+		if c.Router.Namespace == "" {
+			return nil, fmt.Errorf("the netns runner needs a namespace")
+		}
+		return runner.Netns{Namespace: c.Router.Namespace}, nil
+	case "ssh":
+		if c.Router.Host == "" {
+			return nil, fmt.Errorf("the ssh runner needs a host")
+		}
+		return runner.SSH{
+			Host:         c.Router.Host,
+			Port:         c.Router.Port,
+			IdentityFile: c.Router.IdentityFile,
+			Options:      c.Router.Options,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown runner \"%s\", should be local, netns or ssh", c.Router.Runner)
+}
+
+// WANs returns the uplinks of the router, or nil when none are configured
+func (c Config) WANs() (*conntrack.WANs, error) {
+	if len(c.Router.WANs) == 0 {
+		return nil, nil
+	}
+
+	var wans []conntrack.WAN
+	for _, w := range c.Router.WANs {
+		if w.Name == "" {
+			return nil, fmt.Errorf("uplinks needs a name")
+		}
+		wan := conntrack.WAN{Name: w.Name, Interface: w.Interface}
+
+		for _, a := range w.Addresses {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("uplink %s: %s", w.Name, err)
+			}
+			wan.Addresses = append(wan.Addresses, addr)
+		}
+
+		// hosts are single addresses or prefixes
+		for _, h := range w.Hosts {
+			prefix, err := netip.ParsePrefix(h)
+			if err != nil {
+				addr, aerr := netip.ParseAddr(h)
+				if aerr != nil {
+					return nil, fmt.Errorf("uplink %s: %s", w.Name, err)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			wan.Hosts = append(wan.Hosts, prefix)
+		}
+		wans = append(wans, wan)
+	}
+	return conntrack.NewWANs(wans...), nil
+}
+
+// LeaseSource returns where leases are read, the leases of another host are read by r
+func (c Config) LeaseSource(r runner.Runner) dnsmasq.LeaseSource {
+	if c.Router.Runner == "ssh" {
+		return dnsmasq.CommandLeaseFile{Runner: r, Path: c.Router.Leases}
+	}
+	return dnsmasq.LeaseFile(c.Router.Leases)
+}
+
+// Reloader returns how dnsmasq is told about changed reservations, commands are run by r
+func (c Config) Reloader(r runner.Runner) dnsmasq.Reloader {
+	if len(c.Reservations.Reload) > 0 {
+		return dnsmasq.CommandReloader{Runner: r, Command: c.Reservations.Reload}
+	}
+	return dnsmasq.PIDReloader{PIDFile: c.Reservations.PIDFile}
+}
+
+// QueryStore returns the dns query statistics, the log of another host is read by r
+func (c Config) QueryStore(r runner.Runner) (*dnsmasq.Queries, error) {
+	window, err := time.ParseDuration(c.Queries.Window)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query window: %s", err)
+	}
+
+	var queryLog dnsmasq.QueryLog
+	switch {
+	case c.Queries.Syslog != "":
+		network, address, found := strings.Cut(c.Queries.Syslog, ":")
+		if !found || (network != "unixgram" && network != "udp") {
+			return nil, fmt.Errorf("syslog must be unixgram:path or udp:host:port, not %s", c.Queries.Syslog)
+		}
+		queryLog = dnsmasq.SyslogSocket{Network: network, Address: address}
+	case c.Router.Runner == "ssh":
+		queryLog = dnsmasq.CommandLogFile{Runner: r, Path: c.Queries.Log}
+	default:
+		queryLog = dnsmasq.LogFile{Path: c.Queries.Log}
+	}
+
+	return &dnsmasq.Queries{Log: queryLog, Window: window}, nil
+}
+
+// UnixSocket returns the socket described by the config
+func (c Config) UnixSocket() (daemon.UnixSocket, error) {
+	return c.unixSocket(c.Socket.Path)
+}
+
+// CommandSocket returns the socket clients send commands to
+func (c Config) CommandSocket() (daemon.UnixSocket, error) {
+	return c.unixSocket(c.Socket.CommandPath)
+}
+
+// unixSocket returns a socket at path with the configured permissions
+func (c Config) unixSocket(path string) (daemon.UnixSocket, error) {
+	mode, err := strconv.ParseUint(c.Socket.Mode, 8, 32)
+	if err != nil {
+		return daemon.UnixSocket{}, fmt.Errorf("invalid socket mode %s: %s", c.Socket.Mode, err)
+	}
+
+	return daemon.UnixSocket{
+		Path:  path,
+		Owner: c.Socket.Owner,
+		Group: c.Socket.Group,
+		Mode:  os.FileMode(mode),
+	}, nil
+}
+
+// Authorizer returns an authorizer allowing the configured users and groups
+func (c Config) Authorizer() (*daemon.PeerCredAuthorizer, error) {
+	a := &daemon.PeerCredAuthorizer{}
+
+	var err error
+	for _, list := range []struct {
+		ids    *[]int
+		names  []string
+		lookup func([]string) ([]int, error)
+	}{
+		{&a.ReadUIDs, c.Read.Users, daemon.LookupUsers},
+		{&a.ReadGIDs, c.Read.Groups, daemon.LookupGroups},
+		{&a.AdminUIDs, c.Admin.Users, daemon.LookupUsers},
+		{&a.AdminGIDs, c.Admin.Groups, daemon.LookupGroups},
+	} {
+		*list.ids, err = list.lookup(list.names)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// TLSServer returns the tls server described by the config
+func (c Config) TLSServer() (*daemon.TLSServer, error) {
+	s := &daemon.TLSServer{
+		CertFile:     c.TLS.CertFile,
+		KeyFile:      c.TLS.KeyFile,
+		ClientCAFile: c.TLS.ClientCAFile,
+		Roles:        make(map[string]daemon.Role),
+	}
+
+	var err error
+	if c.TLS.DefaultRole != "" {
+		s.DefaultRole, err = daemon.ParseRole(c.TLS.DefaultRole)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, role := range c.TLS.Roles {
+		s.Roles[name], err = daemon.ParseRole(role)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %s: %s", name, err)
+		}
+	}
+
+	return s, nil
+}
+
+// MaxAges returns the default and per store staleness thresholds
+func (c Config) MaxAges() (time.Duration, map[string]time.Duration, error) {
+	var maxAge time.Duration
+	var err error
+	if c.Health.MaxAge != "" {
+		maxAge, err = time.ParseDuration(c.Health.MaxAge)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid max age: %s", err)
+		}
+	}
+
+	maxAges := make(map[string]time.Duration)
+	for name, age := range c.Health.MaxAges {
+		maxAges[name], err = time.ParseDuration(age)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid max age of %s: %s", name, err)
+		}
+	}
+
+	return maxAge, maxAges, nil
+}
+
+// QuotaRules returns the configured quotas
+func (c Config) QuotaRules() ([]quota.Rule, error) {
+	rules := make([]quota.Rule, len(c.Quota.Rules))
+	for i, r := range c.Quota.Rules {
+		limit, err := quota.ParseSize(r.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("quota %s: %s", r.Name, err)
+		}
+
+		rules[i] = quota.Rule{
+			Name:     r.Name,
+			Devices:  r.Devices,
+			Shared:   r.Shared,
+			Limit:    limit,
+			Warning:  r.Warning,
+			Schedule: quota.Schedule{Period: quota.Period(r.Period), Day: r.Day, Hour: r.Hour},
+		}
+	}
+	return rules, nil
+}
+
+// QuotaHooks returns the hooks fired by quotas, events are always logged
+func (c Config) QuotaHooks() []quota.Hook {
+	hooks := []quota.Hook{quota.LogHook{}}
+	if len(c.Quota.Command) > 0 {
+		hooks = append(hooks, quota.CommandHook{Command: c.Quota.Command})
+	}
+	if c.Quota.Webhook != "" {
+		hooks = append(hooks, quota.WebhookHook{URL: c.Quota.Webhook})
+	}
+	if c.Quota.NFT.Set != "" {
+		set := quota.NFTSet{Family: c.Quota.NFT.Family, Table: c.Quota.NFT.Table, Set: c.Quota.NFT.Set}
+		hooks = append(hooks, quota.EnforceHook{Enforcer: set})
+	}
+	return hooks
+}
+
+// Exporter returns the flow exporter described by the config
+func (c Config) Exporter() (*netflow.Exporter, error) {
+	e := &netflow.Exporter{Domain: c.Export.Domain}
+
+	var err error
+	e.ActiveTimeout, err = time.ParseDuration(c.Export.ActiveTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid active timeout: %s", err)
+	}
+	e.TemplateRefresh, err = time.ParseDuration(c.Export.TemplateRefresh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template refresh: %s", err)
+	}
+
+	for _, collector := range c.Export.Collectors {
+		version, err := netflow.ParseVersion(collector.Version)
+		if err != nil {
+			return nil, fmt.Errorf("collector %s: %s", collector.Address, err)
+		}
+		e.Collectors = append(e.Collectors, netflow.Collector{Address: collector.Address, Version: version})
+	}
+	return e, nil
+}
+
+// FederationStore returns the store of the peers, which cannot be combined with
+// anything about the hosts of this router
+func (c Config) FederationStore() (*federation.Store, error) {
+	for _, p := range c.Federation.Peers {
+		if p.Site == "" || p.URL == "" {
+			return nil, fmt.Errorf("peers needs both a site and an url")
+		}
+	}
+
+	for _, local := range []struct {
+		name       string
+		configured bool
+	}{
+		{"Devices", c.Devices.Path != ""},
+		{"Reservations", c.Reservations.Path != ""},
+		{"Queries", c.Queries.Log != "" || c.Queries.Syslog != ""},
+		{"Quota", len(c.Quota.Rules) > 0},
+		{"Portal", c.Portal.Listen != ""},
+		{"Export", len(c.Export.Collectors) > 0},
+	} {
+		if local.configured {
+			return nil, fmt.Errorf("federation cannot be combined with %s, which is about the hosts of this router", local.name)
+		}
+	}
+
+	timeout, err := time.ParseDuration(c.Federation.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid federation timeout: %s", err)
+	}
+
+	s := federation.New(c.Federation.Peers...)
+	s.Client = &http.Client{Timeout: timeout}
+	return s, nil
+}
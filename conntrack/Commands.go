@@ -0,0 +1,297 @@
+package conntrack
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Commands returns the commands this store answers through the daemon
+func (s *StateStore) Commands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"flows":       s.flowsCommand,
+		"breakdown":   s.breakdownCommand,
+		"remote":      s.remoteCommand,
+		"remote-port": s.remotePortCommand,
+		"tuple":       s.tupleCommand,
+		"nat":         s.natCommand,
+		"wan":         s.wanCommand,
+		"forwards":    s.forwardsCommand,
+	}
+}
+
+// AdminCommands returns the commands this store answers through the daemon, which changes the conntrack table
+func (s *StateStore) AdminCommands() map[string]func(io.Writer, []string) error {
+	if s.Controller == nil {
+		return nil
+	}
+
+	return map[string]func(io.Writer, []string) error{
+		"teardown": s.teardownCommand,
+	}
+}
+
+// teardownCommand deletes flows and writes the ones deleted, with -n nothing is deleted
+// teardown [-n] host <ip>
+// teardown [-n] tuple <protocol> <src:sport> <dst:dport>
+// teardown [-n] tuple <icmp|icmpv6> <src> <dst> type=<type> code=<code> id=<id>
+// teardown [-n] filter <key=value>...
+func (s *StateStore) teardownCommand(w io.Writer, args []string) error {
+	usage := fmt.Errorf("usage: teardown [-n] host <ip> | tuple <protocol> <src:sport> <dst:dport> | filter <key=value>...")
+
+	dryRun := len(args) > 0 && args[0] == "-n"
+	if dryRun {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return usage
+	}
+
+	var f Filter
+	var err error
+	switch args[0] {
+	case "host":
+		var ip netip.Addr
+		ip, err = netip.ParseAddr(args[1])
+		f = HostFilter(ip)
+	case "tuple":
+		var t Tuple
+		t, err = ParseTuple(strings.Join(args[1:], " "))
+		f = TupleFilter(t)
+	case "filter":
+		f, err = ParseFilter(args[1:])
+	default:
+		return usage
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", usage, err)
+	}
+
+	flows, deleted, err := Teardown(s.Controller, f, dryRun)
+	if err != nil {
+		return err
+	}
+
+	for i := range flows {
+		err = writeFlows(w, &flows[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	if dryRun {
+		_, err = fmt.Fprintf(w, "would remove %d flows\n", len(flows))
+		return err
+	}
+
+	// our table no longer reflects reality
+	s.lock.Lock()
+	s.lastPopulate = time.Time{}
+	s.lock.Unlock()
+
+	// flows starting or ending after the listing makes the count differ from it
+	if deleted != len(flows) {
+		_, err = fmt.Fprintf(w, "listed %d flows, ", len(flows))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "removed %d flows\n", deleted)
+	return err
+}
+
+// flowsCommand writes all flows of a lan host: flows <ip>
+func (s *StateStore) flowsCommand(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: flows <lan ip>")
+	}
+
+	flows, err := s.StatesByIP(args[0])
+	if err != nil {
+		return err
+	}
+	return writeFlows(w, flows...)
+}
+
+// breakdownCommand writes what the flows of a lan host consists of: breakdown <ip>
+func (s *StateStore) breakdownCommand(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: breakdown <lan ip>")
+	}
+
+	summary, err := s.SummaryByIP(args[0])
+	if err != nil {
+		return err
+	}
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(t, "flows\t%d\n", summary.Flows)
+	fmt.Fprintf(t, "sent\t%d packets\t%d bytes\n", summary.Original.Packets, summary.Original.Bytes)
+	fmt.Fprintf(t, "received\t%d packets\t%d bytes\n", summary.Reply.Packets, summary.Reply.Bytes)
+	fmt.Fprintf(t, "assured\t%d\n", summary.Assured)
+	fmt.Fprintf(t, "unreplied\t%d\n", summary.Unreplied)
+
+	sections := []struct {
+		title  string
+		counts map[string]int
+	}{
+		{"protocol", summary.Protocols},
+		{"tcp state", summary.States},
+		{"category", summary.Categories},
+		{"service", summary.Services},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(t, "\n%s\tflows\n", section.title)
+		for _, c := range sortedCounts(section.counts) {
+			fmt.Fprintf(t, "%s\t%d\n", c.name, c.count)
+		}
+	}
+
+	return t.Flush()
+}
+
+// remoteCommand writes all flows with a remote host: remote <ip>
+func (s *StateStore) remoteCommand(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: remote <remote ip>")
+	}
+
+	flows, err := s.FlowsByRemote(args[0])
+	if err != nil {
+		return err
+	}
+	return writeFlows(w, flows...)
+}
+
+// remotePortCommand writes all flows with a remote port: remote-port <port>
+func (s *StateStore) remotePortCommand(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: remote-port <port>")
+	}
+
+	port, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("unable to parse port: %s", err)
+	}
+
+	flows, err := s.FlowsByRemotePort(uint16(port))
+	if err != nil {
+		return err
+	}
+	return writeFlows(w, flows...)
+}
+
+// tupleCommand writes the flow with a given original direction: tuple <protocol> <src:sport> <dst:dport>,
+// icmp flows are written as tuple <icmp|icmpv6> <src> <dst> type=<type> code=<code> id=<id>
+func (s *StateStore) tupleCommand(w io.Writer, args []string) error {
+	t, err := ParseTuple(strings.Join(args, " "))
+	if err != nil {
+		return fmt.Errorf("usage: tuple <protocol> <src:sport> <dst:dport> | <icmp|icmpv6> <src> <dst> type=<type> code=<code> id=<id>: %s", err)
+	}
+
+	flow, err := s.FlowByTuple(t)
+	if err != nil {
+		return err
+	}
+	return writeFlows(w, flow)
+}
+
+// natCommand writes the flow with a given reply direction, as seen on the wan side: nat <protocol> <remote:port> <wan:port>
+func (s *StateStore) natCommand(w io.Writer, args []string) error {
+	t, err := ParseTuple(strings.Join(args, " "))
+	if err != nil {
+		return fmt.Errorf("usage: nat <protocol> <remote:port> <wan:port>: %s", err)
+	}
+
+	flow, err := s.FlowByReplyTuple(t)
+	if err != nil {
+		return err
+	}
+	return writeFlows(w, flow)
+}
+
+// wanCommand writes the traffic of every host through each uplink, hosts using uplinks
+// they are not expected to are marked unexpected: wan [lan ip]
+func (s *StateStore) wanCommand(w io.Writer, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: wan [lan ip]")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return err
+	}
+
+	hosts := make([]netip.Addr, 0, len(s.summaries))
+	for host := range s.summaries {
+		if len(args) == 0 || host == parseIndex(args[0]) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Less(hosts[j]) })
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(t, "host\twan\taddress\tflows\tsent\treceived\t")
+	for _, host := range hosts {
+		for _, d := range s.WANs.details(host, s.summaries[host]) {
+			mark := ""
+			if !d.Expected {
+				mark = "unexpected"
+			}
+			fmt.Fprintf(t, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n", host, d.WAN, d.Address, d.Flows, d.BytesOut, d.BytesIn, mark)
+		}
+	}
+	return t.Flush()
+}
+
+// forwardsCommand writes the forwarded ports of every lan host which received
+// connections, and the remotes connecting the most: forwards [lan ip]
+func (s *StateStore) forwardsCommand(w io.Writer, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: forwards [lan ip]")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return err
+	}
+
+	hosts := make([]netip.Addr, 0, len(s.forwards))
+	for host := range s.forwards {
+		if len(args) == 0 || host == parseIndex(args[0]) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Less(hosts[j]) })
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(t, "host\tport\tflows\tremotes\treceived\tsent\ttop remotes")
+	for _, host := range hosts {
+		for _, f := range s.forwardsOf(host) {
+			fmt.Fprintf(t, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", host, f.Name(), f.Flows, len(f.Remotes), f.Original.Bytes, f.Reply.Bytes, f.TopRemotes(3))
+		}
+	}
+	return t.Flush()
+}
+
+// writeFlows writes flows one per line, the way conntrack does
+func writeFlows(w io.Writer, flows ...*Flow) error {
+	for _, f := range flows {
+		_, err := fmt.Fprintln(w, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
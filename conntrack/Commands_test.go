@@ -0,0 +1,35 @@
+package conntrack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	s := fixtureStore(t, "flows_test_file.txt")
+	commands := s.Commands()
+
+	var b bytes.Buffer
+	err := commands["nat"](&b, strings.Fields("tcp 52.222.168.153:443 85.191.222.130:49746"))
+	if err != nil {
+		t.Fatalf("nat command failed: %s", err)
+	}
+	if !strings.HasPrefix(b.String(), "tcp      6 29 CLOSE_WAIT src=192.168.1.191 ") {
+		t.Fatalf("nat command found the wrong flow: %s", b.String())
+	}
+
+	b.Reset()
+	err = commands["remote"](&b, []string{"93.184.216.34"})
+	if err != nil {
+		t.Fatalf("remote command failed: %s", err)
+	}
+	if strings.Count(b.String(), "\n") != 4 {
+		t.Fatalf("remote command did not write 4 flows: %s", b.String())
+	}
+
+	err = commands["remote-port"](&b, []string{"http"})
+	if err == nil {
+		t.Fatalf("remote-port command accepted a port name")
+	}
+}
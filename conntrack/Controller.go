@@ -0,0 +1,104 @@
+package conntrack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/fasmide/routerlogin/runner"
+)
+
+// Controller manipulates the kernels conntrack table
+type Controller interface {
+	// List returns every flow matching the filter
+	List(f Filter) ([]Flow, error)
+	// Delete deletes every flow matching the filter and returns how many was deleted
+	Delete(f Filter) (int, error)
+}
+
+// Teardown deletes the flows matching a filter, returning the flows listed beforehand and
+// the number conntrack deleted. When dryRun is set nothing is deleted and the flows that
+// would have been are returned.
+//
+// Listing and deleting are separate calls to conntrack, flows may start or end in between,
+// so the listed flows are not exactly the deleted ones, only the count is
+func Teardown(c Controller, f Filter, dryRun bool) ([]Flow, int, error) {
+	err := f.Validate()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	flows, err := c.List(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to list flows: %s", err)
+	}
+
+	if dryRun || len(flows) == 0 {
+		return flows, 0, nil
+	}
+
+	deleted, err := c.Delete(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to delete flows: %s", err)
+	}
+
+	return flows, deleted, nil
+}
+
+// CLIController controls conntrack by running the conntrack command line tool
+type CLIController struct {
+	// Runner runs conntrack, on this host when nil
+	Runner runner.Runner
+}
+
+// List runs conntrack -L with the filter
+func (c *CLIController) List(f Filter) ([]Flow, error) {
+	output, err := c.output(append([]string{"-L"}, f.Args()...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return readFlows(NewScanner(bytes.NewReader(output)), f)
+}
+
+// Delete runs conntrack -D with the filter, conntrack writes every flow it deletes
+func (c *CLIController) Delete(f Filter) (int, error) {
+	output, err := c.output(append([]string{"-D"}, f.Args()...)...)
+	if err != nil {
+		return 0, err
+	}
+
+	flows, err := readFlows(NewScanner(bytes.NewReader(output)), Filter{})
+	return len(flows), err
+}
+
+// output runs conntrack and returns what it wrote to stdout
+func (c *CLIController) output(args ...string) ([]byte, error) {
+	output, err := runner.Output(context.Background(), CommandSource{Runner: c.Runner}.runner(), "conntrack", args...)
+	if err != nil {
+		return nil, fmt.Errorf("conntrack error: %s", err)
+	}
+
+	return output, nil
+}
+
+// readFlows reads every flow matching the filter
+func readFlows(r FlowReader, f Filter) ([]Flow, error) {
+	flows := make([]Flow, 0)
+
+	for {
+		flow, err := r.Read()
+		if err == io.EOF {
+			return flows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// conntrack filters for us, but an empty filter matches everything anyway
+		if f.Match(flow) {
+			flows = append(flows, *flow)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package conntrack
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fasmide/routerlogin/runner"
+)
+
+// fakeController keeps a conntrack table in memory
+type fakeController struct {
+	flows []Flow
+
+	// started are flows starting between listing and deleting
+	started []Flow
+}
+
+func (c *fakeController) List(f Filter) ([]Flow, error) {
+	res := make([]Flow, 0)
+	for i := range c.flows {
+		if f.Match(&c.flows[i]) {
+			res = append(res, c.flows[i])
+		}
+	}
+	return res, nil
+}
+
+func (c *fakeController) Delete(f Filter) (int, error) {
+	c.flows, c.started = append(c.flows, c.started...), nil
+
+	kept := c.flows[:0]
+	for i := range c.flows {
+		if !f.Match(&c.flows[i]) {
+			kept = append(kept, c.flows[i])
+		}
+	}
+	deleted := len(c.flows) - len(kept)
+	c.flows = kept
+	return deleted, nil
+}
+
+// fixtureController returns a fake controller holding the flows of a test file
+func fixtureController(t *testing.T, path string) *fakeController {
+	c := &fakeController{}
+	for _, line := range readLines(t, path) {
+		flow, err := ParseFlowLine(line)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", line, err)
+		}
+		c.flows = append(c.flows, flow)
+	}
+	return c
+}
+
+func TestTeardown(t *testing.T) {
+	c := fixtureController(t, "flows_test_file.txt")
+	total := len(c.flows)
+	host := HostFilter(netip.MustParseAddr("192.168.1.191"))
+
+	flows, _, err := Teardown(c, host, true)
+	if err != nil {
+		t.Fatalf("dry run failed: %s", err)
+	}
+	if len(flows) == 0 {
+		t.Fatalf("dry run found no flows")
+	}
+	if len(c.flows) != total {
+		t.Fatalf("dry run deleted flows")
+	}
+
+	deleted, n, err := Teardown(c, host, false)
+	if err != nil {
+		t.Fatalf("teardown failed: %s", err)
+	}
+	if len(deleted) != len(flows) || n != len(flows) || len(c.flows) != total-len(flows) {
+		t.Fatalf("teardown was expected to delete %d flows, deleted %d", len(flows), total-len(c.flows))
+	}
+
+	_, _, err = Teardown(c, Filter{}, false)
+	if err == nil {
+		t.Fatalf("teardown accepted a filter matching every flow")
+	}
+	if len(c.flows) != total-len(flows) {
+		t.Fatalf("refused teardown deleted flows")
+	}
+}
+
+func TestTeardownRace(t *testing.T) {
+	s := fixtureStore(t, "flows_test_file.txt")
+	c := fixtureController(t, "flows_test_file.txt")
+	s.Controller = c
+
+	// a connection starting after the listing is deleted as well
+	flow, err := ParseFlowLine("tcp      6 120 SYN_SENT src=192.168.1.191 dst=52.222.168.153 sport=49747 dport=443 [UNREPLIED] src=52.222.168.153 dst=85.191.222.130 sport=443 dport=49747 mark=0 use=1")
+	if err != nil {
+		t.Fatalf("unable to parse flow: %s", err)
+	}
+	c.started = []Flow{flow}
+
+	var b bytes.Buffer
+	err = s.AdminCommands()["teardown"](&b, strings.Fields("filter proto=tcp src=192.168.1.191 dst=52.222.168.153"))
+	if err != nil {
+		t.Fatalf("teardown command failed: %s", err)
+	}
+	if !strings.HasSuffix(b.String(), "listed 1 flows, removed 2 flows\n") {
+		t.Fatalf("teardown did not report what was deleted: %s", b.String())
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	f, err := ParseFilter(strings.Fields("proto=tcp src=192.168.1.191 dport=443 mark=0"))
+	if err != nil {
+		t.Fatalf("unable to parse filter: %s", err)
+	}
+	if f.String() != "proto=tcp src=192.168.1.191 dport=443 mark=0" {
+		t.Fatalf("filter did not format as it was parsed: %s", f)
+	}
+	if strings.Join(f.Args(), " ") != "-p tcp -s 192.168.1.191 --dport 443 --mark 0" {
+		t.Fatalf("unexpected conntrack arguments: %+v", f.Args())
+	}
+
+	f, err = ParseFilter(strings.Fields("proto=icmpv6 icmp=128/0/4711"))
+	if err != nil {
+		t.Fatalf("unable to parse filter: %s", err)
+	}
+	if f.String() != "proto=icmpv6 icmp=128/0/4711" {
+		t.Fatalf("filter did not format as it was parsed: %s", f)
+	}
+	if strings.Join(f.Args(), " ") != "-p icmpv6 --icmpv6-type 128 --icmpv6-code 0 --icmpv6-id 4711" {
+		t.Fatalf("unexpected conntrack arguments: %+v", f.Args())
+	}
+
+	for _, args := range []string{"", "dport=443", "src=nope", "proto", "color=blue", "icmp=8/0/1", "proto=icmp icmp=8/0"} {
+		_, err = ParseFilter(strings.Fields(args))
+		if err == nil {
+			t.Fatalf("filter \"%s\" was accepted", args)
+		}
+	}
+}
+
+func TestTeardownCommand(t *testing.T) {
+	s := fixtureStore(t, "flows_test_file.txt")
+	c := fixtureController(t, "flows_test_file.txt")
+	s.Controller = c
+	total := len(c.flows)
+
+	teardown := s.AdminCommands()["teardown"]
+
+	var b bytes.Buffer
+	err := teardown(&b, strings.Fields("-n tuple tcp 192.168.1.191:49746 52.222.168.153:443"))
+	if err != nil {
+		t.Fatalf("teardown command failed: %s", err)
+	}
+	if !strings.HasSuffix(b.String(), "would remove 1 flows\n") || len(c.flows) != total {
+		t.Fatalf("dry run did not report a single flow: %s", b.String())
+	}
+
+	b.Reset()
+	err = teardown(&b, strings.Fields("filter proto=tcp src=192.168.1.191 sport=49746"))
+	if err != nil {
+		t.Fatalf("teardown command failed: %s", err)
+	}
+	if !strings.HasSuffix(b.String(), "removed 1 flows\n") || len(c.flows) != total-1 {
+		t.Fatalf("teardown did not remove a single flow: %s", b.String())
+	}
+	if !s.lastPopulate.IsZero() {
+		t.Fatalf("teardown did not invalidate the store")
+	}
+
+	for _, args := range []string{"", "host", "host nope", "everything 1.2.3.4", "filter"} {
+		err = teardown(&b, strings.Fields(args))
+		if err == nil {
+			t.Fatalf("teardown accepted \"%s\"", args)
+		}
+	}
+
+	s.Controller = nil
+	if len(s.AdminCommands()) != 0 {
+		t.Fatalf("teardown is available without a controller")
+	}
+}
+
+func TestCLIController(t *testing.T) {
+	listing, err := os.ReadFile("flows_test_file.txt")
+	if err != nil {
+		t.Fatalf("unable to read flows: %s", err)
+	}
+
+	fake := &runner.Fake{Commands: map[string]runner.Result{
+		"conntrack -L -p tcp -s 192.168.1.191": {Output: string(listing)},
+		"conntrack -D -p tcp -s 192.168.1.191": {Output: string(listing), Code: 1, Stderr: "conntrack v1.4.6 (conntrack-tools): Operation failed: Operation not permitted"},
+	}}
+	c := &CLIController{Runner: fake}
+	f := Filter{Protocol: "tcp", Source: netip.MustParseAddr("192.168.1.191")}
+
+	flows, err := c.List(f)
+	if err != nil {
+		t.Fatalf("unable to list: %s", err)
+	}
+	for _, flow := range flows {
+		if !f.Match(&flow) {
+			t.Fatalf("listed flow outside the filter: %s", flow.String())
+		}
+	}
+
+	_, err = c.Delete(f)
+	if err == nil || !strings.Contains(err.Error(), "Operation not permitted") {
+		t.Fatalf("unexpected delete error: %v", err)
+	}
+	if started := fake.Started(); len(started) != 2 {
+		t.Fatalf("unexpected commands: %s", started)
+	}
+}
+
+func TestSourceLister(t *testing.T) {
+	listing, err := os.ReadFile("conntrack_listing_test_file.xml")
+	if err != nil {
+		t.Fatalf("unable to read flows: %s", err)
+	}
+
+	source := CommandSource{Runner: &runner.Fake{Commands: map[string]runner.Result{"conntrack -L -o xml": {Output: string(listing)}}}}
+	f := Filter{Protocol: "tcp", Source: netip.MustParseAddr("192.168.1.191")}
+
+	flows, err := SourceLister{Source: source, Format: XML}.List(f)
+	if err != nil {
+		t.Fatalf("unable to list: %s", err)
+	}
+	if len(flows) == 0 {
+		t.Fatalf("no flows listed")
+	}
+	for _, flow := range flows {
+		if !f.Match(&flow) {
+			t.Fatalf("listed flow outside the filter: %s", flow.String())
+		}
+	}
+
+	_, err = SourceLister{Source: source}.List(f)
+	if err == nil {
+		t.Fatalf("failing listing was not reported")
+	}
+}
@@ -0,0 +1,88 @@
+package conntrack
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// Destination is a remote end a host talks to
+type Destination struct {
+	Address  netip.Addr
+	Service  string
+	Flows    int
+	BytesOut uint
+	BytesIn  uint
+}
+
+// HostDetails is everything the store knows about a single host
+type HostDetails struct {
+	Summary *Summary
+
+	// Flows are formatted the way conntrack prints them
+	Flows []string
+
+	// Destinations are the remote ends with the most traffic first
+	Destinations []Destination
+
+	// WANs are the uplinks the flows left through, the most used first
+	WANs []WANDetail
+
+	// Forwards are the ports forwarded to the host which received connections, the busiest first
+	Forwards []Forward
+}
+
+// maxDestinations is how many destinations Details returns
+const maxDestinations = 10
+
+// Details returns the summary, flows and top destinations of an ip address
+func (s *StateStore) Details(ip string) (interface{}, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	index := parseIndex(ip)
+	details := HostDetails{Summary: newSummary(), Flows: make([]string, 0), Destinations: make([]Destination, 0)}
+	if summary, found := s.summaries[index]; found {
+		details.Summary = summary.clone()
+	}
+	details.WANs = s.WANs.details(index, details.Summary)
+	details.Forwards = s.forwardsOf(index)
+
+	byAddress := make(map[netip.Addr]*Destination)
+	for _, f := range s.flows[index] {
+		details.Flows = append(details.Flows, f.String())
+
+		remote := f.Original.Layer3.Destination
+		d, found := byAddress[remote]
+		if !found {
+			d = &Destination{Address: remote, Service: s.Services.Name(f.Protocol, f.Original.Layer4.DPort)}
+			byAddress[remote] = d
+		}
+		d.Flows++
+		d.BytesOut += f.Original.Counter.Bytes
+		d.BytesIn += f.Reply.Counter.Bytes
+	}
+
+	for _, d := range byAddress {
+		details.Destinations = append(details.Destinations, *d)
+	}
+	sort.Slice(details.Destinations, func(i, j int) bool {
+		a, b := details.Destinations[i], details.Destinations[j]
+		if a.BytesOut+a.BytesIn != b.BytesOut+b.BytesIn {
+			return a.BytesOut+a.BytesIn > b.BytesOut+b.BytesIn
+		}
+		if a.Flows != b.Flows {
+			return a.Flows > b.Flows
+		}
+		return a.Address.Less(b.Address)
+	})
+	if len(details.Destinations) > maxDestinations {
+		details.Destinations = details.Destinations[:maxDestinations]
+	}
+
+	return details, nil
+}
@@ -0,0 +1,195 @@
+package conntrack
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Filter selects flows by their original direction, zero fields matches anything
+type Filter struct {
+	Protocol    string
+	Source      netip.Addr
+	Destination netip.Addr
+	SPort       uint16
+	DPort       uint16
+
+	// Mark is only matched when MatchMark is set, as zero is a perfectly valid mark
+	Mark      uint32
+	MatchMark bool
+
+	// ICMP is only matched when MatchICMP is set, zero is a valid type, code and id
+	ICMP      ICMP
+	MatchICMP bool
+}
+
+// HostFilter returns a filter matching flows originating from a host
+func HostFilter(ip netip.Addr) Filter {
+	return Filter{Source: ip}
+}
+
+// TupleFilter returns a filter matching a single flow by its original direction
+func TupleFilter(t Tuple) Filter {
+	return Filter{
+		Protocol:    t.Protocol,
+		Source:      t.Source,
+		SPort:       t.SPort,
+		Destination: t.Destination,
+		DPort:       t.DPort,
+		ICMP:        t.ICMP,
+		MatchICMP:   isICMP(t.Protocol),
+	}
+}
+
+// ParseFilter parses filters written as key=value words e.g.
+// proto=tcp src=192.168.1.191 dport=443 mark=256
+// proto=icmp dst=1.1.1.1 icmp=8/0/1234, as type/code/id
+func ParseFilter(args []string) (Filter, error) {
+	f := Filter{}
+
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return f, fmt.Errorf("filter %s should be key=value", arg)
+		}
+
+		var err error
+		switch parts[0] {
+		case "proto":
+			f.Protocol = parts[1]
+		case "src":
+			f.Source, err = netip.ParseAddr(parts[1])
+		case "dst":
+			f.Destination, err = netip.ParseAddr(parts[1])
+		case "sport", "dport":
+			var port uint64
+			port, err = strconv.ParseUint(parts[1], 10, 16)
+			if parts[0] == "sport" {
+				f.SPort = uint16(port)
+			} else {
+				f.DPort = uint16(port)
+			}
+		case "mark":
+			var mark uint64
+			mark, err = strconv.ParseUint(parts[1], 0, 32)
+			f.Mark = uint32(mark)
+			f.MatchMark = true
+		case "icmp":
+			fields := strings.Split(parts[1], "/")
+			if len(fields) != 3 {
+				err = fmt.Errorf("expected type/code/id")
+				break
+			}
+			for i, key := range []string{"type", "code", "id"} {
+				if err == nil {
+					err = parseICMP([]byte(key), []byte(fields[i]), &f.ICMP)
+				}
+			}
+			f.MatchICMP = true
+		default:
+			return f, fmt.Errorf("unknown filter %s, use proto, src, dst, sport, dport, mark or icmp", parts[0])
+		}
+		if err != nil {
+			return f, fmt.Errorf("unable to parse filter %s: %s", arg, err)
+		}
+	}
+
+	return f, f.Validate()
+}
+
+// Validate refuses filters which would select every flow, or which conntrack cannot express
+func (f Filter) Validate() error {
+	if f == (Filter{}) {
+		return fmt.Errorf("filter matches every flow")
+	}
+	if (f.SPort != 0 || f.DPort != 0) && f.Protocol == "" {
+		return fmt.Errorf("filtering by port requires a protocol")
+	}
+	if f.MatchICMP && !isICMP(f.Protocol) {
+		return fmt.Errorf("filtering by icmp requires protocol icmp or icmpv6")
+	}
+	return nil
+}
+
+// Match reports if a flow is selected by the filter
+func (f Filter) Match(flow *Flow) bool {
+	o := flow.Original
+	switch {
+	case f.Protocol != "" && f.Protocol != flow.Protocol:
+		return false
+	case f.Source.IsValid() && f.Source != o.Layer3.Source:
+		return false
+	case f.Destination.IsValid() && f.Destination != o.Layer3.Destination:
+		return false
+	case f.SPort != 0 && f.SPort != o.Layer4.SPort:
+		return false
+	case f.DPort != 0 && f.DPort != o.Layer4.DPort:
+		return false
+	case f.MatchMark && f.Mark != flow.Mark:
+		return false
+	case f.MatchICMP && f.ICMP != o.ICMP:
+		return false
+	}
+	return true
+}
+
+// Args returns the conntrack arguments selecting the same flows as the filter
+func (f Filter) Args() []string {
+	args := make([]string, 0, 18)
+	if f.Protocol != "" {
+		args = append(args, "-p", f.Protocol)
+	}
+	if f.Source.IsValid() {
+		args = append(args, "-s", f.Source.String())
+	}
+	if f.Destination.IsValid() {
+		args = append(args, "-d", f.Destination.String())
+	}
+	if f.SPort != 0 {
+		args = append(args, "--sport", strconv.Itoa(int(f.SPort)))
+	}
+	if f.DPort != 0 {
+		args = append(args, "--dport", strconv.Itoa(int(f.DPort)))
+	}
+	if f.MatchMark {
+		args = append(args, "--mark", strconv.FormatUint(uint64(f.Mark), 10))
+	}
+	if f.MatchICMP {
+		// the options of icmpv6 are named after it
+		prefix := "--" + f.Protocol + "-"
+		args = append(args,
+			prefix+"type", strconv.Itoa(int(f.ICMP.Type)),
+			prefix+"code", strconv.Itoa(int(f.ICMP.Code)),
+			prefix+"id", strconv.Itoa(int(f.ICMP.ID)),
+		)
+	}
+	return args
+}
+
+// String formats the filter the way ParseFilter reads it
+func (f Filter) String() string {
+	parts := make([]string, 0, 6)
+	if f.Protocol != "" {
+		parts = append(parts, "proto="+f.Protocol)
+	}
+	if f.Source.IsValid() {
+		parts = append(parts, "src="+f.Source.String())
+	}
+	if f.Destination.IsValid() {
+		parts = append(parts, "dst="+f.Destination.String())
+	}
+	if f.SPort != 0 {
+		parts = append(parts, "sport="+strconv.Itoa(int(f.SPort)))
+	}
+	if f.DPort != 0 {
+		parts = append(parts, "dport="+strconv.Itoa(int(f.DPort)))
+	}
+	if f.MatchMark {
+		parts = append(parts, "mark="+strconv.FormatUint(uint64(f.Mark), 10))
+	}
+	if f.MatchICMP {
+		parts = append(parts, fmt.Sprintf("icmp=%d/%d/%d", f.ICMP.Type, f.ICMP.Code, f.ICMP.ID))
+	}
+	return strings.Join(parts, " ")
+}
@@ -1,12 +1,18 @@
 package conntrack
 
 import (
+	"bytes"
 	"fmt"
-	"net"
-	"strconv"
+	"net/netip"
 	"strings"
+	"time"
 )
 
+// timestampLayout is the ctime(3) layout conntrack uses for [start=...] and [stop=...]
+// conntrack pads the day with a space, which disappears when we split the line
+// into fields, so we parse without padding and format with it
+const timestampLayout = "Mon Jan 2 15:04:05 2006"
+
 // Flow represents a tracked connection
 type Flow struct {
 
@@ -16,10 +22,26 @@ type Flow struct {
 	// Reply direction
 	Reply Direction
 
-	TTL           int
-	State         string // ASSURED, UNREPLIED
-	Protocol      string // tcp, udp, imcp....
-	ProtocolState string // ESTABLISHED, CLOSE_WAIT etc
+	Family         string // ipv4, ipv6 - only present in text output with -o extended, xml and netlink always have it
+	TTL            int
+	State          string // ASSURED, UNREPLIED
+	Protocol       string // tcp, udp, imcp....
+	ProtocolNumber int    // 6, 17, 1....
+	ProtocolState  string // ESTABLISHED, CLOSE_WAIT etc
+	Offload        string // OFFLOAD, HW_OFFLOAD
+
+	Mark   uint32
+	Use    uint
+	Zone   uint16
+	ID     uint32
+	SecCtx string
+	Labels []string
+
+	// Start, Stop and DeltaTime are only present when conntrack is run with -o timestamp
+	// and the kernel has nf_conntrack_timestamp enabled
+	Start     time.Time
+	Stop      time.Time
+	DeltaTime time.Duration
 
 	// NAT is not really a conntrack thing, we just check if the original
 	// and reply directions match each others ip addresses for convenience
@@ -30,13 +52,17 @@ type Flow struct {
 type Direction struct {
 	Layer3  Layer3
 	Layer4  Layer4
+	ICMP    ICMP
 	Counter Counter
+
+	// Zone is the per direction zone, printed as zone-orig= and zone-reply=
+	Zone uint16
 }
 
 // Layer3 represents data of the layer 3 OSI stack
 type Layer3 struct {
-	Source      net.IP
-	Destination net.IP
+	Source      netip.Addr
+	Destination netip.Addr
 }
 
 // Layer4 represents data of the layer 4 OSI stack
@@ -45,6 +71,13 @@ type Layer4 struct {
 	DPort uint16
 }
 
+// ICMP holds the fields conntrack tracks icmp and icmpv6 flows by, instead of ports
+type ICMP struct {
+	Type uint8
+	Code uint8
+	ID   uint16
+}
+
 // Counter represents the accumulated package and byte count for this direction..
 type Counter struct {
 	Packets uint
@@ -57,117 +90,238 @@ type Counter struct {
 // tcp      6 431884 ESTABLISHED src=192.168.1.244 dst=216.58.213.202 sport=42412 dport=443 packets=18 bytes=2272 src=216.58.213.202 dst=85.191.222.130 sport=443 dport=42412 packets=22 bytes=15245 [ASSURED] mark=0 use=1
 // udp      17 156 src=192.168.1.76 dst=209.206.58.5 sport=44017 dport=7351 packets=16330 bytes=2287570 src=209.206.58.5 dst=85.191.222.130 sport=7351 dport=44017 packets=16106 bytes=1205484 [ASSURED] mark=0 use=1
 // udp      17 19 src=192.168.1.149 dst=239.255.255.250 sport=45162 dport=1900 packets=3 bytes=1340 [UNREPLIED] src=239.255.255.250 dst=192.168.1.149 sport=1900 dport=45162 packets=0 bytes=0 mark=0 use=1
+// icmp     1 29 src=192.168.1.149 dst=8.8.8.8 type=8 code=0 id=4711 src=8.8.8.8 dst=85.191.222.130 type=0 code=0 id=4711 mark=256 zone=3 use=1 id=1889106592
+// ipv4     2 tcp      6 431999 ESTABLISHED src=192.168.1.191 dst=192.168.1.1 sport=35786 dport=22 src=192.168.1.1 dst=192.168.1.191 sport=22 dport=35786 [ASSURED] [OFFLOAD] mark=0 secctx=system_u:object_r:unlabeled_t:s0 [start=Mon Jun  4 10:00:00 2018] use=1
 func ParseFlowLine(s string) (Flow, error) {
 	flow := Flow{}
 
-	parts := strings.Fields(s)
-	if len(parts) == 0 {
-		return flow, fmt.Errorf("Supplied string had no fields: \"%s\"", s)
+	parts := splitFields([]byte(s), nil)
+	if len(parts) < 2 {
+		return flow, fmt.Errorf("Supplied string had too few fields: \"%s\"", s)
+	}
+
+	err := parseFlow(parts, &flow)
+	return flow, err
+}
+
+// parseFlow parses the fields of a single line of conntrack output into flow, which is reset first
+func parseFlow(parts [][]byte, flow *Flow) error {
+	*flow = Flow{}
+
+	if len(parts) < 2 {
+		return fmt.Errorf("Supplied line had too few fields: \"%s\"", bytes.Join(parts, []byte(" ")))
 	}
 	// we use this index to jump in our parts
 	index := 0
 
-	// part 0 is Protocol
-	flow.Protocol = parts[index]
+	// when run with -o extended, the line is prefixed with the layer 3 protocol
+	// which is followed by its number in decimal that we can derive from the name
+	if string(parts[index]) == "ipv4" || string(parts[index]) == "ipv6" {
+		flow.Family = intern(parts[index])
+		index = index + 2
+	}
+
+	// the layer 4 protocol
+	if index+1 >= len(parts) {
+		return fmt.Errorf("Supplied line had no protocol: \"%s\"", bytes.Join(parts, []byte(" ")))
+	}
+	flow.Protocol = intern(parts[index])
 	index++
 
-	// part 1 is protocol in decimal...
-	// which we dont use
+	// followed by protocol in decimal
+	protocolNumber, err := parseUint(parts[index], 8)
+	if err != nil {
+		return fmt.Errorf("Unable to parse protocol number from conntrack: %s", err)
+	}
+	flow.ProtocolNumber = int(protocolNumber)
 	index++
 
 	// part 2 is ttl (unless we are parsing events - when there is no ttl)
-	if !strings.HasPrefix(parts[index], "src=") {
+	if index < len(parts) && len(parts[index]) > 0 && parts[index][0] >= '0' && parts[index][0] <= '9' {
 
-		ttl, err := strconv.Atoi(parts[index])
+		ttl, err := parseUint(parts[index], 32)
 		if err != nil {
-			return flow, fmt.Errorf("Unable to parse ttl from conntrack: %s could not be parsed as integer: %s", parts[index], err)
+			return fmt.Errorf("Unable to parse ttl from conntrack: %s", err)
 		}
-		flow.TTL = ttl
+		flow.TTL = int(ttl)
 		index++
 	}
 
 	// if we where talking tcp, we have a special field in here
 	// i dont know if other protocols also have this special field so, we
 	// are looking for the begining of layer3-4 instead
-	if !strings.HasPrefix(parts[index], "src=") {
-		flow.ProtocolState = parts[index]
+	if index < len(parts) && !hasPrefix(parts[index], "src=") {
+		flow.ProtocolState = intern(parts[index])
 		index++
 	}
 
+	if index >= len(parts) {
+		return fmt.Errorf("Supplied line had no layer 3 and 4 information: \"%s\"", bytes.Join(parts, []byte(" ")))
+	}
+
 	// the next parts are layer3-4 info, we have a special function for these
-	offset, err := parseLayer3And4(parts[index:], &flow.Original)
+	offset, err := parseLayer3And4(parts[index:], flow.Protocol, &flow.Original)
 	if err != nil {
-		return flow, fmt.Errorf("Unable to parse layer 3 and 4 from line %+v: %s", parts, err)
+		return fmt.Errorf("Unable to parse layer 3 and 4 from line \"%s\": %s", bytes.Join(parts, []byte(" ")), err)
 	}
 	index = index + offset
 
 	// this part is usually "[UNREPLIED]"
 	// but if it has a prefix of src= - move along
-	if !strings.HasPrefix(parts[index], "src=") {
-		flow.State = parts[index]
+	if index < len(parts) && !hasPrefix(parts[index], "src=") {
+		flow.State = intern(bytes.Trim(parts[index], "[]"))
 		index++
 	}
 
+	if index >= len(parts) {
+		return fmt.Errorf("Supplied line had no reply direction: \"%s\"", bytes.Join(parts, []byte(" ")))
+	}
+
 	// then we should get back to our reply layer3-4
-	offset, err = parseLayer3And4(parts[index:], &flow.Reply)
+	offset, err = parseLayer3And4(parts[index:], flow.Protocol, &flow.Reply)
 	if err != nil {
-		return flow, fmt.Errorf("Unable to parse layer 3 and 4 from line: %+v: %s", parts, err)
+		return fmt.Errorf("Unable to parse layer 3 and 4 from line \"%s\": %s", bytes.Join(parts, []byte(" ")), err)
 	}
 	index = index + offset
 
 	// If conntrack does not expect the reply to be received by the source - we properly have NAT
-	if !flow.Original.Layer3.Source.Equal(flow.Reply.Layer3.Destination) {
+	if flow.Original.Layer3.Source != flow.Reply.Layer3.Destination {
 		flow.NAT = true
 	}
 
-	// are we at the end?
-	if index == len(parts) {
-		return flow, nil
-	}
-
-	// not at the end huh? - we could be assured - lets check
-	if parts[index] == "[ASSURED]" {
-		flow.State = "ASSURED"
+	// whatever is left are flags and meta data about the flow as a whole
+	err = parseTrailer(parts[index:], flow)
+	if err != nil {
+		return fmt.Errorf("Unable to parse trailer from line \"%s\": %s", bytes.Join(parts, []byte(" ")), err)
 	}
 
 	// That is all
 
-	return flow, nil
+	return nil
+}
+
+// parseTrailer parses the parts following the reply direction such as:
+// [ASSURED] [OFFLOAD] mark=0 secctx=system_u:object_r:unlabeled_t:s0 zone=1 [start=Mon Jun  4 10:00:00 2018] use=1 id=3735928559
+func parseTrailer(s [][]byte, f *Flow) error {
+	for i := 0; i < len(s); i++ {
+		part := s[i]
+
+		// timestamps contains spaces - collect parts until we find the closing bracket
+		if hasPrefix(part, "[start=") || hasPrefix(part, "[stop=") {
+			timestamp := string(part)
+			for !strings.HasSuffix(timestamp, "]") && i+1 < len(s) {
+				i++
+				timestamp = timestamp + " " + string(s[i])
+			}
+			key, value := splitField([]byte(strings.Trim(timestamp, "[]")))
+			t, err := time.ParseInLocation(timestampLayout, string(value), time.Local)
+			if err != nil {
+				return fmt.Errorf("unable to parse %s timestamp: %s", key, err)
+			}
+			if string(key) == "start" {
+				f.Start = t
+			} else {
+				f.Stop = t
+			}
+			continue
+		}
+
+		switch string(part) {
+		case "[ASSURED]":
+			f.State = "ASSURED"
+			continue
+		case "[OFFLOAD]", "[HW_OFFLOAD]":
+			f.Offload = intern(bytes.Trim(part, "[]"))
+			continue
+		}
+
+		key, value := splitField(part)
+		switch string(key) {
+		case "mark":
+			mark, err := parseUint(value, 32)
+			if err != nil {
+				return fmt.Errorf("unable to parse mark: %s", err)
+			}
+			f.Mark = uint32(mark)
+		case "use":
+			use, err := parseUint(value, 64)
+			if err != nil {
+				return fmt.Errorf("unable to parse use: %s", err)
+			}
+			f.Use = uint(use)
+		case "zone":
+			zone, err := parseUint(value, 16)
+			if err != nil {
+				return fmt.Errorf("unable to parse zone: %s", err)
+			}
+			f.Zone = uint16(zone)
+		case "id":
+			id, err := parseUint(value, 32)
+			if err != nil {
+				return fmt.Errorf("unable to parse id: %s", err)
+			}
+			f.ID = uint32(id)
+		case "delta-time":
+			delta, err := parseUint(value, 64)
+			if err != nil {
+				return fmt.Errorf("unable to parse delta-time: %s", err)
+			}
+			f.DeltaTime = time.Duration(delta) * time.Second
+		case "secctx":
+			f.SecCtx = string(value)
+		case "labels":
+			f.Labels = strings.Split(string(value), ",")
+		}
+		// anything else is something newer conntrack versions have come up with, skip it
+	}
+	return nil
 }
 
 // we will be parsing slices of parts such as:
 // src=192.168.1.149 dst=239.255.255.250 sport=45162 dport=1900 packets=3 bytes=1340
-func parseLayer3And4(s []string, d *Direction) (int, error) {
+// src=192.168.1.149 dst=8.8.8.8 type=8 code=0 id=4711 zone-orig=1 packets=3 bytes=252
+func parseLayer3And4(s [][]byte, protocol string, d *Direction) (int, error) {
 	// We return length so that the call'er is able to figure out how much we parsed
 	length := 0
 
+	// type, code and id are only for icmp traffic, for anything else an id is the flow id
+	icmp := strings.HasPrefix(protocol, "icmp")
+
 	// our line always starts with src, if we encounter another src, we have gone too far
 	var srcPassed bool
 	for _, s := range s {
-		parts := strings.Split(s, "=")
-		switch parts[0] {
+		key, value := splitField(s)
+		switch string(key) {
 		case "src":
 			if srcPassed {
 				// we have gone too far
 				return length, nil
 			}
 
-			d.Layer3.Source = net.ParseIP(parts[1])
+			addr, err := parseAddr(value)
+			if err != nil {
+				return length, fmt.Errorf("Conntrack: Parselayer3-4: Unable to parse src: %s", err)
+			}
+			d.Layer3.Source = addr
 			length++
 			srcPassed = true
 
 		case "dst":
-			d.Layer3.Destination = net.ParseIP(parts[1])
+			addr, err := parseAddr(value)
+			if err != nil {
+				return length, fmt.Errorf("Conntrack: Parselayer3-4: Unable to parse dst: %s", err)
+			}
+			d.Layer3.Destination = addr
 			length++
 		case "dport":
-			dport, err := strconv.ParseUint(parts[1], 10, 16)
+			dport, err := parseUint(value, 16)
 			if err != nil {
 				return length, fmt.Errorf("Conntrack: Parselayer3-4: Unable to parse dport: %s", err)
 			}
 			d.Layer4.DPort = uint16(dport)
 			length++
 		case "sport":
-			sport, err := strconv.ParseUint(parts[1], 10, 16)
+			sport, err := parseUint(value, 16)
 			if err != nil {
 				return length, fmt.Errorf("Conntrack: Parselayer3-4: Unable to parse sport: %s", err)
 			}
@@ -175,25 +329,35 @@ func parseLayer3And4(s []string, d *Direction) (int, error) {
 			length++
 		case "packets":
 
-			packets, err := strconv.ParseUint(parts[1], 10, 64)
+			packets, err := parseUint(value, 64)
 			if err != nil {
 				return length, fmt.Errorf("Parselayer3-4: Unable to parse packets: %s", err)
 			}
 			d.Counter.Packets = uint(packets)
 			length++
 		case "bytes":
-			bytes, err := strconv.ParseUint(parts[1], 10, 64)
+			bytes, err := parseUint(value, 64)
 			if err != nil {
 				return length, fmt.Errorf("Parselayer3-4: Unable to parse bytes: %s", err)
 			}
 			d.Counter.Bytes = uint(bytes)
 			length++
-		// type, id and code are only for icmp traffic - lets just skip it for now
-		case "type":
-			length++
-		case "id":
+		case "zone-orig", "zone-reply":
+			zone, err := parseUint(value, 16)
+			if err != nil {
+				return length, fmt.Errorf("Parselayer3-4: Unable to parse %s: %s", key, err)
+			}
+			d.Zone = uint16(zone)
 			length++
-		case "code":
+		case "type", "code", "id":
+			if !icmp {
+				// this is not ours, but belongs to the flow as a whole
+				return length, nil
+			}
+			err := parseICMP(key, value, &d.ICMP)
+			if err != nil {
+				return length, fmt.Errorf("Parselayer3-4: %s", err)
+			}
 			length++
 		default:
 			// we have encountered a field we dont know and we should be pretty sure we have no more fields left...
@@ -202,3 +366,105 @@ func parseLayer3And4(s []string, d *Direction) (int, error) {
 	}
 	return length, nil
 }
+
+// parseICMP parses one of the type, code or id fields of an icmp flow
+func parseICMP(key, value []byte, i *ICMP) error {
+	var bitSize uint = 8
+	if string(key) == "id" {
+		bitSize = 16
+	}
+
+	v, err := parseUint(value, bitSize)
+	if err != nil {
+		return fmt.Errorf("Unable to parse icmp %s: %s", key, err)
+	}
+
+	switch string(key) {
+	case "type":
+		i.Type = uint8(v)
+	case "code":
+		i.Code = uint8(v)
+	case "id":
+		i.ID = uint16(v)
+	}
+	return nil
+}
+
+// String formats the flow the same way conntrack does, ParseFlowLine is able to read it back
+func (f Flow) String() string {
+	var b strings.Builder
+
+	switch f.Family {
+	case "ipv4":
+		b.WriteString("ipv4     2 ")
+	case "ipv6":
+		b.WriteString("ipv6     10 ")
+	}
+
+	fmt.Fprintf(&b, "%-8s %d ", f.Protocol, f.ProtocolNumber)
+	if f.TTL != 0 {
+		fmt.Fprintf(&b, "%d ", f.TTL)
+	}
+	if f.ProtocolState != "" {
+		fmt.Fprintf(&b, "%s ", f.ProtocolState)
+	}
+
+	f.Original.writeTo(&b, f.Protocol, "zone-orig")
+	if f.State == "UNREPLIED" {
+		b.WriteString("[UNREPLIED] ")
+	}
+	f.Reply.writeTo(&b, f.Protocol, "zone-reply")
+
+	if f.State == "ASSURED" {
+		b.WriteString("[ASSURED] ")
+	}
+	if f.Offload != "" {
+		fmt.Fprintf(&b, "[%s] ", f.Offload)
+	}
+	if f.Mark != 0 {
+		fmt.Fprintf(&b, "mark=%d ", f.Mark)
+	}
+	if f.SecCtx != "" {
+		fmt.Fprintf(&b, "secctx=%s ", f.SecCtx)
+	}
+	if f.Zone != 0 {
+		fmt.Fprintf(&b, "zone=%d ", f.Zone)
+	}
+	if !f.Start.IsZero() {
+		fmt.Fprintf(&b, "[start=%s] ", f.Start.Format(time.ANSIC))
+	}
+	if !f.Stop.IsZero() {
+		fmt.Fprintf(&b, "[stop=%s] ", f.Stop.Format(time.ANSIC))
+	}
+	if f.DeltaTime != 0 {
+		fmt.Fprintf(&b, "delta-time=%d ", f.DeltaTime/time.Second)
+	}
+	if f.Use != 0 {
+		fmt.Fprintf(&b, "use=%d ", f.Use)
+	}
+	if f.ID != 0 {
+		fmt.Fprintf(&b, "id=%d ", f.ID)
+	}
+	if len(f.Labels) > 0 {
+		fmt.Fprintf(&b, "labels=%s ", strings.Join(f.Labels, ","))
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// writeTo writes a single direction the way conntrack prints it
+func (d Direction) writeTo(b *strings.Builder, protocol, zoneKey string) {
+	fmt.Fprintf(b, "src=%s dst=%s ", d.Layer3.Source, d.Layer3.Destination)
+
+	if strings.HasPrefix(protocol, "icmp") {
+		fmt.Fprintf(b, "type=%d code=%d id=%d ", d.ICMP.Type, d.ICMP.Code, d.ICMP.ID)
+	} else if d.Layer4.SPort != 0 || d.Layer4.DPort != 0 {
+		fmt.Fprintf(b, "sport=%d dport=%d ", d.Layer4.SPort, d.Layer4.DPort)
+	}
+	if d.Zone != 0 {
+		fmt.Fprintf(b, "%s=%d ", zoneKey, d.Zone)
+	}
+	if d.Counter != (Counter{}) {
+		fmt.Fprintf(b, "packets=%d bytes=%d ", d.Counter.Packets, d.Counter.Bytes)
+	}
+}
@@ -1,9 +1,13 @@
 package conntrack
 
+import "time"
+
 // FlowUpdate wraps a flow with meta data about it being an update, delete or a new flow
 type FlowUpdate struct {
-  // could be NEW, UPDATE and DELETE
-  Type string
-  // the flow
-  Flow Flow
+	// could be NEW, UPDATE and DESTROY
+	Type string
+	// Time is when conntrack saw the event, only present when conntrack is run with -o timestamp
+	Time time.Time
+	// the flow
+	Flow Flow
 }
@@ -0,0 +1,221 @@
+package conntrack
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLines returns every line of a test file
+func readLines(t *testing.T, path string) []string {
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open test file: %s", err)
+	}
+	defer fd.Close()
+
+	lines := make([]string, 0)
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("unable to read test file: %s", err)
+	}
+	return lines
+}
+
+func TestFlowRoundTrip(t *testing.T) {
+	for _, line := range readLines(t, "flows_test_file.txt") {
+		flow, err := ParseFlowLine(line)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", line, err)
+		}
+
+		// formatting the flow should give us the same fields, minus what conntrack
+		// prints with zero values
+		formatted := flow.String()
+		if strings.Join(strings.Fields(formatted), " ") != strings.Join(withoutZeroFields(strings.Fields(line)), " ") {
+			t.Fatalf("flow did not format as it was parsed:\n%s\n%s", line, formatted)
+		}
+
+		again, err := ParseFlowLine(formatted)
+		if err != nil {
+			t.Fatalf("unable to parse formatted flow %s: %s", formatted, err)
+		}
+		if !reflect.DeepEqual(flow, again) {
+			t.Fatalf("flow changed when parsed again:\n%+v\n%+v", flow, again)
+		}
+	}
+}
+
+func TestUpdateRoundTrip(t *testing.T) {
+	for _, line := range readLines(t, "conntrack_test_file.txt") {
+		update, err := ParseUpdateLine(line)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", line, err)
+		}
+
+		again, err := ParseFlowLine(update.Flow.String())
+		if err != nil {
+			t.Fatalf("unable to parse formatted flow %s: %s", update.Flow, err)
+		}
+		if !reflect.DeepEqual(update.Flow, again) {
+			t.Fatalf("flow changed when parsed again:\n%+v\n%+v", update.Flow, again)
+		}
+	}
+}
+
+// withoutZeroFields removes fields conntrack prints, but String leaves out because they are zero
+func withoutZeroFields(fields []string) []string {
+	res := make([]string, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "mark=0":
+			continue
+		case "packets=0":
+			if i+1 < len(fields) && fields[i+1] == "bytes=0" {
+				i++
+				continue
+			}
+		}
+		res = append(res, fields[i])
+	}
+	return res
+}
+
+func TestParseMeta(t *testing.T) {
+	line := "tcp      6 86399 ESTABLISHED src=10.8.0.6 dst=104.16.249.249 sport=39022 dport=443 zone-orig=2 src=104.16.249.249 dst=85.191.222.130 sport=443 dport=39022 zone-reply=3 [ASSURED] [HW_OFFLOAD] mark=256 secctx=system_u:object_r:unlabeled_t:s0 zone=1 [start=Mon Jun  4 10:00:00 2018] use=2 id=3735928559 labels=vpn,kids"
+	flow, err := ParseFlowLine(line)
+	if err != nil {
+		t.Fatalf("unable to parse flow: %s", err)
+	}
+
+	if flow.Mark != 256 {
+		t.Fatalf("mark was expected to be 256, was %d", flow.Mark)
+	}
+	if flow.Use != 2 {
+		t.Fatalf("use was expected to be 2, was %d", flow.Use)
+	}
+	if flow.ID != 3735928559 {
+		t.Fatalf("id was expected to be 3735928559, was %d", flow.ID)
+	}
+	if flow.Zone != 1 || flow.Original.Zone != 2 || flow.Reply.Zone != 3 {
+		t.Fatalf("zones was expected to be 1, 2 and 3, was %d, %d and %d", flow.Zone, flow.Original.Zone, flow.Reply.Zone)
+	}
+	if flow.State != "ASSURED" {
+		t.Fatalf("state was expected to be ASSURED, was %s", flow.State)
+	}
+	if flow.Offload != "HW_OFFLOAD" {
+		t.Fatalf("offload was expected to be HW_OFFLOAD, was %s", flow.Offload)
+	}
+	if flow.SecCtx != "system_u:object_r:unlabeled_t:s0" {
+		t.Fatalf("secctx was not parsed: %s", flow.SecCtx)
+	}
+	if !reflect.DeepEqual(flow.Labels, []string{"vpn", "kids"}) {
+		t.Fatalf("labels was expected to be vpn and kids, was %+v", flow.Labels)
+	}
+	start := time.Date(2018, time.June, 4, 10, 0, 0, 0, time.Local)
+	if !flow.Start.Equal(start) {
+		t.Fatalf("start was expected to be %s, was %s", start, flow.Start)
+	}
+	if !flow.Stop.IsZero() {
+		t.Fatalf("stop was not expected, was %s", flow.Stop)
+	}
+}
+
+func TestParseICMP(t *testing.T) {
+	line := "icmp     1 29 src=192.168.1.149 dst=8.8.8.8 type=8 code=0 id=4711 src=8.8.8.8 dst=85.191.222.130 type=0 code=0 id=4711 mark=0 use=1 id=1889106592"
+	flow, err := ParseFlowLine(line)
+	if err != nil {
+		t.Fatalf("unable to parse flow: %s", err)
+	}
+
+	compareOriginal := ICMP{Type: 8, Code: 0, ID: 4711}
+	if flow.Original.ICMP != compareOriginal {
+		t.Fatalf("original icmp was expected to be %+v, was %+v", compareOriginal, flow.Original.ICMP)
+	}
+	compareReply := ICMP{Type: 0, Code: 0, ID: 4711}
+	if flow.Reply.ICMP != compareReply {
+		t.Fatalf("reply icmp was expected to be %+v, was %+v", compareReply, flow.Reply.ICMP)
+	}
+
+	// the last id belongs to the flow and not to icmp
+	if flow.ID != 1889106592 {
+		t.Fatalf("id was expected to be 1889106592, was %d", flow.ID)
+	}
+	if !flow.NAT {
+		t.Fatalf("flow was expected to be natted")
+	}
+}
+
+func TestParseExtended(t *testing.T) {
+	line := "ipv6     10 udp      17 29 src=2001:db8:1::10 dst=2001:4860:4860::8844 sport=40002 dport=53 src=2001:4860:4860::8844 dst=2001:db8:1::10 sport=53 dport=40002 mark=0 use=1"
+	flow, err := ParseFlowLine(line)
+	if err != nil {
+		t.Fatalf("unable to parse flow: %s", err)
+	}
+
+	if flow.Family != "ipv6" || flow.Protocol != "udp" || flow.ProtocolNumber != 17 || flow.TTL != 29 {
+		t.Fatalf("extended flow was not parsed correctly: %+v", flow)
+	}
+	if flow.Original.Layer3.Source != netip.MustParseAddr("2001:db8:1::10") {
+		t.Fatalf("unexpected source: %s", flow.Original.Layer3.Source)
+	}
+}
+
+func TestParseUpdateTimestamp(t *testing.T) {
+	line := "[1528106400.123456]\t [DESTROY] tcp      6 src=192.168.1.157 dst=87.248.214.49 sport=54556 dport=443 packets=12 bytes=1523 src=87.248.214.49 dst=85.191.222.130 sport=443 dport=54556 packets=10 bytes=6789 [ASSURED] delta-time=17"
+	update, err := ParseUpdateLine(line)
+	if err != nil {
+		t.Fatalf("unable to parse update: %s", err)
+	}
+
+	if update.Type != "DESTROY" {
+		t.Fatalf("type was expected to be DESTROY, was %s", update.Type)
+	}
+	if update.Time.Unix() != 1528106400 || update.Time.Nanosecond()/1000 != 123456 {
+		t.Fatalf("unexpected update time: %s", update.Time)
+	}
+	if update.Flow.DeltaTime != 17*time.Second {
+		t.Fatalf("delta-time was expected to be 17s, was %s", update.Flow.DeltaTime)
+	}
+
+	// every microsecond survives parsing, a float64 loses some of them
+	for usec := 0; usec < 1000000; usec += 997 {
+		stamp := fmt.Sprintf("1760870000.%06d", usec)
+		when, err := parseTimestamp(stamp)
+		if err != nil || when.Unix() != 1760870000 || when.Nanosecond() != usec*1000 {
+			t.Fatalf("%s was parsed as %s: %v", stamp, when, err)
+		}
+	}
+	for _, invalid := range []string{"", "x.1", "1.x", "1.-5"} {
+		if _, err := parseTimestamp(invalid); err == nil {
+			t.Fatalf("parsed invalid timestamp \"%s\"", invalid)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	lines := []string{
+		"",
+		"tcp",
+		"tcp 6",
+		"tcp 6 300 ESTABLISHED",
+		"tcp six 300 src=1.2.3.4",
+		"tcp 6 300 ESTABLISHED src=1.2.3.4 dst=1.2.3.5 sport=1 dport=2",
+		"tcp 6 300 ESTABLISHED src=1.2.3.4 dst=1.2.3.5 sport=99999 dport=2 src=1.2.3.5 dst=1.2.3.4 sport=2 dport=1",
+		"tcp 6 300 ESTABLISHED src=1.2.3.4 dst=1.2.3.5 sport=1 dport=2 src=1.2.3.5 dst=1.2.3.4 sport=2 dport=1 mark=x",
+	}
+	for _, line := range lines {
+		_, err := ParseFlowLine(line)
+		if err == nil {
+			t.Fatalf("parsing \"%s\" did not fail", line)
+		}
+	}
+}
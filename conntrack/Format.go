@@ -0,0 +1,56 @@
+package conntrack
+
+import "io"
+
+// FlowReader reads flows one at a time, from conntrack -L
+type FlowReader interface {
+	Read() (*Flow, error)
+}
+
+// FlowUpdateReader reads flow updates one at a time, from conntrack -E
+type FlowUpdateReader interface {
+	Read() (*FlowUpdate, error)
+}
+
+// Format is the output format we ask conntrack for
+type Format string
+
+const (
+	// Text is conntrack's default whitespace separated format
+	Text Format = ""
+	// XML is conntrack's -o xml format, which does not need any guessing when parsed
+	XML Format = "xml"
+)
+
+// Args returns the arguments conntrack needs to output this format
+func (f Format) Args() []string {
+	if f == XML {
+		return []string{"-o", "xml"}
+	}
+	return nil
+}
+
+// NewReader returns a reader of conntrack -L output in this format
+func (f Format) NewReader(in io.Reader) FlowReader {
+	if f == XML {
+		return NewXMLReader(in)
+	}
+	return NewReader(in)
+}
+
+// NewUpdateReader returns a reader of conntrack -E output in this format
+func (f Format) NewUpdateReader(in io.Reader) FlowUpdateReader {
+	if f == XML {
+		return NewXMLUpdateReader(in)
+	}
+	return NewUpdateReader(in)
+}
+
+// NewScanner returns a reader of conntrack -L output in this format, which may reuse
+// the flow it returns between reads
+func (f Format) NewScanner(in io.Reader) FlowReader {
+	if f == XML {
+		return NewXMLReader(in)
+	}
+	return NewScanner(in)
+}
@@ -0,0 +1,134 @@
+package conntrack
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// forwardKey identifies a forwarded port of a lan host
+type forwardKey struct {
+	Protocol string
+	Port     uint16
+	HostPort uint16
+}
+
+// Forward is the inbound traffic of a port forwarded to a lan host
+type Forward struct {
+	Protocol string
+
+	// Port is the port connected to on the wan side, and HostPort the one it is
+	// forwarded to on the lan host
+	Port     uint16
+	HostPort uint16
+
+	Flows int
+
+	// Remotes counts flows by the remote address connecting
+	Remotes map[netip.Addr]int
+
+	// Original is the traffic from the remotes, and Reply the traffic of the lan host
+	Original Counter
+	Reply    Counter
+}
+
+// inbound reports if a flow is an inbound connection forwarded to a lan host: the
+// destination was translated, and the original destination is a wan address. Without
+// uplinks, connections from anything but private addresses are taken as coming from
+// the wan, keeping redirects of lan traffic, e.g. of dns to the router, outbound
+func (s *StateStore) inbound(f *Flow) bool {
+	if f.Reply.Layer3.Source == f.Original.Layer3.Destination {
+		return false
+	}
+
+	if s.WANs != nil && len(s.WANs.WANs) > 0 {
+		return s.WANs.wan(f.Original.Layer3.Destination) != nil
+	}
+
+	remote := f.Original.Layer3.Source.Unmap()
+	return !remote.IsPrivate() && !remote.IsLoopback() && !remote.IsLinkLocalUnicast()
+}
+
+// addInbound adds an inbound flow to the forwards of the lan host it is forwarded to
+func (s *StateStore) addInbound(f *Flow) {
+	host := f.Reply.Layer3.Source.Unmap()
+
+	forwards, found := s.forwards[host]
+	if !found {
+		forwards = make(map[forwardKey]*Forward)
+		s.forwards[host] = forwards
+	}
+
+	key := forwardKey{Protocol: f.Protocol, Port: f.Original.Layer4.DPort, HostPort: f.Reply.Layer4.SPort}
+	fw, found := forwards[key]
+	if !found {
+		fw = &Forward{Protocol: key.Protocol, Port: key.Port, HostPort: key.HostPort, Remotes: make(map[netip.Addr]int)}
+		forwards[key] = fw
+	}
+
+	fw.Flows++
+	fw.Remotes[f.Original.Layer3.Source]++
+	fw.Original.Packets += f.Original.Counter.Packets
+	fw.Original.Bytes += f.Original.Counter.Bytes
+	fw.Reply.Packets += f.Reply.Counter.Packets
+	fw.Reply.Bytes += f.Reply.Counter.Bytes
+}
+
+// Name returns the forward as port/protocol, with the port of the lan host when it differs
+func (f *Forward) Name() string {
+	if f.HostPort != f.Port {
+		return fmt.Sprintf("%d/%s->%d", f.Port, f.Protocol, f.HostPort)
+	}
+	return fmt.Sprintf("%d/%s", f.Port, f.Protocol)
+}
+
+// TopRemotes formats the n remotes with the most flows as address:flows
+func (f *Forward) TopRemotes(n int) string {
+	counts := make(map[string]int, len(f.Remotes))
+	for a, c := range f.Remotes {
+		counts[a.String()] = c
+	}
+	return topCounts(counts, n)
+}
+
+// clone returns a deep copy of the forward
+func (f *Forward) clone() Forward {
+	res := *f
+	res.Remotes = make(map[netip.Addr]int, len(f.Remotes))
+	for a, c := range f.Remotes {
+		res.Remotes[a] = c
+	}
+	return res
+}
+
+// forwardsOf returns copies of the forwards of a lan host, the busiest first
+func (s *StateStore) forwardsOf(host netip.Addr) []Forward {
+	res := make([]Forward, 0, len(s.forwards[host]))
+	for _, f := range s.forwards[host] {
+		res = append(res, f.clone())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Flows != b.Flows {
+			return a.Flows > b.Flows
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Protocol < b.Protocol
+	})
+	return res
+}
+
+// forwardColumns returns the number of inbound flows of a lan host, and its busiest forwards as port/protocol:flows
+func forwardColumns(forwards []Forward) (flows int, busiest string) {
+	parts := make([]string, 0, 3)
+	for i, f := range forwards {
+		flows += f.Flows
+		if i < 3 {
+			parts = append(parts, fmt.Sprintf("%s:%d", f.Name(), f.Flows))
+		}
+	}
+	return flows, strings.Join(parts, " ")
+}
@@ -0,0 +1,104 @@
+package conntrack
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/fasmide/routerlogin/runner"
+)
+
+// forwardListing has 8443/tcp of the wan forwarded to 443/tcp of 192.168.1.50, which
+// also connects out, a connection forwarded with hairpin nat, and a dns redirect
+const forwardListing = `tcp      6 431999 ESTABLISHED src=203.0.113.50 dst=85.191.222.130 sport=40000 dport=8443 packets=5 bytes=600 src=192.168.1.50 dst=203.0.113.50 sport=443 dport=40000 packets=4 bytes=3000 [ASSURED] mark=0 use=1
+tcp      6 431999 ESTABLISHED src=203.0.113.50 dst=85.191.222.130 sport=40001 dport=8443 packets=5 bytes=600 src=192.168.1.50 dst=203.0.113.50 sport=443 dport=40001 packets=4 bytes=3000 [ASSURED] mark=0 use=1
+tcp      6 431999 ESTABLISHED src=198.51.100.7 dst=85.191.222.130 sport=50000 dport=8443 packets=5 bytes=600 src=192.168.1.50 dst=198.51.100.7 sport=443 dport=50000 packets=4 bytes=3000 [ASSURED] mark=0 use=1
+tcp      6 431999 ESTABLISHED src=198.51.100.7 dst=85.191.222.130 sport=50001 dport=22 packets=5 bytes=100 src=192.168.1.60 dst=192.168.1.1 sport=22 dport=50001 packets=4 bytes=200 [ASSURED] mark=0 use=1
+tcp      6 431999 ESTABLISHED src=192.168.1.50 dst=52.85.250.243 sport=54376 dport=443 packets=10 bytes=1000 src=52.85.250.243 dst=85.191.222.130 sport=443 dport=54376 packets=20 bytes=20000 [ASSURED] mark=0 use=1
+udp      17 29 src=192.168.1.10 dst=8.8.8.8 sport=5000 dport=53 packets=1 bytes=70 src=192.168.1.1 dst=192.168.1.10 sport=53 dport=5000 packets=1 bytes=120 mark=0 use=1
+`
+
+// forwardStore returns a store reading forwardListing
+func forwardStore(wans *WANs) *StateStore {
+	return &StateStore{
+		Source: CommandSource{Runner: &runner.Fake{Commands: map[string]runner.Result{"conntrack -L": {Output: forwardListing}}}},
+		WANs:   wans,
+	}
+}
+
+func TestStateStoreForwards(t *testing.T) {
+	s := forwardStore(nil)
+
+	addresses, err := s.Addresses()
+	if err != nil {
+		t.Fatalf("unable to read addresses: %s", err)
+	}
+	var found []string
+	for _, a := range addresses {
+		found = append(found, a.String())
+	}
+	if len(found) != 2 || !strings.Contains(strings.Join(found, " "), "192.168.1.60") {
+		t.Fatalf("expected the lan hosts connected to and out, not the remotes: %s", found)
+	}
+
+	data, _ := s.Data("192.168.1.50")
+	if data["nInbound"] != "3" || data["forwards"] != "8443/tcp->443:3" || data["nFlows"] != "1" {
+		t.Fatalf("unexpected columns: %+v", data)
+	}
+	if data, _ := s.Data("203.0.113.50"); data["nFlows"] != "0" {
+		t.Fatalf("remotes were taken as lan hosts: %+v", data)
+	}
+
+	metrics, _ := s.Metrics("192.168.1.50")
+	if metrics["inboundFlows"] != 3 || metrics["inboundBytesIn"] != 1800 || metrics["inboundBytesOut"] != 9000 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	// what the lan host sends to whoever connected is its usage as well
+	if metrics["usageBytesOut"] != 1000+9000 || metrics["usageBytesIn"] != 20000+1800 {
+		t.Fatalf("inbound flows were not counted as usage: %+v", metrics)
+	}
+
+	flows, err := s.FlowsByRemote("203.0.113.50")
+	if err != nil || len(flows) != 2 {
+		t.Fatalf("inbound flows were not found by remote: %v %s", flows, err)
+	}
+	flows, err = s.FlowsByRemotePort(50000)
+	if err != nil || len(flows) != 1 {
+		t.Fatalf("inbound flows were not found by remote port: %v %s", flows, err)
+	}
+	tuple, _ := ParseTuple("tcp 192.168.1.50:443 203.0.113.50:40000")
+	if _, err := s.FlowByReplyTuple(tuple); err != nil {
+		t.Fatalf("inbound flow was not found by reply tuple: %s", err)
+	}
+
+	details, _ := s.Details("192.168.1.50")
+	forwards := details.(HostDetails).Forwards
+	if len(forwards) != 1 || forwards[0].Remotes[netip.MustParseAddr("203.0.113.50")] != 2 || forwards[0].TopRemotes(1) != "203.0.113.50:2" {
+		t.Fatalf("unexpected forwards: %+v", forwards)
+	}
+
+	var out bytes.Buffer
+	err = s.forwardsCommand(&out, nil)
+	if err != nil {
+		t.Fatalf("forwards command failed: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "192.168.1.50") || !strings.HasPrefix(lines[2], "192.168.1.60") {
+		t.Fatalf("unexpected output: %s", out.String())
+	}
+}
+
+func TestStateStoreForwardsByWAN(t *testing.T) {
+	// only connections to the uplinks are inbound once they are known
+	s := forwardStore(NewWANs(WAN{Name: "lte", Addresses: []netip.Addr{netip.MustParseAddr("100.64.0.2")}}))
+
+	data, err := s.Data("192.168.1.50")
+	if err != nil {
+		t.Fatalf("unable to read data: %s", err)
+	}
+	if data["nInbound"] != "0" {
+		t.Fatalf("connections to an unknown address were inbound: %+v", data)
+	}
+}
@@ -0,0 +1,473 @@
+//go:build linux
+
+package conntrack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+)
+
+// message types and attributes from linux/netfilter/nfnetlink_conntrack.h
+const (
+	nfnlSubsysCTNetlink = 1
+
+	ipctnlMsgCTGet    = 1
+	ipctnlMsgCTDelete = 2
+
+	ctaTupleOrig       = 1
+	ctaTupleReply      = 2
+	ctaStatus          = 3
+	ctaProtoinfo       = 4
+	ctaTimeout         = 7
+	ctaMark            = 8
+	ctaCountersOrig    = 9
+	ctaCountersReply   = 10
+	ctaUse             = 11
+	ctaID              = 12
+	ctaZone            = 18
+	ctaTupleIP         = 1
+	ctaTupleProto      = 2
+	ctaTupleZone       = 3
+	ctaIPv4Src         = 1
+	ctaIPv4Dst         = 2
+	ctaIPv6Src         = 3
+	ctaIPv6Dst         = 4
+	ctaProtoNum        = 1
+	ctaProtoSrcPort    = 2
+	ctaProtoDstPort    = 3
+	ctaProtoICMPID     = 4
+	ctaProtoICMPType   = 5
+	ctaProtoICMPCode   = 6
+	ctaProtoICMPv6ID   = 7
+	ctaProtoICMPv6Type = 8
+	ctaProtoICMPv6Code = 9
+	ctaProtoinfoTCP    = 1
+	ctaProtoinfoTCPSt  = 1
+	ctaCountersPackets = 1
+	ctaCountersBytes   = 2
+
+	ipsSeenReply = 1 << 1
+	ipsAssured   = 1 << 2
+	ipsOffload   = 1 << 14
+	ipsHWOffload = 1 << 15
+
+	nlaFNested   = 0x8000
+	nlaTypeMask  = ^uint16(0xc000)
+	nfgenMsgSize = 4
+)
+
+// protocolNames names the protocol numbers conntrack has names for
+var protocolNames = map[int]string{
+	1:   "icmp",
+	6:   "tcp",
+	17:  "udp",
+	33:  "dccp",
+	47:  "gre",
+	58:  "icmpv6",
+	132: "sctp",
+	136: "udplite",
+}
+
+// tcpStates are the names of enum tcp_conntrack, in order
+var tcpStates = []string{
+	"NONE", "SYN_SENT", "SYN_RECV", "ESTABLISHED", "FIN_WAIT",
+	"CLOSE_WAIT", "LAST_ACK", "TIME_WAIT", "CLOSE", "SYN_SENT2",
+}
+
+// NetlinkController controls conntrack by talking ctnetlink to the kernel directly,
+// it requires CAP_NET_ADMIN but no conntrack binary
+type NetlinkController struct {
+	seq uint32
+}
+
+// List dumps the conntrack table and returns the flows matching the filter
+func (c *NetlinkController) List(f Filter) ([]Flow, error) {
+	// an unspecified family dumps both ipv4 and ipv6
+	request := c.message(ipctnlMsgCTGet, syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP, syscall.AF_UNSPEC, nil)
+
+	flows := make([]Flow, 0)
+	err := netlinkRequest(request, func(m syscall.NetlinkMessage) error {
+		flow, err := decodeFlow(m.Data)
+		if err != nil {
+			return err
+		}
+		if f.Match(&flow) {
+			flows = append(flows, flow)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return flows, nil
+}
+
+// Delete deletes the flows matching the filter one by one, by their original tuple
+func (c *NetlinkController) Delete(f Filter) (int, error) {
+	flows, err := c.List(f)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for i := range flows {
+		family := uint8(syscall.AF_INET)
+		if flows[i].Original.Layer3.Source.Is6() {
+			family = syscall.AF_INET6
+		}
+
+		attrs := encodeTuple(ctaTupleOrig, flows[i].Original, flows[i].ProtocolNumber, flows[i].Protocol)
+		if flows[i].Zone != 0 {
+			attrs = append(attrs, attribute(ctaZone, binary.BigEndian.AppendUint16(nil, flows[i].Zone))...)
+		}
+
+		request := c.message(ipctnlMsgCTDelete, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, family, attrs)
+		err := netlinkRequest(request, nil)
+
+		// the flow may have ended by itself since we listed it
+		if err == syscall.ENOENT {
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("unable to delete %s: %s", flows[i].Original.Tuple(flows[i].Protocol), err)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// message builds a ctnetlink message
+func (c *NetlinkController) message(msgType uint16, flags uint16, family uint8, attrs []byte) []byte {
+	length := syscall.NLMSG_HDRLEN + nfgenMsgSize + len(attrs)
+	b := make([]byte, 0, length)
+
+	// struct nlmsghdr is in host byte order
+	b = binary.NativeEndian.AppendUint32(b, uint32(length))
+	b = binary.NativeEndian.AppendUint16(b, nfnlSubsysCTNetlink<<8|msgType)
+	b = binary.NativeEndian.AppendUint16(b, flags)
+	b = binary.NativeEndian.AppendUint32(b, atomic.AddUint32(&c.seq, 1))
+	b = binary.NativeEndian.AppendUint32(b, 0)
+
+	// struct nfgenmsg, version 0 and resource id 0
+	b = append(b, family, 0, 0, 0)
+
+	return append(b, attrs...)
+}
+
+// netlinkRequest sends a request and hands every reply to handle, until the kernel is done
+func netlinkRequest(request []byte, handle func(syscall.NetlinkMessage) error) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("unable to open netlink socket: %s", err)
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return fmt.Errorf("unable to bind netlink socket: %s", err)
+	}
+
+	err = syscall.Sendto(fd, request, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return fmt.Errorf("unable to send netlink request: %s", err)
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("unable to receive netlink reply: %s", err)
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("unable to parse netlink reply: %s", err)
+		}
+
+		for _, m := range messages {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				// an error of zero is an acknowledgement
+				if len(m.Data) < 4 {
+					return fmt.Errorf("short netlink error")
+				}
+				errno := -int32(binary.NativeEndian.Uint32(m.Data))
+				if errno == 0 {
+					return nil
+				}
+				return syscall.Errno(errno)
+			}
+
+			if handle != nil {
+				err = handle(m)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// attribute encodes a single netlink attribute, padded to four bytes
+func attribute(attrType uint16, value []byte) []byte {
+	b := make([]byte, 0, syscall.NLA_HDRLEN+len(value)+3)
+	b = binary.NativeEndian.AppendUint16(b, uint16(syscall.NLA_HDRLEN+len(value)))
+	b = binary.NativeEndian.AppendUint16(b, attrType)
+	b = append(b, value...)
+	for len(b)%syscall.NLA_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// nested encodes attributes nested within another
+func nested(attrType uint16, attrs ...[]byte) []byte {
+	var value []byte
+	for _, a := range attrs {
+		value = append(value, a...)
+	}
+	return attribute(attrType|nlaFNested, value)
+}
+
+// encodeTuple encodes a direction as a CTA_TUPLE_ORIG or CTA_TUPLE_REPLY attribute
+func encodeTuple(attrType uint16, d Direction, protocolNumber int, protocol string) []byte {
+	var ip []byte
+	if d.Layer3.Source.Is4() {
+		src, dst := d.Layer3.Source.As4(), d.Layer3.Destination.As4()
+		ip = nested(ctaTupleIP, attribute(ctaIPv4Src, src[:]), attribute(ctaIPv4Dst, dst[:]))
+	} else {
+		src, dst := d.Layer3.Source.As16(), d.Layer3.Destination.As16()
+		ip = nested(ctaTupleIP, attribute(ctaIPv6Src, src[:]), attribute(ctaIPv6Dst, dst[:]))
+	}
+
+	proto := [][]byte{attribute(ctaProtoNum, []byte{uint8(protocolNumber)})}
+	switch protocol {
+	case "icmp":
+		proto = append(proto,
+			attribute(ctaProtoICMPID, binary.BigEndian.AppendUint16(nil, d.ICMP.ID)),
+			attribute(ctaProtoICMPType, []byte{d.ICMP.Type}),
+			attribute(ctaProtoICMPCode, []byte{d.ICMP.Code}),
+		)
+	case "icmpv6":
+		proto = append(proto,
+			attribute(ctaProtoICMPv6ID, binary.BigEndian.AppendUint16(nil, d.ICMP.ID)),
+			attribute(ctaProtoICMPv6Type, []byte{d.ICMP.Type}),
+			attribute(ctaProtoICMPv6Code, []byte{d.ICMP.Code}),
+		)
+	default:
+		proto = append(proto,
+			attribute(ctaProtoSrcPort, binary.BigEndian.AppendUint16(nil, d.Layer4.SPort)),
+			attribute(ctaProtoDstPort, binary.BigEndian.AppendUint16(nil, d.Layer4.DPort)),
+		)
+	}
+
+	attrs := [][]byte{ip, nested(ctaTupleProto, proto...)}
+	if d.Zone != 0 {
+		attrs = append(attrs, attribute(ctaTupleZone, binary.BigEndian.AppendUint16(nil, d.Zone)))
+	}
+	return nested(attrType, attrs...)
+}
+
+// parseAttributes splits a buffer of attributes into their types and values
+func parseAttributes(b []byte) (map[uint16][]byte, error) {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= syscall.NLA_HDRLEN {
+		length := int(binary.NativeEndian.Uint16(b))
+		attrType := binary.NativeEndian.Uint16(b[2:]) & nlaTypeMask
+		if length < syscall.NLA_HDRLEN || length > len(b) {
+			return nil, fmt.Errorf("attribute %d has invalid length %d", attrType, length)
+		}
+		attrs[attrType] = b[syscall.NLA_HDRLEN:length]
+
+		aligned := (length + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs, nil
+}
+
+// decodeFlow decodes the payload of a ctnetlink message into a Flow
+func decodeFlow(b []byte) (Flow, error) {
+	flow := Flow{}
+	if len(b) < nfgenMsgSize {
+		return flow, fmt.Errorf("short ctnetlink message")
+	}
+
+	switch b[0] {
+	case syscall.AF_INET:
+		flow.Family = "ipv4"
+	case syscall.AF_INET6:
+		flow.Family = "ipv6"
+	}
+
+	attrs, err := parseAttributes(b[nfgenMsgSize:])
+	if err != nil {
+		return flow, err
+	}
+
+	orig, found := attrs[ctaTupleOrig]
+	if !found {
+		return flow, fmt.Errorf("flow has no original tuple")
+	}
+	flow.ProtocolNumber, err = decodeTuple(orig, &flow.Original)
+	if err != nil {
+		return flow, fmt.Errorf("unable to decode original tuple: %s", err)
+	}
+	flow.Protocol = protocolNames[flow.ProtocolNumber]
+	if flow.Protocol == "" {
+		flow.Protocol = "unknown"
+	}
+
+	reply, found := attrs[ctaTupleReply]
+	if !found {
+		return flow, fmt.Errorf("flow has no reply tuple")
+	}
+	_, err = decodeTuple(reply, &flow.Reply)
+	if err != nil {
+		return flow, fmt.Errorf("unable to decode reply tuple: %s", err)
+	}
+
+	if v, found := attrs[ctaStatus]; found && len(v) == 4 {
+		status := binary.BigEndian.Uint32(v)
+		if status&ipsSeenReply == 0 {
+			flow.State = "UNREPLIED"
+		}
+		if status&ipsAssured != 0 {
+			flow.State = "ASSURED"
+		}
+		if status&ipsOffload != 0 {
+			flow.Offload = "OFFLOAD"
+		}
+		if status&ipsHWOffload != 0 {
+			flow.Offload = "HW_OFFLOAD"
+		}
+	}
+	if v, found := attrs[ctaTimeout]; found && len(v) == 4 {
+		flow.TTL = int(binary.BigEndian.Uint32(v))
+	}
+	if v, found := attrs[ctaMark]; found && len(v) == 4 {
+		flow.Mark = binary.BigEndian.Uint32(v)
+	}
+	if v, found := attrs[ctaUse]; found && len(v) == 4 {
+		flow.Use = uint(binary.BigEndian.Uint32(v))
+	}
+	if v, found := attrs[ctaID]; found && len(v) == 4 {
+		flow.ID = binary.BigEndian.Uint32(v)
+	}
+	if v, found := attrs[ctaZone]; found && len(v) == 2 {
+		flow.Zone = binary.BigEndian.Uint16(v)
+	}
+	if v, found := attrs[ctaProtoinfo]; found && flow.Protocol == "tcp" {
+		info, err := parseAttributes(v)
+		if err != nil {
+			return flow, err
+		}
+		tcp, err := parseAttributes(info[ctaProtoinfoTCP])
+		if err != nil {
+			return flow, err
+		}
+		if state, found := tcp[ctaProtoinfoTCPSt]; found && len(state) == 1 && int(state[0]) < len(tcpStates) {
+			flow.ProtocolState = tcpStates[state[0]]
+		}
+	}
+	if v, found := attrs[ctaCountersOrig]; found {
+		flow.Original.Counter, err = decodeCounters(v)
+		if err != nil {
+			return flow, err
+		}
+	}
+	if v, found := attrs[ctaCountersReply]; found {
+		flow.Reply.Counter, err = decodeCounters(v)
+		if err != nil {
+			return flow, err
+		}
+	}
+
+	// If conntrack does not expect the reply to be received by the source - we properly have NAT
+	if flow.Original.Layer3.Source != flow.Reply.Layer3.Destination {
+		flow.NAT = true
+	}
+
+	return flow, nil
+}
+
+// decodeTuple decodes a CTA_TUPLE_ORIG or CTA_TUPLE_REPLY into a direction and returns its protocol number
+func decodeTuple(b []byte, d *Direction) (int, error) {
+	tuple, err := parseAttributes(b)
+	if err != nil {
+		return 0, err
+	}
+
+	ip, err := parseAttributes(tuple[ctaTupleIP])
+	if err != nil {
+		return 0, err
+	}
+	if src, dst := ip[ctaIPv4Src], ip[ctaIPv4Dst]; len(src) == 4 && len(dst) == 4 {
+		d.Layer3.Source = netip.AddrFrom4([4]byte(src))
+		d.Layer3.Destination = netip.AddrFrom4([4]byte(dst))
+	} else if src, dst := ip[ctaIPv6Src], ip[ctaIPv6Dst]; len(src) == 16 && len(dst) == 16 {
+		d.Layer3.Source = netip.AddrFrom16([16]byte(src))
+		d.Layer3.Destination = netip.AddrFrom16([16]byte(dst))
+	} else {
+		return 0, fmt.Errorf("tuple has no addresses")
+	}
+
+	proto, err := parseAttributes(tuple[ctaTupleProto])
+	if err != nil {
+		return 0, err
+	}
+	num, found := proto[ctaProtoNum]
+	if !found || len(num) != 1 {
+		return 0, fmt.Errorf("tuple has no protocol")
+	}
+
+	if v, found := proto[ctaProtoSrcPort]; found && len(v) == 2 {
+		d.Layer4.SPort = binary.BigEndian.Uint16(v)
+	}
+	if v, found := proto[ctaProtoDstPort]; found && len(v) == 2 {
+		d.Layer4.DPort = binary.BigEndian.Uint16(v)
+	}
+	for _, icmp := range [][3]uint16{{ctaProtoICMPID, ctaProtoICMPType, ctaProtoICMPCode}, {ctaProtoICMPv6ID, ctaProtoICMPv6Type, ctaProtoICMPv6Code}} {
+		if v, found := proto[icmp[0]]; found && len(v) == 2 {
+			d.ICMP.ID = binary.BigEndian.Uint16(v)
+		}
+		if v, found := proto[icmp[1]]; found && len(v) == 1 {
+			d.ICMP.Type = v[0]
+		}
+		if v, found := proto[icmp[2]]; found && len(v) == 1 {
+			d.ICMP.Code = v[0]
+		}
+	}
+
+	if v, found := tuple[ctaTupleZone]; found && len(v) == 2 {
+		d.Zone = binary.BigEndian.Uint16(v)
+	}
+
+	return int(num[0]), nil
+}
+
+// decodeCounters decodes CTA_COUNTERS_ORIG and CTA_COUNTERS_REPLY
+func decodeCounters(b []byte) (Counter, error) {
+	counters, err := parseAttributes(b)
+	if err != nil {
+		return Counter{}, err
+	}
+
+	c := Counter{}
+	if v, found := counters[ctaCountersPackets]; found && len(v) == 8 {
+		c.Packets = uint(binary.BigEndian.Uint64(v))
+	}
+	if v, found := counters[ctaCountersBytes]; found && len(v) == 8 {
+		c.Bytes = uint(binary.BigEndian.Uint64(v))
+	}
+	return c, nil
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package conntrack
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+func TestNetlinkTupleRoundTrip(t *testing.T) {
+	for _, line := range readLines(t, "flows_test_file.txt") {
+		flow, err := ParseFlowLine(line)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", line, err)
+		}
+
+		// the encoded attribute is nested, decodeTuple reads its payload
+		encoded := encodeTuple(ctaTupleOrig, flow.Original, flow.ProtocolNumber, flow.Protocol)
+		d := Direction{}
+		num, err := decodeTuple(encoded[syscall.NLA_HDRLEN:], &d)
+		if err != nil {
+			t.Fatalf("unable to decode tuple of %s: %s", line, err)
+		}
+
+		if num != flow.ProtocolNumber {
+			t.Fatalf("protocol number was expected to be %d, was %d", flow.ProtocolNumber, num)
+		}
+		if d.Tuple(flow.Protocol) != flow.Original.Tuple(flow.Protocol) || d.ICMP != flow.Original.ICMP {
+			t.Fatalf("tuple changed when encoded:\n%+v\n%+v", flow.Original, d)
+		}
+	}
+}
+
+func TestNetlinkDecodeFlow(t *testing.T) {
+	flow, err := ParseFlowLine("tcp      6 431999 ESTABLISHED src=192.168.1.191 dst=52.222.168.153 sport=49746 dport=443 packets=50 bytes=20898 src=52.222.168.153 dst=85.191.222.130 sport=443 dport=49746 packets=48 bytes=13171 [ASSURED] mark=256 use=1 id=4711")
+	if err != nil {
+		t.Fatalf("unable to parse flow: %s", err)
+	}
+
+	u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+	counters := func(attrType uint16, c Counter) []byte {
+		return nested(attrType,
+			attribute(ctaCountersPackets, binary.BigEndian.AppendUint64(nil, uint64(c.Packets))),
+			attribute(ctaCountersBytes, binary.BigEndian.AppendUint64(nil, uint64(c.Bytes))),
+		)
+	}
+
+	msg := []byte{syscall.AF_INET, 0, 0, 0}
+	for _, attr := range [][]byte{
+		encodeTuple(ctaTupleOrig, flow.Original, flow.ProtocolNumber, flow.Protocol),
+		encodeTuple(ctaTupleReply, flow.Reply, flow.ProtocolNumber, flow.Protocol),
+		attribute(ctaStatus, u32(ipsSeenReply|ipsAssured)),
+		attribute(ctaTimeout, u32(uint32(flow.TTL))),
+		attribute(ctaMark, u32(flow.Mark)),
+		attribute(ctaUse, u32(uint32(flow.Use))),
+		attribute(ctaID, u32(flow.ID)),
+		nested(ctaProtoinfo, nested(ctaProtoinfoTCP, attribute(ctaProtoinfoTCPSt, []byte{3}))),
+		counters(ctaCountersOrig, flow.Original.Counter),
+		counters(ctaCountersReply, flow.Reply.Counter),
+	} {
+		msg = append(msg, attr...)
+	}
+
+	decoded, err := decodeFlow(msg)
+	if err != nil {
+		t.Fatalf("unable to decode flow: %s", err)
+	}
+
+	// the text format does not carry the family unless asked to
+	decoded.Family = ""
+	if decoded.String() != flow.String() {
+		t.Fatalf("decoded flow differs:\n%s\n%s", flow, decoded)
+	}
+
+	_, err = decodeFlow(msg[:nfgenMsgSize+2])
+	if err == nil {
+		t.Fatalf("truncated message was decoded")
+	}
+}
@@ -1,32 +1,28 @@
 package conntrack
 
 import (
-	"bufio"
 	"io"
 )
 
-// reader embedds io.Reader and reads FlowUpdates from it
+// reader embedds io.Reader and reads Flows from it
 type reader struct {
 	io.Reader
-	buffer *bufio.Reader
+	scanner *scanner
 }
 
 // NewReader returns a new reader
 func NewReader(in io.Reader) *reader {
-	return &reader{Reader: in, buffer: bufio.NewReader(in)}
+	return &reader{Reader: in, scanner: NewScanner(in)}
 }
 
 // Read reads the next Flow from its embedded reader
 func (r *reader) Read() (*Flow, error) {
-	line, err := r.buffer.ReadString('\n')
+	f, err := r.scanner.Read()
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := ParseFlowLine(line)
-	if err != nil {
-		return nil, err
-	}
-
-	return &f, nil
+	// the scanner reuses its flow, our callers may keep theirs
+	flow := *f
+	return &flow, nil
 }
@@ -0,0 +1,427 @@
+package conntrack
+
+// This is the text parser as it was before the scanner, kept to benchmark the
+// scanner against
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// referenceFlow is Flow as it was before the scanner, with net.IP addresses
+type referenceFlow struct {
+
+	// Original direction
+	Original referenceDirection
+
+	// Reply direction
+	Reply referenceDirection
+
+	Family         string // ipv4, ipv6 - only present when conntrack is run with -o extended
+	TTL            int
+	State          string // ASSURED, UNREPLIED
+	Protocol       string // tcp, udp, imcp....
+	ProtocolNumber int    // 6, 17, 1....
+	ProtocolState  string // ESTABLISHED, CLOSE_WAIT etc
+	Offload        string // OFFLOAD, HW_OFFLOAD
+
+	Mark   uint32
+	Use    uint
+	Zone   uint16
+	ID     uint32
+	SecCtx string
+	Labels []string
+
+	// Start, Stop and DeltaTime are only present when conntrack is run with -o timestamp
+	// and the kernel has nf_conntrack_timestamp enabled
+	Start     time.Time
+	Stop      time.Time
+	DeltaTime time.Duration
+
+	// NAT is not really a conntrack thing, we just check if the original
+	// and reply directions match each others ip addresses for convenience
+	NAT bool
+}
+
+// referenceDirection is Direction before the scanner
+type referenceDirection struct {
+	Layer3  referenceLayer3
+	Layer4  referenceLayer4
+	ICMP    referenceICMP
+	Counter referenceCounter
+
+	// Zone is the per direction zone, printed as zone-orig= and zone-reply=
+	Zone uint16
+}
+
+// referenceLayer3 held net.IP addresses, which are allocated by net.ParseIP
+type referenceLayer3 struct {
+	Source      net.IP
+	Destination net.IP
+}
+
+// referenceLayer4 is Layer4 before the scanner
+type referenceLayer4 struct {
+	SPort uint16
+	DPort uint16
+}
+
+// referenceICMP is ICMP before the scanner
+type referenceICMP struct {
+	Type uint8
+	Code uint8
+	ID   uint16
+}
+
+// referenceCounter is Counter before the scanner
+type referenceCounter struct {
+	Packets uint
+	Bytes   uint
+}
+
+// referenceParseFlowLine is ParseFlowLine before the scanner, splitting strings with
+// strings.Fields and parsing numbers with strconv, BenchmarkReference measures it
+func referenceParseFlowLine(s string) (referenceFlow, error) {
+	flow := referenceFlow{}
+
+	parts := strings.Fields(s)
+	if len(parts) < 2 {
+		return flow, fmt.Errorf("Supplied string had too few fields: \"%s\"", s)
+	}
+	// we use this index to jump in our parts
+	index := 0
+
+	// when run with -o extended, the line is prefixed with the layer 3 protocol
+	// which is followed by its number in decimal that we can derive from the name
+	if parts[index] == "ipv4" || parts[index] == "ipv6" {
+		flow.Family = parts[index]
+		index = index + 2
+	}
+
+	// the layer 4 protocol
+	if index+1 >= len(parts) {
+		return flow, fmt.Errorf("Supplied string had no protocol: \"%s\"", s)
+	}
+	flow.Protocol = parts[index]
+	index++
+
+	// followed by protocol in decimal
+	protocolNumber, err := strconv.Atoi(parts[index])
+	if err != nil {
+		return flow, fmt.Errorf("Unable to parse protocol number from conntrack: %s could not be parsed as integer: %s", parts[index], err)
+	}
+	flow.ProtocolNumber = protocolNumber
+	index++
+
+	// part 2 is ttl (unless we are parsing events - when there is no ttl)
+	if index < len(parts) && parts[index] != "" && parts[index][0] >= '0' && parts[index][0] <= '9' {
+
+		ttl, err := strconv.Atoi(parts[index])
+		if err != nil {
+			return flow, fmt.Errorf("Unable to parse ttl from conntrack: %s could not be parsed as integer: %s", parts[index], err)
+		}
+		flow.TTL = ttl
+		index++
+	}
+
+	// if we where talking tcp, we have a special field in here
+	// i dont know if other protocols also have this special field so, we
+	// are looking for the begining of layer3-4 instead
+	if index < len(parts) && !strings.HasPrefix(parts[index], "src=") {
+		flow.ProtocolState = parts[index]
+		index++
+	}
+
+	if index >= len(parts) {
+		return flow, fmt.Errorf("Supplied string had no layer 3 and 4 information: \"%s\"", s)
+	}
+
+	// the next parts are layer3-4 info, we have a special function for these
+	offset, err := referenceParseLayer3And4(parts[index:], flow.Protocol, &flow.Original)
+	if err != nil {
+		return flow, fmt.Errorf("Unable to parse layer 3 and 4 from line %+v: %s", parts, err)
+	}
+	index = index + offset
+
+	// this part is usually "[UNREPLIED]"
+	// but if it has a prefix of src= - move along
+	if index < len(parts) && !strings.HasPrefix(parts[index], "src=") {
+		flow.State = strings.Trim(parts[index], "[]")
+		index++
+	}
+
+	if index >= len(parts) {
+		return flow, fmt.Errorf("Supplied string had no reply direction: \"%s\"", s)
+	}
+
+	// then we should get back to our reply layer3-4
+	offset, err = referenceParseLayer3And4(parts[index:], flow.Protocol, &flow.Reply)
+	if err != nil {
+		return flow, fmt.Errorf("Unable to parse layer 3 and 4 from line: %+v: %s", parts, err)
+	}
+	index = index + offset
+
+	// If conntrack does not expect the reply to be received by the source - we properly have NAT
+	if !flow.Original.Layer3.Source.Equal(flow.Reply.Layer3.Destination) {
+		flow.NAT = true
+	}
+
+	// whatever is left are flags and meta data about the flow as a whole
+	err = referenceParseTrailer(parts[index:], &flow)
+	if err != nil {
+		return flow, fmt.Errorf("Unable to parse trailer from line: %+v: %s", parts, err)
+	}
+
+	// That is all
+
+	return flow, nil
+}
+
+// referenceParseTrailer parses the parts following the reply direction such as:
+// [ASSURED] [OFFLOAD] mark=0 secctx=system_u:object_r:unlabeled_t:s0 zone=1 [start=Mon Jun  4 10:00:00 2018] use=1 id=3735928559
+func referenceParseTrailer(s []string, f *referenceFlow) error {
+	for i := 0; i < len(s); i++ {
+		part := s[i]
+
+		// timestamps contains spaces - collect parts until we find the closing bracket
+		if strings.HasPrefix(part, "[start=") || strings.HasPrefix(part, "[stop=") {
+			for !strings.HasSuffix(part, "]") && i+1 < len(s) {
+				i++
+				part = part + " " + s[i]
+			}
+			key, value := referenceSplitField(strings.Trim(part, "[]"))
+			t, err := time.ParseInLocation(timestampLayout, value, time.Local)
+			if err != nil {
+				return fmt.Errorf("unable to parse %s timestamp: %s", key, err)
+			}
+			if key == "start" {
+				f.Start = t
+			} else {
+				f.Stop = t
+			}
+			continue
+		}
+
+		switch part {
+		case "[ASSURED]":
+			f.State = "ASSURED"
+			continue
+		case "[OFFLOAD]", "[HW_OFFLOAD]":
+			f.Offload = strings.Trim(part, "[]")
+			continue
+		}
+
+		key, value := referenceSplitField(part)
+		switch key {
+		case "mark":
+			mark, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("unable to parse mark: %s", err)
+			}
+			f.Mark = uint32(mark)
+		case "use":
+			use, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("unable to parse use: %s", err)
+			}
+			f.Use = uint(use)
+		case "zone":
+			zone, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return fmt.Errorf("unable to parse zone: %s", err)
+			}
+			f.Zone = uint16(zone)
+		case "id":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("unable to parse id: %s", err)
+			}
+			f.ID = uint32(id)
+		case "delta-time":
+			delta, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("unable to parse delta-time: %s", err)
+			}
+			f.DeltaTime = time.Duration(delta) * time.Second
+		case "secctx":
+			f.SecCtx = value
+		case "labels":
+			f.Labels = strings.Split(value, ",")
+		}
+		// anything else is something newer conntrack versions have come up with, skip it
+	}
+	return nil
+}
+
+// referenceParseLayer3And4 parses slices of parts such as:
+// src=192.168.1.149 dst=239.255.255.250 sport=45162 dport=1900 packets=3 bytes=1340
+// src=192.168.1.149 dst=8.8.8.8 type=8 code=0 id=4711 zone-orig=1 packets=3 bytes=252
+func referenceParseLayer3And4(s []string, protocol string, d *referenceDirection) (int, error) {
+	// We return length so that the call'er is able to figure out how much we parsed
+	length := 0
+
+	// type, code and id are only for icmp traffic, for anything else an id is the flow id
+	icmp := strings.HasPrefix(protocol, "icmp")
+
+	// our line always starts with src, if we encounter another src, we have gone too far
+	var srcPassed bool
+	for _, s := range s {
+		key, value := referenceSplitField(s)
+		switch key {
+		case "src":
+			if srcPassed {
+				// we have gone too far
+				return length, nil
+			}
+
+			d.Layer3.Source = net.ParseIP(value)
+			length++
+			srcPassed = true
+
+		case "dst":
+			d.Layer3.Destination = net.ParseIP(value)
+			length++
+		case "dport":
+			dport, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return length, fmt.Errorf("Conntrack: Parselayer3-4: Unable to parse dport: %s", err)
+			}
+			d.Layer4.DPort = uint16(dport)
+			length++
+		case "sport":
+			sport, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return length, fmt.Errorf("Conntrack: Parselayer3-4: Unable to parse sport: %s", err)
+			}
+			d.Layer4.SPort = uint16(sport)
+			length++
+		case "packets":
+
+			packets, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return length, fmt.Errorf("Parselayer3-4: Unable to parse packets: %s", err)
+			}
+			d.Counter.Packets = uint(packets)
+			length++
+		case "bytes":
+			bytes, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return length, fmt.Errorf("Parselayer3-4: Unable to parse bytes: %s", err)
+			}
+			d.Counter.Bytes = uint(bytes)
+			length++
+		case "zone-orig", "zone-reply":
+			zone, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return length, fmt.Errorf("Parselayer3-4: Unable to parse %s: %s", key, err)
+			}
+			d.Zone = uint16(zone)
+			length++
+		case "type", "code", "id":
+			if !icmp {
+				// this is not ours, but belongs to the flow as a whole
+				return length, nil
+			}
+			err := referenceParseICMP(key, value, &d.ICMP)
+			if err != nil {
+				return length, fmt.Errorf("Parselayer3-4: %s", err)
+			}
+			length++
+		default:
+			// we have encountered a field we dont know and we should be pretty sure we have no more fields left...
+			return length, nil
+		}
+	}
+	return length, nil
+}
+
+// referenceParseICMP parses one of the type, code or id fields of an icmp flow
+func referenceParseICMP(key, value string, i *referenceICMP) error {
+	bitSize := 8
+	if key == "id" {
+		bitSize = 16
+	}
+
+	v, err := strconv.ParseUint(value, 10, bitSize)
+	if err != nil {
+		return fmt.Errorf("Unable to parse icmp %s: %s", key, err)
+	}
+
+	switch key {
+	case "type":
+		i.Type = uint8(v)
+	case "code":
+		i.Code = uint8(v)
+	case "id":
+		i.ID = uint16(v)
+	}
+	return nil
+}
+
+// referenceSplitField splits key=value into its key and value
+func referenceSplitField(s string) (string, string) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// referenceSink keeps the compiler from optimizing parsing away
+var referenceSink *referenceFlow
+
+// BenchmarkReference reads flows the way StateStore did before the scanner, parsing
+// a line at a time into a newly allocated flow
+func BenchmarkReference(b *testing.B) {
+	data := listing(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for {
+			line, err := r.ReadString('\n')
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatalf("unable to read line: %s", err)
+			}
+
+			f, err := referenceParseFlowLine(line)
+			if err != nil {
+				b.Fatalf("unable to parse flow: %s", err)
+			}
+			referenceSink = &f
+		}
+	}
+}
+
+func TestReference(t *testing.T) {
+	// the reference has to parse the same flows for the benchmark to mean anything
+	for _, line := range readLines(t, "flows_test_file.txt") {
+		flow, err := ParseFlowLine(line)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", line, err)
+		}
+		reference, err := referenceParseFlowLine(line)
+		if err != nil {
+			t.Fatalf("reference was unable to parse %s: %s", line, err)
+		}
+
+		if reference.Original.Layer3.Source.String() != flow.Original.Layer3.Source.String() ||
+			reference.Reply.Layer3.Destination.String() != flow.Reply.Layer3.Destination.String() ||
+			reference.Original.Counter.Bytes != flow.Original.Counter.Bytes ||
+			reference.Protocol != flow.Protocol || reference.State != flow.State || reference.ID != flow.ID {
+			t.Fatalf("reference parsed %s differently:\n%+v\n%+v", line, reference, flow)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// scanner reads Flows from conntrack -L output without allocating per line,
+// the Flow returned by Read is reused and only valid until the next call to Read
+type scanner struct {
+	io.Reader
+	lines  *bufio.Scanner
+	fields [][]byte
+	flow   Flow
+}
+
+// NewScanner returns a new scanner
+func NewScanner(in io.Reader) *scanner {
+	lines := bufio.NewScanner(in)
+	lines.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	return &scanner{Reader: in, lines: lines, fields: make([][]byte, 0, 32)}
+}
+
+// Read reads the next Flow from its embedded reader, the flow is overwritten by the next Read
+func (s *scanner) Read() (*Flow, error) {
+	for s.lines.Scan() {
+		s.fields = splitFields(s.lines.Bytes(), s.fields[:0])
+
+		// empty lines are not flows
+		if len(s.fields) == 0 {
+			continue
+		}
+
+		err := parseFlow(s.fields, &s.flow)
+		if err != nil {
+			return nil, err
+		}
+		return &s.flow, nil
+	}
+
+	if err := s.lines.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// splitFields appends the whitespace separated fields of line to fields
+func splitFields(line []byte, fields [][]byte) [][]byte {
+	start := -1
+	for i, c := range line {
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			if start >= 0 {
+				fields = append(fields, line[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+	}
+	return fields
+}
+
+// splitField splits key=value into its key and value
+func splitField(b []byte) ([]byte, []byte) {
+	for i, c := range b {
+		if c == '=' {
+			return b[:i], b[i+1:]
+		}
+	}
+	return b, nil
+}
+
+// hasPrefix reports if b begins with prefix, without the allocation of converting one into the other
+func hasPrefix(b []byte, prefix string) bool {
+	return len(b) >= len(prefix) && string(b[:len(prefix)]) == prefix
+}
+
+// isDigits reports if b is a non empty decimal number
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// parseUint parses a decimal number which must fit in bitSize bits
+func parseUint(b []byte, bitSize uint) (uint64, error) {
+	if !isDigits(b) {
+		return 0, fmt.Errorf("invalid number \"%s\"", b)
+	}
+
+	max := uint64(1)<<bitSize - 1
+	if bitSize == 64 {
+		max = ^uint64(0)
+	}
+
+	var n uint64
+	for _, c := range b {
+		d := uint64(c - '0')
+		if n > (max-d)/10 {
+			return 0, fmt.Errorf("number \"%s\" is out of range", b)
+		}
+		n = n*10 + d
+	}
+	return n, nil
+}
+
+// intern returns the well known strings conntrack prints as constants, so they need not be allocated
+func intern(b []byte) string {
+	switch string(b) {
+	case "tcp":
+		return "tcp"
+	case "udp":
+		return "udp"
+	case "icmp":
+		return "icmp"
+	case "icmpv6":
+		return "icmpv6"
+	case "ESTABLISHED":
+		return "ESTABLISHED"
+	case "SYN_SENT":
+		return "SYN_SENT"
+	case "SYN_RECV":
+		return "SYN_RECV"
+	case "FIN_WAIT":
+		return "FIN_WAIT"
+	case "CLOSE_WAIT":
+		return "CLOSE_WAIT"
+	case "LAST_ACK":
+		return "LAST_ACK"
+	case "TIME_WAIT":
+		return "TIME_WAIT"
+	case "CLOSE":
+		return "CLOSE"
+	case "UNREPLIED":
+		return "UNREPLIED"
+	case "ASSURED":
+		return "ASSURED"
+	case "OFFLOAD":
+		return "OFFLOAD"
+	case "HW_OFFLOAD":
+		return "HW_OFFLOAD"
+	case "ipv4":
+		return "ipv4"
+	case "ipv6":
+		return "ipv6"
+	}
+	return string(b)
+}
+
+// parseAddr parses an ipv4 or ipv6 address, without allocating
+func parseAddr(b []byte) (netip.Addr, error) {
+	// zones are uncommon enough to let netip take care of them
+	if bytes.IndexByte(b, '%') >= 0 {
+		return netip.ParseAddr(string(b))
+	}
+	if bytes.IndexByte(b, ':') >= 0 {
+		return parseAddr6(b)
+	}
+	return parseAddr4(b)
+}
+
+// parseAddr4 parses dotted decimal ipv4 addresses
+func parseAddr4(b []byte) (netip.Addr, error) {
+	var ip [4]byte
+	octet := 0
+	digits := 0
+	value := 0
+
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9':
+			// leading zeroes are ambiguous, netip refuses them as well
+			if digits > 0 && value == 0 {
+				return netip.Addr{}, fmt.Errorf("invalid ipv4 address \"%s\"", b)
+			}
+			value = value*10 + int(c-'0')
+			digits++
+			if value > 255 {
+				return netip.Addr{}, fmt.Errorf("invalid ipv4 address \"%s\"", b)
+			}
+		case c == '.' && digits > 0 && octet < 3:
+			ip[octet] = byte(value)
+			octet++
+			digits = 0
+			value = 0
+		default:
+			return netip.Addr{}, fmt.Errorf("invalid ipv4 address \"%s\"", b)
+		}
+	}
+
+	if octet != 3 || digits == 0 {
+		return netip.Addr{}, fmt.Errorf("invalid ipv4 address \"%s\"", b)
+	}
+	ip[3] = byte(value)
+
+	return netip.AddrFrom4(ip), nil
+}
+
+// parseAddr6 parses ipv6 addresses, including the ones ending in an ipv4 address
+func parseAddr6(b []byte) (netip.Addr, error) {
+	original := b
+	invalid := func() (netip.Addr, error) {
+		return netip.Addr{}, fmt.Errorf("invalid ipv6 address \"%s\"", original)
+	}
+
+	var ip [16]byte
+	ellipsis := -1 // position of the ::
+	i := 0
+
+	if len(b) >= 2 && b[0] == ':' && b[1] == ':' {
+		ellipsis = 0
+		b = b[2:]
+		if len(b) == 0 {
+			return netip.IPv6Unspecified(), nil
+		}
+	}
+
+	for i < 16 {
+		// read a group of up to four hex digits
+		var group uint32
+		n := 0
+	hex:
+		for ; n < len(b); n++ {
+			c := b[n]
+			switch {
+			case c >= '0' && c <= '9':
+				group = group<<4 + uint32(c-'0')
+			case c >= 'a' && c <= 'f':
+				group = group<<4 + uint32(c-'a'+10)
+			case c >= 'A' && c <= 'F':
+				group = group<<4 + uint32(c-'A'+10)
+			default:
+				break hex
+			}
+			if group > 0xffff {
+				return invalid()
+			}
+		}
+		if n == 0 {
+			return invalid()
+		}
+
+		// the last 32 bits can be written as an ipv4 address
+		if n < len(b) && b[n] == '.' {
+			if (ellipsis < 0 && i != 12) || i+4 > 16 {
+				return invalid()
+			}
+			ip4, err := parseAddr4(b)
+			if err != nil {
+				return invalid()
+			}
+			a := ip4.As4()
+			copy(ip[i:], a[:])
+			i += 4
+			b = nil
+			break
+		}
+
+		ip[i] = byte(group >> 8)
+		ip[i+1] = byte(group)
+		i += 2
+
+		b = b[n:]
+		if len(b) == 0 {
+			break
+		}
+
+		// groups are separated by colons
+		if b[0] != ':' || len(b) == 1 {
+			return invalid()
+		}
+		b = b[1:]
+
+		// and one of them may be the ::
+		if b[0] == ':' {
+			if ellipsis >= 0 {
+				return invalid()
+			}
+			ellipsis = i
+			b = b[1:]
+			if len(b) == 0 {
+				break
+			}
+		}
+	}
+
+	if len(b) != 0 {
+		return invalid()
+	}
+
+	// expand the :: to however many zeroes are missing
+	if i < 16 {
+		if ellipsis < 0 {
+			return invalid()
+		}
+		missing := 16 - i
+		for j := i - 1; j >= ellipsis; j-- {
+			ip[j+missing] = ip[j]
+		}
+		for j := ellipsis + missing - 1; j >= ellipsis; j-- {
+			ip[j] = 0
+		}
+	} else if ellipsis >= 0 {
+		// a :: must stand in for at least one group
+		return invalid()
+	}
+
+	return netip.AddrFrom16(ip), nil
+}
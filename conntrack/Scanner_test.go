@@ -0,0 +1,193 @@
+package conntrack
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+)
+
+// listing turns the conntrack -E test file into something looking like conntrack -L output
+func listing(t testing.TB) []byte {
+	data, err := os.ReadFile("conntrack_test_file.txt")
+	if err != nil {
+		t.Fatalf("unable to read test file: %s", err)
+	}
+
+	var b bytes.Buffer
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) > 10 {
+			b.WriteString(line[10:])
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes()
+}
+
+func TestScannerMatchesParseFlowLine(t *testing.T) {
+	data := listing(t)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	s := NewScanner(bytes.NewReader(data))
+	for i, line := range lines {
+		scanned, err := s.Read()
+		if err != nil {
+			t.Fatalf("line %d: scanner failed: %s", i, err)
+		}
+		parsed, err := ParseFlowLine(line)
+		if err != nil {
+			t.Fatalf("line %d: ParseFlowLine failed: %s", i, err)
+		}
+		if scanned.String() != parsed.String() {
+			t.Fatalf("line %d: scanner and ParseFlowLine disagree:\n%s\n%s", i, scanned, parsed)
+		}
+	}
+
+	_, err := s.Read()
+	if err != io.EOF {
+		t.Fatalf("scanner did not end with EOF: %v", err)
+	}
+}
+
+func TestScannerAllocations(t *testing.T) {
+	data := listing(t)
+	r := bytes.NewReader(data)
+	s := NewScanner(r)
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		_, err := s.Read()
+		if err == io.EOF {
+			r.Reset(data)
+			s = NewScanner(r)
+		}
+	})
+
+	// the only allocations left should be the scanner itself when we start over
+	if allocs > 0.1 {
+		t.Fatalf("scanner allocated %.2f times per flow", allocs)
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	valid := []string{
+		"0.0.0.0", "192.168.1.1", "255.255.255.255", "85.191.222.130",
+		"::", "::1", "1::", "fe80::1", "2001:db8::", "2001:db8:1::10", "2001:4860:4860::8888",
+		"fd00:0:0:0:0:0:0:10", "FD00::ABCD", "::ffff:192.168.1.1", "64:ff9b::192.0.2.33",
+		"1:2:3:4:5:6:7:8", "1:2:3:4:5:6:1.2.3.4", "fe80::1%eth0",
+	}
+	for _, a := range valid {
+		expected := netip.MustParseAddr(a)
+		addr, err := parseAddr([]byte(a))
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", a, err)
+		}
+		if addr != expected {
+			t.Fatalf("%s was parsed as %s, expected %s", a, addr, expected)
+		}
+	}
+
+	invalid := []string{
+		"", "1", "1.2.3", "1.2.3.4.5", "256.1.1.1", "01.2.3.4", "1..2.3", "1.2.3.", "a.b.c.d",
+		":", ":::", "1:2", "1::2::3", "12345::", "1:2:3:4:5:6:7:8:9", "1:2:3:4:5:6:7:8::", "::1.2.3", "g::",
+		"1:2:3:4:5:6:7:1.2.3.4", "1:",
+	}
+	for _, a := range invalid {
+		addr, err := parseAddr([]byte(a))
+		if err == nil {
+			t.Fatalf("parsing %s did not fail, was %s", a, addr)
+		}
+	}
+}
+
+func TestParseUint(t *testing.T) {
+	n, err := parseUint([]byte("65535"), 16)
+	if err != nil || n != 65535 {
+		t.Fatalf("unable to parse 65535: %d, %v", n, err)
+	}
+	n, err = parseUint([]byte("18446744073709551615"), 64)
+	if err != nil || n != 18446744073709551615 {
+		t.Fatalf("unable to parse max uint64: %d, %v", n, err)
+	}
+
+	for _, s := range []string{"", "-1", "65536", "1a", "18446744073709551616"} {
+		bitSize := uint(16)
+		if len(s) > 10 {
+			bitSize = 64
+		}
+		_, err := parseUint([]byte(s), bitSize)
+		if err == nil {
+			t.Fatalf("parsing %s did not fail", s)
+		}
+	}
+}
+
+// BenchmarkReader reads flows through NewReader, one copied Flow per line from the scanner
+func BenchmarkReader(b *testing.B) {
+	data := listing(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r := NewReader(bytes.NewReader(data))
+		for {
+			_, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatalf("unable to read flow: %s", err)
+			}
+		}
+	}
+}
+
+// BenchmarkParseFlowLine parses a line at a time from strings with the scanner's parser,
+// BenchmarkReference is the parser it replaced
+func BenchmarkParseFlowLine(b *testing.B) {
+	data := listing(b)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			_, err := ParseFlowLine(line)
+			if err != nil {
+				b.Fatalf("unable to parse flow: %s", err)
+			}
+		}
+	}
+}
+
+// BenchmarkScannerSummary reads flows the way StateStore does with SummaryOnly
+func BenchmarkScannerSummary(b *testing.B) {
+	data := listing(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		summaries := make(map[netip.Addr]*Summary)
+		s := NewScanner(bytes.NewReader(data))
+		for {
+			flow, err := s.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatalf("unable to read flow: %s", err)
+			}
+
+			summary, exists := summaries[flow.Original.Layer3.Source]
+			if !exists {
+				summary = newSummary()
+				summaries[flow.Original.Layer3.Source] = summary
+			}
+			summary.add(flow, nil)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package conntrack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultCategories groups well known service names, as named by /etc/services
+var defaultCategories = map[string][]string{
+	"web":       {"http", "https", "http-alt", "webcache", "quic"},
+	"dns":       {"domain", "domain-s", "mdns", "llmnr"},
+	"mail":      {"smtp", "submission", "submissions", "pop3", "pop3s", "imap", "imaps"},
+	"streaming": {"rtsp", "rtmp", "mms", "sip", "sip-tls", "spotify"},
+	"gaming":    {"xbox", "steam", "minecraft", "psn"},
+	"remote":    {"ssh", "telnet", "ms-wbt-server", "vnc", "openvpn", "wireguard"},
+	"time":      {"ntp"},
+}
+
+// serviceKey is a port and the protocol it is used with
+type serviceKey struct {
+	protocol string
+	port     uint16
+}
+
+// Services resolves ports to service names, and service names to categories
+type Services struct {
+	names      map[serviceKey]string
+	categories map[string]string
+}
+
+// NewServices returns a services table without any services, and the default categories
+func NewServices() *Services {
+	s := &Services{
+		names:      make(map[serviceKey]string),
+		categories: make(map[string]string),
+	}
+	for category, names := range defaultCategories {
+		for _, name := range names {
+			s.categories[name] = category
+		}
+	}
+	return s
+}
+
+// LoadServices reads a services table from a /etc/services style file, and
+// optionally custom categories from a categories file
+func LoadServices(servicesPath, categoriesPath string) (*Services, error) {
+	s := NewServices()
+
+	fd, err := os.Open(servicesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	err = s.ParseServices(fd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", servicesPath, err)
+	}
+
+	if categoriesPath == "" {
+		return s, nil
+	}
+
+	cfd, err := os.Open(categoriesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cfd.Close()
+
+	err = s.ParseCategories(cfd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", categoriesPath, err)
+	}
+
+	return s, nil
+}
+
+// ParseServices reads lines such as:
+// https           443/tcp                         # http protocol over TLS/SSL
+// domain          53/udp
+func (s *Services) ParseServices(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			continue
+		}
+		if len(parts) < 2 {
+			return fmt.Errorf("service %s has no port", parts[0])
+		}
+
+		portProto := strings.SplitN(parts[1], "/", 2)
+		if len(portProto) != 2 {
+			return fmt.Errorf("service %s has no protocol: %s", parts[0], parts[1])
+		}
+		port, err := strconv.ParseUint(portProto[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("service %s has an invalid port: %s", parts[0], err)
+		}
+
+		// the first name for a port wins, just like getservbyport
+		key := serviceKey{protocol: portProto[1], port: uint16(port)}
+		if _, exists := s.names[key]; !exists {
+			s.names[key] = parts[0]
+		}
+	}
+
+	return scanner.Err()
+}
+
+// ParseCategories reads lines of a category followed by its service names, overriding the defaults:
+// streaming rtsp 1935/tcp
+// gaming 3074/udp 27015/udp
+// ports without a name in the services table can be given as port/protocol
+func (s *Services) ParseCategories(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			continue
+		}
+		if len(parts) < 2 {
+			return fmt.Errorf("category %s has no services", parts[0])
+		}
+
+		for _, name := range parts[1:] {
+			s.categories[name] = parts[0]
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Name returns the service name of a port, or port/protocol when it has no name
+func (s *Services) Name(protocol string, port uint16) string {
+	if s != nil {
+		if name, found := s.names[serviceKey{protocol: protocol, port: port}]; found {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d/%s", port, protocol)
+}
+
+// Category returns the category of a service name, or other
+func (s *Services) Category(name string) string {
+	if s != nil {
+		if category, found := s.categories[name]; found {
+			return category
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,71 @@
+package conntrack
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/fasmide/routerlogin/runner"
+)
+
+// Source is where the store reads conntrack output from
+type Source interface {
+	// List returns a listing of flows in format, as conntrack -L prints it, closing
+	// it returns any error the listing ended with
+	List(format Format) (io.ReadCloser, error)
+
+	// Events returns NEW and DESTROY updates in format, as conntrack -E prints them,
+	// until ctx is done
+	Events(ctx context.Context, format Format) (io.ReadCloser, error)
+}
+
+// CommandSource runs the conntrack command, it is used by the store when no other source is given
+type CommandSource struct {
+	// Runner runs conntrack, on this host when nil
+	Runner runner.Runner
+}
+
+// runner returns Runner or the local one
+func (c CommandSource) runner() runner.Runner {
+	if c.Runner == nil {
+		return runner.Local{}
+	}
+	return c.Runner
+}
+
+// List runs conntrack -L
+func (c CommandSource) List(format Format) (io.ReadCloser, error) {
+	return c.runner().Start(context.Background(), "conntrack", append([]string{"-L"}, format.Args()...)...)
+}
+
+// Events runs conntrack -E
+func (c CommandSource) Events(ctx context.Context, format Format) (io.ReadCloser, error) {
+	return c.runner().Start(ctx, "conntrack", append([]string{"-E", "-e", "NEW,DESTROY"}, format.Args()...)...)
+}
+
+// SourceLister lists the flows of a Source in Format, like the kernel lists them to a
+// Controller. Filtering is done while reading, so it works on any source e.g. a replay
+type SourceLister struct {
+	Source Source
+	Format Format
+}
+
+// List returns every flow of the source matching the filter
+func (l SourceLister) List(f Filter) ([]Flow, error) {
+	input, err := l.Source.List(l.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	flows, err := readFlows(l.Format.NewScanner(input), f)
+	if err != nil {
+		input.Close()
+		return nil, err
+	}
+
+	err = input.Close()
+	if err != nil {
+		return nil, fmt.Errorf("conntrack error: %s", err)
+	}
+	return flows, nil
+}
@@ -3,64 +3,158 @@ package conntrack
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
-	"os/exec"
+	"net/netip"
 	"strconv"
 	"sync"
 	"time"
+
+	"github.com/fasmide/routerlogin/health"
 )
 
 // StateStore stores information about the current conntrack state
 type StateStore struct {
-	db map[string][]*Flow
+	// Format is the output format conntrack is asked to use, defaults to Text
+	Format Format
+
+	// SummaryOnly makes the store aggregate flows into per host summaries while
+	// reading them, instead of keeping every flow around. StatesByIP finds no flows when set
+	SummaryOnly bool
+
+	// Services names the remote ports of flows in summaries, ports are left unnamed when nil
+	Services *Services
+
+	// WANs names the uplinks flows leave through, the table shows which ones each host
+	// uses when set
+	WANs *WANs
+
+	// Source is where conntrack output is read from, the conntrack command when nil
+	Source Source
+
+	// Controller tears down flows for the teardown command, which is unavailable when nil
+	Controller Controller
+
+	// summaries and flows are both indexed by the original direction source
+	summaries map[netip.Addr]*Summary
+	flows     map[netip.Addr][]*Flow
+
+	// forwards are inbound connections, by the lan host they are forwarded to
+	forwards map[netip.Addr]map[forwardKey]*Forward
+
+	// secondary indexes of the retained flows
+	byRemote     map[netip.Addr][]*Flow
+	byRemotePort map[uint16][]*Flow
+	byTuple      map[Tuple]*Flow
+	byReplyTuple map[Tuple]*Flow
+
+	slab flowSlab
+
+	// usage counts traffic per host across listings
+	usage usage
 
 	lock         sync.Mutex
 	lastPopulate time.Time
+	refreshes    health.Tracker
 }
 
 // ensure updates the database if needed
 func (s *StateStore) ensure() error {
 	if time.Now().Sub(s.lastPopulate) > time.Second*5 {
-		s.db = make(map[string][]*Flow)
-		return s.populate()
+		start := time.Now()
+		s.reset()
+		err := s.populate()
+		s.refreshes.Record(start, err)
+		return err
 	}
 
 	return nil
 }
 
-// populate populates the database which is expected to be empty
-func (s *StateStore) populate() error {
-	command := exec.Command("conntrack", "-L")
+// Health returns the state of reading conntrack
+func (s *StateStore) Health() health.State {
+	return s.refreshes.State()
+}
 
-	input, err := command.StdoutPipe()
-	if err != nil {
-		return err
+// reset empties the database
+func (s *StateStore) reset() {
+	s.summaries = make(map[netip.Addr]*Summary)
+	s.flows = make(map[netip.Addr][]*Flow)
+	s.forwards = make(map[netip.Addr]map[forwardKey]*Forward)
+	s.byRemote = make(map[netip.Addr][]*Flow)
+	s.byRemotePort = make(map[uint16][]*Flow)
+	s.byTuple = make(map[Tuple]*Flow)
+	s.byReplyTuple = make(map[Tuple]*Flow)
+	s.slab = flowSlab{}
+}
+
+// add adds a flow to the database, the flow is copied if it is retained
+func (s *StateStore) add(flow *Flow) {
+	// port forwards are about the lan host connected to, not the one connecting
+	if s.inbound(flow) {
+		s.addInbound(flow)
+
+		if s.usage.current != nil {
+			s.usage.add(flow.Reply.Layer3.Source.Unmap(), flow, true)
+		}
+		if !s.SummaryOnly {
+			s.index(s.slab.add(flow), flow.Original.Layer3.Source, flow.Original.Layer4.SPort)
+		}
+		return
 	}
-	defer input.Close()
 
-	// errorReader is read if someting fails down the line
-	errorReader, err := command.StderrPipe()
-	if err != nil {
-		return err
+	// we dont need knowledge about non-natted flows
+	if !flow.NAT {
+		return
 	}
-	defer errorReader.Close()
 
-	var stderr []byte
+	// we always use the original direction source as our index
+	index := flow.Original.Layer3.Source
 
-	go func() {
-		stderr, _ = ioutil.ReadAll(errorReader)
-	}()
+	summary, exists := s.summaries[index]
+	if !exists {
+		summary = newSummary()
+		s.summaries[index] = summary
+	}
+	summary.add(flow, s.Services)
+
+	if s.usage.current != nil {
+		s.usage.add(index, flow, false)
+	}
+
+	if s.SummaryOnly {
+		return
+	}
 
-	// our flow reader
-	r := NewReader(input)
+	f := s.slab.add(flow)
+	s.flows[index] = append(s.flows[index], f)
 
-	err = command.Start()
+	// the remote end is whoever the lan host is talking to
+	s.index(f, f.Original.Layer3.Destination, f.Original.Layer4.DPort)
+}
+
+// index adds a retained flow to the lookups by remote and by tuple
+func (s *StateStore) index(f *Flow, remote netip.Addr, port uint16) {
+	s.byRemote[remote] = append(s.byRemote[remote], f)
+	s.byRemotePort[port] = append(s.byRemotePort[port], f)
+
+	s.byTuple[f.Original.Tuple(f.Protocol)] = f
+	s.byReplyTuple[f.Reply.Tuple(f.Protocol)] = f
+}
+
+// populate populates the database which is expected to be empty
+func (s *StateStore) populate() error {
+	s.WANs.refresh()
+
+	input, err := s.source().List(s.Format)
 	if err != nil {
 		return err
 	}
 
+	// our flow reader, it reuses the flow it returns so we must copy what we want to keep
+	r := s.Format.NewScanner(input)
+
+	s.usage.begin()
 	for {
 		var flow *Flow
 		flow, err = r.Read()
@@ -70,40 +164,44 @@ func (s *StateStore) populate() error {
 			break // and let whatever comes next handle the error
 		}
 
-		// we dont need knowledge about non-natted flows
-		if !flow.NAT {
-			continue
-		}
-
-		// we always use the original direction source as our index
-		index := flow.Original.Layer3.Source.String()
-
-		// append flow if flow slice exists
-		if _, exists := s.db[index]; exists {
-			s.db[index] = append(s.db[index], flow)
-			continue
-		}
-
-		// Insert new flow slice
-		s.db[index] = []*Flow{flow}
+		s.add(flow)
 	}
 	// if the error is not nil and also is not an EOF error - we have a problem
 	if err != io.EOF && err != nil {
+		input.Close()
 		return err
 	}
 
-	// wait for command to exit and check for non status 0 codes
-	err = command.Wait()
+	// wait for the listing to end and check for non status 0 codes
+	err = input.Close()
 	if err != nil {
-		return fmt.Errorf("conntrack error: %s: %s", err, stderr)
+		return fmt.Errorf("conntrack error: %s", err)
 	}
+	s.usage.end()
 
-	log.Printf("conntrack.StateStore: updated store with %d entrys", len(s.db))
+	log.Printf("conntrack.StateStore: updated store with %d entrys", len(s.summaries))
 	s.lastPopulate = time.Now()
 
 	return nil
 }
 
+// source returns Source or the conntrack command
+func (s *StateStore) source() Source {
+	if s.Source == nil {
+		return CommandSource{}
+	}
+	return s.Source
+}
+
+// Reload drops the current state, so the next query reads it from conntrack again
+func (s *StateStore) Reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastPopulate = time.Time{}
+	return nil
+}
+
 // Addresses returns a sorted slice of ip addresses found
 func (s *StateStore) Addresses() ([]net.IP, error) {
 	s.lock.Lock()
@@ -115,11 +213,16 @@ func (s *StateStore) Addresses() ([]net.IP, error) {
 		return nil, err
 	}
 
-	res := make([]net.IP, len(s.db))
-	i := 0
-	for ip := range s.db {
-		res[i] = net.ParseIP(ip)
-		i++
+	res := make([]net.IP, 0, len(s.summaries)+len(s.forwards))
+	for ip := range s.summaries {
+		res = append(res, net.IP(ip.AsSlice()))
+	}
+
+	// hosts only receiving forwarded connections
+	for ip := range s.forwards {
+		if _, found := s.summaries[ip]; !found {
+			res = append(res, net.IP(ip.AsSlice()))
+		}
 	}
 	return res, nil
 }
@@ -133,7 +236,105 @@ func (s *StateStore) Data(ip string) (map[string]string, error) {
 		return nil, err
 	}
 
-	return map[string]string{"nFlows": strconv.Itoa(len(s.db[ip]))}, nil
+	summary, found := s.summaries[parseIndex(ip)]
+	if !found {
+		summary = newSummary()
+	}
+	inbound, forwards := forwardColumns(s.forwardsOf(parseIndex(ip)))
+
+	data := map[string]string{
+		"nFlows":     strconv.Itoa(summary.Flows),
+		"nTCP":       strconv.Itoa(summary.Protocols["tcp"]),
+		"nUDP":       strconv.Itoa(summary.Protocols["udp"]),
+		"nICMP":      strconv.Itoa(summary.Protocols["icmp"]),
+		"nOther":     strconv.Itoa(summary.Protocols["other"]),
+		"nAssured":   strconv.Itoa(summary.Assured),
+		"nUnreplied": strconv.Itoa(summary.Unreplied),
+		"categories": topCounts(summary.Categories, 3),
+		"nInbound":   strconv.Itoa(inbound),
+		"forwards":   forwards,
+	}
+
+	if s.WANs != nil {
+		data["wans"], data["unexpectedWAN"] = s.WANs.columns(parseIndex(ip), summary)
+	}
+	return data, nil
+}
+
+// Metrics returns the numbers of an ip address worth keeping history of
+func (s *StateStore) Metrics(ip string) (map[string]float64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	index := parseIndex(ip)
+	summary, found := s.summaries[index]
+	if !found {
+		summary = newSummary()
+	}
+	usage := s.usage.totals[index]
+
+	var inbound Forward
+	for _, f := range s.forwards[index] {
+		inbound.Flows += f.Flows
+		inbound.Original.Bytes += f.Original.Bytes
+		inbound.Reply.Bytes += f.Reply.Bytes
+	}
+
+	metrics := map[string]float64{
+		"flows":      float64(summary.Flows),
+		"tcp":        float64(summary.Protocols["tcp"]),
+		"udp":        float64(summary.Protocols["udp"]),
+		"bytesOut":   float64(summary.Original.Bytes),
+		"bytesIn":    float64(summary.Reply.Bytes),
+		"packetsOut": float64(summary.Original.Packets),
+		"packetsIn":  float64(summary.Reply.Packets),
+
+		// unlike the above, these keeps growing after flows end
+		"usageBytesOut": float64(usage.Sent.Bytes),
+		"usageBytesIn":  float64(usage.Received.Bytes),
+
+		// connections forwarded to the host, received from and sent to the remotes
+		"inboundFlows":    float64(inbound.Flows),
+		"inboundBytesIn":  float64(inbound.Original.Bytes),
+		"inboundBytesOut": float64(inbound.Reply.Bytes),
+	}
+
+	// the traffic of every uplink, by its name
+	if s.WANs != nil {
+		for _, wan := range s.WANs.WANs {
+			metrics["bytesOut."+wan.Name] = 0
+			metrics["bytesIn."+wan.Name] = 0
+		}
+		for _, u := range summary.WANs {
+			if wan := s.WANs.wan(u.Address); wan != nil {
+				metrics["bytesOut."+wan.Name] += float64(u.Original.Bytes)
+				metrics["bytesIn."+wan.Name] += float64(u.Reply.Bytes)
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// SummaryByIP returns the aggregated state of all flows from a given ip
+func (s *StateStore) SummaryByIP(ip string) (*Summary, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	if summary, found := s.summaries[parseIndex(ip)]; found {
+		// hand out a copy, the store keeps updating its own
+		return summary.clone(), nil
+	}
+
+	return nil, fmt.Errorf("no flows found")
 }
 
 // StatesByIP returns all flows from a given ip
@@ -147,9 +348,99 @@ func (s *StateStore) StatesByIP(ip string) ([]*Flow, error) {
 		return nil, err
 	}
 
-	if flow, found := s.db[ip]; found {
+	if flow, found := s.flows[parseIndex(ip)]; found {
 		return flow, nil
 	}
 
 	return nil, fmt.Errorf("no flows found")
 }
+
+// FlowsByRemote returns all flows between lan hosts and a given remote ip
+func (s *StateStore) FlowsByRemote(ip string) ([]*Flow, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	if flows, found := s.byRemote[parseIndex(ip)]; found {
+		return flows, nil
+	}
+
+	return nil, fmt.Errorf("no flows found")
+}
+
+// FlowsByRemotePort returns all flows between lan hosts and a given remote port
+func (s *StateStore) FlowsByRemotePort(port uint16) ([]*Flow, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	if flows, found := s.byRemotePort[port]; found {
+		return flows, nil
+	}
+
+	return nil, fmt.Errorf("no flows found")
+}
+
+// FlowByTuple returns the flow with the given original direction
+func (s *StateStore) FlowByTuple(t Tuple) (*Flow, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	if flow, found := s.byTuple[t]; found {
+		return flow, nil
+	}
+
+	return nil, fmt.Errorf("no flow found")
+}
+
+// FlowByReplyTuple returns the flow with the given reply direction, this is the
+// translated tuple seen on the wan side, e.g. in an abuse report
+func (s *StateStore) FlowByReplyTuple(t Tuple) (*Flow, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	if flow, found := s.byReplyTuple[t]; found {
+		return flow, nil
+	}
+
+	return nil, fmt.Errorf("no flow found")
+}
+
+// parseIndex turns an ip address from our callers into the index we use, anything
+// not parseable becomes the zero address which is never found
+func parseIndex(ip string) netip.Addr {
+	addr, _ := netip.ParseAddr(ip)
+	return addr.Unmap()
+}
+
+// flowSlab hands out copies of flows from larger chunks, so we do not allocate every flow by itself
+type flowSlab struct {
+	chunk []Flow
+}
+
+// add copies the flow into the slab and returns the copy
+func (s *flowSlab) add(f *Flow) *Flow {
+	if len(s.chunk) == cap(s.chunk) {
+		s.chunk = make([]Flow, 0, 1024)
+	}
+	s.chunk = append(s.chunk, *f)
+	return &s.chunk[len(s.chunk)-1]
+}
@@ -1,6 +1,16 @@
 package conntrack
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasmide/routerlogin/runner"
+)
 
 func TestStateStore(t *testing.T) {
 	// notice you would maybe want to run something like
@@ -27,3 +37,274 @@ func TestStateStore(t *testing.T) {
 		t.Fatalf("first flow found, had no state: %+v", flows[0])
 	}
 }
+
+// fixtureStore returns a store populated from a test file instead of conntrack
+func fixtureStore(t *testing.T, path string) *StateStore {
+	s := &StateStore{}
+	s.reset()
+	for _, line := range readLines(t, path) {
+		flow, err := ParseFlowLine(line)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", line, err)
+		}
+		s.add(&flow)
+	}
+
+	// make sure the store does not try to run conntrack
+	s.lastPopulate = time.Now().Add(time.Hour)
+	return s
+}
+
+func TestStateStoreIndexes(t *testing.T) {
+	s := fixtureStore(t, "flows_test_file.txt")
+
+	flows, err := s.FlowsByRemote("93.184.216.34")
+	if err != nil {
+		t.Fatalf("no flows to remote host: %s", err)
+	}
+	if len(flows) != 4 {
+		t.Fatalf("expected 4 flows to remote host, found %d", len(flows))
+	}
+
+	flows, err = s.FlowsByRemotePort(80)
+	if err != nil {
+		t.Fatalf("no flows to remote port: %s", err)
+	}
+	for _, f := range flows {
+		if f.Original.Layer4.DPort != 80 {
+			t.Fatalf("flow to another port found: %s", f)
+		}
+	}
+
+	tuple, err := ParseTuple("tcp 192.168.1.191:49746 52.222.168.153:443")
+	if err != nil {
+		t.Fatalf("unable to parse tuple: %s", err)
+	}
+	flow, err := s.FlowByTuple(tuple)
+	if err != nil {
+		t.Fatalf("no flow by tuple: %s", err)
+	}
+	if flow.ProtocolState != "CLOSE_WAIT" {
+		t.Fatalf("wrong flow found by tuple: %s", flow)
+	}
+
+	// an abuse report would tell us about our wan address and port
+	tuple, err = ParseTuple("udp 209.206.58.5:7351 85.191.222.130:44017")
+	if err != nil {
+		t.Fatalf("unable to parse tuple: %s", err)
+	}
+	flow, err = s.FlowByReplyTuple(tuple)
+	if err != nil {
+		t.Fatalf("no flow by reply tuple: %s", err)
+	}
+	if flow.Original.Layer3.Source.String() != "192.168.1.76" {
+		t.Fatalf("wrong lan host found by reply tuple: %s", flow)
+	}
+
+	// non natted flows are not indexed
+	_, err = s.FlowsByRemote("192.168.1.1")
+	if err == nil {
+		t.Fatalf("found flows to a lan host")
+	}
+}
+
+func TestStateStoreSummaryOnly(t *testing.T) {
+	s := &StateStore{SummaryOnly: true}
+	s.reset()
+	flow, err := ParseFlowLine("udp      17 156 src=192.168.1.76 dst=209.206.58.5 sport=44017 dport=7351 packets=16330 bytes=2287570 src=209.206.58.5 dst=85.191.222.130 sport=7351 dport=44017 packets=16106 bytes=1205484 [ASSURED] mark=0 use=1")
+	if err != nil {
+		t.Fatalf("unable to parse flow: %s", err)
+	}
+	s.add(&flow)
+	s.add(&flow)
+	s.lastPopulate = time.Now().Add(time.Hour)
+
+	summary, err := s.SummaryByIP("192.168.1.76")
+	if err != nil {
+		t.Fatalf("no summary found: %s", err)
+	}
+	if summary.Flows != 2 || summary.Original.Bytes != 2*2287570 || summary.Reply.Packets != 2*16106 {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+
+	_, err = s.StatesByIP("192.168.1.76")
+	if err == nil {
+		t.Fatalf("flows was retained")
+	}
+}
+
+func TestTupleString(t *testing.T) {
+	for _, s := range []string{"tcp 192.168.1.191:35786 52.222.168.153:443", "udp [2001:db8:1::10]:40002 [2001:4860:4860::8844]:53"} {
+		tuple, err := ParseTuple(s)
+		if err != nil {
+			t.Fatalf("unable to parse tuple: %s", err)
+		}
+		if tuple.String() != s {
+			t.Fatalf("tuple %s was formatted as %s", s, tuple)
+		}
+	}
+
+	_, err := ParseTuple("tcp 192.168.1.191 52.222.168.153:443")
+	if err == nil {
+		t.Fatalf("parsing tuple without port did not fail")
+	}
+}
+
+func TestStateStorePings(t *testing.T) {
+	s := &StateStore{}
+	s.reset()
+	c := &fakeController{}
+	s.Controller = c
+
+	// two pings from the same host to the same destination at once
+	for _, line := range []string{
+		"icmp     1 29 src=192.168.1.149 dst=8.8.8.8 type=8 code=0 id=4711 src=8.8.8.8 dst=85.191.222.130 type=0 code=0 id=4711 mark=0 use=1",
+		"icmp     1 29 src=192.168.1.149 dst=8.8.8.8 type=8 code=0 id=4712 src=8.8.8.8 dst=85.191.222.130 type=0 code=0 id=4712 mark=0 use=1",
+	} {
+		flow, err := ParseFlowLine(line)
+		if err != nil {
+			t.Fatalf("unable to parse flow: %s", err)
+		}
+		s.add(&flow)
+		c.flows = append(c.flows, flow)
+	}
+	s.lastPopulate = time.Now().Add(time.Hour)
+
+	for _, id := range []uint16{4711, 4712} {
+		tuple, err := ParseTuple(fmt.Sprintf("icmp 192.168.1.149 8.8.8.8 type=8 code=0 id=%d", id))
+		if err != nil {
+			t.Fatalf("unable to parse tuple: %s", err)
+		}
+		if tuple.String() != fmt.Sprintf("icmp 192.168.1.149 8.8.8.8 type=8 code=0 id=%d", id) {
+			t.Fatalf("tuple was formatted as %s", tuple)
+		}
+		flow, err := s.FlowByTuple(tuple)
+		if err != nil || flow.Original.ICMP.ID != id {
+			t.Fatalf("ping %d not found by tuple: %v %v", id, flow, err)
+		}
+
+		reply := Tuple{Protocol: "icmp", Source: netip.MustParseAddr("8.8.8.8"), Destination: netip.MustParseAddr("85.191.222.130"), ICMP: ICMP{ID: id}}
+		flow, err = s.FlowByReplyTuple(reply)
+		if err != nil || flow.Original.ICMP.ID != id {
+			t.Fatalf("ping %d not found by reply tuple: %v %v", id, flow, err)
+		}
+	}
+
+	var b bytes.Buffer
+	err := s.AdminCommands()["teardown"](&b, strings.Fields("tuple icmp 192.168.1.149 8.8.8.8 type=8 code=0 id=4712"))
+	if err != nil {
+		t.Fatalf("teardown command failed: %s", err)
+	}
+	if len(c.flows) != 1 || c.flows[0].Original.ICMP.ID != 4711 {
+		t.Fatalf("teardown removed the wrong ping: %+v", c.flows)
+	}
+
+	for _, tuple := range []string{"icmp 192.168.1.149 8.8.8.8", "icmp 192.168.1.149 8.8.8.8 type=8 code=0 seq=1", "icmp 192.168.1.149:0 8.8.8.8 type=8 code=0 id=1"} {
+		_, err = ParseTuple(tuple)
+		if err == nil {
+			t.Fatalf("tuple \"%s\" was accepted", tuple)
+		}
+	}
+}
+
+func TestStateStoreDetails(t *testing.T) {
+	s := fixtureStore(t, "flows_test_file.txt")
+
+	res, err := s.Details("192.168.1.191")
+	if err != nil {
+		t.Fatalf("unable to get details: %s", err)
+	}
+	details := res.(HostDetails)
+
+	if len(details.Flows) != details.Summary.Flows || len(details.Flows) == 0 {
+		t.Fatalf("details has %d flows, summary %d", len(details.Flows), details.Summary.Flows)
+	}
+
+	flows := 0
+	for i, d := range details.Destinations {
+		flows += d.Flows
+		if i > 0 && d.BytesIn+d.BytesOut > details.Destinations[i-1].BytesIn+details.Destinations[i-1].BytesOut {
+			t.Fatalf("destinations are not sorted by traffic: %+v", details.Destinations)
+		}
+	}
+	if flows != len(details.Flows) {
+		t.Fatalf("destinations has %d flows, expected %d", flows, len(details.Flows))
+	}
+
+	res, err = s.Details("10.0.0.1")
+	if err != nil || res.(HostDetails).Summary.Flows != 0 {
+		t.Fatalf("unknown host was expected to have empty details: %+v %v", res, err)
+	}
+}
+
+func TestStateStoreUsage(t *testing.T) {
+	s := &StateStore{}
+
+	listing := func(lines ...string) {
+		s.reset()
+		s.usage.begin()
+		for _, line := range lines {
+			flow, err := ParseFlowLine(line)
+			if err != nil {
+				t.Fatalf("unable to parse flow: %s", err)
+			}
+			s.add(&flow)
+		}
+		s.usage.end()
+		s.lastPopulate = time.Now().Add(time.Hour)
+	}
+
+	// a flow growing, a flow ending and a flow replaced by another one on the same tuple
+	listing(
+		"tcp      6 300 ESTABLISHED src=192.168.1.191 dst=93.184.216.34 sport=36464 dport=80 packets=10 bytes=1000 src=93.184.216.34 dst=85.191.222.130 sport=80 dport=36464 packets=20 bytes=5000 [ASSURED] mark=0 use=1",
+		"udp      17 29 src=192.168.1.191 dst=1.1.1.1 sport=53211 dport=53 packets=1 bytes=70 src=1.1.1.1 dst=85.191.222.130 sport=53 dport=53211 packets=1 bytes=130 mark=0 use=1",
+	)
+	listing(
+		"tcp      6 300 ESTABLISHED src=192.168.1.191 dst=93.184.216.34 sport=36464 dport=80 packets=15 bytes=1500 src=93.184.216.34 dst=85.191.222.130 sport=80 dport=36464 packets=30 bytes=9000 [ASSURED] mark=0 use=1",
+	)
+	listing(
+		"tcp      6 300 ESTABLISHED src=192.168.1.191 dst=93.184.216.34 sport=36464 dport=80 packets=2 bytes=100 src=93.184.216.34 dst=85.191.222.130 sport=80 dport=36464 packets=2 bytes=400 [ASSURED] mark=0 use=1",
+	)
+
+	metrics, err := s.Metrics("192.168.1.191")
+	if err != nil {
+		t.Fatalf("no metrics: %s", err)
+	}
+	if metrics["usageBytesOut"] != 1500+70+100 || metrics["usageBytesIn"] != 9000+130+400 {
+		t.Fatalf("unexpected usage: %+v", metrics)
+	}
+
+	// the current flows alone are much less
+	if metrics["bytesOut"] != 100 {
+		t.Fatalf("unexpected bytes out: %+v", metrics)
+	}
+}
+
+func TestStateStoreRunner(t *testing.T) {
+	listing, err := os.ReadFile("conntrack_listing_test_file.txt")
+	if err != nil {
+		t.Fatalf("unable to read listing: %s", err)
+	}
+
+	fake := &runner.Fake{Commands: map[string]runner.Result{
+		"conntrack -L": {Output: string(listing)},
+	}}
+	s := &StateStore{Source: CommandSource{Runner: fake}}
+
+	a, err := s.Addresses()
+	if err != nil {
+		t.Fatalf("unable to populate from runner: %s", err)
+	}
+	if len(a) == 0 {
+		t.Fatalf("no addresses found in listing")
+	}
+
+	// conntrack failing, e.g. without the needed capabilities
+	fake.Commands["conntrack -L"] = runner.Result{Code: 1, Stderr: "conntrack v1.4.6 (conntrack-tools): Operation failed: Operation not permitted"}
+	s.Reload()
+
+	_, err = s.Addresses()
+	if err == nil || !strings.Contains(err.Error(), "status 1: conntrack v1.4.6 (conntrack-tools): Operation failed: Operation not permitted") {
+		t.Fatalf("error did not tell why conntrack failed: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package conntrack
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Summary is the aggregated state of all the flows from a single host
+type Summary struct {
+	Flows int
+
+	// Original and Reply are the summed counters of each direction
+	Original Counter
+	Reply    Counter
+
+	// Protocols counts flows by tcp, udp, icmp and other
+	Protocols map[string]int
+
+	// States counts tcp flows by their state, ESTABLISHED, TIME_WAIT etc
+	States map[string]int
+
+	// Assured and Unreplied counts flows by their conntrack state
+	Assured   int
+	Unreplied int
+
+	// Services counts flows by the service name of their remote port, and Categories by its category
+	Services   map[string]int
+	Categories map[string]int
+
+	// WANs sums the flows by the address they were translated to, the wan side of the nat
+	WANs map[netip.Addr]WANUsage
+}
+
+// newSummary returns an empty summary
+func newSummary() *Summary {
+	return &Summary{
+		Protocols:  make(map[string]int),
+		States:     make(map[string]int),
+		Services:   make(map[string]int),
+		Categories: make(map[string]int),
+		WANs:       make(map[netip.Addr]WANUsage),
+	}
+}
+
+// add adds a flow to the summary
+func (s *Summary) add(f *Flow, services *Services) {
+	s.Flows++
+	s.Original.Packets += f.Original.Counter.Packets
+	s.Original.Bytes += f.Original.Counter.Bytes
+	s.Reply.Packets += f.Reply.Counter.Packets
+	s.Reply.Bytes += f.Reply.Counter.Bytes
+
+	switch f.Protocol {
+	case "tcp", "udp":
+		s.Protocols[f.Protocol]++
+	case "icmp", "icmpv6":
+		s.Protocols["icmp"]++
+	default:
+		s.Protocols["other"]++
+	}
+
+	if f.Protocol == "tcp" && f.ProtocolState != "" {
+		s.States[f.ProtocolState]++
+	}
+
+	switch f.State {
+	case "ASSURED":
+		s.Assured++
+	case "UNREPLIED":
+		s.Unreplied++
+	}
+
+	// flows without ports, such as icmp, are their own service
+	service := f.Protocol
+	if f.Original.Layer4.DPort != 0 {
+		service = services.Name(f.Protocol, f.Original.Layer4.DPort)
+	}
+	s.Services[service]++
+	s.Categories[services.Category(service)]++
+
+	wan := f.Reply.Layer3.Destination
+	u := s.WANs[wan]
+	u.Address = wan
+	u.Flows++
+	u.Original.Packets += f.Original.Counter.Packets
+	u.Original.Bytes += f.Original.Counter.Bytes
+	u.Reply.Packets += f.Reply.Counter.Packets
+	u.Reply.Bytes += f.Reply.Counter.Bytes
+	s.WANs[wan] = u
+}
+
+// clone returns a deep copy of the summary
+func (s *Summary) clone() *Summary {
+	res := *s
+	res.Protocols = cloneCounts(s.Protocols)
+	res.States = cloneCounts(s.States)
+	res.Services = cloneCounts(s.Services)
+	res.Categories = cloneCounts(s.Categories)
+	res.WANs = make(map[netip.Addr]WANUsage, len(s.WANs))
+	for a, u := range s.WANs {
+		res.WANs[a] = u
+	}
+	return &res
+}
+
+// cloneCounts copies a map of counts
+func cloneCounts(m map[string]int) map[string]int {
+	res := make(map[string]int, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
+
+// count is a single entry of a map of counts
+type count struct {
+	name  string
+	count int
+}
+
+// sortedCounts returns counts with the highest first
+func sortedCounts(m map[string]int) []count {
+	res := make([]count, 0, len(m))
+	for name, c := range m {
+		res = append(res, count{name: name, count: c})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].count != res[j].count {
+			return res[i].count > res[j].count
+		}
+		return res[i].name < res[j].name
+	})
+	return res
+}
+
+// topCounts formats the n highest counts as name:count name:count
+func topCounts(m map[string]int, n int) string {
+	sorted := sortedCounts(m)
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	parts := make([]string, len(sorted))
+	for i, c := range sorted {
+		parts[i] = fmt.Sprintf("%s:%d", c.name, c.count)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,112 @@
+package conntrack
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServices(t *testing.T) {
+	fd, err := os.Open("services_test_file.txt")
+	if err != nil {
+		t.Fatalf("unable to open test file: %s", err)
+	}
+	defer fd.Close()
+
+	s := NewServices()
+	err = s.ParseServices(fd)
+	if err != nil {
+		t.Fatalf("unable to parse services: %s", err)
+	}
+
+	if name := s.Name("tcp", 443); name != "https" {
+		t.Fatalf("443/tcp was expected to be https, was %s", name)
+	}
+	if name := s.Name("udp", 27015); name != "27015/udp" {
+		t.Fatalf("27015/udp was expected to have no name, was %s", name)
+	}
+	if category := s.Category("domain"); category != "dns" {
+		t.Fatalf("domain was expected to be dns, was %s", category)
+	}
+
+	err = s.ParseCategories(strings.NewReader("# our own\ngaming 27015/udp\nweb ssh\n"))
+	if err != nil {
+		t.Fatalf("unable to parse categories: %s", err)
+	}
+	if category := s.Category("27015/udp"); category != "gaming" {
+		t.Fatalf("27015/udp was expected to be gaming, was %s", category)
+	}
+	if category := s.Category("ssh"); category != "web" {
+		t.Fatalf("ssh was expected to be overridden as web, was %s", category)
+	}
+
+	err = s.ParseServices(strings.NewReader("broken 80\n"))
+	if err == nil {
+		t.Fatalf("parsing a service without protocol did not fail")
+	}
+
+	// a nil table still names ports
+	var none *Services
+	if name := none.Name("tcp", 80); name != "80/tcp" {
+		t.Fatalf("80/tcp was expected to have no name, was %s", name)
+	}
+}
+
+func TestSummaryBreakdown(t *testing.T) {
+	services, err := LoadServices("services_test_file.txt", "")
+	if err != nil {
+		t.Fatalf("unable to load services: %s", err)
+	}
+
+	s := &StateStore{Services: services}
+	s.reset()
+	for _, line := range readLines(t, "flows_test_file.txt") {
+		flow, err := ParseFlowLine(line)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", line, err)
+		}
+		s.add(&flow)
+	}
+	s.lastPopulate = time.Now().Add(time.Hour)
+
+	summary, err := s.SummaryByIP("192.168.1.191")
+	if err != nil {
+		t.Fatalf("no summary found: %s", err)
+	}
+	if summary.Protocols["tcp"] != summary.Flows {
+		t.Fatalf("all flows was expected to be tcp: %+v", summary)
+	}
+	if summary.States["ESTABLISHED"] != 5 || summary.States["CLOSE_WAIT"] != 1 {
+		t.Fatalf("unexpected tcp states: %+v", summary.States)
+	}
+	if summary.Services["http"] != 4 || summary.Categories["web"] != 6 {
+		t.Fatalf("unexpected services: %+v %+v", summary.Services, summary.Categories)
+	}
+
+	// changing the copy must not change the store
+	summary.Services["http"] = 0
+	again, _ := s.SummaryByIP("192.168.1.191")
+	if again.Services["http"] != 4 {
+		t.Fatalf("summary was not copied")
+	}
+
+	data, err := s.Data("192.168.1.149")
+	if err != nil {
+		t.Fatalf("no data: %s", err)
+	}
+	if data["nICMP"] != "2" || data["nUDP"] != "0" || data["nUnreplied"] != "0" {
+		t.Fatalf("unexpected data: %+v", data)
+	}
+
+	var b bytes.Buffer
+	err = s.Commands()["breakdown"](&b, []string{"192.168.1.149"})
+	if err != nil {
+		t.Fatalf("breakdown failed: %s", err)
+	}
+	if !regexp.MustCompile(`(?m)^icmp +2$`).MatchString(b.String()) {
+		t.Fatalf("breakdown did not count icmp: %s", b.String())
+	}
+}
@@ -0,0 +1,113 @@
+package conntrack
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Tuple identifies a flow in a single direction, icmp flows have no ports and are told
+// apart by their icmp fields instead
+type Tuple struct {
+	Protocol    string
+	Source      netip.Addr
+	SPort       uint16
+	Destination netip.Addr
+	DPort       uint16
+	ICMP        ICMP
+}
+
+// Tuple returns the tuple of this direction
+func (d Direction) Tuple(protocol string) Tuple {
+	t := Tuple{
+		Protocol:    protocol,
+		Source:      d.Layer3.Source,
+		SPort:       d.Layer4.SPort,
+		Destination: d.Layer3.Destination,
+		DPort:       d.Layer4.DPort,
+	}
+	if isICMP(protocol) {
+		t.ICMP = d.ICMP
+	}
+	return t
+}
+
+// isICMP returns whether a protocol is icmp or icmpv6
+func isICMP(protocol string) bool {
+	return strings.HasPrefix(protocol, "icmp")
+}
+
+// ParseTuple parses tuples the way String formats them e.g.
+// tcp 192.168.1.191:35786 52.222.168.153:443
+// udp [2001:db8:1::10]:40002 [2001:4860:4860::8844]:53
+// icmp 192.168.1.191 1.1.1.1 type=8 code=0 id=1234
+func ParseTuple(s string) (Tuple, error) {
+	parts := strings.Fields(s)
+	if len(parts) > 0 && isICMP(parts[0]) {
+		return parseICMPTuple(parts)
+	}
+	if len(parts) != 3 {
+		return Tuple{}, fmt.Errorf("tuple \"%s\" should be protocol, source and destination", s)
+	}
+
+	source, err := netip.ParseAddrPort(parts[1])
+	if err != nil {
+		return Tuple{}, fmt.Errorf("unable to parse tuple source: %s", err)
+	}
+	destination, err := netip.ParseAddrPort(parts[2])
+	if err != nil {
+		return Tuple{}, fmt.Errorf("unable to parse tuple destination: %s", err)
+	}
+
+	return Tuple{
+		Protocol:    parts[0],
+		Source:      source.Addr().Unmap(),
+		SPort:       source.Port(),
+		Destination: destination.Addr().Unmap(),
+		DPort:       destination.Port(),
+	}, nil
+}
+
+// parseICMPTuple parses the fields of an icmp tuple
+func parseICMPTuple(parts []string) (Tuple, error) {
+	if len(parts) != 6 {
+		return Tuple{}, fmt.Errorf("tuple \"%s\" should be protocol, source, destination, type, code and id", strings.Join(parts, " "))
+	}
+
+	t := Tuple{Protocol: parts[0]}
+	source, err := netip.ParseAddr(parts[1])
+	if err != nil {
+		return Tuple{}, fmt.Errorf("unable to parse tuple source: %s", err)
+	}
+	destination, err := netip.ParseAddr(parts[2])
+	if err != nil {
+		return Tuple{}, fmt.Errorf("unable to parse tuple destination: %s", err)
+	}
+	t.Source, t.Destination = source.Unmap(), destination.Unmap()
+
+	for i, key := range []string{"type", "code", "id"} {
+		value, found := strings.CutPrefix(parts[3+i], key+"=")
+		if !found {
+			return Tuple{}, fmt.Errorf("expected %s=, got \"%s\"", key, parts[3+i])
+		}
+		err = parseICMP([]byte(key), []byte(value), &t.ICMP)
+		if err != nil {
+			return Tuple{}, err
+		}
+	}
+	return t, nil
+}
+
+// String formats the tuple as protocol source:sport destination:dport, or as protocol
+// source destination type code id for icmp
+func (t Tuple) String() string {
+	if isICMP(t.Protocol) {
+		return fmt.Sprintf("%s %s %s type=%d code=%d id=%d", t.Protocol, t.Source, t.Destination, t.ICMP.Type, t.ICMP.Code, t.ICMP.ID)
+	}
+	return fmt.Sprintf(
+		"%s %s %s",
+		t.Protocol,
+		netip.AddrPortFrom(t.Source, t.SPort),
+		netip.AddrPortFrom(t.Destination, t.DPort),
+	)
+}
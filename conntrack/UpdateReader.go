@@ -2,8 +2,11 @@ package conntrack
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // updateReader embedds io.Reader and reads FlowUpdates from it
@@ -24,14 +27,66 @@ func (r *updateReader) Read() (*FlowUpdate, error) {
 		return nil, err
 	}
 
-	// the flow type knows nothing about the first 10 bytes, these
-	// indicate if this flow is NEW, if its an UPDATE or a DESTROY'ed flow
-	u := FlowUpdate{Type: strings.Trim(line[:10], " []")}
-	u.Flow, err = ParseFlowLine(line[10:])
+	return ParseUpdateLine(line)
+}
+
+// ParseUpdateLine parses a single line of conntrack -E output e.g.
+// [NEW] tcp      6 120 SYN_SENT src=192.168.1.157 dst=87.248.214.49 sport=54556 dport=443 [UNREPLIED] src=87.248.214.49 dst=85.191.222.130 sport=443 dport=54556
+// [1528106400.123456] [DESTROY] udp      17 src=192.168.1.76 dst=1.1.1.1 sport=53211 dport=53 src=1.1.1.1 dst=85.191.222.130 sport=53 dport=53211
+func ParseUpdateLine(line string) (*FlowUpdate, error) {
+	u := FlowUpdate{}
+	line = strings.TrimLeft(line, " \t")
+
+	// with -o timestamp every event is prefixed with seconds.microseconds
+	if len(line) > 1 && line[0] == '[' && line[1] >= '0' && line[1] <= '9' {
+		end := strings.IndexByte(line, ']')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated timestamp in update: \"%s\"", line)
+		}
+		timestamp, err := parseTimestamp(line[1:end])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse update timestamp: %s", err)
+		}
+		u.Time = timestamp
+		line = strings.TrimLeft(line[end+1:], " \t")
+	}
 
+	// the flow type knows nothing about the first field, it indicates
+	// if this flow is NEW, if its an UPDATE or a DESTROY'ed flow
+	end := strings.IndexByte(line, ']')
+	if len(line) == 0 || line[0] != '[' || end < 0 {
+		return nil, fmt.Errorf("update had no event type: \"%s\"", line)
+	}
+	u.Type = line[1:end]
+
+	var err error
+	u.Flow, err = ParseFlowLine(line[end+1:])
 	if err != nil {
 		return nil, err
 	}
 
 	return &u, nil
 }
+
+// parseTimestamp parses seconds.microseconds as integers, a float64 cannot hold
+// epoch seconds with microseconds exactly
+func parseTimestamp(s string) (time.Time, error) {
+	secs, frac, _ := strings.Cut(s, ".")
+	seconds, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// the fraction is microseconds, but any number of digits are read as a fraction
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	nanoseconds := int64(0)
+	if frac != "" {
+		nanoseconds, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if err != nil || frac[0] == '-' || frac[0] == '+' {
+			return time.Time{}, fmt.Errorf("invalid fraction \"%s\"", frac)
+		}
+	}
+	return time.Unix(seconds, nanoseconds), nil
+}
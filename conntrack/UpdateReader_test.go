@@ -1,7 +1,7 @@
 package conntrack
 
 import (
-	"net"
+	"net/netip"
 	"os"
 	"testing"
 )
@@ -47,8 +47,8 @@ func TestReader(t *testing.T) {
 	if flow.Flow.Original.Counter != compareCounter {
 		t.Fatalf("original counter packets was expected to be %+v, was %+v", compareCounter, flow.Flow.Original.Counter)
 	}
-	compareIP := net.ParseIP("162.243.158.119")
-	if !flow.Flow.Reply.Layer3.Destination.Equal(compareIP) {
+	compareIP := netip.MustParseAddr("162.243.158.119")
+	if flow.Flow.Reply.Layer3.Destination != compareIP {
 		t.Fatalf(
 			"flow reply layer3 destination did not have exptected value of %s: was %s",
 			compareIP,
@@ -0,0 +1,82 @@
+package conntrack
+
+import "net/netip"
+
+// usageKey identifies a flow across listings, the id tells apart flows reusing a tuple
+// when conntrack prints it, and is zero otherwise
+type usageKey struct {
+	Tuple
+	ID uint32
+}
+
+// Usage is the traffic of a host since the store started counting
+type Usage struct {
+	Sent     Counter
+	Received Counter
+}
+
+// usage turns the counters of flows, which disappear along with their flows, into
+// ever growing counters per host. Traffic of a flow between the last listing it was
+// seen in and its end is never counted
+type usage struct {
+	// previous holds the counters of every flow from the last complete listing
+	previous map[usageKey]Usage
+	current  map[usageKey]Usage
+
+	// pending is added to totals once the listing completes, so a failed listing counts nothing
+	pending map[netip.Addr]Usage
+	totals  map[netip.Addr]Usage
+}
+
+// begin starts counting a new listing
+func (u *usage) begin() {
+	u.current = make(map[usageKey]Usage)
+	u.pending = make(map[netip.Addr]Usage)
+	if u.totals == nil {
+		u.totals = make(map[netip.Addr]Usage)
+	}
+}
+
+// add counts what a flow has sent and received since the previous listing, the lan
+// host of inbound flows sends in the reply direction
+func (u *usage) add(host netip.Addr, f *Flow, inbound bool) {
+	counters := Usage{Sent: f.Original.Counter, Received: f.Reply.Counter}
+	if inbound {
+		counters = Usage{Sent: f.Reply.Counter, Received: f.Original.Counter}
+	}
+	key := usageKey{Tuple: f.Original.Tuple(f.Protocol), ID: f.ID}
+	u.current[key] = counters
+
+	p := u.pending[host]
+	previous := u.previous[key]
+	p.Sent = addDelta(p.Sent, previous.Sent, counters.Sent)
+	p.Received = addDelta(p.Received, previous.Received, counters.Received)
+	u.pending[host] = p
+}
+
+// end commits the listing
+func (u *usage) end() {
+	for host, p := range u.pending {
+		t := u.totals[host]
+		t.Sent.Packets += p.Sent.Packets
+		t.Sent.Bytes += p.Sent.Bytes
+		t.Received.Packets += p.Received.Packets
+		t.Received.Bytes += p.Received.Bytes
+		u.totals[host] = t
+	}
+
+	u.previous = u.current
+	u.current = nil
+	u.pending = nil
+}
+
+// addDelta adds the growth from previous to current onto sum, a counter which went
+// backwards belongs to a new flow and counts from zero
+func addDelta(sum, previous, current Counter) Counter {
+	if current.Bytes < previous.Bytes || current.Packets < previous.Packets {
+		previous = Counter{}
+	}
+	sum.Packets += current.Packets - previous.Packets
+	sum.Bytes += current.Bytes - previous.Bytes
+	return sum
+}
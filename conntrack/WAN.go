@@ -0,0 +1,190 @@
+package conntrack
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// WAN is an uplink, known by the addresses flows leaving through it are translated to
+type WAN struct {
+	Name      string
+	Addresses []netip.Addr
+
+	// Interface is looked up for its addresses at every listing, for uplinks whose address
+	// changes. It is looked up on this host, routers read through a runner needs Addresses
+	Interface string
+
+	// Hosts are the lan hosts expected to leave through this uplink, every host when empty
+	Hosts []netip.Prefix
+}
+
+// WANs names the uplinks of flows by their translated source address, the zero value
+// and nil knows no uplinks and expects every host to use any address
+type WANs struct {
+	WANs []WAN
+
+	lock   sync.Mutex
+	byAddr map[netip.Addr]*WAN
+}
+
+// NewWANs returns the uplinks, with their addresses looked up
+func NewWANs(wans ...WAN) *WANs {
+	w := &WANs{WANs: wans}
+	w.refresh()
+	return w
+}
+
+// refresh looks up the addresses of the interfaces of uplinks, uplinks whose interface
+// is missing, e.g. a ppp link being down, only have their configured addresses
+func (w *WANs) refresh() {
+	if w == nil {
+		return
+	}
+
+	byAddr := make(map[netip.Addr]*WAN)
+	for i := range w.WANs {
+		wan := &w.WANs[i]
+		for _, a := range wan.Addresses {
+			byAddr[a.Unmap()] = wan
+		}
+		if wan.Interface == "" {
+			continue
+		}
+
+		addrs, err := interfaceAddrs(wan.Interface)
+		if err != nil {
+			log.Printf("conntrack.WANs: unable to look up %s of %s: %s", wan.Interface, wan.Name, err)
+		}
+		for _, a := range addrs {
+			byAddr[a] = wan
+		}
+	}
+
+	w.lock.Lock()
+	w.byAddr = byAddr
+	w.lock.Unlock()
+}
+
+// interfaceAddrs returns the addresses of a network interface
+func interfaceAddrs(name string) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []netip.Addr
+	for _, a := range addrs {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil {
+			res = append(res, prefix.Addr().Unmap())
+		}
+	}
+	return res, nil
+}
+
+// wan returns the uplink of a translated address, or nil
+func (w *WANs) wan(addr netip.Addr) *WAN {
+	if w == nil {
+		return nil
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.byAddr[addr.Unmap()]
+}
+
+// Name returns the name of the uplink of a translated address, unknown addresses are their own name
+func (w *WANs) Name(addr netip.Addr) string {
+	if wan := w.wan(addr); wan != nil {
+		return wan.Name
+	}
+	return addr.String()
+}
+
+// Expected reports if a host leaving through a translated address is expected, hosts
+// are unexpected on unknown addresses and on uplinks listing other hosts
+func (w *WANs) Expected(host, addr netip.Addr) bool {
+	if w == nil || len(w.WANs) == 0 {
+		return true
+	}
+
+	wan := w.wan(addr)
+	if wan == nil {
+		return false
+	}
+	if len(wan.Hosts) == 0 {
+		return true
+	}
+	for _, p := range wan.Hosts {
+		if p.Contains(host.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// WANUsage is the traffic of a host through a translated address
+type WANUsage struct {
+	Address  netip.Addr
+	Flows    int
+	Original Counter
+	Reply    Counter
+}
+
+// WANDetail is the traffic of a host through an uplink
+type WANDetail struct {
+	WAN      string
+	Address  netip.Addr
+	Flows    int
+	BytesOut uint
+	BytesIn  uint
+	Expected bool
+}
+
+// details returns the traffic of a host through each uplink, the most used first
+func (w *WANs) details(host netip.Addr, s *Summary) []WANDetail {
+	res := make([]WANDetail, 0, len(s.WANs))
+	for _, u := range s.WANs {
+		res = append(res, WANDetail{
+			WAN:      w.Name(u.Address),
+			Address:  u.Address,
+			Flows:    u.Flows,
+			BytesOut: u.Original.Bytes,
+			BytesIn:  u.Reply.Bytes,
+			Expected: w.Expected(host, u.Address),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.BytesOut+a.BytesIn != b.BytesOut+b.BytesIn {
+			return a.BytesOut+a.BytesIn > b.BytesOut+b.BytesIn
+		}
+		return a.Address.Less(b.Address)
+	})
+	return res
+}
+
+// columns returns the uplinks a host used, the most used first, and the ones it was not expected to
+func (w *WANs) columns(host netip.Addr, s *Summary) (used, unexpected string) {
+	var names, unexpectedNames []string
+	seen := make(map[string]bool)
+	for _, d := range w.details(host, s) {
+		if seen[d.WAN] {
+			continue
+		}
+		seen[d.WAN] = true
+
+		names = append(names, d.WAN)
+		if !d.Expected {
+			unexpectedNames = append(unexpectedNames, d.WAN)
+		}
+	}
+	return strings.Join(names, ","), strings.Join(unexpectedNames, ",")
+}
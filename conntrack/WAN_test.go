@@ -0,0 +1,84 @@
+package conntrack
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/fasmide/routerlogin/runner"
+)
+
+// dualWANListing has 192.168.1.10 leaving through both uplinks, 192.168.1.20 through
+// the one reserved for 192.168.1.10, and 192.168.1.30 through an unknown address
+const dualWANListing = `tcp      6 431999 ESTABLISHED src=192.168.1.10 dst=52.85.250.243 sport=54376 dport=443 packets=10 bytes=1000 src=52.85.250.243 dst=85.191.222.130 sport=443 dport=54376 packets=20 bytes=20000 [ASSURED] mark=0 use=1
+tcp      6 431999 ESTABLISHED src=192.168.1.10 dst=52.85.250.244 sport=54377 dport=443 packets=10 bytes=500 src=52.85.250.244 dst=100.64.0.2 sport=443 dport=54377 packets=20 bytes=500 [ASSURED] mark=0 use=1
+udp      17 29 src=192.168.1.20 dst=1.1.1.1 sport=53211 dport=53 packets=1 bytes=70 src=1.1.1.1 dst=100.64.0.2 sport=53 dport=53211 packets=1 bytes=120 mark=0 use=1
+udp      17 29 src=192.168.1.30 dst=1.1.1.1 sport=53212 dport=53 packets=1 bytes=70 src=1.1.1.1 dst=203.0.113.7 sport=53 dport=53212 packets=1 bytes=120 mark=0 use=1
+`
+
+func TestStateStoreWANs(t *testing.T) {
+	s := &StateStore{
+		Source: CommandSource{Runner: &runner.Fake{Commands: map[string]runner.Result{"conntrack -L": {Output: dualWANListing}}}},
+		WANs: NewWANs(
+			WAN{Name: "fiber", Addresses: []netip.Addr{netip.MustParseAddr("85.191.222.130")}},
+			WAN{Name: "lte", Addresses: []netip.Addr{netip.MustParseAddr("100.64.0.2")}, Hosts: []netip.Prefix{netip.MustParsePrefix("192.168.1.10/32")}},
+		),
+	}
+
+	for ip, expected := range map[string][2]string{
+		"192.168.1.10": {"fiber,lte", ""},
+		"192.168.1.20": {"lte", "lte"},
+		"192.168.1.30": {"203.0.113.7", "203.0.113.7"},
+		"192.168.1.40": {"", ""},
+	} {
+		data, err := s.Data(ip)
+		if err != nil {
+			t.Fatalf("unable to read data: %s", err)
+		}
+		if data["wans"] != expected[0] || data["unexpectedWAN"] != expected[1] {
+			t.Errorf("%s: expected wans %q and unexpected %q, got %q and %q", ip, expected[0], expected[1], data["wans"], data["unexpectedWAN"])
+		}
+	}
+
+	metrics, _ := s.Metrics("192.168.1.10")
+	if metrics["bytesOut.fiber"] != 1000 || metrics["bytesIn.fiber"] != 20000 || metrics["bytesOut.lte"] != 500 {
+		t.Fatalf("unexpected wan metrics: %+v", metrics)
+	}
+	metrics, _ = s.Metrics("192.168.1.30")
+	for _, key := range []string{"bytesOut.fiber", "bytesIn.fiber", "bytesOut.lte", "bytesIn.lte"} {
+		if value, found := metrics[key]; !found || value != 0 {
+			t.Fatalf("metrics of unused uplinks should be zero: %+v", metrics)
+		}
+	}
+
+	details, _ := s.Details("192.168.1.10")
+	wans := details.(HostDetails).WANs
+	if len(wans) != 2 || wans[0].WAN != "fiber" || wans[0].Flows != 1 || !wans[1].Expected {
+		t.Fatalf("unexpected details: %+v", wans)
+	}
+
+	var out bytes.Buffer
+	err := s.wanCommand(&out, []string{"192.168.1.20"})
+	if err != nil {
+		t.Fatalf("wan command failed: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "192.168.1.20") || !strings.HasSuffix(lines[1], "unexpected") {
+		t.Fatalf("unexpected output: %s", out.String())
+	}
+}
+
+func TestWANsUnconfigured(t *testing.T) {
+	var w *WANs
+	addr := netip.MustParseAddr("85.191.222.130")
+	if w.Name(addr) != "85.191.222.130" || !w.Expected(netip.MustParseAddr("192.168.1.10"), addr) {
+		t.Fatalf("without uplinks addresses should be named by themselves and expected")
+	}
+
+	s := fixtureStore(t, "flows_test_file.txt")
+	data, _ := s.Data("192.168.1.191")
+	if _, found := data["wans"]; found {
+		t.Fatalf("wan columns without uplinks: %+v", data)
+	}
+}
@@ -0,0 +1,74 @@
+package conntrack
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Event types published by Watch
+const (
+	EventFlowNew     = "flow-new"
+	EventFlowDestroy = "flow-destroy"
+)
+
+// Watch follows conntrack events and emits flow-new and flow-destroy events of
+// natted flows, by their original source, until ctx is done or conntrack exits
+func (s *StateStore) Watch(ctx context.Context, emit func(kind, host string, data interface{})) error {
+	return s.Follow(ctx, func(u *FlowUpdate) {
+		emitUpdate(u, emit)
+	})
+}
+
+// Follow follows conntrack events from the source and calls f with every NEW and DESTROY update, natted
+// or not, until ctx is done or conntrack exits
+func (s *StateStore) Follow(ctx context.Context, f func(*FlowUpdate)) error {
+	input, err := s.source().Events(ctx, s.Format)
+	if err != nil {
+		return err
+	}
+
+	err = readUpdates(s.Format.NewUpdateReader(input), f)
+	cerr := input.Close()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("conntrack exited: %v", cerr)
+}
+
+// readUpdates calls f with every update read, until the reader is exhausted
+func readUpdates(r FlowUpdateReader, f func(*FlowUpdate)) error {
+	for {
+		update, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f(update)
+	}
+}
+
+// emitUpdate emits the event of an update
+func emitUpdate(update *FlowUpdate, emit func(kind, host string, data interface{})) {
+	// just like the store, we only care about natted flows
+	if !update.Flow.NAT {
+		return
+	}
+
+	var kind string
+	switch update.Type {
+	case "NEW":
+		kind = EventFlowNew
+	case "DESTROY":
+		kind = EventFlowDestroy
+	default:
+		return
+	}
+
+	emit(kind, update.Flow.Original.Layer3.Source.String(), update.Flow.String())
+}
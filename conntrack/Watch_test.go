@@ -0,0 +1,38 @@
+package conntrack
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fasmide/routerlogin/runner"
+)
+
+func TestWatch(t *testing.T) {
+	events, err := os.ReadFile("conntrack_events_test_file.txt")
+	if err != nil {
+		t.Fatalf("unable to read events: %s", err)
+	}
+
+	fake := &runner.Fake{Commands: map[string]runner.Result{
+		"conntrack -E -e NEW,DESTROY": {Output: string(events)},
+	}}
+	s := &StateStore{Source: CommandSource{Runner: fake}}
+
+	kinds := make(map[string]int)
+	err = s.Watch(context.Background(), func(kind, host string, data interface{}) {
+		if host == "" || data.(string) == "" {
+			t.Fatalf("%s event without host or flow", kind)
+		}
+		kinds[kind]++
+	})
+
+	// the fake conntrack exits once its events are read
+	if err == nil || !strings.HasPrefix(err.Error(), "conntrack exited") {
+		t.Fatalf("unexpected watch error: %v", err)
+	}
+	if kinds[EventFlowNew] == 0 || kinds[EventFlowDestroy] == 0 || len(kinds) != 2 {
+		t.Fatalf("expected new and destroy events only, got %+v", kinds)
+	}
+}
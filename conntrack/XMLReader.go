@@ -0,0 +1,240 @@
+package conntrack
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// xmlFlow is a <flow> element as written by conntrack -o xml
+type xmlFlow struct {
+	Type  string    `xml:"type,attr"`
+	Metas []xmlMeta `xml:"meta"`
+	When  *xmlWhen  `xml:"when"`
+}
+
+// xmlMeta is either the original, reply or independent part of a flow
+type xmlMeta struct {
+	Direction string `xml:"direction,attr"`
+
+	// original and reply
+	Layer3 struct {
+		ProtoName string `xml:"protoname,attr"`
+		Src       string `xml:"src"`
+		Dst       string `xml:"dst"`
+	} `xml:"layer3"`
+	Layer4 struct {
+		ProtoNum  int    `xml:"protonum,attr"`
+		ProtoName string `xml:"protoname,attr"`
+		SPort     uint16 `xml:"sport"`
+		DPort     uint16 `xml:"dport"`
+		Type      uint8  `xml:"type"`
+		Code      uint8  `xml:"code"`
+		ID        uint16 `xml:"id"`
+	} `xml:"layer4"`
+	Counters struct {
+		Packets uint `xml:"packets"`
+		Bytes   uint `xml:"bytes"`
+	} `xml:"counters"`
+
+	// both directions and independent has a zone
+	Zone uint16 `xml:"zone"`
+
+	// independent
+	State     string    `xml:"state"`
+	Timeout   int       `xml:"timeout"`
+	Mark      uint32    `xml:"mark"`
+	SecCtx    string    `xml:"secctx"`
+	Use       uint      `xml:"use"`
+	ID        uint32    `xml:"id"`
+	Assured   *struct{} `xml:"assured"`
+	Unreplied *struct{} `xml:"unreplied"`
+	Timestamp struct {
+		Start int64 `xml:"start"`
+		Stop  int64 `xml:"stop"`
+	} `xml:"timestamp"`
+	DeltaTime int64    `xml:"deltatime"`
+	Labels    []string `xml:"labels>label"`
+}
+
+// xmlWhen is the local time an event happened, present when conntrack -E is run with -o xml,timestamp
+type xmlWhen struct {
+	Hour   int `xml:"hour"`
+	Minute int `xml:"min"`
+	Second int `xml:"sec"`
+	Day    int `xml:"day"`
+	Month  int `xml:"month"`
+	Year   int `xml:"year"`
+}
+
+// xmlDecoder streams <flow> elements from conntrack -o xml output
+type xmlDecoder struct {
+	decoder *xml.Decoder
+}
+
+// next decodes the next <flow> element
+func (d *xmlDecoder) next() (*xmlFlow, error) {
+	for {
+		token, err := d.decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "flow" {
+			// <?xml ...?>, <conntrack> and whitespace between flows
+			continue
+		}
+
+		var f xmlFlow
+		err = d.decoder.DecodeElement(&f, &start)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode flow: %s", err)
+		}
+		return &f, nil
+	}
+}
+
+// flow converts the decoded xml into a Flow
+func (x *xmlFlow) flow() (Flow, error) {
+	flow := Flow{}
+
+	var original, reply bool
+	for _, m := range x.Metas {
+		switch m.Direction {
+		case "original":
+			// xml always names the family, text only does with -o extended
+			flow.Family = m.Layer3.ProtoName
+			flow.Protocol = m.Layer4.ProtoName
+			flow.ProtocolNumber = m.Layer4.ProtoNum
+			err := m.direction(&flow.Original, flow.Protocol)
+			if err != nil {
+				return flow, err
+			}
+			original = true
+		case "reply":
+			err := m.direction(&flow.Reply, flow.Protocol)
+			if err != nil {
+				return flow, err
+			}
+			reply = true
+		case "independent":
+			flow.ProtocolState = m.State
+			flow.TTL = m.Timeout
+			flow.Mark = m.Mark
+			flow.SecCtx = m.SecCtx
+			flow.Zone = m.Zone
+			flow.Use = m.Use
+			flow.ID = m.ID
+			flow.Labels = m.Labels
+			flow.DeltaTime = time.Duration(m.DeltaTime) * time.Second
+			if m.Assured != nil {
+				flow.State = "ASSURED"
+			}
+			if m.Unreplied != nil {
+				flow.State = "UNREPLIED"
+			}
+			if m.Timestamp.Start != 0 {
+				flow.Start = time.Unix(0, m.Timestamp.Start)
+			}
+			if m.Timestamp.Stop != 0 {
+				flow.Stop = time.Unix(0, m.Timestamp.Stop)
+			}
+		}
+	}
+
+	if !original || !reply {
+		return flow, fmt.Errorf("flow is missing its original or reply direction")
+	}
+
+	// If conntrack does not expect the reply to be received by the source - we properly have NAT
+	if flow.Original.Layer3.Source != flow.Reply.Layer3.Destination {
+		flow.NAT = true
+	}
+
+	return flow, nil
+}
+
+// direction fills a Direction from an original or reply meta element
+func (m *xmlMeta) direction(d *Direction, protocol string) error {
+	var err error
+	d.Layer3.Source, err = netip.ParseAddr(m.Layer3.Src)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s src: %s", m.Direction, err)
+	}
+	d.Layer3.Destination, err = netip.ParseAddr(m.Layer3.Dst)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s dst: %s", m.Direction, err)
+	}
+	if strings.HasPrefix(protocol, "icmp") {
+		d.ICMP = ICMP{Type: m.Layer4.Type, Code: m.Layer4.Code, ID: m.Layer4.ID}
+	} else {
+		d.Layer4 = Layer4{SPort: m.Layer4.SPort, DPort: m.Layer4.DPort}
+	}
+	d.Counter = Counter{Packets: m.Counters.Packets, Bytes: m.Counters.Bytes}
+	d.Zone = m.Zone
+
+	return nil
+}
+
+// xmlReader reads Flows from conntrack -L -o xml
+type xmlReader struct {
+	io.Reader
+	xmlDecoder
+}
+
+// NewXMLReader returns a new reader
+func NewXMLReader(in io.Reader) *xmlReader {
+	return &xmlReader{Reader: in, xmlDecoder: xmlDecoder{decoder: xml.NewDecoder(in)}}
+}
+
+// Read reads the next Flow from its embedded reader
+func (r *xmlReader) Read() (*Flow, error) {
+	x, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := x.flow()
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// xmlUpdateReader reads FlowUpdates from conntrack -E -o xml
+type xmlUpdateReader struct {
+	io.Reader
+	xmlDecoder
+}
+
+// NewXMLUpdateReader returns a new reader
+func NewXMLUpdateReader(in io.Reader) *xmlUpdateReader {
+	return &xmlUpdateReader{Reader: in, xmlDecoder: xmlDecoder{decoder: xml.NewDecoder(in)}}
+}
+
+// Read reads the next FlowUpdate from its embedded reader
+func (r *xmlUpdateReader) Read() (*FlowUpdate, error) {
+	x, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	// the text format has upper case types
+	u := FlowUpdate{Type: strings.ToUpper(x.Type)}
+	if x.When != nil {
+		w := x.When
+		u.Time = time.Date(w.Year, time.Month(w.Month), w.Day, w.Hour, w.Minute, w.Second, 0, time.Local)
+	}
+
+	u.Flow, err = x.flow()
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
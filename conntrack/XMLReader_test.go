@@ -0,0 +1,169 @@
+package conntrack
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXMLReaderEquivalence(t *testing.T) {
+	text, err := os.Open("conntrack_listing_test_file.txt")
+	if err != nil {
+		t.Fatalf("unable to open test file: %s", err)
+	}
+	defer text.Close()
+
+	xml, err := os.Open("conntrack_listing_test_file.xml")
+	if err != nil {
+		t.Fatalf("unable to open test file: %s", err)
+	}
+	defer xml.Close()
+
+	textReader := Text.NewReader(text)
+	xmlReader := XML.NewReader(xml)
+
+	n := 0
+	for {
+		textFlow, textErr := textReader.Read()
+		xmlFlow, xmlErr := xmlReader.Read()
+		if textErr == io.EOF && xmlErr == io.EOF {
+			break
+		}
+		if textErr != nil || xmlErr != nil {
+			t.Fatalf("flow %d: readers did not agree on errors: text: %v, xml: %v", n, textErr, xmlErr)
+		}
+
+		if !reflect.DeepEqual(textFlow, xmlFlow) {
+			t.Fatalf("flow %d: text and xml flows differ:\n%+v\n%+v", n, textFlow, xmlFlow)
+		}
+		n++
+	}
+
+	if n == 0 {
+		t.Fatalf("no flows was read")
+	}
+}
+
+// extendedPrefix is the family -o extended prefixes text output with
+var extendedPrefix = regexp.MustCompile(`ipv[46]\s+\d+\s+`)
+
+// withoutFamily returns conntrack text output without the -o extended prefix of every line
+func withoutFamily(t *testing.T, path string) io.Reader {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to open test file: %s", err)
+	}
+	return strings.NewReader(extendedPrefix.ReplaceAllString(string(data), ""))
+}
+
+func TestXMLReaderPlainEquivalence(t *testing.T) {
+	xml, err := os.Open("conntrack_listing_test_file.xml")
+	if err != nil {
+		t.Fatalf("unable to open test file: %s", err)
+	}
+	defer xml.Close()
+
+	textReader := Text.NewReader(withoutFamily(t, "conntrack_listing_test_file.txt"))
+	xmlReader := XML.NewReader(xml)
+
+	n := 0
+	for {
+		textFlow, textErr := textReader.Read()
+		xmlFlow, xmlErr := xmlReader.Read()
+		if textErr == io.EOF && xmlErr == io.EOF {
+			break
+		}
+		if textErr != nil || xmlErr != nil {
+			t.Fatalf("flow %d: readers did not agree on errors: text: %v, xml: %v", n, textErr, xmlErr)
+		}
+
+		// plain conntrack -L does not print the family, xml always does
+		if textFlow.Family != "" || xmlFlow.Family == "" {
+			t.Fatalf("flow %d: unexpected families, text: %q, xml: %q", n, textFlow.Family, xmlFlow.Family)
+		}
+		xmlFlow.Family = ""
+		if !reflect.DeepEqual(textFlow, xmlFlow) {
+			t.Fatalf("flow %d: text and xml flows differ:\n%+v\n%+v", n, textFlow, xmlFlow)
+		}
+		n++
+	}
+
+	if n == 0 {
+		t.Fatalf("no flows was read")
+	}
+}
+
+func TestXMLUpdateReaderEquivalence(t *testing.T) {
+	text, err := os.Open("conntrack_events_test_file.txt")
+	if err != nil {
+		t.Fatalf("unable to open test file: %s", err)
+	}
+	defer text.Close()
+
+	xml, err := os.Open("conntrack_events_test_file.xml")
+	if err != nil {
+		t.Fatalf("unable to open test file: %s", err)
+	}
+	defer xml.Close()
+
+	textReader := Text.NewUpdateReader(text)
+	xmlReader := XML.NewUpdateReader(xml)
+
+	n := 0
+	for {
+		textUpdate, textErr := textReader.Read()
+		xmlUpdate, xmlErr := xmlReader.Read()
+		if textErr == io.EOF && xmlErr == io.EOF {
+			break
+		}
+		if textErr != nil || xmlErr != nil {
+			t.Fatalf("update %d: readers did not agree on errors: text: %v, xml: %v", n, textErr, xmlErr)
+		}
+
+		if !reflect.DeepEqual(textUpdate, xmlUpdate) {
+			t.Fatalf("update %d: text and xml updates differ:\n%+v\n%+v", n, textUpdate, xmlUpdate)
+		}
+		n++
+	}
+
+	if n == 0 {
+		t.Fatalf("no updates was read")
+	}
+}
+
+func TestXMLUpdateReaderTimestamp(t *testing.T) {
+	// conntrack -E -o xml,timestamp does not close the conntrack element until it exits
+	in := strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<conntrack>
+<flow type="destroy"><meta direction="original"><layer3 protonum="2" protoname="ipv4"><src>192.168.1.157</src><dst>87.248.214.49</dst></layer3><layer4 protonum="6" protoname="tcp"><sport>54556</sport><dport>443</dport></layer4><counters><packets>12</packets><bytes>1523</bytes></counters></meta><meta direction="reply"><layer3 protonum="2" protoname="ipv4"><src>87.248.214.49</src><dst>85.191.222.130</dst></layer3><layer4 protonum="6" protoname="tcp"><sport>443</sport><dport>54556</dport></layer4><counters><packets>10</packets><bytes>6789</bytes></counters></meta><meta direction="independent"><timestamp><start>1528106383000000000</start><stop>1528106400000000000</stop></timestamp><deltatime>17</deltatime><assured/></meta><when><hour>10</hour><min>0</min><sec>0</sec><wday>2</wday><day>4</day><month>6</month><year>2018</year></when></flow>
+`)
+
+	update, err := NewXMLUpdateReader(in).Read()
+	if err != nil {
+		t.Fatalf("unable to read update: %s", err)
+	}
+
+	if update.Type != "DESTROY" {
+		t.Fatalf("type was expected to be DESTROY, was %s", update.Type)
+	}
+	when := time.Date(2018, time.June, 4, 10, 0, 0, 0, time.Local)
+	if !update.Time.Equal(when) {
+		t.Fatalf("time was expected to be %s, was %s", when, update.Time)
+	}
+	if update.Flow.Stop.Sub(update.Flow.Start) != update.Flow.DeltaTime {
+		t.Fatalf("start, stop and delta-time does not agree: %+v", update.Flow)
+	}
+	if update.Flow.Original.Counter.Bytes != 1523 || update.Flow.Reply.Counter.Packets != 10 {
+		t.Fatalf("counters was not read: %+v", update.Flow)
+	}
+
+	// and then the stream ends without </conntrack>
+	_, err = NewXMLUpdateReader(strings.NewReader("<conntrack>")).Read()
+	if err == nil {
+		t.Fatalf("reading an empty stream did not fail")
+	}
+}
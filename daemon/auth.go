@@ -0,0 +1,191 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+)
+
+// Role is what a client is allowed to do
+type Role int
+
+const (
+	// RoleNone clients are disconnected right away
+	RoleNone Role = iota
+	// RoleRead clients may run commands which only reads state
+	RoleRead
+	// RoleAdmin clients may also run admin commands
+	RoleAdmin
+)
+
+// String names the role
+func (r Role) String() string {
+	switch r {
+	case RoleRead:
+		return "read"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// ParseRole parses the name of a role
+func ParseRole(name string) (Role, error) {
+	for _, r := range []Role{RoleNone, RoleRead, RoleAdmin} {
+		if r.String() == name {
+			return r, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %s, use none, read or admin", name)
+}
+
+// Authorizer decides the role of a newly accepted connection, connections
+// which should be rejected gets RoleNone along with an error explaining why
+type Authorizer interface {
+	Authorize(c net.Conn) (Role, error)
+}
+
+// Credentials identifies the process at the other end of a unix socket
+type Credentials struct {
+	UID int
+	GID int
+	PID int
+}
+
+// PeerCredAuthorizer authorizes unix socket connections by the uid and gids of the
+// connecting process, root is always admin
+type PeerCredAuthorizer struct {
+	ReadUIDs  []int
+	ReadGIDs  []int
+	AdminUIDs []int
+	AdminGIDs []int
+
+	// groups looks up the supplementary groups of a uid, defaults to the user database
+	groups func(uid int) []int
+}
+
+// Authorize reads the peer credentials of a unix socket connection
+func (a *PeerCredAuthorizer) Authorize(c net.Conn) (Role, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return RoleNone, fmt.Errorf("connection from %s is not a unix socket", c.RemoteAddr())
+	}
+
+	creds, err := PeerCredentials(uc)
+	if err != nil {
+		return RoleNone, err
+	}
+
+	role := a.Role(creds)
+	if role == RoleNone {
+		return RoleNone, fmt.Errorf("uid %d gid %d pid %d is not allowed", creds.UID, creds.GID, creds.PID)
+	}
+	return role, nil
+}
+
+// Role returns the role granted to given credentials
+func (a *PeerCredAuthorizer) Role(creds Credentials) Role {
+	if creds.UID == 0 {
+		return RoleAdmin
+	}
+
+	groups := a.groups
+	if groups == nil {
+		groups = supplementaryGroups
+	}
+	gids := append([]int{creds.GID}, groups(creds.UID)...)
+
+	switch {
+	case contains(a.AdminUIDs, creds.UID) || containsAny(a.AdminGIDs, gids):
+		return RoleAdmin
+	case contains(a.ReadUIDs, creds.UID) || containsAny(a.ReadGIDs, gids):
+		return RoleRead
+	}
+	return RoleNone
+}
+
+// supplementaryGroups returns the groups a user is member of, besides its primary group
+func supplementaryGroups(uid int) []int {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return nil
+	}
+
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil
+	}
+
+	gids := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if gid, err := strconv.Atoi(id); err == nil {
+			gids = append(gids, gid)
+		}
+	}
+	return gids
+}
+
+// contains reports if ids contains id
+func contains(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny reports if ids contains any of candidates
+func containsAny(ids []int, candidates []int) bool {
+	for _, c := range candidates {
+		if contains(ids, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupUsers resolves user names or numeric uids
+func LookupUsers(names []string) ([]int, error) {
+	return lookupIDs(names, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+}
+
+// LookupGroups resolves group names or numeric gids
+func LookupGroups(names []string) ([]int, error) {
+	return lookupIDs(names, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+}
+
+// lookupIDs resolves names with lookup, numbers are used as they are
+func lookupIDs(names []string, lookup func(string) (string, error)) ([]int, error) {
+	ids := make([]int, 0, len(names))
+	for _, name := range names {
+		if id, err := strconv.Atoi(name); err == nil {
+			ids = append(ids, id)
+			continue
+		}
+
+		id, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("%s has non numeric id %s", name, id)
+		}
+		ids = append(ids, n)
+	}
+	return ids, nil
+}
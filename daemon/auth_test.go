@@ -0,0 +1,104 @@
+package daemon
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRole(t *testing.T) {
+	a := &PeerCredAuthorizer{
+		ReadUIDs:  []int{1000},
+		ReadGIDs:  []int{100},
+		AdminUIDs: []int{1001},
+		AdminGIDs: []int{27},
+		groups: func(uid int) []int {
+			if uid == 1002 {
+				return []int{27}
+			}
+			return nil
+		},
+	}
+
+	cases := []struct {
+		creds Credentials
+		role  Role
+	}{
+		{Credentials{UID: 0, GID: 0}, RoleAdmin},
+		{Credentials{UID: 1000, GID: 1000}, RoleRead},
+		{Credentials{UID: 1001, GID: 1001}, RoleAdmin},
+		{Credentials{UID: 1002, GID: 1002}, RoleAdmin},
+		{Credentials{UID: 1003, GID: 100}, RoleRead},
+		{Credentials{UID: 1004, GID: 1004}, RoleNone},
+	}
+	for _, c := range cases {
+		if role := a.Role(c.creds); role != c.role {
+			t.Fatalf("%+v was expected to be %s, was %s", c.creds, c.role, role)
+		}
+	}
+}
+
+func TestLookupIDs(t *testing.T) {
+	ids, err := LookupUsers([]string{"0", "root"})
+	if err != nil {
+		t.Fatalf("unable to look up users: %s", err)
+	}
+	if ids[0] != 0 || ids[1] != 0 {
+		t.Fatalf("root was expected to be uid 0: %+v", ids)
+	}
+
+	_, err = LookupGroups([]string{"no-such-group-hopefully"})
+	if err == nil {
+		t.Fatalf("unknown group was resolved")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "run", "routerlogin.sock")
+
+	l, err := UnixSocket{Path: path, Mode: 0600}.Listen()
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("socket was not created: %s", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket has wrong mode %s", info.Mode())
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	// a stale socket is replaced
+	l, err = UnixSocket{Path: path}.Listen()
+	if err != nil {
+		t.Fatalf("unable to replace stale socket: %s", err)
+	}
+	l.Close()
+
+	// but other files are not
+	err = os.WriteFile(path, []byte("hello"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+	_, err = UnixSocket{Path: path}.Listen()
+	if err == nil {
+		t.Fatalf("a regular file was replaced by the socket")
+	}
+
+	open := filepath.Join(dir, "open")
+	err = os.Mkdir(open, 0777)
+	if err == nil {
+		err = os.Chmod(open, 0777)
+	}
+	if err != nil {
+		t.Fatalf("unable to create directory: %s", err)
+	}
+	_, err = UnixSocket{Path: filepath.Join(open, "routerlogin.sock")}.Listen()
+	if err == nil {
+		t.Fatalf("socket was created in a world writable directory")
+	}
+}
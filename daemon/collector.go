@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -13,6 +15,19 @@ type Store interface {
 	Data(string) (map[string]string, error)
 }
 
+// Overrider is implemented by stores whose values replaces the ones of other stores,
+// for the keys it lists and only when not empty
+type Overrider interface {
+	Overrides() []string
+}
+
+// RowStore is implemented by stores with rows of their own, which may have several rows
+// of an address such as hosts of different sites numbered alike. Their rows are added to
+// the table as they are, instead of adding columns to the rows of every address
+type RowStore interface {
+	Rows() ([]map[string]string, error)
+}
+
 // Collector collects from given stores
 type Collector struct {
 	// Stores are the stores we will be reading from
@@ -26,7 +41,17 @@ type Collector struct {
 // Collect is the actual collecting function
 func (c *Collector) Collect() error {
 
-	addresses := c.addresses()
+	// stores with rows of their own are left out of the rows of addresses
+	columns := Collector{}
+	var rowStores []RowStore
+	for _, store := range c.Stores {
+		if rs, ok := store.(RowStore); ok {
+			rowStores = append(rowStores, rs)
+			continue
+		}
+		columns.Stores = append(columns.Stores, store)
+	}
+	addresses := columns.addresses()
 
 	c.Data = make([][]string, 0)
 	c.Headers = make([]string, 2)
@@ -37,30 +62,43 @@ func (c *Collector) Collect() error {
 	fieldOrder["ip"] = 1
 
 	for _, addr := range addresses {
-		addrData, err := c.data(addr)
+		addrData, err := columns.data(addr)
 		if err != nil {
 			return fmt.Errorf("could not get address data: %s", err)
 		}
+		c.add(fieldOrder, addrData)
+	}
 
-		line := make([]string, len(addrData)+1)
-		// loop this ip's data and put it into our table
-		for key, value := range addrData {
+	for _, rs := range rowStores {
+		rows, err := rs.Rows()
+		if err != nil {
+			return fmt.Errorf("unable to retrieve rows from %T: %s", rs, err)
+		}
+		for _, row := range rows {
+			c.add(fieldOrder, row)
+		}
+	}
+	return nil
+}
 
-			var o int
-			var exists bool
-			if o, exists = fieldOrder[key]; !exists {
-				// assign next fieldOrder
-				o = len(fieldOrder)
-				fieldOrder[key] = o
-				c.Headers = append(c.Headers, "")
-			}
-			c.Headers[o] = key
-			line[o] = value
+// add adds a row to the table, keys not seen before are given the next columns
+func (c *Collector) add(fieldOrder map[string]int, row map[string]string) {
+	for key := range row {
+		o, exists := fieldOrder[key]
+		if !exists {
+			// assign next fieldOrder
+			o = len(fieldOrder)
+			fieldOrder[key] = o
+			c.Headers = append(c.Headers, "")
 		}
-		c.Data = append(c.Data, line)
+		c.Headers[o] = key
+	}
 
+	line := make([]string, len(c.Headers))
+	for key, value := range row {
+		line[fieldOrder[key]] = value
 	}
-	return nil
+	c.Data = append(c.Data, line)
 }
 
 // Data will collect data from all stores and combine them
@@ -69,14 +107,29 @@ func (c *Collector) data(ip string) (map[string]string, error) {
 	line := make(map[string]string)
 	line["ip"] = ip
 
+	// overrides are applied once every other store is in the line
+	overrides := make(map[string]string)
+
 	for _, store := range c.Stores {
 		sData, err := store.Data(ip)
 		if err != nil {
 			return nil, fmt.Errorf("unable to retive data from %T: %s", store, err)
 		}
 
+		overriding := make(map[string]bool)
+		if o, ok := store.(Overrider); ok {
+			for _, key := range o.Overrides() {
+				overriding[key] = true
+			}
+		}
+
 		// put this data into our line
 		for key, value := range sData {
+			if overriding[key] {
+				overrides[key] = value
+				continue
+			}
+
 			// we should not overwrite keys
 			if _, exists := line[key]; exists {
 				return nil, fmt.Errorf("duplicate key found: %s", key)
@@ -84,9 +137,154 @@ func (c *Collector) data(ip string) (map[string]string, error) {
 			line[key] = value
 		}
 	}
+
+	for key, value := range overrides {
+		if _, exists := line[key]; value != "" || !exists {
+			line[key] = value
+		}
+	}
 	return line, nil
 }
 
+// Query filters and aggregates the table by arguments as given to the table command,
+// column=value filters by Where and "by column" aggregates by By
+func (c *Collector) Query(args []string) error {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "by" {
+			if i != len(args)-2 {
+				return fmt.Errorf("by should be last and followed by a single column")
+			}
+			return c.By(args[i+1])
+		}
+
+		column, value, found := strings.Cut(args[i], "=")
+		if !found {
+			return fmt.Errorf("expected column=value or by <column>, got \"%s\"", args[i])
+		}
+		err := c.Where(column, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Where keeps the rows whose column has the given value, columns of comma separated
+// lists such as tags matches any of their values
+func (c *Collector) Where(column, value string) error {
+	o := c.column(column)
+	if o < 0 {
+		return fmt.Errorf("no column named %s", column)
+	}
+
+	rows := c.Data[:0]
+	for _, row := range c.Data {
+		if o < len(row) && hasValue(row[o], value) {
+			rows = append(rows, row)
+		}
+	}
+	c.Data = rows
+	return nil
+}
+
+// hasValue reports if a cell has a value, or has it in its comma separated list
+func hasValue(cell, value string) bool {
+	if cell == value {
+		return true
+	}
+	for _, v := range strings.Split(cell, ",") {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// By turns the table into one row per value of a column, with the number of hosts
+// having the value and the sums of every numeric column
+func (c *Collector) By(column string) error {
+	o := c.column(column)
+	if o < 0 {
+		return fmt.Errorf("no column named %s", column)
+	}
+
+	// numeric columns are those where every value is a number
+	var numeric []int
+	for i := range c.Headers {
+		if i != o && c.numeric(i) {
+			numeric = append(numeric, i)
+		}
+	}
+
+	headers := []string{column, "hosts"}
+	for _, i := range numeric {
+		headers = append(headers, c.Headers[i])
+	}
+
+	rows := make(map[string][]float64)
+	var order []string
+	for _, row := range c.Data {
+		key := cell(row, o)
+		sums, found := rows[key]
+		if !found {
+			sums = make([]float64, len(numeric)+1)
+			rows[key] = sums
+			order = append(order, key)
+		}
+
+		sums[0]++
+		for j, i := range numeric {
+			v, _ := strconv.ParseFloat(cell(row, i), 64)
+			sums[j+1] += v
+		}
+	}
+
+	c.Headers = headers
+	c.Data = make([][]string, 0, len(order))
+	for _, key := range order {
+		line := []string{key}
+		for _, v := range rows[key] {
+			line = append(line, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		c.Data = append(c.Data, line)
+	}
+	return nil
+}
+
+// column returns the index of a column, or -1
+func (c *Collector) column(name string) int {
+	for i, h := range c.Headers {
+		if h == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// numeric reports if every non empty value of a column is a number, and some are
+func (c *Collector) numeric(i int) bool {
+	found := false
+	for _, row := range c.Data {
+		v := cell(row, i)
+		if v == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// cell returns a cell of a row, rows may be shorter than the headers
+func cell(row []string, i int) string {
+	if i < len(row) {
+		return row[i]
+	}
+	return ""
+}
+
 // addresses returns the distinct set of ip addresses from all stores
 func (c *Collector) addresses() []string {
 	// lets try one of these new and shiny concurrent maps
@@ -96,6 +294,8 @@ func (c *Collector) addresses() []string {
 	for _, store := range c.Stores {
 		wg.Add(1)
 		go func(store Store) {
+			defer wg.Done()
+
 			ips, err := store.Addresses()
 			if err != nil {
 				log.Printf("unable to get addresses from %T: %s", store, err)
@@ -104,7 +304,6 @@ func (c *Collector) addresses() []string {
 			for _, ip := range ips {
 				m.LoadOrStore(ip.String(), struct{}{})
 			}
-			wg.Done()
 		}(store)
 	}
 
@@ -0,0 +1,167 @@
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// commandTimeout is how long we wait for clients of command listeners to send a command,
+// clients which does not send anything gets the table
+const commandTimeout = 500 * time.Millisecond
+
+// CommandListener is implemented by listeners whose clients may send a command, clients
+// of other listeners are sent the table right away without waiting for one
+type CommandListener interface {
+	net.Listener
+	AcceptsCommands() bool
+}
+
+// Commands returns l as a listener whose clients may send a command
+func Commands(l net.Listener) net.Listener {
+	return commandListener{Listener: l}
+}
+
+// commandListener accepts commands on behalf of its listener
+type commandListener struct {
+	net.Listener
+}
+
+// AcceptsCommands reports that clients may send commands
+func (commandListener) AcceptsCommands() bool {
+	return true
+}
+
+// acceptsCommands reports if clients of l may send commands, and returns the listener
+// l wraps, which authorizes its own connections when it is an Authorizer
+func acceptsCommands(l net.Listener) (net.Listener, bool) {
+	if c, ok := l.(commandListener); ok {
+		return c.Listener, true
+	}
+	if c, ok := l.(CommandListener); ok {
+		return l, c.AcceptsCommands()
+	}
+	return l, false
+}
+
+// CommandFunc handles a command sent by a client, args are the
+// whitespace separated words following the command name
+type CommandFunc func(w io.Writer, args []string) error
+
+// Commander is implemented by stores which answers commands of their own
+type Commander interface {
+	Commands() map[string]func(io.Writer, []string) error
+}
+
+// AdminCommander is implemented by stores which answers commands that changes state
+type AdminCommander interface {
+	AdminCommands() map[string]func(io.Writer, []string) error
+}
+
+// handler is a registered command
+type handler struct {
+	f CommandFunc
+
+	// admin commands changes state, as opposed to just reading it
+	admin bool
+}
+
+// Handle registers a command
+func (d *Daemon) Handle(name string, f CommandFunc) {
+	d.handle(name, handler{f: f})
+}
+
+// HandleAdmin registers a command which changes state
+func (d *Daemon) HandleAdmin(name string, f CommandFunc) {
+	d.handle(name, handler{f: f, admin: true})
+}
+
+// handle registers a handler by its name
+func (d *Daemon) handle(name string, h handler) {
+	if d.commands == nil {
+		d.commands = make(map[string]handler)
+	}
+	d.commands[name] = h
+}
+
+// serve reads a single command from a connection and writes its output, clients which
+// may not send commands are sent the table
+func (d *Daemon) serve(c net.Conn, role Role, commands bool) error {
+	if !commands {
+		return d.run(c, role, "table", nil)
+	}
+
+	err := c.SetReadDeadline(time.Now().Add(commandTimeout))
+	if err != nil {
+		return err
+	}
+
+	// any error, including a timeout, means the client have nothing to say
+	line, _ := bufio.NewReader(c).ReadString('\n')
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fields = []string{"table"}
+	}
+
+	return d.run(c, role, fields[0], fields[1:])
+}
+
+// run runs a command, errors from the command are reported to the client
+func (d *Daemon) run(w io.Writer, role Role, name string, args []string) error {
+	var f CommandFunc
+	switch name {
+	case "table":
+		f = d.tableCommand
+	case "help":
+		f = d.helpCommand
+	case "health":
+		f = d.healthCommand
+	case "history":
+		f = d.historyCommand
+	default:
+		h := d.commands[name]
+		if h.admin && role < RoleAdmin {
+			log.Printf("refused %s command %s %v", role, name, args)
+			_, err := fmt.Fprintf(w, "permission denied: %s requires admin\n", name)
+			return err
+		}
+		f = h.f
+	}
+
+	if f == nil {
+		_, err := fmt.Fprintf(w, "unknown command \"%s\", try help\n", name)
+		return err
+	}
+
+	err := f(w, args)
+	if err != nil {
+		log.Printf("command %s %v failed: %s", name, args, err)
+		_, err = fmt.Fprintf(w, "error: %s\n", err)
+	}
+	return err
+}
+
+// tableCommand writes the host table: table [column=value]... [by <column>]
+func (d *Daemon) tableCommand(w io.Writer, args []string) error {
+	return d.writeTable(w, args)
+}
+
+// helpCommand lists the available commands
+func (d *Daemon) helpCommand(w io.Writer, _ []string) error {
+	names := []string{"health", "help", "history", "table"}
+	for name, c := range d.commands {
+		if c.admin {
+			name = name + " (admin)"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	_, err := fmt.Fprintln(w, strings.Join(names, "\n"))
+	return err
+}
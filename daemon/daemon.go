@@ -1,46 +1,105 @@
 package daemon
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/fasmide/routerlogin/history"
 	"github.com/olekukonko/tablewriter"
 )
 
 // Daemon accepts connections from a listener and outputs data when they connect
 type Daemon struct {
-	stores []Store
+	// Authorizer decides what connecting clients may do, every client is admin when nil,
+	// use SetAuthorizer to change it while serving
+	Authorizer Authorizer
+
+	// MaxAge is how old the data of a store may be before the daemon is unhealthy,
+	// defaults to a minute, MaxAges overrides it for stores by their name e.g. dnsmasq.Store
+	MaxAge  time.Duration
+	MaxAges map[string]time.Duration
+
+	// History is where Sample puts metrics of every host, the history command and
+	// /api/history are unavailable when nil
+	History *history.History
+
+	// Events are published to by RunEvents and Sample, /api/events is unavailable when nil
+	Events *Broker
+
+	// ShutdownTimeout is how long Serve waits for clients to finish when stopping, defaults to 10 seconds
+	ShutdownTimeout time.Duration
+
+	stores   []Store
+	commands map[string]handler
+
+	lock  sync.RWMutex
+	conns sync.WaitGroup
 }
 
-// Accept accepts everything on given listener
+// Accept accepts everything on given listener, until it is closed
 func (d *Daemon) Accept(l net.Listener) error {
+	return d.Serve(context.Background(), l)
+}
 
-	for {
-		fd, err := l.Accept()
-		if err != nil {
-			log.Fatal("accept error:", err)
-		}
+// handleConn authorizes and serves a connection accepted from l
+func (d *Daemon) handleConn(l net.Listener, c net.Conn) {
+	defer c.Close()
 
-		go func(c net.Conn) {
-			_, err := d.WriteTo(c)
-			if err != nil {
-				log.Printf("failed writing to connection: %s", err)
-			}
-			c.Close()
-		}(fd)
+	l, commands := acceptsCommands(l)
+	role, err := d.authorize(l, c)
+	if err != nil {
+		log.Printf("rejected connection: %s", err)
+		return
+	}
+
+	err = d.serve(c, role, commands)
+	if err != nil {
+		log.Printf("failed writing to connection: %s", err)
 	}
 }
 
+// authorize returns the role of a new connection, listeners which are
+// authorizers themselves decides for their own connections
+func (d *Daemon) authorize(l net.Listener, c net.Conn) (Role, error) {
+	a, ok := l.(Authorizer)
+	if !ok {
+		d.lock.RLock()
+		a = d.Authorizer
+		d.lock.RUnlock()
+	}
+	if a == nil {
+		return RoleAdmin, nil
+	}
+
+	role, err := a.Authorize(c)
+	if err == nil && role == RoleNone {
+		err = fmt.Errorf("%s has no role", c.RemoteAddr())
+	}
+	return role, err
+}
+
 // WriteTo to outputs our output to a writer
 func (d *Daemon) WriteTo(w io.Writer) (int64, error) {
+	return 0, d.writeTable(w, nil)
+}
 
+// writeTable writes the host table, filtered and aggregated by args, see Collector.Query
+func (d *Daemon) writeTable(w io.Writer, args []string) error {
 	c := Collector{Stores: d.stores}
 	err := c.Collect()
 
 	if err != nil {
-		return 0, fmt.Errorf("unable to collect data: %s", err)
+		return fmt.Errorf("unable to collect data: %s", err)
+	}
+
+	err = c.Query(args)
+	if err != nil {
+		return err
 	}
 
 	t := tablewriter.NewWriter(w)
@@ -49,10 +108,23 @@ func (d *Daemon) WriteTo(w io.Writer) (int64, error) {
 	t.AppendBulk(c.Data)
 	t.Render()
 
-	return 0, nil
+	return nil
 }
 
-// AddStore adds given stores to the daemon
+// AddStore adds given stores to the daemon, along with any commands they have
 func (d *Daemon) AddStore(s ...Store) {
 	d.stores = append(d.stores, s...)
+
+	for _, store := range s {
+		if c, ok := store.(Commander); ok {
+			for name, f := range c.Commands() {
+				d.Handle(name, f)
+			}
+		}
+		if c, ok := store.(AdminCommander); ok {
+			for name, f := range c.AdminCommands() {
+				d.HandleAdmin(name, f)
+			}
+		}
+	}
 }
@@ -1,10 +1,14 @@
 package daemon
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -119,3 +123,199 @@ func TestDistinctAddresses(t *testing.T) {
 		t.Fatalf("distinct addresses does not seem distinct: %+v", addresses)
 	}
 }
+
+// Teststore10 has a group, tags and a flow count for three hosts
+type Teststore10 struct{}
+
+func (t *Teststore10) Data(ip string) (map[string]string, error) {
+	data := map[string]struct{ hostname, group, tags, flows string }{
+		"10.0.0.1": {"phone", "kids", "tablet,games", "10"},
+		"10.0.0.2": {"*", "kids", "games", "5"},
+		"10.0.0.3": {"nas", "servers", "", ""},
+	}[ip]
+	return map[string]string{"hostname": data.hostname, "group": data.group, "tags": data.tags, "flows": data.flows}, nil
+}
+func (t *Teststore10) Addresses() ([]net.IP, error) {
+	return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}, nil
+}
+
+// Teststore11 names a single host, overriding its hostname
+type Teststore11 struct{}
+
+func (t *Teststore11) Data(ip string) (map[string]string, error) {
+	if ip == "10.0.0.2" {
+		return map[string]string{"hostname": "laptop"}, nil
+	}
+	return map[string]string{"hostname": ""}, nil
+}
+func (t *Teststore11) Addresses() ([]net.IP, error) {
+	return nil, nil
+}
+func (t *Teststore11) Overrides() []string {
+	return []string{"hostname"}
+}
+
+// rows returns the rows of a collector as column=value strings
+func rows(c *Collector) []string {
+	var res []string
+	for _, row := range c.Data {
+		var cells []string
+		for i, h := range c.Headers {
+			cells = append(cells, h+"="+cell(row, i))
+		}
+		sort.Strings(cells)
+		res = append(res, strings.Join(cells, " "))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestCollectorQuery(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"group=kids"}, []string{
+			"flows=10 group=kids hostname=phone ip=10.0.0.1 tags=tablet,games",
+			"flows=5 group=kids hostname=laptop ip=10.0.0.2 tags=games",
+		}},
+		{[]string{"tags=tablet"}, []string{
+			"flows=10 group=kids hostname=phone ip=10.0.0.1 tags=tablet,games",
+		}},
+		{[]string{"by", "group"}, []string{
+			"flows=0 group=servers hosts=1",
+			"flows=15 group=kids hosts=2",
+		}},
+		{[]string{"tags=games", "by", "group"}, []string{
+			"flows=15 group=kids hosts=2",
+		}},
+	} {
+		c := Collector{Stores: []Store{&Teststore11{}, &Teststore10{}}}
+		err := c.Collect()
+		if err != nil {
+			t.Fatalf("unable to collect: %s", err)
+		}
+
+		err = c.Query(test.args)
+		if err != nil {
+			t.Fatalf("unable to query %v: %s", test.args, err)
+		}
+		if res := rows(&c); !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("%v gave %q, expected %q", test.args, res, test.expected)
+		}
+	}
+
+	c := Collector{Stores: []Store{&Teststore10{}}}
+	c.Collect()
+	for _, args := range [][]string{{"nothing=1"}, {"by"}, {"by", "group", "flows"}, {"group"}} {
+		if err := c.Query(args); err == nil {
+			t.Errorf("invalid query %v was accepted", args)
+		}
+	}
+}
+
+type Teststore3 struct {
+	Teststore1
+}
+
+func (t *Teststore3) Commands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"echo": func(w io.Writer, args []string) error {
+			_, err := io.WriteString(w, strings.Join(args, " "))
+			return err
+		},
+		"fail": func(w io.Writer, args []string) error {
+			return fmt.Errorf("failed on purpose")
+		},
+	}
+}
+
+type Teststore4 struct {
+	Teststore3
+}
+
+func (t *Teststore4) AdminCommands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"reset": func(w io.Writer, args []string) error {
+			_, err := io.WriteString(w, "done")
+			return err
+		},
+	}
+}
+
+// command sends a command to a daemon as admin and returns its response
+func command(t *testing.T, d *Daemon, cmd string) string {
+	return commandAs(t, d, RoleAdmin, cmd)
+}
+
+// commandAs sends a command to a daemon with given role and returns its response
+func commandAs(t *testing.T, d *Daemon, role Role, cmd string) string {
+	client, server := net.Pipe()
+
+	go func() {
+		err := d.serve(server, role, true)
+		if err != nil {
+			t.Errorf("serve failed: %s", err)
+		}
+		server.Close()
+	}()
+
+	_, err := io.WriteString(client, cmd)
+	if err != nil {
+		t.Fatalf("unable to send command: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("could not read response from daemon: %s", err)
+	}
+	return string(data)
+}
+
+func TestCommands(t *testing.T) {
+	daemon := Daemon{}
+	daemon.AddStore(&Teststore3{})
+
+	if res := command(t, &daemon, "echo hello  there\n"); res != "hello there" {
+		t.Fatalf("echo command did not echo: %s", res)
+	}
+
+	if res := command(t, &daemon, "fail\n"); res != "error: failed on purpose\n" {
+		t.Fatalf("fail command did not report its error: %s", res)
+	}
+
+	if res := command(t, &daemon, "blarh\n"); !strings.HasPrefix(res, "unknown command") {
+		t.Fatalf("unknown command was not reported: %s", res)
+	}
+
+	if res := command(t, &daemon, "help\n"); res != "echo\nfail\nhealth\nhelp\nhistory\ntable\n" {
+		t.Fatalf("help did not list commands: %s", res)
+	}
+
+	// clients not sending anything gets the table, so does clients asking for it
+	for _, cmd := range []string{"", "\n", "table\n"} {
+		if res := command(t, &daemon, cmd); !strings.Contains(res, "127.0.0.1") {
+			t.Fatalf("%q did not return the table: %s", cmd, res)
+		}
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	daemon := Daemon{}
+	daemon.AddStore(&Teststore4{})
+
+	if res := command(t, &daemon, "reset\n"); res != "done" {
+		t.Fatalf("admin command did not run: %s", res)
+	}
+
+	if res := command(t, &daemon, "help\n"); res != "echo\nfail\nhealth\nhelp\nhistory\nreset (admin)\ntable\n" {
+		t.Fatalf("help did not mark admin commands: %s", res)
+	}
+
+	if res := commandAs(t, &daemon, RoleRead, "reset\n"); !strings.HasPrefix(res, "permission denied") {
+		t.Fatalf("admin command ran as read only: %s", res)
+	}
+	if res := commandAs(t, &daemon, RoleRead, "echo hi\n"); res != "hi" {
+		t.Fatalf("read only client could not run echo: %s", res)
+	}
+}
@@ -0,0 +1,104 @@
+package daemon
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+)
+
+// web holds the dashboard, which only talks to the api below
+//
+//go:embed web
+var web embed.FS
+
+// DetailStore is implemented by stores which knows more about a host than fits in the table
+type DetailStore interface {
+	Details(ip string) (interface{}, error)
+}
+
+// tableResponse is the host table as served to the dashboard
+type tableResponse struct {
+	Headers []string   `json:"headers"`
+	Rows    [][]string `json:"rows"`
+}
+
+// hostResponse is a single host as served to the dashboard
+type hostResponse struct {
+	IP string `json:"ip"`
+
+	// Row is the host's line of the table, by header
+	Row map[string]string `json:"row"`
+
+	// Details are the details of each store, by store name
+	Details map[string]interface{} `json:"details"`
+}
+
+// dashboardHandler serves the embedded dashboard
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(web, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
+
+// tableHandler serves the host table, collected exactly as the table command does
+// and filtered and aggregated by ?where=column=value and ?by=column
+func (d *Daemon) tableHandler(w http.ResponseWriter, r *http.Request) {
+	c := Collector{Stores: d.stores}
+	err := c.Collect()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	args := r.URL.Query()["where"]
+	if by := r.URL.Query().Get("by"); by != "" {
+		args = append(args, "by", by)
+	}
+	err = c.Query(args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, tableResponse{Headers: c.Headers, Rows: c.Data})
+}
+
+// hostHandler serves the table row and store details of a single host
+func (d *Daemon) hostHandler(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil {
+		http.Error(w, "invalid ip address", http.StatusBadRequest)
+		return
+	}
+
+	c := Collector{Stores: d.stores}
+	row, err := c.data(ip.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := hostResponse{IP: ip.String(), Row: row, Details: make(map[string]interface{})}
+	for _, s := range d.stores {
+		if ds, ok := s.(DetailStore); ok {
+			details, err := ds.Details(ip.String())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.Details[storeName(s)] = details
+		}
+	}
+
+	writeJSON(w, res)
+}
+
+// writeJSON writes v as json
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Teststore8 has details about its hosts
+type Teststore8 struct {
+	Teststore2
+}
+
+func (t *Teststore8) Details(ip string) (interface{}, error) {
+	return map[string]string{"lease": ip}, nil
+}
+
+// get requests path from the http interface of d
+func get(t *testing.T, d *Daemon, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	d.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestDashboard(t *testing.T) {
+	d := &Daemon{}
+	d.AddStore(&Teststore1{}, &Teststore8{})
+
+	for _, path := range []string{"/", "/app.js", "/style.css"} {
+		rec := get(t, d, path)
+		if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Fatalf("%s was not served: %d", path, rec.Code)
+		}
+	}
+	if body := get(t, d, "/").Body.String(); strings.Contains(body, "http://") || strings.Contains(body, "https://") {
+		t.Fatalf("dashboard refers to external resources")
+	}
+
+	table := tableResponse{}
+	err := json.Unmarshal(get(t, d, "/api/table").Body.Bytes(), &table)
+	if err != nil {
+		t.Fatalf("unable to decode table: %s", err)
+	}
+
+	// the same table as the table command
+	c := Collector{Stores: d.stores}
+	c.Collect()
+	if len(table.Rows) != len(c.Data) || strings.Join(table.Headers, " ") != strings.Join(c.Headers, " ") {
+		t.Fatalf("table differs from the collected one: %+v %+v", table, c)
+	}
+
+	host := hostResponse{}
+	err = json.Unmarshal(get(t, d, "/api/hosts/127.0.0.1").Body.Bytes(), &host)
+	if err != nil {
+		t.Fatalf("unable to decode host: %s", err)
+	}
+	if host.Row["something"] != "80" || host.Details["daemon.Teststore8"].(map[string]interface{})["lease"] != "127.0.0.1" {
+		t.Fatalf("unexpected host %+v", host)
+	}
+
+	if rec := get(t, d, "/api/hosts/nope"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid ip was accepted: %d", rec.Code)
+	}
+}
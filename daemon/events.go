@@ -0,0 +1,315 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types published by the daemon itself, stores publish their own
+const (
+	EventHostAppeared    = "host-appeared"
+	EventHostDisappeared = "host-disappeared"
+	EventMetrics         = "metrics"
+
+	// EventGap tells a resuming client that events was lost since its last event id
+	EventGap = "gap"
+)
+
+// heartbeatInterval is how often idle event streams are written to, so proxies keeps them open
+const heartbeatInterval = 15 * time.Second
+
+// subscriberBuffer is how many events a subscriber may fall behind before it is dropped
+const subscriberBuffer = 256
+
+// Event is something that happened to a host
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Host string      `json:"host,omitempty"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// EventFilter selects events by host and type, empty sets selects everything
+type EventFilter struct {
+	Hosts map[string]bool
+	Types map[string]bool
+}
+
+// Match reports if the filter selects an event, gaps are always selected
+func (f EventFilter) Match(e Event) bool {
+	if e.Type == EventGap {
+		return true
+	}
+	return (len(f.Hosts) == 0 || f.Hosts[e.Host]) && (len(f.Types) == 0 || f.Types[e.Type])
+}
+
+// subscriber is a client following events
+type subscriber struct {
+	filter EventFilter
+	events chan Event
+}
+
+// Broker hands events to subscribers and keeps the latest around, so clients
+// reconnecting with their last event id can catch up
+type Broker struct {
+	lock        sync.Mutex
+	nextID      uint64
+	buffer      []Event
+	size        int
+	subscribers map[*subscriber]struct{}
+}
+
+// NewBroker returns a broker remembering size events. Event ids begin at the current
+// time in microseconds, so ids from before a restart are older than any new id
+func NewBroker(size int) *Broker {
+	return &Broker{
+		nextID:      uint64(time.Now().UnixMicro()),
+		buffer:      make([]Event, 0, size),
+		size:        size,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Publish publishes an event, subscribers too slow to keep up are dropped
+func (b *Broker) Publish(kind, host string, data interface{}) Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	e := Event{ID: b.nextID, Type: kind, Host: host, Time: time.Now(), Data: data}
+	b.nextID++
+
+	if len(b.buffer) == b.size {
+		copy(b.buffer, b.buffer[1:])
+		b.buffer = b.buffer[:len(b.buffer)-1]
+	}
+	b.buffer = append(b.buffer, e)
+
+	for s := range b.subscribers {
+		if !s.filter.Match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			delete(b.subscribers, s)
+			close(s.events)
+		}
+	}
+
+	return e
+}
+
+// Subscribe returns the remembered events after the given id followed by new events as
+// they are published. A gap event comes first if events after the id was forgotten, and
+// the channel is closed if the subscriber falls too far behind. cancel must be called when done
+func (b *Broker) Subscribe(after uint64, f EventFilter) ([]Event, <-chan Event, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	replay := make([]Event, 0)
+	if after != 0 {
+		oldest := b.nextID
+		if len(b.buffer) > 0 {
+			oldest = b.buffer[0].ID
+		}
+		if after+1 < oldest {
+			replay = append(replay, Event{ID: oldest - 1, Type: EventGap, Time: time.Now()})
+		}
+		for _, e := range b.buffer {
+			if e.ID > after && f.Match(e) {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	s := &subscriber{filter: f, events: make(chan Event, subscriberBuffer)}
+	b.subscribers[s] = struct{}{}
+
+	cancel := func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, found := b.subscribers[s]; found {
+			delete(b.subscribers, s)
+			close(s.events)
+		}
+	}
+	return replay, s.events, cancel
+}
+
+// EventStore is implemented by stores which can tell when something happens,
+// Watch publishes events with emit until ctx is done
+type EventStore interface {
+	Watch(ctx context.Context, emit func(kind, host string, data interface{})) error
+}
+
+// RunEvents publishes events from every EventStore, and hosts appearing and
+// disappearing from the table which is looked at every interval, until ctx is done
+func (d *Daemon) RunEvents(ctx context.Context, interval time.Duration) {
+	if d.Events == nil {
+		return
+	}
+
+	for _, s := range d.stores {
+		if es, ok := s.(EventStore); ok {
+			go d.watch(ctx, es)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var hosts map[string]bool
+	for {
+		hosts = d.publishHosts(hosts)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// watch runs a watching store, and restarts it if it fails
+func (d *Daemon) watch(ctx context.Context, s EventStore) {
+	for {
+		err := s.Watch(ctx, func(kind, host string, data interface{}) {
+			d.Events.Publish(kind, host, data)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("daemon: watching %T failed, restarting: %s", s, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// publishHosts publishes the hosts which appeared and disappeared since previous,
+// nothing is published the first time around when previous is nil
+func (d *Daemon) publishHosts(previous map[string]bool) map[string]bool {
+	c := Collector{Stores: d.stores}
+	current := make(map[string]bool)
+	for _, ip := range c.addresses() {
+		current[ip] = true
+	}
+
+	if previous == nil {
+		return current
+	}
+
+	for ip := range current {
+		if !previous[ip] {
+			d.Events.Publish(EventHostAppeared, ip, nil)
+		}
+	}
+	for ip := range previous {
+		if !current[ip] {
+			d.Events.Publish(EventHostDisappeared, ip, nil)
+		}
+	}
+	return current
+}
+
+// eventsHandler streams events as server-sent events. host= and type= takes comma
+// separated lists to filter by, and resuming clients are caught up from the
+// Last-Event-ID header, or the lastEventId parameter
+func (d *Daemon) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if d.Events == nil {
+		http.Error(w, "events are not enabled", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	params := r.URL.Query()
+	filter := EventFilter{Hosts: splitSet(params.Get("host")), Types: splitSet(params.Get("type"))}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = params.Get("lastEventId")
+	}
+	var after uint64
+	if lastID != "" {
+		var err error
+		after, err = strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid last event id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	replay, events, cancel := d.Events.Subscribe(after, filter)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, e := range replay {
+		if writeEvent(w, e) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case e, ok := <-events:
+			// we fell behind, the client will resume from its last event
+			if !ok {
+				return
+			}
+			err = writeEvent(w, e)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes an event in the server-sent events format
+func writeEvent(w http.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// splitSet splits a comma separated list into a set, empty lists gives an empty set
+func splitSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
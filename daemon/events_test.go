@@ -0,0 +1,160 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBroker(t *testing.T) {
+	b := NewBroker(3)
+
+	first := b.Publish("lease-added", "192.168.1.2", nil)
+	b.Publish("flow-new", "192.168.1.3", nil)
+	b.Publish("flow-new", "192.168.1.2", nil)
+
+	// resuming after the first event replays the rest
+	replay, _, cancel := b.Subscribe(first.ID, EventFilter{})
+	cancel()
+	if len(replay) != 2 || replay[0].ID != first.ID+1 {
+		t.Fatalf("unexpected replay %+v", replay)
+	}
+
+	// with filters
+	replay, events, cancel := b.Subscribe(first.ID-1, EventFilter{Hosts: splitSet("192.168.1.2"), Types: splitSet("flow-new")})
+	defer cancel()
+	if len(replay) != 1 || replay[0].Host != "192.168.1.2" || replay[0].Type != "flow-new" {
+		t.Fatalf("unexpected filtered replay %+v", replay)
+	}
+
+	b.Publish("flow-new", "192.168.1.3", nil)
+	b.Publish("flow-new", "192.168.1.2", nil)
+	if e := <-events; e.Host != "192.168.1.2" {
+		t.Fatalf("filtered subscriber got %+v", e)
+	}
+
+	// the first event is forgotten by now
+	replay, _, cancel = b.Subscribe(first.ID, EventFilter{})
+	cancel()
+	if len(replay) != 4 || replay[0].Type != EventGap {
+		t.Fatalf("missed events was not reported as a gap: %+v", replay)
+	}
+
+	// new subscribers gets nothing old
+	replay, _, cancel = b.Subscribe(0, EventFilter{})
+	cancel()
+	if len(replay) != 0 {
+		t.Fatalf("new subscriber got old events: %+v", replay)
+	}
+}
+
+func TestBrokerDropsSlowSubscribers(t *testing.T) {
+	b := NewBroker(10)
+	_, events, cancel := b.Subscribe(0, EventFilter{})
+	defer cancel()
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		b.Publish("metrics", "192.168.1.2", nil)
+	}
+
+	n := 0
+	for range events {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Fatalf("slow subscriber received %d events before being dropped", n)
+	}
+}
+
+// Teststore9 has hosts which come and go
+type Teststore9 struct {
+	Teststore2
+	ips []net.IP
+}
+
+func (t *Teststore9) Addresses() ([]net.IP, error) {
+	return t.ips, nil
+}
+
+func TestPublishHosts(t *testing.T) {
+	store := &Teststore9{ips: []net.IP{net.ParseIP("192.168.1.2")}}
+	d := &Daemon{Events: NewBroker(10)}
+	d.AddStore(store)
+
+	_, events, cancel := d.Events.Subscribe(0, EventFilter{})
+	defer cancel()
+
+	hosts := d.publishHosts(nil)
+	store.ips = []net.IP{net.ParseIP("192.168.1.3")}
+	d.publishHosts(hosts)
+
+	appeared, disappeared := <-events, <-events
+	if appeared.Type == EventHostDisappeared {
+		appeared, disappeared = disappeared, appeared
+	}
+	if appeared.Type != EventHostAppeared || appeared.Host != "192.168.1.3" || disappeared.Host != "192.168.1.2" {
+		t.Fatalf("unexpected events %+v %+v", appeared, disappeared)
+	}
+}
+
+// readEvent reads a single server-sent event
+func readEvent(t *testing.T, r *bufio.Reader) Event {
+	e := Event{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unable to read event: %s", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" && e.Type != "" {
+			return e
+		}
+		if strings.HasPrefix(line, "data: ") {
+			err = json.Unmarshal([]byte(line[6:]), &e)
+			if err != nil {
+				t.Fatalf("unable to decode event: %s", err)
+			}
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	d := &Daemon{Events: NewBroker(10)}
+	server := httptest.NewServer(d.HTTPHandler())
+	defer server.Close()
+
+	first := d.Events.Publish("lease-added", "192.168.1.2", map[string]string{"mac": "aa"})
+	d.Events.Publish("flow-new", "192.168.1.2", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/events?type=lease-added,lease-expired", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(first.ID-1, 10))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", res.Header.Get("Content-Type"))
+	}
+
+	r := bufio.NewReader(res.Body)
+	if e := readEvent(t, r); e.ID != first.ID || e.Type != "lease-added" {
+		t.Fatalf("missed event was not replayed: %+v", e)
+	}
+
+	d.Events.Publish("flow-new", "192.168.1.2", nil)
+	expired := d.Events.Publish("lease-expired", "192.168.1.2", nil)
+	if e := readEvent(t, r); e.ID != expired.ID {
+		t.Fatalf("unexpected live event %+v", e)
+	}
+}
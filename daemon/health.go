@@ -0,0 +1,148 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fasmide/routerlogin/health"
+)
+
+// defaultMaxAge is used when Daemon.MaxAge is not set
+const defaultMaxAge = time.Minute
+
+// HealthReporter is implemented by stores which keeps track of refreshing their data
+type HealthReporter interface {
+	Health() health.State
+}
+
+// StoreHealth is the health of a single store
+type StoreHealth struct {
+	Name string `json:"name"`
+	health.State
+
+	Age     time.Duration `json:"age"`
+	MaxAge  time.Duration `json:"maxAge"`
+	Healthy bool          `json:"healthy"`
+}
+
+// HealthReport is the health of every store, the daemon is ready once every
+// store have been read and healthy while none of them are failing with stale data
+type HealthReport struct {
+	Ready   bool          `json:"ready"`
+	Healthy bool          `json:"healthy"`
+	Stores  []StoreHealth `json:"stores"`
+}
+
+// Health reports how every store is doing from the refreshes it keeps track of, without
+// refreshing anything itself. Stores are refreshed when clients, the history sampler or
+// the event stream ask for their data, and are unhealthy once their data is older than
+// their max age, whether their refreshes fail or never end. Stores never read are only
+// unhealthy when failing
+func (d *Daemon) Health() HealthReport {
+	report := HealthReport{Ready: true, Healthy: true}
+	now := time.Now()
+
+	for _, s := range d.stores {
+		h := StoreHealth{Name: storeName(s)}
+		if r, ok := s.(HealthReporter); ok {
+			h.State = r.Health()
+		} else {
+			// stores which does not keep track of themselves keeps their data in memory,
+			// and are judged by a call for it
+			start := time.Now()
+			_, err := s.Addresses()
+			t := health.Tracker{}
+			t.Record(start, err)
+			h.State = t.State()
+		}
+
+		h.Age = h.State.Age(now)
+		h.MaxAge = d.maxAge(h.Name)
+		h.Healthy = h.Age <= h.MaxAge && (h.State.Ready() || h.State.LastError == "")
+
+		report.Ready = report.Ready && h.State.Ready()
+		report.Healthy = report.Healthy && h.Healthy
+		report.Stores = append(report.Stores, h)
+	}
+
+	return report
+}
+
+// maxAge returns the staleness threshold of a store
+func (d *Daemon) maxAge(name string) time.Duration {
+	if age, found := d.MaxAges[name]; found {
+		return age
+	}
+	if d.MaxAge != 0 {
+		return d.MaxAge
+	}
+	return defaultMaxAge
+}
+
+// Healthy returns why the daemon is unhealthy, or nil
+func (d *Daemon) Healthy() error {
+	report := d.Health()
+	if report.Healthy {
+		return nil
+	}
+
+	problems := make([]string, 0)
+	for _, s := range report.Stores {
+		switch {
+		case s.Healthy:
+			continue
+		case !s.Ready():
+			problems = append(problems, fmt.Sprintf("%s was never read: %s", s.Name, s.LastError))
+		case s.LastError == "":
+			problems = append(problems, fmt.Sprintf("%s is %s old", s.Name, s.Age.Round(time.Second)))
+		default:
+			problems = append(problems, fmt.Sprintf("%s is %s old: %s", s.Name, s.Age.Round(time.Second), s.LastError))
+		}
+	}
+	return fmt.Errorf("%s", strings.Join(problems, ", "))
+}
+
+// storeName names a store by its type e.g. conntrack.StateStore
+func storeName(s Store) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", s), "*")
+}
+
+// healthCommand writes the health of every store
+func (d *Daemon) healthCommand(w io.Writer, _ []string) error {
+	report := d.Health()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "healthy: %t, ready: %t\n", report.Healthy, report.Ready)
+	fmt.Fprintln(tw, "store\tstatus\tlast success\tage\tmax age\tlatency\tlast error")
+	for _, s := range report.Stores {
+		status := "ok"
+		if !s.Healthy {
+			status = "unhealthy"
+		}
+		success := "never"
+		if s.Ready() {
+			success = s.LastSuccess.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Name, status, success,
+			s.Age.Round(time.Millisecond), s.MaxAge, s.Latency.Round(time.Microsecond), s.LastError)
+	}
+	return tw.Flush()
+}
+
+// healthHandler serves the health report, with 503 when check fails
+func (d *Daemon) healthHandler(check func(HealthReport) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := d.Health()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !check(report) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
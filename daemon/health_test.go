@@ -0,0 +1,135 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasmide/routerlogin/health"
+)
+
+// Teststore6 reports a given refresh state
+type Teststore6 struct {
+	Teststore2
+	state     health.State
+	err       error
+	refreshes int
+}
+
+func (t *Teststore6) Addresses() ([]net.IP, error) {
+	t.refreshes++
+	return nil, t.err
+}
+
+func (t *Teststore6) Health() health.State {
+	return t.state
+}
+
+func TestHealth(t *testing.T) {
+	fresh := &Teststore6{state: health.State{LastSuccess: time.Now(), Latency: time.Millisecond}}
+	d := &Daemon{}
+	d.AddStore(fresh, &Teststore1{})
+
+	report := d.Health()
+	if !report.Healthy || !report.Ready || len(report.Stores) != 2 {
+		t.Fatalf("fresh stores was not healthy: %+v", report)
+	}
+	if report.Stores[0].Name != "daemon.Teststore6" || report.Stores[1].Name != "daemon.Teststore1" {
+		t.Fatalf("stores was not named by their type: %+v", report.Stores)
+	}
+	if err := d.Healthy(); err != nil {
+		t.Fatalf("healthy daemon reported %s", err)
+	}
+
+	// stale data is unhealthy, but still ready
+	fresh.state.LastSuccess = time.Now().Add(-2 * time.Minute)
+	fresh.state.LastError = "conntrack error"
+	report = d.Health()
+	if report.Healthy || !report.Ready {
+		t.Fatalf("stale store was healthy: %+v", report)
+	}
+	if err := d.Healthy(); err == nil || !strings.Contains(err.Error(), "conntrack error") {
+		t.Fatalf("stale store did not report its error: %v", err)
+	}
+
+	// as is stale data of a store whose refresh never ended
+	fresh.state.LastError = ""
+	if err := d.Healthy(); err == nil || !strings.HasSuffix(err.Error(), "2m0s old") {
+		t.Fatalf("stale store without errors was healthy: %v", err)
+	}
+
+	// unless the store is allowed to be that old
+	d.MaxAges = map[string]time.Duration{"daemon.Teststore6": 5 * time.Minute}
+	if report = d.Health(); !report.Healthy {
+		t.Fatalf("threshold of store was not used: %+v", report)
+	}
+
+	// stores never read successfully are not ready
+	d.AddStore(&Teststore6{err: errors.New("broken")})
+	if report = d.Health(); report.Ready {
+		t.Fatalf("store never read was ready: %+v", report)
+	}
+
+	// stores keeping track of their refreshes are only observed
+	if fresh.refreshes != 0 {
+		t.Fatalf("health refreshed a store %d times", fresh.refreshes)
+	}
+}
+
+func TestHealthCommand(t *testing.T) {
+	d := &Daemon{}
+	d.AddStore(&Teststore6{state: health.State{LastError: "no such file"}})
+
+	res := command(t, d, "health\n")
+	if !strings.HasPrefix(res, "healthy: false, ready: false\n") || !strings.Contains(res, "daemon.Teststore6  unhealthy  never") || !strings.Contains(res, "no such file") {
+		t.Fatalf("unexpected health output:\n%s", res)
+	}
+}
+
+func TestHealthHTTP(t *testing.T) {
+	store := &Teststore6{}
+	d := &Daemon{}
+	d.AddStore(store)
+	h := d.HTTPHandler()
+
+	get := func(path string) (int, HealthReport) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		report := HealthReport{}
+		err := json.Unmarshal(rec.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatalf("unable to decode %s: %s", path, err)
+		}
+		return rec.Code, report
+	}
+
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz was expected to fail before the first refresh, got %d", code)
+	}
+
+	store.state.LastSuccess = time.Now().Add(-2 * time.Minute)
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz was expected to pass after a refresh, got %d", code)
+	}
+
+	// a refresh which never ends fails nothing, the data still gets stale
+	if code, report := get("/healthz"); code != http.StatusServiceUnavailable || report.Stores[0].LastError != "" {
+		t.Fatalf("healthz was expected to fail on stale data without errors, got %d %+v", code, report)
+	}
+
+	store.state.LastError = "conntrack error"
+	if code, report := get("/healthz"); code != http.StatusServiceUnavailable || report.Stores[0].Age < 2*time.Minute {
+		t.Fatalf("healthz was expected to fail on stale data, got %d %+v", code, report)
+	}
+
+	store.state.LastSuccess = time.Now()
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz was expected to pass, got %d", code)
+	}
+}
@@ -0,0 +1,215 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasmide/routerlogin/history"
+)
+
+// MetricStore is implemented by stores having numbers worth keeping history of,
+// stores without it have their Data values sampled when they are numbers
+type MetricStore interface {
+	Metrics(ip string) (map[string]float64, error)
+}
+
+// Sample adds the metrics of every host to the history, stores failing for a host are
+// logged and left out of its sample
+func (d *Daemon) Sample(now time.Time) error {
+	if d.History == nil {
+		return fmt.Errorf("history is not enabled")
+	}
+
+	c := Collector{Stores: d.stores}
+	for _, ip := range c.addresses() {
+		all := make(map[string]float64)
+		for _, s := range d.stores {
+			metrics, err := storeMetrics(s, ip)
+			if err != nil {
+				log.Printf("daemon: unable to sample %T for %s: %s", s, ip, err)
+				continue
+			}
+			for name, v := range metrics {
+				all[name] = v
+			}
+		}
+
+		for name, v := range all {
+			d.History.Add(now, ip, name, v)
+		}
+		if d.Events != nil && len(all) > 0 {
+			d.Events.Publish(EventMetrics, ip, all)
+		}
+	}
+
+	d.History.Prune(now.Add(-d.History.Retention()))
+	return nil
+}
+
+// storeMetrics returns the metrics of a store
+func storeMetrics(s Store, ip string) (map[string]float64, error) {
+	if m, ok := s.(MetricStore); ok {
+		return m.Metrics(ip)
+	}
+
+	data, err := s.Data(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make(map[string]float64)
+	for name, value := range data {
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			metrics[name] = v
+		}
+	}
+	return metrics, nil
+}
+
+// RunSampler samples every interval until ctx is done
+func (d *Daemon) RunSampler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := d.Sample(now)
+			if err != nil {
+				log.Printf("daemon: %s", err)
+			}
+		}
+	}
+}
+
+// historyQuery is a query for a single series
+type historyQuery struct {
+	Host   string
+	Metric string
+	From   time.Time
+	To     time.Time
+
+	// Rate turns counters into their change per second
+	Rate bool
+}
+
+// points answers the query
+func (q historyQuery) points(h *history.History) []history.Point {
+	points := h.Query(q.Host, q.Metric, q.From, q.To)
+	if q.Rate {
+		return history.Rate(points)
+	}
+	return points
+}
+
+// historyCommand lists hosts, metrics of a host, or points of a metric
+// history
+// history <ip>
+// history <ip> <metric> [duration] [rate]
+func (d *Daemon) historyCommand(w io.Writer, args []string) error {
+	if d.History == nil {
+		return fmt.Errorf("history is not enabled")
+	}
+
+	switch len(args) {
+	case 0:
+		_, err := fmt.Fprintln(w, strings.Join(d.History.Hosts(), "\n"))
+		return err
+	case 1:
+		_, err := fmt.Fprintln(w, strings.Join(d.History.Metrics(args[0]), "\n"))
+		return err
+	}
+
+	q := historyQuery{Host: args[0], Metric: args[1], To: time.Now()}
+	since := time.Hour
+	for _, arg := range args[2:] {
+		if arg == "rate" {
+			q.Rate = true
+			continue
+		}
+		var err error
+		since, err = time.ParseDuration(arg)
+		if err != nil {
+			return fmt.Errorf("usage: history <ip> <metric> [duration] [rate]: %s", err)
+		}
+	}
+	q.From = q.To.Add(-since)
+
+	for _, p := range q.points(d.History) {
+		_, err := fmt.Fprintf(w, "%s %s\n", p.Time.Format(time.RFC3339), strconv.FormatFloat(p.Value, 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyHandler serves the history as json, with the same choices as the history command:
+// /api/history lists hosts, ?host= lists its metrics and ?host=&metric= returns points.
+// The time range is given by since=<duration>, defaulting to an hour, or from= and to= in
+// RFC3339, and rate=true turns counters into their change per second
+func (d *Daemon) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if d.History == nil {
+		http.Error(w, "history is not enabled", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	q := historyQuery{Host: params.Get("host"), Metric: params.Get("metric"), To: time.Now()}
+
+	var res interface{}
+	switch {
+	case q.Host == "":
+		res = d.History.Hosts()
+	case q.Metric == "":
+		res = d.History.Metrics(q.Host)
+	default:
+		var err error
+		q.From, q.To, err = parseRange(params.Get("since"), params.Get("from"), params.Get("to"), q.To)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Rate = params.Get("rate") == "true"
+		res = q.points(d.History)
+	}
+
+	writeJSON(w, res)
+}
+
+// parseRange parses a time range given by either since or from and to
+func parseRange(since, from, to string, now time.Time) (time.Time, time.Time, error) {
+	end := now
+	var err error
+	if to != "" {
+		end, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return end, end, fmt.Errorf("invalid to: %s", err)
+		}
+	}
+
+	if from != "" {
+		start, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid from: %s", err)
+		}
+		return start, end, nil
+	}
+
+	d := time.Hour
+	if since != "" {
+		d, err = time.ParseDuration(since)
+		if err != nil {
+			return end, end, fmt.Errorf("invalid since: %s", err)
+		}
+	}
+	return end.Add(-d), end, nil
+}
@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasmide/routerlogin/history"
+)
+
+// Teststore7 has metrics of its own, failing for a given host
+type Teststore7 struct {
+	Teststore2
+	bytes float64
+	fail  string
+}
+
+func (t *Teststore7) Metrics(ip string) (map[string]float64, error) {
+	if ip == t.fail {
+		return nil, fmt.Errorf("no metrics for %s", ip)
+	}
+	return map[string]float64{"bytesIn": t.bytes}, nil
+}
+
+func TestSample(t *testing.T) {
+	metrics := &Teststore7{}
+	d := &Daemon{History: history.New(history.DefaultTiers)}
+	d.AddStore(&Teststore1{}, metrics)
+
+	now := time.Now().Add(-time.Minute)
+	for i := 0; i < 3; i++ {
+		metrics.bytes = float64(i * 1000)
+		err := d.Sample(now.Add(time.Duration(i) * 10 * time.Second))
+		if err != nil {
+			t.Fatalf("unable to sample: %s", err)
+		}
+	}
+
+	if hosts := d.History.Hosts(); !reflect.DeepEqual(hosts, []string{"127.0.0.1", "127.0.0.2"}) {
+		t.Fatalf("unexpected hosts %+v", hosts)
+	}
+
+	// numeric data of stores without metrics are sampled as well
+	if m := d.History.Metrics("127.0.0.1"); !reflect.DeepEqual(m, []string{"bytesIn", "something"}) {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+
+	res := command(t, d, "history 127.0.0.1 bytesIn 1h rate\n")
+	if strings.Count(res, " 100\n") != 2 {
+		t.Fatalf("unexpected rates:\n%s", res)
+	}
+
+	rec := httptest.NewRecorder()
+	d.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/history?host=127.0.0.1&metric=bytesIn&since=10m", nil))
+	points := []history.Point{}
+	err := json.Unmarshal(rec.Body.Bytes(), &points)
+	if err != nil {
+		t.Fatalf("unable to decode response: %s", err)
+	}
+	if len(points) != 3 || points[2].Value != 2000 {
+		t.Fatalf("unexpected points %+v", points)
+	}
+
+	rec = httptest.NewRecorder()
+	d.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/history?host=127.0.0.1&metric=bytesIn&since=soon", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid range was accepted: %d", rec.Code)
+	}
+}
+
+func TestSampleFailingStore(t *testing.T) {
+	d := &Daemon{History: history.New(history.DefaultTiers)}
+	d.AddStore(&Teststore1{}, &Teststore7{bytes: 1000, fail: "127.0.0.1"})
+
+	err := d.Sample(time.Now())
+	if err != nil {
+		t.Fatalf("a failing store failed the sample: %s", err)
+	}
+
+	// the failing store is skipped for its host, other stores and hosts are still sampled
+	if m := d.History.Metrics("127.0.0.1"); !reflect.DeepEqual(m, []string{"something"}) {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+	if m := d.History.Metrics("127.0.0.2"); !reflect.DeepEqual(m, []string{"bytesIn", "something"}) {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+}
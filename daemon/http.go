@@ -0,0 +1,24 @@
+package daemon
+
+import (
+	"net/http"
+)
+
+// HTTPHandler returns the http interface of the daemon:
+// /healthz answers 200 while every store is healthy, 503 otherwise
+// /readyz answers 200 once every store have been read, 503 before
+// /api/history answers history queries, see historyHandler
+// /api/table is the host table and /api/hosts/{ip} a single host with store details
+// /api/events streams events, see eventsHandler
+// / is the dashboard
+func (d *Daemon) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /healthz", d.healthHandler(func(r HealthReport) bool { return r.Healthy }))
+	mux.Handle("GET /readyz", d.healthHandler(func(r HealthReport) bool { return r.Ready }))
+	mux.HandleFunc("GET /api/history", d.historyHandler)
+	mux.HandleFunc("GET /api/table", d.tableHandler)
+	mux.HandleFunc("GET /api/hosts/{ip}", d.hostHandler)
+	mux.HandleFunc("GET /api/events", d.eventsHandler)
+	mux.Handle("GET /", dashboardHandler())
+	return mux
+}
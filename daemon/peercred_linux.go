@@ -0,0 +1,28 @@
+package daemon
+
+import (
+	"net"
+	"syscall"
+)
+
+// PeerCredentials returns the credentials of the process which connected a unix socket
+func PeerCredentials(c *net.UnixConn) (Credentials, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+	if credErr != nil {
+		return Credentials{}, credErr
+	}
+
+	return Credentials{UID: int(ucred.Uid), GID: int(ucred.Gid), PID: int(ucred.Pid)}, nil
+}
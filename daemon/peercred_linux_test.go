@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// unixPair returns both ends of a unix socket connection
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	l, err := UnixSocket{Path: filepath.Join(t.TempDir(), "test.sock")}.Listen()
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %s", err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.UnixConn), server.(*net.UnixConn)
+}
+
+func TestPeerCredentials(t *testing.T) {
+	_, server := unixPair(t)
+
+	creds, err := PeerCredentials(server)
+	if err != nil {
+		t.Fatalf("unable to read peer credentials: %s", err)
+	}
+	if creds.UID != os.Getuid() || creds.GID != os.Getgid() || creds.PID != os.Getpid() {
+		t.Fatalf("unexpected credentials %+v", creds)
+	}
+
+	// we are allowed to read as ourself, and root is admin no matter what
+	a := &PeerCredAuthorizer{ReadUIDs: []int{os.Getuid()}}
+	role, err := a.Authorize(server)
+	if err != nil {
+		t.Fatalf("unable to authorize: %s", err)
+	}
+	if expected := map[bool]Role{true: RoleAdmin, false: RoleRead}[os.Getuid() == 0]; role != expected {
+		t.Fatalf("role was expected to be %s, was %s", expected, role)
+	}
+
+	if os.Getuid() != 0 {
+		a = &PeerCredAuthorizer{}
+		_, err = a.Authorize(server)
+		if err == nil {
+			t.Fatalf("connection was authorized without being allowed")
+		}
+	}
+
+	d := Daemon{Authorizer: a}
+	_, err = d.authorize(&MockListener{}, &MockConn{})
+	if err == nil {
+		t.Fatalf("a connection which is not a unix socket was authorized")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+)
+
+// PeerCredentials is only available on linux
+func PeerCredentials(c *net.UnixConn) (Credentials, error) {
+	return Credentials{}, fmt.Errorf("peer credentials are not supported on this platform")
+}
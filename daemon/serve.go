@@ -0,0 +1,145 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultShutdownTimeout is used when Daemon.ShutdownTimeout is not set
+const defaultShutdownTimeout = 10 * time.Second
+
+// Reloader is implemented by stores which can reread their configuration or data
+type Reloader interface {
+	Reload() error
+}
+
+// Serve accepts connections on every listener until ctx is cancelled or a listener fails.
+// When stopping the listeners are closed, which also removes unix socket files, clients
+// being served are given ShutdownTimeout to finish. Stores running in the background stop
+// with the context they were started with
+func (d *Daemon) Serve(ctx context.Context, listeners ...net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// conns are the connections being served, so they can be cut off if they take too long
+	var connsLock sync.Mutex
+	conns := make(map[net.Conn]struct{})
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- d.acceptLoop(ctx, l, func(c net.Conn, done bool) {
+				connsLock.Lock()
+				defer connsLock.Unlock()
+				if done {
+					delete(conns, c)
+				} else {
+					conns[c] = struct{}{}
+				}
+			})
+			cancel()
+		}(l)
+	}
+
+	<-ctx.Done()
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	// the first error tells why we stopped, listeners closed by us are not errors
+	var err error
+	for range listeners {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	// commands still running after being cut off are not waited for, they could take forever
+	if !d.drain() {
+		connsLock.Lock()
+		log.Printf("daemon: cutting off %d clients which did not finish in time", len(conns))
+		for c := range conns {
+			c.Close()
+		}
+		connsLock.Unlock()
+	}
+
+	return err
+}
+
+// acceptLoop accepts connections from l until it is closed, track is told about
+// connections when they start and when they are done
+func (d *Daemon) acceptLoop(ctx context.Context, l net.Listener, track func(c net.Conn, done bool)) error {
+	delay := 5 * time.Millisecond
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			// running out of file descriptors or clients giving up early might pass
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED) {
+				log.Printf("daemon: accept error: %s, retrying in %s", err, delay)
+				time.Sleep(delay)
+				delay = min(delay*2, time.Second)
+				continue
+			}
+			return err
+		}
+		delay = 5 * time.Millisecond
+
+		d.conns.Add(1)
+		track(c, false)
+		go func() {
+			defer d.conns.Done()
+			defer track(c, true)
+			d.handleConn(l, c)
+		}()
+	}
+}
+
+// drain waits for clients being served and reports if they all finished in time
+func (d *Daemon) drain() bool {
+	timeout := d.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// SetAuthorizer replaces the authorizer, connections already accepted keeps their role
+func (d *Daemon) SetAuthorizer(a Authorizer) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.Authorizer = a
+}
+
+// Reload reloads every store implementing Reloader, the listeners are left alone
+func (d *Daemon) Reload() error {
+	var errs []error
+	for _, s := range d.stores {
+		if r, ok := s.(Reloader); ok {
+			errs = append(errs, r.Reload())
+		}
+	}
+	return errors.Join(errs...)
+}
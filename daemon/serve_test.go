@@ -0,0 +1,189 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Teststore5 is slow to answer, and records being reloaded
+type Teststore5 struct {
+	Teststore1
+	delay    time.Duration
+	reloaded int
+}
+
+func (t *Teststore5) Commands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"slow": func(w io.Writer, args []string) error {
+			time.Sleep(t.delay)
+			_, err := io.WriteString(w, "finally")
+			return err
+		},
+	}
+}
+
+func (t *Teststore5) Reload() error {
+	t.reloaded++
+	if t.reloaded > 1 {
+		return errors.New("reloaded too much")
+	}
+	return nil
+}
+
+// serve starts serving a unix socket in a temporary directory
+func serve(t *testing.T, d *Daemon) (string, context.CancelFunc, chan error) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	l, err := UnixSocket{Path: path}.Listen()
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Serve(ctx, Commands(l))
+	}()
+	return path, cancel, done
+}
+
+// dialCommand sends a command to a unix socket and returns a channel with the response
+func dialCommand(t *testing.T, path, cmd string) chan string {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	_, err = io.WriteString(c, cmd)
+	if err != nil {
+		t.Fatalf("unable to send command: %s", err)
+	}
+
+	res := make(chan string, 1)
+	go func() {
+		defer c.Close()
+		data, _ := io.ReadAll(c)
+		res <- string(data)
+	}()
+	return res
+}
+
+func TestServeDrains(t *testing.T) {
+	store := &Teststore5{delay: 200 * time.Millisecond}
+	d := &Daemon{}
+	d.AddStore(store)
+
+	path, cancel, done := serve(t, d)
+	res := dialCommand(t, path, "slow\n")
+
+	// give the daemon a moment to start the command before stopping
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if r := <-res; r != "finally" {
+		t.Fatalf("client was cut off during shutdown: %s", r)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("serve failed: %s", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file was not removed: %v", err)
+	}
+}
+
+func TestServeTimeout(t *testing.T) {
+	store := &Teststore5{delay: time.Second}
+	d := &Daemon{ShutdownTimeout: 50 * time.Millisecond}
+	d.AddStore(store)
+
+	path, cancel, done := serve(t, d)
+	res := dialCommand(t, path, "slow\n")
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("serve failed: %s", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("serve waited %s for a client past its timeout", time.Since(start))
+	}
+	if r := <-res; strings.Contains(r, "finally") {
+		t.Fatalf("slow client was not cut off: %s", r)
+	}
+}
+
+func TestReload(t *testing.T) {
+	store := &Teststore5{}
+	d := &Daemon{}
+	d.AddStore(store, &Teststore2{})
+
+	path, cancel, done := serve(t, d)
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := d.Reload(); err != nil || store.reloaded != 1 {
+		t.Fatalf("store was not reloaded: %v", err)
+	}
+	if err := d.Reload(); err == nil {
+		t.Fatalf("reload error was not reported")
+	}
+
+	// reloading leaves the listener alone
+	if r := <-dialCommand(t, path, "table\n"); !strings.Contains(r, "127.0.0.1") {
+		t.Fatalf("daemon stopped serving after reload: %s", r)
+	}
+
+	d.SetAuthorizer(&PeerCredAuthorizer{groups: func(int) []int { return nil }})
+	if os.Getuid() != 0 {
+		if r := <-dialCommand(t, path, "table\n"); r != "" {
+			t.Fatalf("new authorizer was not used: %s", r)
+		}
+	}
+}
+
+func TestPlainClients(t *testing.T) {
+	d := &Daemon{}
+	d.AddStore(&Teststore1{})
+
+	path := filepath.Join(t.TempDir(), "test.sock")
+	l, err := UnixSocket{Path: path}.Listen()
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Serve(ctx, l)
+	}()
+
+	// clients of plain sockets which sends nothing are not kept waiting for a command
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	start := time.Now()
+	data, _ := io.ReadAll(c)
+	c.Close()
+	if time.Since(start) >= commandTimeout || !strings.Contains(string(data), "127.0.0.1") {
+		t.Fatalf("plain client got %q after %s", data, time.Since(start))
+	}
+
+	// and commands sent to them are not run
+	if r := <-dialCommand(t, path, "health\n"); !strings.Contains(r, "127.0.0.1") {
+		t.Fatalf("plain socket ran a command: %s", r)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("serve failed: %s", err)
+	}
+}
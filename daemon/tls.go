@@ -0,0 +1,167 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout is how long clients have to complete the tls handshake
+const handshakeTimeout = 10 * time.Second
+
+// TLSServer serves the daemon over tls, its certificates can be reloaded without
+// restarting the listeners using them
+type TLSServer struct {
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile enables mutual tls, clients must then present a certificate signed by one of its CAs
+	ClientCAFile string
+
+	// Roles maps client certificate common names to roles, use SetRoles to change them while serving
+	Roles map[string]Role
+
+	// DefaultRole is given to clients not found in Roles, which is every client without mutual tls
+	DefaultRole Role
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// Reload reads the certificates from disk, new connections uses them right away
+func (s *TLSServer) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load server certificate: %s", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if s.ClientCAFile != "" {
+		pem, err := os.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("unable to load client CA: %s", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", s.ClientCAFile)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cert = &cert
+	s.clientCAs = clientCAs
+
+	return nil
+}
+
+// SetRoles replaces Roles and DefaultRole
+func (s *TLSServer) SetRoles(roles map[string]Role, defaultRole Role) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Roles = roles
+	s.DefaultRole = defaultRole
+}
+
+// Listen loads the certificates and listens for tls connections on given tcp address
+func (s *TLSServer) Listen(address string) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	tl, err := s.Wrap(l)
+	if err != nil {
+		l.Close()
+	}
+	return tl, err
+}
+
+// Wrap loads the certificates and serves tls on an existing listener, e.g. one passed by systemd
+func (s *TLSServer) Wrap(l net.Listener) (net.Listener, error) {
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: s.configForClient,
+	}
+
+	return &tlsListener{Listener: tls.NewListener(l, config), server: s}, nil
+}
+
+// configForClient hands out the certificates currently loaded
+func (s *TLSServer) configForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*s.cert},
+	}
+	if s.clientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = s.clientCAs
+	}
+	return config, nil
+}
+
+// Authorize completes the handshake and returns the role of the client certificate
+func (s *TLSServer) Authorize(c net.Conn) (Role, error) {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return RoleNone, fmt.Errorf("connection from %s is not tls", c.RemoteAddr())
+	}
+
+	err := tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return RoleNone, err
+	}
+	err = tc.Handshake()
+	if err != nil {
+		return RoleNone, fmt.Errorf("tls handshake with %s failed: %s", c.RemoteAddr(), err)
+	}
+	err = tc.SetDeadline(time.Time{})
+	if err != nil {
+		return RoleNone, err
+	}
+
+	name := ""
+	s.lock.RLock()
+	role := s.DefaultRole
+	if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+		name = certs[0].Subject.CommonName
+		if r, found := s.Roles[name]; found {
+			role = r
+		}
+	}
+	s.lock.RUnlock()
+
+	if role == RoleNone {
+		return RoleNone, fmt.Errorf("certificate \"%s\" from %s is not allowed", name, c.RemoteAddr())
+	}
+	return role, nil
+}
+
+// tlsListener authorizes its own connections by their certificates
+type tlsListener struct {
+	net.Listener
+	server *TLSServer
+}
+
+// Authorize lets the server authorize the connection
+func (l *tlsListener) Authorize(c net.Conn) (Role, error) {
+	return l.server.Authorize(c)
+}
+
+// AcceptsCommands reports that tls clients may send commands, there are no plain tls clients to keep waiting
+func (l *tlsListener) AcceptsCommands() bool {
+	return true
+}
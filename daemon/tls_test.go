@@ -0,0 +1,256 @@
+package daemon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is an ephemeral certificate and its key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issue creates a certificate signed by parent, or a self signed CA when parent is nil
+func issue(t *testing.T, parent *testCert, cn string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("unable to generate serial: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unable to parse certificate: %s", err)
+	}
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key as pem files and returns their paths
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	key, err := x509.MarshalPKCS8PrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %s", err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err == nil {
+		err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	}
+	if err != nil {
+		t.Fatalf("unable to write certificate: %s", err)
+	}
+	return certPath, keyPath
+}
+
+// tlsCertificate returns the certificate for use by a tls client
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// tlsFixture is a daemon listening for tls on loopback
+type tlsFixture struct {
+	daemon   *Daemon
+	server   *TLSServer
+	listener net.Listener
+	ca       *testCert
+	roots    *x509.CertPool
+	dir      string
+}
+
+func newTLSFixture(t *testing.T, clientCA bool) *tlsFixture {
+	dir := t.TempDir()
+	ca := issue(t, nil, "test ca")
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := issue(t, ca, "routerlogin").write(t, dir, "server")
+
+	server := &TLSServer{
+		CertFile:    certPath,
+		KeyFile:     keyPath,
+		Roles:       map[string]Role{"monitor": RoleRead, "ops": RoleAdmin},
+		DefaultRole: RoleRead,
+	}
+	if clientCA {
+		server.ClientCAFile = caPath
+		server.DefaultRole = RoleNone
+	}
+
+	l, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	d := &Daemon{}
+	d.AddStore(&Teststore4{})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	return &tlsFixture{daemon: d, server: server, listener: l, ca: ca, roots: roots, dir: dir}
+}
+
+// command connects with an optional client certificate and sends a command
+func (f *tlsFixture) command(t *testing.T, client *testCert, cmd string) (string, error) {
+	go func() {
+		c, err := f.listener.Accept()
+		if err != nil {
+			t.Errorf("unable to accept: %s", err)
+			return
+		}
+		f.daemon.handleConn(f.listener, c)
+	}()
+
+	config := &tls.Config{RootCAs: f.roots}
+	if client != nil {
+		config.Certificates = []tls.Certificate{client.tlsCertificate()}
+	}
+
+	c, err := tls.Dial("tcp", f.listener.Addr().String(), config)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	_, err = io.WriteString(c, cmd)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := io.ReadAll(c)
+	return string(data), err
+}
+
+func TestTLS(t *testing.T) {
+	f := newTLSFixture(t, false)
+
+	res, err := f.command(t, nil, "echo hello\n")
+	if err != nil || res != "hello" {
+		t.Fatalf("echo over tls failed: %s %v", res, err)
+	}
+
+	res, err = f.command(t, nil, "reset\n")
+	if err != nil || !strings.HasPrefix(res, "permission denied") {
+		t.Fatalf("client without certificate ran admin command: %s %v", res, err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	f := newTLSFixture(t, true)
+
+	res, err := f.command(t, issue(t, f.ca, "ops"), "reset\n")
+	if err != nil || res != "done" {
+		t.Fatalf("admin certificate could not run admin command: %s %v", res, err)
+	}
+
+	res, err = f.command(t, issue(t, f.ca, "monitor"), "reset\n")
+	if err != nil || !strings.HasPrefix(res, "permission denied") {
+		t.Fatalf("read only certificate ran admin command: %s %v", res, err)
+	}
+
+	// known to the ca, but not given a role
+	res, _ = f.command(t, issue(t, f.ca, "stranger"), "echo hello\n")
+	if res != "" {
+		t.Fatalf("certificate without role was served: %s", res)
+	}
+
+	// not signed by the ca
+	res, _ = f.command(t, issue(t, issue(t, nil, "other ca"), "ops"), "echo hello\n")
+	if res != "" {
+		t.Fatalf("untrusted certificate was served: %s", res)
+	}
+
+	res, _ = f.command(t, nil, "echo hello\n")
+	if res != "" {
+		t.Fatalf("client without certificate was served: %s", res)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	f := newTLSFixture(t, false)
+
+	issue(t, f.ca, "reloaded").write(t, f.dir, "server")
+	err := f.server.Reload()
+	if err != nil {
+		t.Fatalf("unable to reload: %s", err)
+	}
+
+	var seen string
+	go func() {
+		c, err := f.listener.Accept()
+		if err == nil {
+			f.daemon.handleConn(f.listener, c)
+		}
+	}()
+	c, err := tls.Dial("tcp", f.listener.Addr().String(), &tls.Config{
+		RootCAs: f.roots,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			seen = state.PeerCertificates[0].Subject.CommonName
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to connect after reload: %s", err)
+	}
+	c.Close()
+
+	if seen != "reloaded" {
+		t.Fatalf("server certificate was not reloaded, got %s", seen)
+	}
+
+	// a broken certificate leaves the loaded one in place
+	err = os.WriteFile(f.server.CertFile, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+	if f.server.Reload() == nil {
+		t.Fatalf("broken certificate was loaded")
+	}
+	res, err := f.command(t, nil, "echo still\n")
+	if err != nil || res != "still" {
+		t.Fatalf("server stopped working after failed reload: %s %v", res, err)
+	}
+}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// UnixSocket describes a unix socket to listen on
+type UnixSocket struct {
+	Path string
+
+	// Owner and Group of the socket file as names or numeric ids, empty leaves them as they are
+	Owner string
+	Group string
+
+	// Mode of the socket file, defaults to 0660
+	Mode os.FileMode
+}
+
+// Listen creates the socket, its directory is created if missing and must not be
+// writable by others, as they could then replace the socket with their own
+func (u UnixSocket) Listen() (net.Listener, error) {
+	dir := filepath.Dir(u.Path)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("refusing to create socket in %s which is writable by others (%s)", dir, info.Mode().Perm())
+	}
+
+	// a socket left behind by an earlier run would make listen fail
+	if info, err := os.Lstat(u.Path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", u.Path)
+		}
+		err = os.Remove(u.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", u.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := u.Mode
+	if mode == 0 {
+		mode = 0660
+	}
+
+	err = os.Chmod(u.Path, mode)
+	if err == nil && (u.Owner != "" || u.Group != "") {
+		err = u.chown()
+	}
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("unable to set permissions of %s: %s", u.Path, err)
+	}
+
+	return l, nil
+}
+
+// chown changes the owner and group of the socket file
+func (u UnixSocket) chown() error {
+	uid, gid := -1, -1
+
+	if u.Owner != "" {
+		ids, err := LookupUsers([]string{u.Owner})
+		if err != nil {
+			return err
+		}
+		uid = ids[0]
+	}
+	if u.Group != "" {
+		ids, err := LookupGroups([]string{u.Group})
+		if err != nil {
+			return err
+		}
+		gid = ids[0]
+	}
+
+	return os.Chown(u.Path, uid, gid)
+}
@@ -0,0 +1,247 @@
+// the dashboard only uses the daemon's own api, so it shows exactly what the socket table shows
+"use strict";
+
+const main = document.getElementById("main");
+const search = document.getElementById("search");
+
+// sort is the column the table is sorted by, and its direction
+let sort = { column: "ip", desc: false };
+let refresh = null;
+let stream = null;
+
+// el creates an element with text or children
+function el(tag, content, attrs) {
+	const e = document.createElement(tag);
+	for (const [k, v] of Object.entries(attrs || {})) {
+		e.setAttribute(k, v);
+	}
+	if (Array.isArray(content)) {
+		content.forEach((c) => e.appendChild(c));
+	} else if (content !== undefined && content !== null) {
+		e.textContent = content;
+	}
+	return e;
+}
+
+async function api(path) {
+	const res = await fetch(path);
+	if (!res.ok) {
+		throw new Error(path + ": " + (await res.text()));
+	}
+	return res.json();
+}
+
+function showError(err) {
+	main.replaceChildren(el("p", err.message, { class: "error" }));
+}
+
+// compare compares numbers as numbers and everything else as text
+function compare(a, b) {
+	const x = parseFloat(a), y = parseFloat(b);
+	if (!isNaN(x) && !isNaN(y) && String(x) === a && String(y) === b) {
+		return x - y;
+	}
+	if (/^[\d.]+$/.test(a) && /^[\d.]+$/.test(b)) {
+		// ipv4 addresses sorts by their octets
+		const pa = a.split(".").map(Number), pb = b.split(".").map(Number);
+		for (let i = 0; i < Math.max(pa.length, pb.length); i++) {
+			if ((pa[i] || 0) !== (pb[i] || 0)) {
+				return (pa[i] || 0) - (pb[i] || 0);
+			}
+		}
+		return 0;
+	}
+	return (a || "").localeCompare(b || "");
+}
+
+async function showTable() {
+	let table;
+	try {
+		table = await api("api/table");
+	} catch (err) {
+		return showError(err);
+	}
+
+	const column = table.headers.indexOf(sort.column);
+	const needle = search.value.toLowerCase();
+	const rows = table.rows
+		.filter((row) => !needle || row.some((v) => (v || "").toLowerCase().includes(needle)))
+		.sort((a, b) => (sort.desc ? -1 : 1) * compare(a[column], b[column]));
+
+	const head = el("tr", table.headers.map((h) => {
+		const th = el("th", h);
+		if (h === sort.column) {
+			th.className = sort.desc ? "desc" : "asc";
+		}
+		th.onclick = () => {
+			sort = { column: h, desc: h === sort.column ? !sort.desc : false };
+			showTable();
+		};
+		return th;
+	}));
+
+	const ip = table.headers.indexOf("ip");
+	const body = rows.map((row) => {
+		const tr = el("tr", table.headers.map((_, i) => el("td", row[i])));
+		tr.onclick = () => { location.hash = "#/host/" + row[ip]; };
+		return tr;
+	});
+
+	main.replaceChildren(el("table", [el("thead", [head]), el("tbody", body)]));
+}
+
+// chart draws series of points as an svg line chart
+function chart(series, title) {
+	const width = 800, height = 200, pad = 40;
+	const ns = "http://www.w3.org/2000/svg";
+	const svg = document.createElementNS(ns, "svg");
+	svg.setAttribute("viewBox", `0 0 ${width} ${height}`);
+	svg.setAttribute("class", "chart");
+	svg.setAttribute("width", "100%");
+
+	const all = series.flatMap((s) => s.points);
+	if (all.length === 0) {
+		return el("p", title + ": no history yet");
+	}
+
+	const times = all.map((p) => new Date(p.time).getTime());
+	const t0 = Math.min(...times), t1 = Math.max(...times) || t0 + 1;
+	const max = Math.max(...all.map((p) => p.value), 1);
+	const x = (t) => pad + (t - t0) / Math.max(t1 - t0, 1) * (width - 2 * pad);
+	const y = (v) => height - pad / 2 - v / max * (height - pad);
+
+	for (const s of series) {
+		const d = s.points.map((p, i) => (i ? "L" : "M") + x(new Date(p.time).getTime()).toFixed(1) + "," + y(p.value).toFixed(1)).join(" ");
+		const path = document.createElementNS(ns, "path");
+		path.setAttribute("d", d);
+		path.setAttribute("stroke", s.color);
+		svg.appendChild(path);
+	}
+
+	const label = (text, lx, ly) => {
+		const t = document.createElementNS(ns, "text");
+		t.setAttribute("x", lx);
+		t.setAttribute("y", ly);
+		t.textContent = text;
+		svg.appendChild(t);
+	};
+	label(formatBytes(max) + "/s", 2, pad / 2 + 4);
+	label(new Date(t0).toLocaleTimeString(), pad, height - 2);
+	label(new Date(t1).toLocaleTimeString(), width - pad - 50, height - 2);
+
+	const legend = el("div", series.map((s) => el("span", "■ " + s.name, { style: "color: " + s.color })), { class: "legend" });
+	return el("div", [el("h3", title), svg, legend]);
+}
+
+function formatBytes(n) {
+	const units = ["B", "KB", "MB", "GB", "TB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+// grown returns how much a counter grew over its points, skipping drops like Rate does
+function grown(points) {
+	let total = 0;
+	for (let i = 1; i < points.length; i++) {
+		total += Math.max(points[i].value - points[i - 1].value, 0);
+	}
+	return total;
+}
+
+// keyValues shows an object as a two column table
+function keyValues(obj) {
+	return el("table", Object.entries(obj || {}).map(([k, v]) =>
+		el("tr", [el("th", k), el("td", typeof v === "object" ? JSON.stringify(v) : String(v))])));
+}
+
+async function showHost(ip) {
+	let host;
+	try {
+		host = await api("api/hosts/" + encodeURIComponent(ip));
+	} catch (err) {
+		return showError(err);
+	}
+
+	const sections = [el("h2", (host.row.hostname ? host.row.hostname + " " : "") + host.ip)];
+	sections.push(el("section", [el("h3", "table"), keyValues(host.row)]));
+
+	const lease = host.details["dnsmasq.Store"];
+	if (lease !== undefined) {
+		sections.push(el("section", [el("h3", "lease"), lease ? keyValues(lease) : el("p", "no lease")]));
+	}
+
+	const conntrack = host.details["conntrack.StateStore"];
+	if (conntrack) {
+		const rows = conntrack.Destinations.map((d) => el("tr", [
+			el("td", d.Address), el("td", d.Service), el("td", String(d.Flows)),
+			el("td", formatBytes(d.BytesOut)), el("td", formatBytes(d.BytesIn)),
+		]));
+		const head = el("tr", ["destination", "service", "flows", "sent", "received"].map((h) => el("th", h)));
+		sections.push(el("section", [el("h3", "top destinations"), el("table", [el("thead", [head]), el("tbody", rows)])]));
+		sections.push(el("section", [el("h3", "flows"), el("pre", conntrack.Flows.join("\n") || "no flows")]));
+	}
+
+	const charts = el("section", []);
+	sections.splice(1, 0, charts);
+	main.replaceChildren(...sections);
+
+	try {
+		// the usage counters only grow, unlike the bytes of the flows alive right now
+		const query = "api/history?since=1h&host=" + encodeURIComponent(ip) + "&metric=";
+		const [sent, received, sentTotal, receivedTotal] = await Promise.all([
+			api(query + "usageBytesOut&rate=true"), api(query + "usageBytesIn&rate=true"),
+			api(query + "usageBytesOut"), api(query + "usageBytesIn"),
+		]);
+		charts.appendChild(chart([
+			{ name: "sent", color: "#d35400", points: sent },
+			{ name: "received", color: "#2980b9", points: received },
+		], "bandwidth, last hour: sent " + formatBytes(grown(sentTotal)) + ", received " + formatBytes(grown(receivedTotal))));
+	} catch (err) {
+		charts.appendChild(el("p", "history is unavailable: " + err.message));
+	}
+}
+
+// followTable redraws the table when hosts change, falling back to polling without events
+function followTable() {
+	let pending = false;
+	stream = new EventSource("api/events?type=host-appeared,host-disappeared,metrics");
+	const redraw = () => {
+		if (!pending) {
+			pending = true;
+			setTimeout(() => { pending = false; showTable(); }, 1000);
+		}
+	};
+	["host-appeared", "host-disappeared", "metrics"].forEach((type) => stream.addEventListener(type, redraw));
+	stream.onerror = () => {
+		if (stream.readyState === EventSource.CLOSED && refresh === null) {
+			refresh = setInterval(showTable, 5000);
+		}
+	};
+}
+
+function route() {
+	clearInterval(refresh);
+	refresh = null;
+	if (stream) {
+		stream.close();
+		stream = null;
+	}
+
+	const m = location.hash.match(/^#\/host\/(.+)$/);
+	if (m) {
+		search.hidden = true;
+		showHost(decodeURIComponent(m[1]));
+		return;
+	}
+	search.hidden = false;
+	showTable();
+	followTable();
+}
+
+search.oninput = showTable;
+window.onhashchange = route;
+route();
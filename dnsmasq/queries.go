@@ -0,0 +1,435 @@
+package dnsmasq
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fasmide/routerlogin/health"
+)
+
+const (
+	// pendingTimeout is how long a query waits for its answer to be logged
+	pendingTimeout = 30 * time.Second
+
+	// maxDomains is how many domains are counted per host, the least asked ones are
+	// forgotten when there are more
+	maxDomains = 1000
+)
+
+// DomainCount is how many times a domain was asked for
+type DomainCount struct {
+	Domain string
+	Count  int
+}
+
+// QueryDetails are the dns queries of a host
+type QueryDetails struct {
+	Queries   int
+	Forwarded int
+	Cached    int
+	NXDomain  int
+
+	// Blocked are queries answered by the config, address=/domain/ block lists
+	Blocked int
+
+	PerMinute    float64
+	NXDomainRate float64
+
+	// TopDomains are the domains asked for the most first
+	TopDomains []DomainCount
+}
+
+// hostQueries counts the queries of a host
+type hostQueries struct {
+	QueryDetails
+
+	domains map[string]int
+
+	// minutes are the queries of the last minutes in a ring, the newest is minute
+	minutes []int
+	minute  int64
+}
+
+// newHostQueries returns counts with a window of n minutes
+func newHostQueries(n int, now time.Time) *hostQueries {
+	return &hostQueries{
+		domains: make(map[string]int),
+		minutes: make([]int, n),
+		minute:  now.Unix() / 60,
+	}
+}
+
+// advance moves the window to the minute of now
+func (h *hostQueries) advance(now time.Time) {
+	minute := now.Unix() / 60
+	if minute-h.minute >= int64(len(h.minutes)) {
+		for i := range h.minutes {
+			h.minutes[i] = 0
+		}
+		h.minute = minute
+		return
+	}
+	for h.minute < minute {
+		h.minute++
+		h.minutes[h.minute%int64(len(h.minutes))] = 0
+	}
+}
+
+// query counts a query for domain
+func (h *hostQueries) query(domain string, now time.Time) {
+	h.advance(now)
+	h.minutes[h.minute%int64(len(h.minutes))]++
+	h.Queries++
+
+	h.domains[domain]++
+	if len(h.domains) > maxDomains {
+		sorted := sortedDomains(h.domains)
+		for _, d := range sorted[maxDomains/2:] {
+			delete(h.domains, d.Domain)
+		}
+	}
+}
+
+// details returns the counts at now, with the n top domains
+func (h *hostQueries) details(now time.Time, n int) QueryDetails {
+	h.advance(now)
+
+	d := h.QueryDetails
+	sum := 0
+	for _, c := range h.minutes {
+		sum += c
+	}
+	d.PerMinute = float64(sum) / float64(len(h.minutes))
+	if d.Queries > 0 {
+		d.NXDomainRate = 100 * float64(d.NXDomain) / float64(d.Queries)
+	}
+
+	d.TopDomains = sortedDomains(h.domains)
+	if len(d.TopDomains) > n {
+		d.TopDomains = d.TopDomains[:n]
+	}
+	return d
+}
+
+// sortedDomains returns domains asked for the most first
+func sortedDomains(m map[string]int) []DomainCount {
+	sorted := make([]DomainCount, 0, len(m))
+	for domain, count := range m {
+		sorted = append(sorted, DomainCount{Domain: domain, Count: count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Domain < sorted[j].Domain
+	})
+	return sorted
+}
+
+// pendingQuery is a query waiting for its answer to be logged
+type pendingQuery struct {
+	client    netip.Addr
+	time      time.Time
+	forwarded bool
+}
+
+// Queries counts the dns queries of every host from the log dnsmasq writes with
+// log-queries. Answers are only logged with the domain, so they are matched to the
+// oldest query of it unless log-queries=extra logs the client as well
+type Queries struct {
+	Log QueryLog
+
+	// Window is how long queries per minute are averaged over, 5 minutes when zero
+	Window time.Duration
+
+	lock    sync.Mutex
+	hosts   map[netip.Addr]*hostQueries
+	pending map[string][]pendingQuery
+	follows health.Tracker
+
+	// now is replaced by tests
+	now func() time.Time
+}
+
+// clock returns the current time
+func (q *Queries) clock() time.Time {
+	if q.now != nil {
+		return q.now()
+	}
+	return time.Now()
+}
+
+// windowMinutes returns the number of minutes in the window
+func (q *Queries) windowMinutes() int {
+	if q.Window == 0 {
+		return 5
+	}
+	if n := int(q.Window / time.Minute); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// Run follows the log until ctx is done, following it again when it fails
+func (q *Queries) Run(ctx context.Context) {
+	for {
+		start := time.Now()
+		failed := make(chan error, 1)
+		go func() {
+			failed <- q.Log.Follow(ctx, q.Add)
+		}()
+
+		// following is a refresh which never ends, it is healthy until it fails
+		ticker := time.NewTicker(10 * time.Second)
+		var err error
+	following:
+		for {
+			select {
+			case err = <-failed:
+				break following
+			case now := <-ticker.C:
+				q.follows.Record(now, nil)
+				q.sweep(q.clock())
+			}
+		}
+		ticker.Stop()
+
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("the log ended")
+		}
+		q.follows.Record(start, err)
+		log.Printf("dnsmasq: unable to follow the query log, retrying: %s", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// Add counts a line of the log, lines not about queries are ignored
+func (q *Queries) Add(line string) {
+	l, ok := parseLogLine(line)
+	if !ok {
+		return
+	}
+	now := q.clock()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.hosts == nil {
+		q.hosts = make(map[netip.Addr]*hostQueries)
+		q.pending = make(map[string][]pendingQuery)
+	}
+
+	switch l.Kind {
+	case logQuery:
+		host, found := q.hosts[l.Client]
+		if !found {
+			host = newHostQueries(q.windowMinutes(), now)
+			q.hosts[l.Client] = host
+		}
+		host.query(l.Domain, now)
+
+		q.prune(l.Domain, now)
+		q.pending[l.Domain] = append(q.pending[l.Domain], pendingQuery{client: l.Client, time: now})
+
+	case logForwarded:
+		for i, p := range q.pending[l.Domain] {
+			if !p.forwarded && (!l.Client.IsValid() || p.client == l.Client) {
+				q.pending[l.Domain][i].forwarded = true
+				q.hosts[p.client].Forwarded++
+				break
+			}
+		}
+
+	default:
+		// answers with several records are logged once per record, only the first counts
+		p, found := q.answered(l)
+		if !found {
+			return
+		}
+		host := q.hosts[p.client]
+		switch {
+		case l.Kind == logConfig:
+			host.Blocked++
+		case l.Value == "NXDOMAIN":
+			host.NXDomain++
+		}
+		if l.Kind == logCached {
+			host.Cached++
+		}
+	}
+}
+
+// answered removes and returns the query answered by l, while locked. Replies answer
+// forwarded queries, while the cache and config answers them right away
+func (q *Queries) answered(l logLine) (pendingQuery, bool) {
+	pending := q.pending[l.Domain]
+	for i, p := range pending {
+		if p.forwarded != (l.Kind == logReply) || (l.Client.IsValid() && p.client != l.Client) {
+			continue
+		}
+		if len(pending) == 1 {
+			delete(q.pending, l.Domain)
+		} else {
+			q.pending[l.Domain] = append(pending[:i:i], pending[i+1:]...)
+		}
+		return p, true
+	}
+	return pendingQuery{}, false
+}
+
+// prune forgets queries of domain whose answers were never logged, while locked
+func (q *Queries) prune(domain string, now time.Time) {
+	pending := q.pending[domain]
+	i := 0
+	for i < len(pending) && now.Sub(pending[i].time) > pendingTimeout {
+		i++
+	}
+	if i == len(pending) {
+		delete(q.pending, domain)
+		return
+	}
+	q.pending[domain] = pending[i:]
+}
+
+// sweep forgets every query whose answer was never logged, prune only sees the domain
+// queried, so domains not queried again would otherwise be kept forever
+func (q *Queries) sweep(now time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for domain := range q.pending {
+		q.prune(domain, now)
+	}
+}
+
+// Host returns the queries of a host
+func (q *Queries) Host(ip string) (QueryDetails, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return QueryDetails{}, false
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	host, found := q.hosts[addr.Unmap()]
+	if !found {
+		return QueryDetails{}, false
+	}
+	return host.details(q.clock(), 20), true
+}
+
+// Health returns how following the log is going
+func (q *Queries) Health() health.State {
+	return q.follows.State()
+}
+
+// Addresses returns nothing, hosts are found by the other stores
+func (q *Queries) Addresses() ([]net.IP, error) {
+	return nil, nil
+}
+
+// Data returns the query columns of an ip address
+func (q *Queries) Data(ip string) (map[string]string, error) {
+	d, found := q.Host(ip)
+	if !found {
+		return map[string]string{"dnsPerMinute": "", "nxdomainRate": "", "nBlocked": "", "domains": ""}, nil
+	}
+
+	domains := make([]string, 0, 3)
+	for i := 0; i < len(d.TopDomains) && i < 3; i++ {
+		domains = append(domains, fmt.Sprintf("%s:%d", d.TopDomains[i].Domain, d.TopDomains[i].Count))
+	}
+
+	return map[string]string{
+		"dnsPerMinute": strconv.FormatFloat(d.PerMinute, 'f', 1, 64),
+		"nxdomainRate": strconv.FormatFloat(d.NXDomainRate, 'f', 1, 64),
+		"nBlocked":     strconv.Itoa(d.Blocked),
+		"domains":      strings.Join(domains, " "),
+	}, nil
+}
+
+// Details returns the queries of an ip address, or nil when it has made none
+func (q *Queries) Details(ip string) (interface{}, error) {
+	d, found := q.Host(ip)
+	if !found {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+// Metrics returns the query counts of an ip address
+func (q *Queries) Metrics(ip string) (map[string]float64, error) {
+	d, _ := q.Host(ip)
+	return map[string]float64{
+		"dnsQueries":   float64(d.Queries),
+		"dnsPerMinute": d.PerMinute,
+		"dnsNXDomain":  float64(d.NXDomain),
+		"dnsBlocked":   float64(d.Blocked),
+		"dnsCached":    float64(d.Cached),
+	}, nil
+}
+
+// Commands returns the commands queries answers through the daemon
+func (q *Queries) Commands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"queries": q.queriesCommand,
+	}
+}
+
+// queriesCommand writes the queries of every host, or the top domains of one: queries [ip]
+func (q *Queries) queriesCommand(w io.Writer, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: queries [ip]")
+	}
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if len(args) == 1 {
+		d, found := q.Host(args[0])
+		if !found {
+			return fmt.Errorf("no queries from %s", args[0])
+		}
+		fmt.Fprintf(t, "domain\tqueries\n")
+		for _, c := range d.TopDomains {
+			fmt.Fprintf(t, "%s\t%d\n", c.Domain, c.Count)
+		}
+		return t.Flush()
+	}
+
+	q.lock.Lock()
+	addrs := make([]netip.Addr, 0, len(q.hosts))
+	for addr := range q.hosts {
+		addrs = append(addrs, addr)
+	}
+	q.lock.Unlock()
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+
+	fmt.Fprintf(t, "ip\tqueries\tper minute\tnxdomain\tblocked\tcached\ttop domain\n")
+	for _, addr := range addrs {
+		d, _ := q.Host(addr.String())
+		top := ""
+		if len(d.TopDomains) > 0 {
+			top = d.TopDomains[0].Domain
+		}
+		fmt.Fprintf(t, "%s\t%d\t%.1f\t%.1f%%\t%d\t%d\t%s\n", addr, d.Queries, d.PerMinute, d.NXDomainRate, d.Blocked, d.Cached, top)
+	}
+	return t.Flush()
+}
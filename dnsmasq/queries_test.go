@@ -0,0 +1,284 @@
+package dnsmasq
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want logLine
+	}{
+		{"Oct 19 12:00:01 dnsmasq[1234]: query[AAAA] Example.com. from 192.168.1.20", logLine{Kind: logQuery, Domain: "example.com", Value: "AAAA"}},
+		{"Oct 19 12:00:01 dnsmasq[1234]: forwarded example.com to 1.1.1.1", logLine{Kind: logForwarded, Domain: "example.com", Value: "1.1.1.1"}},
+		{"<30>Oct 19 12:00:01 router dnsmasq[1234]: reply example.com is <CNAME>", logLine{Kind: logReply, Domain: "example.com", Value: "<CNAME>"}},
+		{"Oct 19 12:00:01 dnsmasq[1234]: cached example.com is NXDOMAIN", logLine{Kind: logCached, Domain: "example.com", Value: "NXDOMAIN"}},
+		{"Oct 19 12:00:01 dnsmasq[1234]: config ads.example.com is 0.0.0.0", logLine{Kind: logConfig, Domain: "ads.example.com", Value: "0.0.0.0"}},
+		{"Oct 19 12:00:01 dnsmasq[1234]: /etc/hosts router.lan is 192.168.1.1", logLine{Kind: logLocal, Domain: "router.lan", Value: "192.168.1.1"}},
+		{"Oct 19 12:00:01 dnsmasq[1234]: 17 192.168.1.21/53422 reply example.com is 1.2.3.4", logLine{Kind: logReply, Domain: "example.com", Value: "1.2.3.4"}},
+	} {
+		l, ok := parseLogLine(c.line)
+		if !ok {
+			t.Fatalf("unable to parse %s", c.line)
+		}
+		if l.Kind != c.want.Kind || l.Domain != c.want.Domain || l.Value != c.want.Value {
+			t.Fatalf("%s was parsed as %+v", c.line, l)
+		}
+	}
+
+	l, _ := parseLogLine("Oct 19 12:00:01 dnsmasq[1234]: 17 192.168.1.21/53422 reply example.com is 1.2.3.4")
+	if l.Client.String() != "192.168.1.21" {
+		t.Fatalf("client of extra logging was not parsed: %+v", l)
+	}
+
+	for _, line := range []string{
+		"Oct 19 12:00:01 dnsmasq[1234]: started, version 2.90 cachesize 150",
+		"Oct 19 12:00:01 dnsmasq-dhcp[1234]: DHCPACK(br-lan) 192.168.1.20 aa:bb:cc:dd:ee:01 laptop",
+		"Oct 19 12:00:01 sshd[99]: query[A] example.com from 192.168.1.20",
+		"Oct 19 12:00:01 dnsmasq[1234]: query[A] example.com from nowhere",
+	} {
+		if l, ok := parseLogLine(line); ok {
+			t.Fatalf("%s was parsed as %+v", line, l)
+		}
+	}
+}
+
+func TestQueries(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	q := &Queries{Window: 2 * time.Minute, now: func() time.Time { return now }}
+
+	for _, line := range []string{
+		"dnsmasq[1]: query[A] example.com from 192.168.1.20",
+		"dnsmasq[1]: query[A] example.com from 192.168.1.21",
+		"dnsmasq[1]: forwarded example.com to 1.1.1.1",
+		// every record of an answer is logged
+		"dnsmasq[1]: reply example.com is 1.2.3.4",
+		"dnsmasq[1]: reply example.com is 1.2.3.5",
+		// the second query is answered from the cache
+		"dnsmasq[1]: cached example.com is 1.2.3.4",
+		"dnsmasq[1]: query[A] nope.example.com from 192.168.1.20",
+		"dnsmasq[1]: forwarded nope.example.com to 1.1.1.1",
+		"dnsmasq[1]: reply nope.example.com is NXDOMAIN",
+		"dnsmasq[1]: query[A] ads.example.com from 192.168.1.20",
+		"dnsmasq[1]: config ads.example.com is 0.0.0.0",
+		"dnsmasq[1]: query[AAAA] example.com from 192.168.1.20",
+		"dnsmasq[1]: cached example.com is NODATA-IPv6",
+	} {
+		q.Add(line)
+	}
+
+	d, found := q.Host("192.168.1.20")
+	if !found {
+		t.Fatalf("host was not counted")
+	}
+	if d.Queries != 4 || d.Forwarded != 2 || d.Cached != 1 || d.NXDomain != 1 || d.Blocked != 1 {
+		t.Fatalf("unexpected counts: %+v", d)
+	}
+	if d.NXDomainRate != 25 || d.PerMinute != 2 {
+		t.Fatalf("unexpected rates: %+v", d)
+	}
+	if len(d.TopDomains) != 3 || d.TopDomains[0] != (DomainCount{Domain: "example.com", Count: 2}) {
+		t.Fatalf("unexpected top domains: %+v", d.TopDomains)
+	}
+
+	other, _ := q.Host("192.168.1.21")
+	if other.Queries != 1 || other.Cached != 1 || other.Forwarded != 0 {
+		t.Fatalf("unexpected counts of second host: %+v", other)
+	}
+
+	row, _ := q.Data("192.168.1.20")
+	if row["dnsPerMinute"] != "2.0" || row["nxdomainRate"] != "25.0" || row["nBlocked"] != "1" || !strings.HasPrefix(row["domains"], "example.com:2 ") {
+		t.Fatalf("unexpected columns: %+v", row)
+	}
+	row, _ = q.Data("192.168.1.99")
+	if row["dnsPerMinute"] != "" {
+		t.Fatalf("host without queries has columns: %+v", row)
+	}
+
+	// queries leave the window, the counts stay
+	now = now.Add(2 * time.Minute)
+	d, _ = q.Host("192.168.1.20")
+	if d.PerMinute != 0 || d.Queries != 4 {
+		t.Fatalf("window did not move: %+v", d)
+	}
+
+	// answers carry the client with log-queries=extra
+	q.Add("dnsmasq[1]: 40 192.168.1.21/5000 query[A] shared.example.com from 192.168.1.21")
+	q.Add("dnsmasq[1]: 41 192.168.1.20/5001 query[A] shared.example.com from 192.168.1.20")
+	q.Add("dnsmasq[1]: 41 192.168.1.20/5001 cached shared.example.com is NXDOMAIN")
+	d, _ = q.Host("192.168.1.20")
+	other, _ = q.Host("192.168.1.21")
+	if d.NXDomain != 2 || other.NXDomain != 0 {
+		t.Fatalf("answer was counted on the wrong host: %+v %+v", d, other)
+	}
+
+	// unanswered queries are forgotten
+	now = now.Add(time.Minute)
+	q.Add("dnsmasq[1]: query[A] shared.example.com from 192.168.1.20")
+	if len(q.pending["shared.example.com"]) != 1 {
+		t.Fatalf("unanswered queries were kept: %+v", q.pending)
+	}
+
+	var out bytes.Buffer
+	err := q.Commands()["queries"](&out, nil)
+	if err != nil || !strings.Contains(out.String(), "192.168.1.20  6        1.0         33.3%") {
+		t.Fatalf("unexpected listing %s:\n%s", err, out.String())
+	}
+	out.Reset()
+	err = q.Commands()["queries"](&out, []string{"192.168.1.21"})
+	if err != nil || !strings.Contains(out.String(), "shared.example.com  1") {
+		t.Fatalf("unexpected domains %s:\n%s", err, out.String())
+	}
+
+	// unanswered queries of domains never queried again are swept
+	q.Add("dnsmasq[1]: query[A] once.example.com from 192.168.1.20")
+	now = now.Add(time.Minute)
+	q.sweep(now)
+	if len(q.pending) != 0 {
+		t.Fatalf("unanswered queries were kept: %+v", q.pending)
+	}
+}
+
+// lines collects followed lines
+type lines struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *lines) add(line string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, line)
+}
+
+// wait waits for n lines
+func (l *lines) wait(t *testing.T, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.lock.Lock()
+		got := append([]string(nil), l.lines...)
+		l.lock.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d lines", n)
+	return nil
+}
+
+func appendFile(t *testing.T, path, data string) {
+	fd, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	_, err = fd.WriteString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.log")
+	appendFile(t, path, "written before we started\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	got := &lines{}
+	done := make(chan error)
+	go func() {
+		done <- LogFile{Path: path, Interval: 10 * time.Millisecond}.Follow(ctx, got.add)
+	}()
+
+	// give Follow time to open the file at its end
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "one\ntw")
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "o\n")
+	got.wait(t, 2)
+
+	// logrotate renames the file and dnsmasq creates a new one after writing a last line
+	err := os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "three\n")
+	appendFile(t, path, "four\n")
+	got.wait(t, 4)
+
+	// copytruncate empties the file
+	err = os.Truncate(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "five\n")
+	result := got.wait(t, 5)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("follow failed: %s", err)
+	}
+	if strings.Join(result, ",") != "one,two,three,four,five" {
+		t.Fatalf("unexpected lines: %q", result)
+	}
+}
+
+func TestSyslogSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := &Queries{Log: SyslogSocket{Network: "unixgram", Address: path}}
+	got := &lines{}
+	done := make(chan error)
+	go func() {
+		done <- q.Log.Follow(ctx, got.add)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(path)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("socket was not created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err := sendDatagram(path, "<30>Oct 19 12:00:01 dnsmasq[1234]: query[A] example.com from 192.168.1.20\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := got.wait(t, 1)
+	q.Add(result[0])
+	if d, _ := q.Host("192.168.1.20"); d.Queries != 1 {
+		t.Fatalf("syslog message was not counted: %q", result)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("follow failed: %s", err)
+	}
+}
+
+func sendDatagram(path, message string) error {
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(message))
+	return err
+}
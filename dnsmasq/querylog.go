@@ -0,0 +1,300 @@
+package dnsmasq
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fasmide/routerlogin/runner"
+)
+
+// QueryLog is where the log dnsmasq writes with log-queries is read from
+type QueryLog interface {
+	// Follow calls f with every new line of the log until ctx is done
+	Follow(ctx context.Context, f func(line string)) error
+}
+
+// LogFile follows a log file from its end like tail -F does, reading the new file when
+// it is rotated and starting over when it is truncated
+type LogFile struct {
+	Path string
+
+	// Interval is how often the file is looked at, every second when zero
+	Interval time.Duration
+}
+
+// Follow reads lines as they are written to the file
+func (l LogFile) Follow(ctx context.Context, f func(line string)) error {
+	fd, err := os.Open(l.Path)
+	if err != nil {
+		return err
+	}
+	defer func() { fd.Close() }()
+
+	offset, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	interval := l.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	r := bufio.NewReader(fd)
+	partial := ""
+	drain := func() error {
+		for {
+			line, err := r.ReadString('\n')
+			offset += int64(len(line))
+			partial += line
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			f(strings.TrimRight(partial, "\r\n"))
+			partial = ""
+		}
+	}
+
+	for {
+		err = drain()
+		if err != nil {
+			return err
+		}
+
+		current, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+
+		// a missing file is being rotated, dnsmasq creates the new one when told to
+		info, err := os.Stat(l.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		switch {
+		case err == nil && !os.SameFile(current, info):
+			next, err := os.Open(l.Path)
+			if err != nil {
+				// looked at again after a while
+				break
+			}
+
+			// whatever was written to the old file before it was let go
+			err = drain()
+			if err != nil {
+				next.Close()
+				return err
+			}
+			if partial != "" {
+				f(strings.TrimRight(partial, "\r\n"))
+			}
+
+			fd.Close()
+			fd, offset, partial = next, 0, ""
+			r.Reset(fd)
+			continue
+
+		case current.Size() < offset:
+			// copytruncate rotation starts the same file over
+			_, err = fd.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			offset, partial = 0, ""
+			r.Reset(fd)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// CommandLogFile follows a log file with tail -F run by Runner, for the log of another host
+type CommandLogFile struct {
+	Runner runner.Runner
+	Path   string
+}
+
+// Follow reads lines as tail prints them
+func (c CommandLogFile) Follow(ctx context.Context, f func(line string)) error {
+	output, err := c.Runner.Start(ctx, "tail", "-n", "0", "-F", c.Path)
+	if err != nil {
+		return err
+	}
+
+	s := bufio.NewScanner(output)
+	for s.Scan() {
+		f(s.Text())
+	}
+
+	err = output.Close()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err == nil {
+		err = s.Err()
+	}
+	if err == nil {
+		err = fmt.Errorf("tail of %s ended", c.Path)
+	}
+	return err
+}
+
+// SyslogSocket receives the log as syslog messages on Address, a unixgram socket path
+// or udp host:port by Network. A syslog daemon forwards dnsmasq's messages to it
+type SyslogSocket struct {
+	Network string
+	Address string
+}
+
+// Follow calls f with every line of every message received
+func (s SyslogSocket) Follow(ctx context.Context, f func(line string)) error {
+	if s.Network == "unixgram" {
+		// a socket left by an earlier run is in the way
+		os.Remove(s.Address)
+		defer os.Remove(s.Address)
+	}
+
+	conn, err := net.ListenPacket(s.Network, s.Address)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimRight(line, "\r\x00"); line != "" {
+				f(line)
+			}
+		}
+	}
+}
+
+// Kinds of log lines
+const (
+	logQuery     = "query"
+	logForwarded = "forwarded"
+	logReply     = "reply"
+	logCached    = "cached"
+	logConfig    = "config"
+	logLocal     = "local"
+)
+
+// logLine is a line of the log of a query
+type logLine struct {
+	Kind   string
+	Domain string
+
+	// Value is the query type of queries, the server of forwarded queries or the answer
+	Value string
+
+	// Client is the host asking, which is only logged with every line when log-queries=extra
+	Client netip.Addr
+}
+
+// logMessage returns the message of a log line written by dnsmasq, as written to its
+// own log-facility file or as a syslog message
+func logMessage(line string) (string, bool) {
+	if i := strings.Index(line, "dnsmasq["); i >= 0 {
+		if j := strings.Index(line[i:], "]: "); j >= 0 {
+			return line[i+j+3:], true
+		}
+	}
+	if i := strings.Index(line, "dnsmasq: "); i >= 0 {
+		return line[i+9:], true
+	}
+	return "", false
+}
+
+// parseLogLine parses lines such as
+//
+//	Oct 19 12:00:01 dnsmasq[1234]: query[A] example.com from 192.168.1.20
+//	Oct 19 12:00:01 dnsmasq[1234]: forwarded example.com to 1.1.1.1
+//	Oct 19 12:00:01 dnsmasq[1234]: reply example.com is 93.184.215.14
+//	Oct 19 12:00:01 dnsmasq[1234]: cached example.com is NXDOMAIN
+//	Oct 19 12:00:01 dnsmasq[1234]: config ads.example.com is 0.0.0.0
+//	<30>Oct 19 12:00:01 dnsmasq[1234]: 17 192.168.1.20/53422 query[A] example.com from 192.168.1.20
+//
+// answers from /etc/hosts, other hosts files and dhcp leases are local
+func parseLogLine(line string) (logLine, bool) {
+	message, found := logMessage(line)
+	if !found {
+		return logLine{}, false
+	}
+	fields := strings.Fields(message)
+
+	var l logLine
+
+	// log-queries=extra prefixes a serial and the client address
+	if len(fields) > 2 && strings.Contains(fields[1], "/") && strings.Trim(fields[0], "0123456789") == "" {
+		client, err := netip.ParseAddr(fields[1][:strings.LastIndex(fields[1], "/")])
+		if err == nil {
+			l.Client = client.Unmap()
+		}
+		fields = fields[2:]
+	}
+	if len(fields) != 4 {
+		return l, false
+	}
+	l.Domain = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+
+	switch {
+	case strings.HasPrefix(fields[0], "query[") && fields[2] == "from":
+		client, err := netip.ParseAddr(fields[3])
+		if err != nil {
+			return l, false
+		}
+		l.Kind, l.Value, l.Client = logQuery, strings.Trim(fields[0][5:], "[]"), client.Unmap()
+
+	case fields[0] == "forwarded" && fields[2] == "to":
+		l.Kind, l.Value = logForwarded, fields[3]
+
+	case fields[2] != "is":
+		return l, false
+
+	case fields[0] == "reply", fields[0] == "cached", fields[0] == "config":
+		l.Kind, l.Value = fields[0], fields[3]
+
+	case fields[0] == "DHCP", strings.HasPrefix(fields[0], "/"):
+		l.Kind, l.Value = logLocal, fields[3]
+
+	default:
+		return l, false
+	}
+	return l, true
+}
@@ -0,0 +1,83 @@
+package dnsmasq
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/fasmide/routerlogin/runner"
+)
+
+// Reloader makes dnsmasq read its hosts files again
+type Reloader interface {
+	Reload() error
+}
+
+// SignalSender sends signals to processes
+type SignalSender interface {
+	Send(pid int, sig os.Signal) error
+}
+
+// ProcessSignaler sends signals to processes on this host
+type ProcessSignaler struct{}
+
+// Send signals the process
+func (ProcessSignaler) Send(pid int, sig os.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
+
+// PIDReloader signals the process whose pid is in PIDFile, dnsmasq reads its hosts
+// files again on SIGHUP
+type PIDReloader struct {
+	PIDFile string
+
+	// Signal defaults to SIGHUP
+	Signal os.Signal
+
+	// Sender defaults to signaling processes on this host
+	Sender SignalSender
+}
+
+// Reload signals the process of PIDFile
+func (p PIDReloader) Reload() error {
+	data, err := os.ReadFile(p.PIDFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("%s holds no pid", p.PIDFile)
+	}
+
+	var sig os.Signal = syscall.SIGHUP
+	if p.Signal != nil {
+		sig = p.Signal
+	}
+	var sender SignalSender = ProcessSignaler{}
+	if p.Sender != nil {
+		sender = p.Sender
+	}
+	return sender.Send(pid, sig)
+}
+
+// CommandReloader runs a command to reload dnsmasq e.g. systemctl reload dnsmasq
+type CommandReloader struct {
+	Runner  runner.Runner
+	Command []string
+}
+
+// Reload runs the command
+func (c CommandReloader) Reload() error {
+	if len(c.Command) == 0 {
+		return fmt.Errorf("no reload command")
+	}
+	_, err := runner.Output(context.Background(), c.Runner, c.Command[0], c.Command[1:]...)
+	return err
+}
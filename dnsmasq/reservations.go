@@ -0,0 +1,404 @@
+package dnsmasq
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fasmide/routerlogin/atomicfile"
+)
+
+// Reservation pins the address of a device, as a line of a dhcp-hostsfile
+type Reservation struct {
+	MAC      string
+	IP       netip.Addr
+	Hostname string
+
+	// Tag is set on the device with set:, for dhcp options of its own
+	Tag string
+}
+
+var (
+	// hostnamePattern is a single dns label, dnsmasq does not hand out domains
+	hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+	tagPattern      = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// Validate checks the reservation and normalizes its mac address
+func (r *Reservation) Validate() error {
+	hw, err := net.ParseMAC(r.MAC)
+	if err != nil || len(hw) != 6 {
+		return fmt.Errorf("invalid mac address \"%s\"", r.MAC)
+	}
+	r.MAC = hw.String()
+
+	if !r.IP.Is4() {
+		return fmt.Errorf("reservations needs an ipv4 address, got \"%s\"", r.IP)
+	}
+	if r.Hostname != "" && !hostnamePattern.MatchString(r.Hostname) {
+		return fmt.Errorf("invalid hostname \"%s\"", r.Hostname)
+	}
+	if r.Tag != "" && !tagPattern.MatchString(r.Tag) {
+		return fmt.Errorf("invalid tag \"%s\"", r.Tag)
+	}
+	return nil
+}
+
+// String formats the reservation as dnsmasq reads it: mac,set:tag,ip,hostname
+func (r Reservation) String() string {
+	fields := []string{r.MAC}
+	if r.Tag != "" {
+		fields = append(fields, "set:"+r.Tag)
+	}
+	fields = append(fields, r.IP.String())
+	if r.Hostname != "" {
+		fields = append(fields, r.Hostname)
+	}
+	return strings.Join(fields, ",")
+}
+
+// ParseReservation parses a line of a dhcp-hostsfile, as written by String
+func ParseReservation(line string) (Reservation, error) {
+	fields := strings.Split(strings.TrimSpace(line), ",")
+	r := Reservation{MAC: fields[0]}
+
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "set:"):
+			r.Tag = strings.TrimPrefix(f, "set:")
+		case !r.IP.IsValid():
+			ip, err := netip.ParseAddr(f)
+			if err != nil {
+				return r, fmt.Errorf("unable to parse \"%s\": expected mac,[set:tag,]ip[,hostname]", line)
+			}
+			r.IP = ip
+		case r.Hostname == "":
+			r.Hostname = f
+		default:
+			return r, fmt.Errorf("unable to parse \"%s\": expected mac,[set:tag,]ip[,hostname]", line)
+		}
+	}
+
+	return r, r.Validate()
+}
+
+// LeaseLookup looks up leases by ip address, Store is one
+type LeaseLookup interface {
+	LeaseByIP(ip string) (*Entry, error)
+}
+
+// Reservations is a dhcp-hostsfile of reservations, changes are written to Path and
+// dnsmasq is reloaded to read them
+type Reservations struct {
+	Path string
+
+	// Leases are checked for other devices holding reserved addresses, when set
+	Leases LeaseLookup
+
+	// Reloader tells dnsmasq to read the file again, when set
+	Reloader Reloader
+
+	// MAC returns the mac address of an ip address, for the reserved column
+	MAC func(ip string) (string, error)
+
+	lock         sync.Mutex
+	reservations map[string]Reservation
+}
+
+// Load reads the reservations of Path, a missing file has none
+func (r *Reservations) Load() error {
+	fd, err := os.Open(r.Path)
+	if os.IsNotExist(err) {
+		r.lock.Lock()
+		r.reservations = make(map[string]Reservation)
+		r.lock.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	reservations := make(map[string]Reservation)
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		res, err := ParseReservation(line)
+		if err != nil {
+			return fmt.Errorf("%s: %s", r.Path, err)
+		}
+		reservations[res.MAC] = res
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reservations = reservations
+	return nil
+}
+
+// Reload reads Path again, picking up changes made by hand
+func (r *Reservations) Reload() error {
+	return r.Load()
+}
+
+// List returns every reservation by address
+func (r *Reservations) List() []Reservation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.list()
+}
+
+// list returns every reservation by address, while locked
+func (r *Reservations) list() []Reservation {
+	res := make([]Reservation, 0, len(r.reservations))
+	for _, reservation := range r.reservations {
+		res = append(res, reservation)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].IP.Less(res[j].IP) })
+	return res
+}
+
+// ByMAC returns the reservation of a device
+func (r *Reservations) ByMAC(mac string) (Reservation, bool) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return Reservation{}, false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res, found := r.reservations[hw.String()]
+	return res, found
+}
+
+// Set creates or replaces the reservation of a device. Addresses and hostnames reserved
+// by other devices are refused, and so are addresses leased to other devices unless forced
+func (r *Reservations) Set(res Reservation, force bool) (Reservation, error) {
+	err := res.Validate()
+	if err != nil {
+		return res, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, other := range r.reservations {
+		if other.MAC == res.MAC {
+			continue
+		}
+		if other.IP == res.IP {
+			return res, fmt.Errorf("%s is already reserved for %s", res.IP, other.MAC)
+		}
+		if res.Hostname != "" && strings.EqualFold(other.Hostname, res.Hostname) {
+			return res, fmt.Errorf("%s is already the hostname of %s", res.Hostname, other.MAC)
+		}
+	}
+
+	if r.Leases != nil && !force {
+		lease, err := r.Leases.LeaseByIP(res.IP.String())
+		if err == nil && !strings.EqualFold(lease.Mac, res.MAC) && !expiredAt(*lease, time.Now()) {
+			return res, fmt.Errorf("%s is leased to %s, force it to reserve it anyway", res.IP, lease.Mac)
+		}
+	}
+
+	if r.reservations == nil {
+		r.reservations = make(map[string]Reservation)
+	}
+	previous, existed := r.reservations[res.MAC]
+	r.reservations[res.MAC] = res
+
+	err = r.save()
+	if err != nil {
+		if existed {
+			r.reservations[res.MAC] = previous
+		} else {
+			delete(r.reservations, res.MAC)
+		}
+		return res, err
+	}
+	return res, r.reload()
+}
+
+// Delete removes the reservation of a device, by its mac or reserved address
+func (r *Reservations) Delete(macOrIP string) (Reservation, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var found *Reservation
+	for _, res := range r.reservations {
+		if strings.EqualFold(res.MAC, macOrIP) || res.IP.String() == macOrIP {
+			found = &res
+			break
+		}
+	}
+	if found == nil {
+		return Reservation{}, fmt.Errorf("no reservation of %s", macOrIP)
+	}
+
+	delete(r.reservations, found.MAC)
+	err := r.save()
+	if err != nil {
+		r.reservations[found.MAC] = *found
+		return *found, err
+	}
+	return *found, r.reload()
+}
+
+// save writes every reservation to Path, replacing it atomically so dnsmasq never
+// reads half a file
+func (r *Reservations) save() error {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# dhcp-hostsfile maintained by routerlogin, mac,[set:tag,]ip[,hostname]")
+	for _, res := range r.list() {
+		fmt.Fprintln(&b, res.String())
+	}
+
+	// dnsmasq drops its privileges before reading hosts files
+	return atomicfile.Write(r.Path, 0644, func(w io.Writer) error {
+		_, err := w.Write(b.Bytes())
+		return err
+	})
+}
+
+// reload tells dnsmasq about the changes, they are saved even if this fails
+func (r *Reservations) reload() error {
+	if r.Reloader == nil {
+		return nil
+	}
+
+	err := r.Reloader.Reload()
+	if err != nil {
+		return fmt.Errorf("saved, but unable to reload dnsmasq: %s", err)
+	}
+	return nil
+}
+
+// Addresses returns nothing, reservations are found by the mac address of hosts
+func (r *Reservations) Addresses() ([]net.IP, error) {
+	return nil, nil
+}
+
+// Data returns the address reserved for the device behind an ip address
+func (r *Reservations) Data(ip string) (map[string]string, error) {
+	reserved := ""
+	if mac, err := r.MAC(ip); err == nil {
+		if res, found := r.ByMAC(mac); found {
+			reserved = res.IP.String()
+		}
+	}
+	return map[string]string{"reserved": reserved}, nil
+}
+
+// Commands returns the commands reservations answers through the daemon
+func (r *Reservations) Commands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"reservations": r.listCommand,
+	}
+}
+
+// AdminCommands returns the commands reservations answers through the daemon, which changes them
+func (r *Reservations) AdminCommands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"reserve":   r.reserveCommand,
+		"unreserve": r.unreserveCommand,
+	}
+}
+
+// listCommand writes every reservation: reservations
+func (r *Reservations) listCommand(w io.Writer, _ []string) error {
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(t, "ip\tmac\thostname\ttag\n")
+	for _, res := range r.List() {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\n", res.IP, res.MAC, res.Hostname, res.Tag)
+	}
+	return t.Flush()
+}
+
+// reserveCommand reserves an ip address, for the device currently leasing it unless
+// another mac is given, keeping its hostname unless another is given. Other devices
+// leasing the address are only replaced with force
+// reserve <ip> [mac=<mac>] [hostname=<hostname>] [tag=<tag>] [force]
+func (r *Reservations) reserveCommand(w io.Writer, args []string) error {
+	usage := fmt.Errorf("usage: reserve <ip> [mac=<mac>] [hostname=<hostname>] [tag=<tag>] [force]")
+	if len(args) < 1 {
+		return usage
+	}
+
+	ip, err := netip.ParseAddr(args[0])
+	if err != nil {
+		return fmt.Errorf("%s: %s", usage, err)
+	}
+	res := Reservation{IP: ip}
+
+	var lease *Entry
+	if r.Leases != nil {
+		lease, _ = r.Leases.LeaseByIP(ip.String())
+	}
+	if lease != nil {
+		res.MAC = lease.Mac
+		if lease.Hostname != "*" {
+			res.Hostname = lease.Hostname
+		}
+	}
+
+	force := false
+	for _, arg := range args[1:] {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "mac":
+			res.MAC = value
+		case "hostname":
+			res.Hostname = value
+		case "tag":
+			res.Tag = value
+		case "force":
+			force = true
+		default:
+			return usage
+		}
+	}
+	if res.MAC == "" {
+		return fmt.Errorf("%s is not leased, give the mac address to reserve it for", ip)
+	}
+
+	res, err = r.Set(res, force)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "reserved %s\n", res)
+	return err
+}
+
+// unreserveCommand removes a reservation: unreserve <mac|ip>
+func (r *Reservations) unreserveCommand(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: unreserve <mac|ip>")
+	}
+
+	res, err := r.Delete(args[0])
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "removed %s\n", res)
+	return err
+}
@@ -0,0 +1,220 @@
+package dnsmasq
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeLeases is a LeaseLookup of leases by ip address
+type fakeLeases map[string]Entry
+
+func (f fakeLeases) LeaseByIP(ip string) (*Entry, error) {
+	if lease, found := f[ip]; found {
+		return &lease, nil
+	}
+	return nil, fmt.Errorf("no Entry with ip %s", ip)
+}
+
+// fakeSender records signals instead of sending them
+type fakeSender struct {
+	pids    []int
+	signals []os.Signal
+	err     error
+}
+
+func (f *fakeSender) Send(pid int, sig os.Signal) error {
+	f.pids = append(f.pids, pid)
+	f.signals = append(f.signals, sig)
+	return f.err
+}
+
+func TestReservations(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "dnsmasq.pid")
+	err := os.WriteFile(pidFile, []byte("4242\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &fakeSender{}
+	leases := fakeLeases{
+		"192.168.1.20": {Mac: "aa:bb:cc:dd:ee:01", IP: "192.168.1.20", Hostname: "laptop", Expiry: time.Now().Add(time.Hour)},
+		"192.168.1.30": {Mac: "aa:bb:cc:dd:ee:02", IP: "192.168.1.30", Hostname: "*", Expiry: time.Now().Add(time.Hour)},
+	}
+	r := &Reservations{
+		Path:     filepath.Join(dir, "hosts"),
+		Leases:   leases,
+		Reloader: PIDReloader{PIDFile: pidFile, Sender: sender},
+		MAC: func(ip string) (string, error) {
+			lease, err := leases.LeaseByIP(ip)
+			if err != nil {
+				return "", err
+			}
+			return lease.Mac, nil
+		},
+	}
+
+	err = r.Load()
+	if err != nil {
+		t.Fatalf("missing file should give no reservations: %s", err)
+	}
+
+	// the lease holder and its hostname is reserved by default
+	var out bytes.Buffer
+	err = r.AdminCommands()["reserve"](&out, []string{"192.168.1.20", "tag=trusted"})
+	if err != nil {
+		t.Fatalf("unable to reserve: %s", err)
+	}
+	if len(sender.pids) != 1 || sender.pids[0] != 4242 || sender.signals[0] != syscall.SIGHUP {
+		t.Fatalf("dnsmasq was not reloaded: %+v", sender)
+	}
+
+	data, err := os.ReadFile(r.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "\naa:bb:cc:dd:ee:01,set:trusted,192.168.1.20,laptop\n") {
+		t.Fatalf("unexpected hosts file:\n%s", data)
+	}
+
+	row, _ := r.Data("192.168.1.20")
+	if row["reserved"] != "192.168.1.20" {
+		t.Fatalf("reserved column is wrong: %+v", row)
+	}
+
+	// an address leased to another device needs force
+	_, err = r.Set(Reservation{MAC: "AA-BB-CC-DD-EE-03", IP: netip.MustParseAddr("192.168.1.30")}, false)
+	if err == nil {
+		t.Fatalf("reserved an address leased to another device")
+	}
+	res, err := r.Set(Reservation{MAC: "AA-BB-CC-DD-EE-03", IP: netip.MustParseAddr("192.168.1.30")}, true)
+	if err != nil {
+		t.Fatalf("unable to force a reservation: %s", err)
+	}
+	if res.MAC != "aa:bb:cc:dd:ee:03" {
+		t.Fatalf("mac address was not normalized: %s", res.MAC)
+	}
+
+	// addresses and hostnames reserved by other devices are refused
+	_, err = r.Set(Reservation{MAC: "aa:bb:cc:dd:ee:04", IP: netip.MustParseAddr("192.168.1.20")}, true)
+	if err == nil {
+		t.Fatalf("reserved an address twice")
+	}
+	_, err = r.Set(Reservation{MAC: "aa:bb:cc:dd:ee:04", IP: netip.MustParseAddr("192.168.1.40"), Hostname: "Laptop"}, true)
+	if err == nil {
+		t.Fatalf("reserved a hostname twice")
+	}
+
+	for _, invalid := range []Reservation{
+		{MAC: "nope", IP: netip.MustParseAddr("192.168.1.50")},
+		{MAC: "aa:bb:cc:dd:ee:05", IP: netip.MustParseAddr("fe80::1")},
+		{MAC: "aa:bb:cc:dd:ee:05", IP: netip.MustParseAddr("192.168.1.50"), Hostname: "no_underscores"},
+		{MAC: "aa:bb:cc:dd:ee:05", IP: netip.MustParseAddr("192.168.1.50"), Tag: "no,commas"},
+	} {
+		_, err = r.Set(invalid, true)
+		if err == nil {
+			t.Fatalf("accepted invalid reservation %+v", invalid)
+		}
+	}
+
+	// updating a device keeps a single line for it
+	_, err = r.Set(Reservation{MAC: "aa:bb:cc:dd:ee:03", IP: netip.MustParseAddr("192.168.1.31"), Hostname: "printer"}, false)
+	if err != nil {
+		t.Fatalf("unable to update reservation: %s", err)
+	}
+
+	// a second instance reads the same reservations
+	reread := &Reservations{Path: r.Path}
+	err = reread.Load()
+	if err != nil {
+		t.Fatalf("unable to read saved reservations: %s", err)
+	}
+	list := reread.List()
+	if len(list) != 2 || list[0] != (Reservation{MAC: "aa:bb:cc:dd:ee:01", IP: netip.MustParseAddr("192.168.1.20"), Hostname: "laptop", Tag: "trusted"}) ||
+		list[1] != (Reservation{MAC: "aa:bb:cc:dd:ee:03", IP: netip.MustParseAddr("192.168.1.31"), Hostname: "printer"}) {
+		t.Fatalf("unexpected reservations: %+v", list)
+	}
+
+	out.Reset()
+	err = r.AdminCommands()["unreserve"](&out, []string{"192.168.1.31"})
+	if err != nil {
+		t.Fatalf("unable to unreserve: %s", err)
+	}
+	_, found := r.ByMAC("aa:bb:cc:dd:ee:03")
+	if found {
+		t.Fatalf("reservation was not removed")
+	}
+	err = r.AdminCommands()["unreserve"](&out, []string{"192.168.1.31"})
+	if err == nil {
+		t.Fatalf("removed a missing reservation")
+	}
+
+	out.Reset()
+	err = r.Commands()["reservations"](&out, nil)
+	if err != nil || !strings.Contains(out.String(), "192.168.1.20  aa:bb:cc:dd:ee:01  laptop    trusted") {
+		t.Fatalf("unexpected listing %s:\n%s", err, out.String())
+	}
+
+	// leftover temporary files would be read by dnsmasq if it was given the directory
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("temporary files were left behind: %+v", entries)
+	}
+}
+
+func TestReservationsReloadFailure(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "dnsmasq.pid")
+	err := os.WriteFile(pidFile, []byte("4242"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Reservations{
+		Path:     filepath.Join(dir, "hosts"),
+		Reloader: PIDReloader{PIDFile: pidFile, Sender: &fakeSender{err: fmt.Errorf("no such process")}},
+	}
+	_ = r.Load()
+
+	// the reservation is saved even when dnsmasq cannot be told about it
+	_, err = r.Set(Reservation{MAC: "aa:bb:cc:dd:ee:01", IP: netip.MustParseAddr("192.168.1.20")}, false)
+	if err == nil || !strings.Contains(err.Error(), "no such process") {
+		t.Fatalf("reload failure was not reported: %v", err)
+	}
+	_, found := r.ByMAC("aa:bb:cc:dd:ee:01")
+	if !found {
+		t.Fatalf("reservation was dropped")
+	}
+
+	r.Reloader = PIDReloader{PIDFile: filepath.Join(dir, "missing.pid"), Sender: &fakeSender{}}
+	_, err = r.Delete("aa:bb:cc:dd:ee:01")
+	if err == nil {
+		t.Fatalf("missing pid file was not reported")
+	}
+}
+
+func TestReservationsMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(path, []byte("# by hand\naa:bb:cc:dd:ee:01,192.168.1.20,laptop\nnot a reservation\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Reservations{Path: path}
+	err = r.Load()
+	if err == nil {
+		t.Fatalf("loaded a malformed hosts file")
+	}
+
+	res, err := ParseReservation("AA:BB:CC:DD:EE:01,set:iot,192.168.1.20")
+	if err != nil || res.MAC != "aa:bb:cc:dd:ee:01" || res.Tag != "iot" || res.Hostname != "" {
+		t.Fatalf("unexpected reservation %+v: %s", res, err)
+	}
+}
@@ -1,21 +1,30 @@
 package dnsmasq
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/fasmide/routerlogin/health"
+	"github.com/fasmide/routerlogin/runner"
 )
 
 // Store exposes an API to lookup dnsmasq leases by different means
 type Store struct {
 	Path string
 
+	// Source is where leases are read from, the file at Path when nil
+	Source LeaseSource
+
 	lock         sync.Mutex
 	lastPopulate time.Time
 	db           map[string]Entry
+	refreshes    health.Tracker
 }
 
 // byExpiry is used for sorting
@@ -25,8 +34,41 @@ func (a byExpiry) Len() int           { return len(a) }
 func (a byExpiry) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byExpiry) Less(i, j int) bool { return a[i].Expiry.Before(a[j].Expiry) }
 
+// LeaseSource is where a store reads leases from
+type LeaseSource interface {
+	// Leases returns the leases, as dnsmasq writes them to its leases file
+	Leases() (io.ReadCloser, error)
+}
+
+// LeaseFile is a leases file by its path
+type LeaseFile string
+
+// Leases opens the file
+func (f LeaseFile) Leases() (io.ReadCloser, error) {
+	return os.Open(string(f))
+}
+
+// CommandLeaseFile is a leases file read with cat by a runner, e.g. on another host
+type CommandLeaseFile struct {
+	Runner runner.Runner
+	Path   string
+}
+
+// Leases runs cat
+func (f CommandLeaseFile) Leases() (io.ReadCloser, error) {
+	return f.Runner.Start(context.Background(), "cat", f.Path)
+}
+
+// source returns Source or the file at Path
+func (s *Store) source() LeaseSource {
+	if s.Source == nil {
+		return LeaseFile(s.Path)
+	}
+	return s.Source
+}
+
 func (s *Store) populate() error {
-	fd, err := os.Open(s.Path)
+	fd, err := s.source().Leases()
 	if err != nil {
 		return err
 	}
@@ -49,13 +91,30 @@ func (s *Store) populate() error {
 
 func (s *Store) ensure() error {
 	if time.Now().Sub(s.lastPopulate) > time.Second*5 {
+		start := time.Now()
 		s.db = make(map[string]Entry)
-		return s.populate()
+		err := s.populate()
+		s.refreshes.Record(start, err)
+		return err
 	}
 
 	return nil
 }
 
+// Health returns the state of reading the leases file
+func (s *Store) Health() health.State {
+	return s.refreshes.State()
+}
+
+// Reload drops the leases read, so the next lookup reads the leases file again
+func (s *Store) Reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastPopulate = time.Time{}
+	return nil
+}
+
 // LeaseByIP returns a single dnsmasq lease found by ip address
 func (s *Store) LeaseByIP(ip string) (*Entry, error) {
 	s.lock.Lock()
@@ -74,6 +133,22 @@ func (s *Store) LeaseByIP(ip string) (*Entry, error) {
 	return nil, fmt.Errorf("no Entry with ip %s", ip)
 }
 
+// Details returns the lease of an ip address, or nil when it has none
+func (s *Store) Details(ip string) (interface{}, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	if entry, found := s.db[ip]; found {
+		return &entry, nil
+	}
+	return nil, nil
+}
+
 // Addresses returns all net.IP addresses discovered by this store
 func (s *Store) Addresses() ([]net.IP, error) {
 	s.lock.Lock()
@@ -114,5 +189,5 @@ func (s *Store) Data(ip string) (map[string]string, error) {
 	}
 	hostname := "n/a"
 	hostname = s.db[ip].Hostname
-	return map[string]string{"hostname": hostname}, nil
+	return map[string]string{"hostname": hostname, "mac": s.db[ip].Mac}, nil
 }
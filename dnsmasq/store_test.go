@@ -2,7 +2,10 @@ package dnsmasq
 
 import (
 	"net"
+	"os"
 	"testing"
+
+	"github.com/fasmide/routerlogin/runner"
 )
 
 func TestIPLookup(t *testing.T) {
@@ -24,6 +27,13 @@ func TestIPLookup(t *testing.T) {
 	if store.lastPopulate != populated {
 		t.Fatalf("store did not cache results")
 	}
+
+	// but after a reload it should
+	_ = store.Reload()
+	_, _ = store.LeaseByIP("192.168.1.132")
+	if store.lastPopulate == populated {
+		t.Fatalf("store did not read leases again after reload")
+	}
 }
 
 func TestWrongPath(t *testing.T) {
@@ -33,6 +43,10 @@ func TestWrongPath(t *testing.T) {
 	if err == nil {
 		t.Fatalf("found lease when using non existing leases path")
 	}
+
+	if state := store.Health(); state.Ready() || state.LastError == "" {
+		t.Fatalf("failed refresh was not reported: %+v", state)
+	}
 }
 
 func TestMalformedLeasesFile(t *testing.T) {
@@ -66,3 +80,20 @@ func TestAddresses(t *testing.T) {
 		t.Fatalf("item 15 did not match ip %s: was %s", match, slice[14])
 	}
 }
+
+func TestCommandLeaseFile(t *testing.T) {
+	leases, err := os.ReadFile("dnsmasq_test.leases")
+	if err != nil {
+		t.Fatalf("unable to read leases: %s", err)
+	}
+
+	fake := &runner.Fake{Commands: map[string]runner.Result{
+		"cat /tmp/dhcp.leases": {Output: string(leases)},
+	}}
+	store := Store{Source: CommandLeaseFile{Runner: fake, Path: "/tmp/dhcp.leases"}}
+
+	lease, err := store.LeaseByIP("192.168.1.132")
+	if err != nil || lease.Mac != "00:aa:bb:cc:dd:ee" {
+		t.Fatalf("unexpected lease read by runner: %+v, %v", lease, err)
+	}
+}
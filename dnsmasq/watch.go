@@ -0,0 +1,92 @@
+package dnsmasq
+
+import (
+	"context"
+	"time"
+)
+
+// Event types published by Watch
+const (
+	EventLeaseAdded   = "lease-added"
+	EventLeaseRenewed = "lease-renewed"
+	EventLeaseExpired = "lease-expired"
+)
+
+// watchInterval is how often Watch reads the leases file
+var watchInterval = 5 * time.Second
+
+// Watch reads the leases every few seconds and emits lease-added, lease-renewed
+// and lease-expired events by ip address, until ctx is done
+func (s *Store) Watch(ctx context.Context, emit func(kind, host string, data interface{})) error {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	var previous map[string]Entry
+	for {
+		current, err := readLeases(s.source())
+		if err != nil {
+			return err
+		}
+
+		// the leases we start out with are not news
+		if previous != nil {
+			diffLeases(previous, current, time.Now(), emit)
+		}
+		previous = current
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// readLeases reads leases by ip address
+func readLeases(source LeaseSource) (map[string]Entry, error) {
+	fd, err := source.Leases()
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	entries, err := Parse(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make(map[string]Entry, len(entries))
+	for _, e := range entries {
+		leases[e.IP] = e
+	}
+	return leases, nil
+}
+
+// diffLeases emits the changes from previous to current, leases past their expiry
+// are expired even if dnsmasq have not removed them from the file yet
+func diffLeases(previous, current map[string]Entry, now time.Time, emit func(kind, host string, data interface{})) {
+	for ip, e := range current {
+		old, found := previous[ip]
+		expired := expiredAt(e, now)
+		switch {
+		case expired && found && !expiredAt(old, now):
+			emit(EventLeaseExpired, ip, e)
+		case expired:
+		case !found || old.Mac != e.Mac || expiredAt(old, now):
+			emit(EventLeaseAdded, ip, e)
+		case !old.Expiry.Equal(e.Expiry):
+			emit(EventLeaseRenewed, ip, e)
+		}
+	}
+
+	for ip, old := range previous {
+		if _, found := current[ip]; !found && !expiredAt(old, now) {
+			emit(EventLeaseExpired, ip, old)
+		}
+	}
+}
+
+// expiredAt reports if a lease have expired, leases with a zero expiry time never expires
+func expiredAt(e Entry, now time.Time) bool {
+	return e.Expiry.Unix() != 0 && e.Expiry.Before(now)
+}
@@ -0,0 +1,97 @@
+package dnsmasq
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDiffLeases(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	lease := func(ip, mac string, expiry time.Duration) Entry {
+		return Entry{IP: ip, Mac: mac, Expiry: now.Add(expiry), Hostname: "host"}
+	}
+
+	previous := map[string]Entry{
+		"192.168.1.2": lease("192.168.1.2", "aa", time.Hour),
+		"192.168.1.3": lease("192.168.1.3", "bb", time.Hour),
+		"192.168.1.4": lease("192.168.1.4", "cc", time.Minute),
+		"192.168.1.5": lease("192.168.1.5", "dd", time.Hour),
+		"192.168.1.6": lease("192.168.1.6", "ee", time.Hour),
+	}
+	current := map[string]Entry{
+		"192.168.1.2": lease("192.168.1.2", "aa", time.Hour),    // unchanged
+		"192.168.1.3": lease("192.168.1.3", "bb", 2*time.Hour),  // renewed
+		"192.168.1.4": lease("192.168.1.4", "cc", -time.Second), // expired, still in the file
+		"192.168.1.6": lease("192.168.1.6", "ff", time.Hour),    // another device got the address
+		"192.168.1.7": lease("192.168.1.7", "gg", time.Hour),    // new
+		"192.168.1.8": lease("192.168.1.8", "hh", -time.Hour),   // expired before we saw it
+	}
+
+	events := make([]string, 0)
+	diffLeases(previous, current, now, func(kind, host string, data interface{}) {
+		events = append(events, kind+" "+host)
+	})
+	sort.Strings(events)
+
+	expected := []string{
+		"lease-added 192.168.1.6",
+		"lease-added 192.168.1.7",
+		"lease-expired 192.168.1.4",
+		"lease-expired 192.168.1.5",
+		"lease-renewed 192.168.1.3",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	defer func(interval time.Duration) { watchInterval = interval }(watchInterval)
+	watchInterval = 20 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	write := func(lines string) {
+		err := os.WriteFile(path, []byte(lines), 0644)
+		if err != nil {
+			t.Fatalf("unable to write leases: %s", err)
+		}
+	}
+	expiry := time.Now().Add(time.Hour).Unix()
+	write(fmt.Sprintf("%d aa:bb:cc:dd:ee:ff 192.168.1.2 phone *\n", expiry))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan string, 4)
+	store := &Store{Path: path}
+	done := make(chan error)
+	go func() {
+		done <- store.Watch(ctx, func(kind, host string, data interface{}) {
+			events <- kind + " " + host
+		})
+	}()
+
+	// the first read is only remembered, so changing the file afterwards gives an event
+	time.Sleep(100 * time.Millisecond)
+	write(fmt.Sprintf("%d aa:bb:cc:dd:ee:ff 192.168.1.2 phone *\n%d 11:bb:cc:dd:ee:ff 192.168.1.3 laptop *\n", expiry, expiry))
+
+	select {
+	case e := <-events:
+		if e != "lease-added 192.168.1.3" {
+			t.Fatalf("unexpected event %s", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event was emitted")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("watch failed: %s", err)
+	}
+}
@@ -0,0 +1,385 @@
+// Package federation pulls the host tables of other routerlogin instances over their
+// http api, so a single daemon can show the hosts of several sites
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fasmide/routerlogin/health"
+)
+
+// Peer is another routerlogin instance serving its http interface
+type Peer struct {
+	// Site names the peer in the site column
+	Site string
+
+	// URL is where the peer serves its http interface e.g. http://10.0.1.1:8080
+	URL string
+}
+
+// peer is a peer and how reading its table went
+type peer struct {
+	Peer
+	refreshes health.Tracker
+	hosts     int
+
+	// conflicts are the addresses of the peer another host has at an earlier site
+	conflicts []string
+}
+
+// host is a host seen at one or more sites
+type host struct {
+	// row is the merged row, with the ip address of the first site
+	row map[string]string
+
+	// sites are the rows of the host by site, as they were before being merged
+	sites map[string]map[string]string
+}
+
+// Store is the host tables of its peers as a single table with a site column. Hosts
+// are merged by mac address, a host seen at several sites has them all in its site
+// column and the values of the first peer which have them. Hosts without a mac address
+// are only the same host at the same site and address. Sites are likely numbered alike,
+// so an address may be of several hosts, each in a row of its own. Peers which cannot
+// be reached are left out until they can, the store only fails when every peer does
+type Store struct {
+	// Client requests the peers, defaults to a client with a 5 second timeout
+	Client *http.Client
+
+	peers []*peer
+
+	lock         sync.Mutex
+	lastPopulate time.Time
+	hosts        []*host
+	byIP         map[string][]*host
+	refreshes    health.Tracker
+}
+
+// New returns a store of peers, in the order their values are preferred
+func New(peers ...Peer) *Store {
+	s := &Store{}
+	for _, p := range peers {
+		s.peers = append(s.peers, &peer{Peer: p})
+	}
+	return s
+}
+
+// client returns Client or its default
+func (s *Store) client() *http.Client {
+	if s.Client == nil {
+		return &http.Client{Timeout: 5 * time.Second}
+	}
+	return s.Client
+}
+
+// table is a host table as served by /api/table
+type table struct {
+	Headers []string   `json:"headers"`
+	Rows    [][]string `json:"rows"`
+}
+
+// fetch returns the rows of a peer by header
+func (s *Store) fetch(p *peer) ([]map[string]string, error) {
+	res, err := s.client().Get(strings.TrimSuffix(p.URL, "/") + "/api/table")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	t := table{}
+	err = json.NewDecoder(res.Body).Decode(&t)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode table: %s", err)
+	}
+
+	rows := make([]map[string]string, 0, len(t.Rows))
+	for _, r := range t.Rows {
+		row := make(map[string]string, len(t.Headers))
+		for i, h := range t.Headers {
+			if i < len(r) {
+				row[h] = r[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ensure updates the rows if needed
+func (s *Store) ensure() error {
+	if time.Now().Sub(s.lastPopulate) > time.Second*5 {
+		start := time.Now()
+		err := s.populate()
+		s.refreshes.Record(start, err)
+		return err
+	}
+
+	return nil
+}
+
+// populate reads the table of every peer at once and merges them
+func (s *Store) populate() error {
+	tables := make([][]map[string]string, len(s.peers))
+	errs := make([]error, len(s.peers))
+
+	var wg sync.WaitGroup
+	for i, p := range s.peers {
+		wg.Add(1)
+		go func(i int, p *peer) {
+			defer wg.Done()
+
+			start := time.Now()
+			tables[i], errs[i] = s.fetch(p)
+			if errs[i] != nil && p.refreshes.State().LastError == "" {
+				log.Printf("federation: unable to read site %s, leaving it out: %s", p.Site, errs[i])
+			}
+			p.refreshes.Record(start, errs[i])
+			p.hosts = len(tables[i])
+		}(i, p)
+	}
+	wg.Wait()
+
+	var hosts []*host
+	byKey := make(map[string]*host)
+	byIP := make(map[string][]*host)
+	failed := 0
+	for i, p := range s.peers {
+		if errs[i] != nil {
+			failed++
+			continue
+		}
+
+		var conflicts []string
+		for _, r := range tables[i] {
+			ip := r["ip"]
+			key := strings.ToLower(r["mac"])
+			if key == "" {
+				key = p.Site + " " + ip
+			}
+
+			h, found := byKey[key]
+			if !found {
+				h = &host{row: map[string]string{"ip": ip}, sites: make(map[string]map[string]string)}
+				byKey[key] = h
+				hosts = append(hosts, h)
+			}
+			h.sites[p.Site] = r
+			merge(h.row, r, p.Site)
+
+			if others := byIP[ip]; len(others) > 0 && others[0] != h {
+				conflicts = append(conflicts, ip)
+			}
+			if !contains(byIP[ip], h) {
+				byIP[ip] = append(byIP[ip], h)
+			}
+		}
+		p.conflicts = conflicts
+	}
+
+	if len(s.peers) > 0 && failed == len(s.peers) {
+		return fmt.Errorf("no site could be read, first error: %s", errs[0])
+	}
+
+	// peers may have stores of their own, every row has every column of every peer
+	columns := map[string]bool{"site": true}
+	for _, t := range tables {
+		for _, r := range t {
+			for key := range r {
+				columns[key] = true
+			}
+		}
+	}
+	for _, h := range hosts {
+		for key := range columns {
+			if _, found := h.row[key]; !found {
+				h.row[key] = ""
+			}
+		}
+	}
+
+	s.hosts = hosts
+	s.byIP = byIP
+	s.lastPopulate = time.Now()
+	return nil
+}
+
+// contains returns whether h is one of hosts
+func contains(hosts []*host, h *host) bool {
+	for _, other := range hosts {
+		if other == h {
+			return true
+		}
+	}
+	return false
+}
+
+// merge adds the row of a site to a merged row, peers federating sites themselves have
+// a site column of their own which is used instead of the site name of the peer
+func merge(merged, row map[string]string, site string) {
+	if sites := row["site"]; sites != "" {
+		site = sites
+	}
+	if merged["site"] == "" {
+		merged["site"] = site
+	} else {
+		merged["site"] += "," + site
+	}
+
+	for key, value := range row {
+		if key == "ip" || key == "site" {
+			continue
+		}
+		if merged[key] == "" {
+			merged[key] = value
+		}
+	}
+}
+
+// Reload drops the rows read, so the next query reads every peer again
+func (s *Store) Reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastPopulate = time.Time{}
+	return nil
+}
+
+// Health returns the state of reading the peers
+func (s *Store) Health() health.State {
+	return s.refreshes.State()
+}
+
+// Addresses returns the addresses of every host of every site
+func (s *Store) Addresses() ([]net.IP, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]net.IP, 0, len(s.byIP))
+	for ip := range s.byIP {
+		if addr := net.ParseIP(ip); addr != nil {
+			res = append(res, addr)
+		}
+	}
+	return res, nil
+}
+
+// Rows returns the merged row of every host, with every site it was seen at
+func (s *Store) Rows() ([]map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]map[string]string, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		row := make(map[string]string, len(h.row))
+		for key, value := range h.row {
+			row[key] = value
+		}
+		res = append(res, row)
+	}
+	return res, nil
+}
+
+// Data returns the merged row of the host first seen with an ip address
+func (s *Store) Data(ip string) (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]string{"site": ""}
+	if hosts := s.byIP[ip]; len(hosts) > 0 {
+		for key, value := range hosts[0].row {
+			res[key] = value
+		}
+	}
+	delete(res, "ip")
+	return res, nil
+}
+
+// Details returns the rows by site of the hosts with an ip address, as they were before
+// being merged
+func (s *Store) Details(ip string) (interface{}, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := s.byIP[ip]
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	sites := make(map[string]map[string]string)
+	for _, h := range hosts {
+		for site, row := range h.sites {
+			sites[site] = row
+		}
+	}
+	return sites, nil
+}
+
+// Commands returns the peers command
+func (s *Store) Commands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"peers": s.peersCommand,
+	}
+}
+
+// peersCommand writes how reading every peer went
+func (s *Store) peersCommand(w io.Writer, _ []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.ensure()
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+	}
+
+	peers := append([]*peer(nil), s.peers...)
+	sort.SliceStable(peers, func(i, j int) bool { return peers[i].Site < peers[j].Site })
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "site\turl\tstatus\thosts\tconflicts\tlast success\tlatency\tlast error")
+	for _, p := range peers {
+		state := p.refreshes.State()
+		status, hosts, success := "ok", fmt.Sprint(p.hosts), "never"
+		if state.LastError != "" {
+			status, hosts = "unreachable", "-"
+		}
+		if state.Ready() {
+			success = state.LastSuccess.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", p.Site, p.URL, status, hosts, len(p.conflicts), success, state.Latency.Round(time.Millisecond), state.LastError)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,250 @@
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fasmide/routerlogin/daemon"
+)
+
+// hosts is a store of fixed rows by ip address
+type hosts map[string]map[string]string
+
+func (h hosts) Addresses() ([]net.IP, error) {
+	var res []net.IP
+	for ip := range h {
+		res = append(res, net.ParseIP(ip))
+	}
+	return res, nil
+}
+
+func (h hosts) Data(ip string) (map[string]string, error) {
+	res := map[string]string{"hostname": "", "nFlows": "0"}
+	for key, value := range h[ip] {
+		res[key] = value
+	}
+	return res, nil
+}
+
+// serve serves a daemon of stores on loopback, and returns its url
+func serve(t *testing.T, stores ...daemon.Store) string {
+	d := &daemon.Daemon{}
+	d.AddStore(stores...)
+
+	server := httptest.NewServer(d.HTTPHandler())
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// unreachable returns the url of a daemon which is gone
+func unreachable(t *testing.T) string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+// rows returns the table of a daemon by ip address and header
+func rows(t *testing.T, url string) map[string]map[string]string {
+	res, err := http.Get(url + "/api/table")
+	if err != nil {
+		t.Fatalf("unable to get table: %s", err)
+	}
+	defer res.Body.Close()
+
+	tbl := table{}
+	err = json.NewDecoder(res.Body).Decode(&tbl)
+	if err != nil {
+		t.Fatalf("unable to decode table: %s", err)
+	}
+
+	byIP := make(map[string]map[string]string)
+	for _, r := range tbl.Rows {
+		row := make(map[string]string)
+		for i, h := range tbl.Headers {
+			if i < len(r) {
+				row[h] = r[i]
+			}
+		}
+		byIP[row["ip"]] = row
+	}
+	return byIP
+}
+
+func TestFederation(t *testing.T) {
+	hq := serve(t, hosts{
+		"192.168.1.10": {"hostname": "laptop", "mac": "aa:00:00:00:00:10", "nFlows": "3"},
+		"192.168.1.20": {"hostname": "printer"},
+	})
+
+	// an access point on the same lan, where the laptop roams to
+	ap := serve(t, hosts{
+		"192.168.1.10": {"mac": "aa:00:00:00:00:10", "nFlows": "5"},
+		"192.168.1.30": {"hostname": "phone"},
+	})
+
+	store := New(Peer{Site: "hq", URL: hq}, Peer{Site: "ap", URL: ap + "/"}, Peer{Site: "branch", URL: unreachable(t)})
+	federated := serve(t, store)
+
+	merged := rows(t, federated)
+	if len(merged) != 3 {
+		t.Fatalf("expected 3 hosts, got %+v", merged)
+	}
+	if laptop := merged["192.168.1.10"]; laptop["site"] != "hq,ap" || laptop["hostname"] != "laptop" || laptop["nFlows"] != "3" {
+		t.Fatalf("laptop was not merged: %+v", laptop)
+	}
+	if phone := merged["192.168.1.30"]; phone["site"] != "ap" || phone["hostname"] != "phone" {
+		t.Fatalf("unexpected phone: %+v", phone)
+	}
+
+	// the rows of each site are kept for the host details
+	details, _ := store.Details("192.168.1.10")
+	if sites := details.(map[string]map[string]string); sites["ap"]["nFlows"] != "5" || sites["hq"]["hostname"] != "laptop" {
+		t.Fatalf("unexpected details: %+v", sites)
+	}
+
+	res, err := http.Get(federated + "/api/table?where=site=ap&by=site")
+	if err != nil {
+		t.Fatalf("unable to query table: %s", err)
+	}
+	defer res.Body.Close()
+	bySite := table{}
+	json.NewDecoder(res.Body).Decode(&bySite)
+	if len(bySite.Rows) != 2 {
+		t.Fatalf("unexpected rows by site: %+v", bySite)
+	}
+
+	var out bytes.Buffer
+	store.peersCommand(&out, nil)
+	for _, line := range strings.Split(out.String(), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && (fields[0] == "branch") != (fields[2] == "unreachable") {
+			t.Fatalf("unexpected peer status: %s", line)
+		}
+	}
+	if store.Health().LastError != "" {
+		t.Fatalf("store failed with a single site unreachable: %+v", store.Health())
+	}
+
+	// a federation of federations keeps the sites
+	top := New(Peer{Site: "europe", URL: federated})
+	if data, _ := top.Data("192.168.1.10"); data["site"] != "hq,ap" {
+		t.Fatalf("nested sites were lost: %+v", data)
+	}
+	if data, _ := top.Data("10.0.0.1"); data["site"] != "" {
+		t.Fatalf("unknown host had a site: %+v", data)
+	}
+}
+
+// owners is a store of owner and group columns, which only some peers have
+type owners map[string]string
+
+func (o owners) Addresses() ([]net.IP, error) {
+	return nil, nil
+}
+
+func (o owners) Data(ip string) (map[string]string, error) {
+	return map[string]string{"owner": o[ip], "group": ""}, nil
+}
+
+func TestFederationColumns(t *testing.T) {
+	// hosts of the site with more columns come first or last as the table is collected
+	// in no particular order, enough of them makes it likely to happen both ways
+	hq, branch := hosts{}, hosts{}
+	for i := 1; i <= 20; i++ {
+		hq[fmt.Sprintf("192.168.1.%d", i)] = map[string]string{"hostname": "laptop"}
+		branch[fmt.Sprintf("10.0.0.%d", i)] = map[string]string{"hostname": "till"}
+	}
+	federated := serve(t, New(Peer{Site: "hq", URL: serve(t, hq)}, Peer{Site: "branch", URL: serve(t, branch, owners{"10.0.0.10": "shop"})}))
+
+	res, err := http.Get(federated + "/api/table")
+	if err != nil {
+		t.Fatalf("unable to get table: %s", err)
+	}
+	defer res.Body.Close()
+
+	tbl := table{}
+	json.NewDecoder(res.Body).Decode(&tbl)
+	if len(tbl.Rows) != 40 {
+		t.Fatalf("unexpected table: %+v", tbl)
+	}
+	for _, r := range tbl.Rows {
+		if len(r) < len(tbl.Headers) {
+			t.Fatalf("row without every column: %v of %v", r, tbl.Headers)
+		}
+	}
+	if merged := rows(t, federated); merged["10.0.0.10"]["owner"] != "shop" || merged["192.168.1.10"]["owner"] != "" {
+		t.Fatalf("unexpected owners: %+v", merged)
+	}
+}
+
+func TestFederationOverlapping(t *testing.T) {
+	hq := serve(t, hosts{
+		"192.168.1.10": {"hostname": "laptop", "mac": "aa:00:00:00:00:10"},
+		"192.168.1.20": {"hostname": "printer"},
+	})
+
+	// a branch numbering its lan the same, where the addresses are of other hosts and
+	// the laptop visiting got another address
+	branch := serve(t, hosts{
+		"192.168.1.10": {"hostname": "till", "mac": "bb:00:00:00:00:10", "nFlows": "7"},
+		"192.168.1.11": {"hostname": "laptop", "mac": "AA:00:00:00:00:10"},
+		"192.168.1.20": {"hostname": "scale"},
+	})
+
+	store := New(Peer{Site: "hq", URL: hq}, Peer{Site: "branch", URL: branch})
+	res, err := http.Get(serve(t, store) + "/api/table")
+	if err != nil {
+		t.Fatalf("unable to get table: %s", err)
+	}
+	defer res.Body.Close()
+	tbl := table{}
+	json.NewDecoder(res.Body).Decode(&tbl)
+
+	var found []string
+	for _, r := range tbl.Rows {
+		row := make(map[string]string)
+		for i, h := range tbl.Headers {
+			row[h] = r[i]
+		}
+		found = append(found, row["hostname"]+"@"+row["site"]+"="+row["ip"])
+	}
+	sort.Strings(found)
+	expected := "laptop@hq,branch=192.168.1.10 printer@hq=192.168.1.20 scale@branch=192.168.1.20 till@branch=192.168.1.10"
+	if strings.Join(found, " ") != expected {
+		t.Fatalf("unexpected hosts: %s", found)
+	}
+
+	// the rows of every host of an address are kept for the host details
+	details, _ := store.Details("192.168.1.10")
+	if sites := details.(map[string]map[string]string); sites["hq"]["hostname"] != "laptop" || sites["branch"]["hostname"] != "till" {
+		t.Fatalf("unexpected details: %+v", sites)
+	}
+
+	var out bytes.Buffer
+	store.peersCommand(&out, nil)
+	for _, line := range strings.Split(out.String(), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && (fields[0] == "branch") != (fields[4] == "2") {
+			t.Fatalf("unexpected conflicts: %s", line)
+		}
+	}
+}
+
+func TestFederationUnreachable(t *testing.T) {
+	store := New(Peer{Site: "a", URL: unreachable(t)}, Peer{Site: "b", URL: unreachable(t)})
+
+	_, err := store.Addresses()
+	if err == nil {
+		t.Fatalf("no error with every site unreachable")
+	}
+	if store.Health().Failures != 1 {
+		t.Fatalf("failure was not recorded: %+v", store.Health())
+	}
+}
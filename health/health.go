@@ -0,0 +1,64 @@
+// Package health keeps track of how well stores are refreshing their data
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// State describes the refreshes of a store
+type State struct {
+	LastAttempt time.Time     `json:"lastAttempt"`
+	LastSuccess time.Time     `json:"lastSuccess"`
+	LastError   string        `json:"lastError,omitempty"`
+	Latency     time.Duration `json:"latency"`
+	Refreshes   int           `json:"refreshes"`
+	Failures    int           `json:"failures"`
+}
+
+// Ready reports if the store ever refreshed successfully
+func (s State) Ready() bool {
+	return !s.LastSuccess.IsZero()
+}
+
+// Age returns the age of the data, which is zero before the first successful refresh
+func (s State) Age(now time.Time) time.Duration {
+	if !s.Ready() {
+		return 0
+	}
+	return now.Sub(s.LastSuccess)
+}
+
+// Tracker records refreshes, it is safe for concurrent use
+type Tracker struct {
+	lock  sync.Mutex
+	state State
+}
+
+// Record records a refresh which began at start and ended now with err
+func (t *Tracker) Record(start time.Time, err error) {
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.state.LastAttempt = start
+	t.state.Latency = now.Sub(start)
+	t.state.Refreshes++
+
+	if err != nil {
+		t.state.LastError = err.Error()
+		t.state.Failures++
+		return
+	}
+
+	t.state.LastSuccess = now
+	t.state.LastError = ""
+}
+
+// State returns the current state
+func (t *Tracker) State() State {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.state
+}
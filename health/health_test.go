@@ -0,0 +1,36 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := Tracker{}
+	if tracker.State().Ready() {
+		t.Fatalf("tracker was ready before any refresh")
+	}
+
+	start := time.Now().Add(-time.Second)
+	tracker.Record(start, nil)
+	state := tracker.State()
+	if !state.Ready() || state.Latency < time.Second || state.Refreshes != 1 {
+		t.Fatalf("successful refresh was not recorded: %+v", state)
+	}
+	success := state.LastSuccess
+
+	tracker.Record(time.Now(), errors.New("no such file"))
+	state = tracker.State()
+	if state.LastError != "no such file" || state.Failures != 1 || state.LastSuccess != success {
+		t.Fatalf("failed refresh was not recorded: %+v", state)
+	}
+	if age := state.Age(success.Add(time.Minute)); age != time.Minute {
+		t.Fatalf("age was expected to be 1m, was %s", age)
+	}
+
+	tracker.Record(time.Now(), nil)
+	if state = tracker.State(); state.LastError != "" {
+		t.Fatalf("error was not cleared by a successful refresh: %+v", state)
+	}
+}
@@ -0,0 +1,216 @@
+// Package history keeps bounded time series of per host metrics in memory,
+// each series is stored at several resolutions which are consolidated as samples arrive
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tier is a resolution at which series are stored
+type Tier struct {
+	// Step is the width of a bucket
+	Step time.Duration
+	// Span is how far back the tier reaches
+	Span time.Duration
+}
+
+// buckets is the number of buckets a tier needs
+func (t Tier) buckets() int {
+	return int(t.Span / t.Step)
+}
+
+// DefaultTiers keeps 10 second buckets for an hour, minutes for a day and quarters for a week
+var DefaultTiers = []Tier{
+	{Step: 10 * time.Second, Span: time.Hour},
+	{Step: time.Minute, Span: 24 * time.Hour},
+	{Step: 15 * time.Minute, Span: 7 * 24 * time.Hour},
+}
+
+// Point is a value at a point in time, Value is the average of the samples in its bucket
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// bucket consolidates the samples of one step
+type bucket struct {
+	Start int64 // unix nanoseconds, zero when unused
+	Sum   float64
+	Count int
+}
+
+// ring is a tier of a series
+type ring struct {
+	Buckets []bucket
+}
+
+// add adds a sample to the bucket of its step, replacing whatever the ring held a lap ago
+func (r *ring) add(step time.Duration, t time.Time, v float64) {
+	start := t.Truncate(step).UnixNano()
+	b := &r.Buckets[int(start/int64(step))%len(r.Buckets)]
+	if b.Start != start {
+		*b = bucket{Start: start}
+	}
+	b.Sum += v
+	b.Count++
+}
+
+// points returns the used buckets between from and to, in order
+func (r *ring) points(step time.Duration, from, to time.Time) []Point {
+	res := make([]Point, 0)
+	// a bucket lap ago is stale, even if it was never overwritten
+	oldest := to.Add(-step * time.Duration(len(r.Buckets))).UnixNano()
+	for _, b := range r.Buckets {
+		if b.Count == 0 || b.Start <= oldest {
+			continue
+		}
+		t := time.Unix(0, b.Start)
+		if t.Before(from.Truncate(step)) || t.After(to) {
+			continue
+		}
+		res = append(res, Point{Time: t, Value: b.Sum / float64(b.Count)})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	return res
+}
+
+// series is the tiers of a single host and metric
+type series struct {
+	Rings []ring
+	Last  time.Time
+}
+
+// key identifies a series
+type key struct {
+	Host   string
+	Metric string
+}
+
+// History holds series of every host and metric, it is safe for concurrent use
+type History struct {
+	tiers []Tier
+
+	lock   sync.RWMutex
+	series map[key]*series
+}
+
+// New returns an empty history using given tiers, from the finest to the coarsest
+func New(tiers []Tier) *History {
+	return &History{tiers: tiers, series: make(map[key]*series)}
+}
+
+// Add records a sample
+func (h *History) Add(t time.Time, host, metric string, v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	k := key{Host: host, Metric: metric}
+	s, found := h.series[k]
+	if !found {
+		s = &series{Rings: make([]ring, len(h.tiers))}
+		for i, tier := range h.tiers {
+			s.Rings[i].Buckets = make([]bucket, tier.buckets())
+		}
+		h.series[k] = s
+	}
+
+	for i, tier := range h.tiers {
+		s.Rings[i].add(tier.Step, t, v)
+	}
+	if t.After(s.Last) {
+		s.Last = t
+	}
+}
+
+// Query returns the points of a series between from and to, at the finest
+// tier reaching back to from
+func (h *History) Query(host, metric string, from, to time.Time) []Point {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	s, found := h.series[key{Host: host, Metric: metric}]
+	if !found || len(h.tiers) == 0 {
+		return []Point{}
+	}
+
+	i := h.tierFor(to.Sub(from))
+	return s.Rings[i].points(h.tiers[i].Step, from, to)
+}
+
+// tierFor returns the finest tier spanning d, or the coarsest if none does
+func (h *History) tierFor(d time.Duration) int {
+	for i, tier := range h.tiers {
+		if tier.Span >= d {
+			return i
+		}
+	}
+	return len(h.tiers) - 1
+}
+
+// Retention returns how far back the coarsest tier reaches
+func (h *History) Retention() time.Duration {
+	if len(h.tiers) == 0 {
+		return 0
+	}
+	return h.tiers[len(h.tiers)-1].Span
+}
+
+// Hosts returns the hosts having series, sorted
+func (h *History) Hosts() []string {
+	return h.list(func(k key) string { return k.Host }, "")
+}
+
+// Metrics returns the metrics recorded for a host, sorted
+func (h *History) Metrics(host string) []string {
+	return h.list(func(k key) string { return k.Metric }, host)
+}
+
+// list returns the distinct names of series keys, optionally limited to a host
+func (h *History) list(name func(key) string, host string) []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	seen := make(map[string]bool)
+	for k := range h.series {
+		if host == "" || k.Host == host {
+			seen[name(k)] = true
+		}
+	}
+
+	res := make([]string, 0, len(seen))
+	for n := range seen {
+		res = append(res, n)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Prune removes series without samples since before, e.g. of devices long gone
+func (h *History) Prune(before time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for k, s := range h.series {
+		if s.Last.Before(before) {
+			delete(h.series, k)
+		}
+	}
+}
+
+// Rate turns points of an ever growing counter into its change per second. Intervals
+// where the counter drops e.g. from restarting are skipped, as nothing tells how much
+// it grew before starting over
+func Rate(points []Point) []Point {
+	res := make([]Point, 0, len(points))
+	for i := 1; i < len(points); i++ {
+		seconds := points[i].Time.Sub(points[i-1].Time).Seconds()
+		delta := points[i].Value - points[i-1].Value
+		if delta < 0 || seconds <= 0 {
+			continue
+		}
+		res = append(res, Point{Time: points[i].Time, Value: delta / seconds})
+	}
+	return res
+}
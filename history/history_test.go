@@ -0,0 +1,136 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTiers are small enough to wrap around in a test
+var testTiers = []Tier{
+	{Step: 10 * time.Second, Span: time.Minute},
+	{Step: time.Minute, Span: 10 * time.Minute},
+}
+
+// fill adds a sample every 10 seconds from start, with the value counting up from zero
+func fill(h *History, start time.Time, n int) {
+	for i := 0; i < n; i++ {
+		h.Add(start.Add(time.Duration(i)*10*time.Second), "192.168.1.2", "flows", float64(i))
+	}
+}
+
+func TestQuery(t *testing.T) {
+	h := New(testTiers)
+	start := time.Date(2026, time.October, 1, 12, 0, 0, 0, time.UTC)
+	fill(h, start, 30) // five minutes
+	now := start.Add(290 * time.Second)
+
+	// the last minute comes from the finest tier
+	points := h.Query("192.168.1.2", "flows", now.Add(-50*time.Second), now)
+	if len(points) != 6 || points[0].Value != 24 || points[5].Value != 29 {
+		t.Fatalf("unexpected points from the finest tier: %+v", points)
+	}
+
+	// which have forgotten anything older than a minute, so the coarser tier answers
+	points = h.Query("192.168.1.2", "flows", start, now)
+	if len(points) != 5 {
+		t.Fatalf("expected 5 one minute points, got %+v", points)
+	}
+	if !points[0].Time.Equal(start) || points[0].Value != 2.5 || points[4].Value != 26.5 {
+		t.Fatalf("minutes was not averaged: %+v", points)
+	}
+
+	if points = h.Query("192.168.1.2", "bytes", start, now); len(points) != 0 {
+		t.Fatalf("unknown metric returned points: %+v", points)
+	}
+
+	// a lap later, nothing from the first minute is left in the finest tier
+	fill(h, start.Add(time.Hour), 1)
+	points = h.Query("192.168.1.2", "flows", start.Add(time.Hour-time.Minute), start.Add(time.Hour))
+	if len(points) != 1 || points[0].Value != 0 {
+		t.Fatalf("stale buckets was returned: %+v", points)
+	}
+}
+
+func TestHostsAndPrune(t *testing.T) {
+	h := New(testTiers)
+	now := time.Now()
+	h.Add(now.Add(-time.Hour), "192.168.1.3", "flows", 1)
+	h.Add(now, "192.168.1.2", "flows", 1)
+	h.Add(now, "192.168.1.2", "bytesIn", 1)
+
+	if hosts := h.Hosts(); !reflect.DeepEqual(hosts, []string{"192.168.1.2", "192.168.1.3"}) {
+		t.Fatalf("unexpected hosts %+v", hosts)
+	}
+	if metrics := h.Metrics("192.168.1.2"); !reflect.DeepEqual(metrics, []string{"bytesIn", "flows"}) {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+
+	h.Prune(now.Add(-time.Minute))
+	if hosts := h.Hosts(); !reflect.DeepEqual(hosts, []string{"192.168.1.2"}) {
+		t.Fatalf("old host was not pruned: %+v", hosts)
+	}
+}
+
+func TestRate(t *testing.T) {
+	start := time.Now()
+	points := []Point{
+		{Time: start, Value: 100},
+		{Time: start.Add(10 * time.Second), Value: 600},
+		{Time: start.Add(20 * time.Second), Value: 200},
+		{Time: start.Add(30 * time.Second), Value: 500},
+	}
+
+	// the drop is skipped rather than counted as new
+	rates := Rate(points)
+	if len(rates) != 2 || rates[0].Value != 50 || rates[1].Value != 30 || !rates[1].Time.Equal(points[3].Time) {
+		t.Fatalf("unexpected rates %+v", rates)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	h := New(testTiers)
+	start := time.Date(2026, time.October, 1, 12, 0, 0, 0, time.UTC)
+	fill(h, start, 30)
+	now := start.Add(290 * time.Second)
+
+	var b bytes.Buffer
+	err := h.Save(&b)
+	if err != nil {
+		t.Fatalf("unable to save: %s", err)
+	}
+
+	loaded := New(testTiers)
+	err = loaded.Load(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to load: %s", err)
+	}
+	if !reflect.DeepEqual(loaded.Query("192.168.1.2", "flows", start, now), h.Query("192.168.1.2", "flows", start, now)) {
+		t.Fatalf("loaded history differs")
+	}
+
+	err = New(DefaultTiers).Load(bytes.NewReader(b.Bytes()))
+	if err == nil {
+		t.Fatalf("history with other tiers was loaded")
+	}
+
+	path := filepath.Join(t.TempDir(), "history")
+	if err = New(testTiers).LoadFile(path); err != nil {
+		t.Fatalf("missing file was not treated as empty: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.RunSaver(ctx, path, time.Hour)
+
+	loaded = New(testTiers)
+	if err = loaded.LoadFile(path); err != nil {
+		t.Fatalf("unable to load file: %s", err)
+	}
+	if len(loaded.Query("192.168.1.2", "flows", start, now)) != 5 {
+		t.Fatalf("saved file did not have the series")
+	}
+}
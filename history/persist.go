@@ -0,0 +1,90 @@
+package history
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/fasmide/routerlogin/atomicfile"
+)
+
+// snapshot is what is written to disk
+type snapshot struct {
+	Tiers  []Tier
+	Series map[key]*series
+}
+
+// Save writes every series to w
+func (h *History) Save(w io.Writer) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return gob.NewEncoder(w).Encode(snapshot{Tiers: h.tiers, Series: h.series})
+}
+
+// Load replaces the series with the ones read from r, which must have been saved with the same tiers
+func (h *History) Load(r io.Reader) error {
+	snap := snapshot{}
+	err := gob.NewDecoder(r).Decode(&snap)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(snap.Tiers, h.tiers) {
+		return fmt.Errorf("history was saved with other tiers")
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.series = snap.Series
+	if h.series == nil {
+		h.series = make(map[key]*series)
+	}
+	return nil
+}
+
+// SaveFile saves the series to path
+func (h *History) SaveFile(path string) error {
+	return atomicfile.Write(path, 0600, h.Save)
+}
+
+// LoadFile loads from path, a missing file leaves the history empty
+func (h *History) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return h.Load(f)
+}
+
+// RunSaver saves to path every interval, and once more when ctx is done
+func (h *History) RunSaver(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+
+		err := h.SaveFile(path)
+		if err != nil {
+			log.Printf("history: unable to save %s: %s", path, err)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
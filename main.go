@@ -1,37 +1,463 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
+	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/fasmide/routerlogin/capture"
 	"github.com/fasmide/routerlogin/conntrack"
 	"github.com/fasmide/routerlogin/daemon"
 	"github.com/fasmide/routerlogin/dnsmasq"
+	"github.com/fasmide/routerlogin/history"
+	"github.com/fasmide/routerlogin/portal"
+	"github.com/fasmide/routerlogin/quota"
+	"github.com/fasmide/routerlogin/registry"
+	"github.com/fasmide/routerlogin/systemd"
 )
 
 func main() {
 
-	d := daemon.Daemon{}
+	configPath := flag.String("config", "", "json config file")
+	recordPath := flag.String("record", "", "record what is read from conntrack and the leases file into this archive")
+	replayPath := flag.String("replay", "", "read conntrack and the leases from this archive instead")
+	speed := flag.Float64("speed", 1, "how many times faster than recorded archives are replayed")
+	flag.Parse()
 
-	listener, err := net.Listen("unix", "/tmp/hello")
+	config, err := loadConfig(*configPath)
 	if err != nil {
-		panic(err)
+		log.Fatalf("unable to load config: %s", err)
 	}
-	d.AddStore(&conntrack.StateStore{})
-	d.AddStore(&dnsmasq.Store{Path: "/var/lib/misc/dnsmasq.leases"})
+
+	authorizer, err := config.Authorizer()
+	if err != nil {
+		log.Fatalf("unable to look up allowed users: %s", err)
+	}
+
+	maxAge, maxAges, err := config.MaxAges()
+	if err != nil {
+		log.Fatalf("unable to configure health: %s", err)
+	}
+
+	d := daemon.Daemon{Authorizer: authorizer, MaxAge: maxAge, MaxAges: maxAges}
+
+	activated, err := systemd.Listeners()
+	if err != nil {
+		log.Fatalf("unable to use sockets from systemd: %s", err)
+	}
+
+	listeners, tlsServer, err := listen(config, activated)
+	if err != nil {
+		log.Fatalf("unable to listen: %s", err)
+	}
+
+	// sockets we were given but have no use for would otherwise stay open and unserved
+	for _, name := range []string{config.Socket.SystemdName, config.Socket.CommandSystemdName, config.TLS.SystemdName} {
+		delete(activated, name)
+	}
+	for name, ls := range activated {
+		log.Printf("closing %d sockets from systemd named %s, which matches no configured socket", len(ls), name)
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+
+	// service names are nice to have, we do fine without them
+	services, err := conntrack.LoadServices("/etc/services", "")
+	if err != nil {
+		log.Printf("unable to load services: %s", err)
+	}
+
+	commands, err := config.Runner()
+	if err != nil {
+		log.Fatalf("unable to run commands: %s", err)
+	}
+
+	var conntrackSource conntrack.Source = conntrack.CommandSource{Runner: commands}
+	leaseSource := config.LeaseSource(commands)
+	var controller conntrack.Controller = &conntrack.CLIController{Runner: commands}
+
+	if *replayPath != "" {
+		player, err := capture.Open(*replayPath)
+		if err != nil {
+			log.Fatalf("unable to replay: %s", err)
+		}
+		player.Speed = *speed
+		conntrackSource, leaseSource = player, player
+
+		// the flows replayed are not there to tear down
+		controller = nil
+	}
+
+	if *recordPath != "" {
+		fd, err := os.Create(*recordPath)
+		if err != nil {
+			log.Fatalf("unable to record: %s", err)
+		}
+		defer fd.Close()
+
+		recorder := &capture.Recorder{Conntrack: conntrackSource, Dnsmasq: leaseSource, Writer: capture.NewWriter(fd)}
+		defer recorder.Writer.Close()
+		conntrackSource, leaseSource = recorder, recorder
+	}
+
+	wans, err := config.WANs()
+	if err != nil {
+		log.Fatalf("unable to configure uplinks: %s", err)
+	}
+
+	states := &conntrack.StateStore{Services: services, Controller: controller, Source: conntrackSource, WANs: wans}
+	leases := &dnsmasq.Store{Source: leaseSource}
+	if len(config.Federation.Peers) > 0 {
+		// a federation shows the hosts of its peers, not the ones of this router
+		peers, err := config.FederationStore()
+		if err != nil {
+			log.Fatalf("unable to federate: %s", err)
+		}
+		d.AddStore(peers)
+	} else {
+		d.AddStore(states)
+		d.AddStore(leases)
+	}
+
+	// the mac address of a host is the one of its lease
+	mac := func(ip string) (string, error) {
+		lease, err := leases.LeaseByIP(ip)
+		if err != nil {
+			return "", err
+		}
+		return lease.Mac, nil
+	}
+
+	if config.Devices.Path != "" {
+		devices := &registry.Registry{Path: config.Devices.Path}
+		err = devices.Load()
+		if err != nil {
+			log.Fatalf("unable to load devices: %s", err)
+		}
+		d.AddStore(&registry.Store{Registry: devices, MAC: mac})
+	}
+
+	if config.Reservations.Path != "" {
+		reservations := &dnsmasq.Reservations{
+			Path:     config.Reservations.Path,
+			Leases:   leases,
+			Reloader: config.Reloader(commands),
+			MAC:      mac,
+		}
+		err = reservations.Load()
+		if err != nil {
+			log.Fatalf("unable to load reservations: %s", err)
+		}
+		d.AddStore(reservations)
+	}
+
+	var queries *dnsmasq.Queries
+	if config.Queries.Log != "" || config.Queries.Syslog != "" {
+		queries, err = config.QueryStore(commands)
+		if err != nil {
+			log.Fatalf("unable to count dns queries: %s", err)
+		}
+		d.AddStore(queries)
+	}
+
+	var quotas *quota.Quotas
+	if len(config.Quota.Rules) > 0 {
+		quotas = &quota.Quotas{
+			Source: states,
+			MAC:    mac,
+			Hooks:  config.QuotaHooks(),
+		}
+
+		rules, err := config.QuotaRules()
+		if err == nil {
+			err = quotas.SetRules(rules)
+		}
+		if err != nil {
+			log.Fatalf("unable to configure quotas: %s", err)
+		}
+		d.AddStore(quotas)
+	}
+
+	var loginPortal *portal.Portal
+	if config.Portal.Listen != "" {
+		if config.Portal.Htpasswd == "" {
+			log.Fatalf("the portal needs an htpasswd file")
+		}
+
+		duration, err := time.ParseDuration(config.Portal.Duration)
+		if err != nil {
+			log.Fatalf("invalid portal session duration: %s", err)
+		}
+
+		loginPortal = &portal.Portal{
+			Auth:     &portal.Htpasswd{Path: config.Portal.Htpasswd},
+			Sessions: &portal.Sessions{Path: config.Portal.Path},
+			MAC:      mac,
+			Duration: duration,
+		}
+		if config.Portal.Path != "" {
+			err = loginPortal.Sessions.Load()
+			if err != nil {
+				log.Fatalf("unable to load portal sessions: %s", err)
+			}
+		}
+		d.AddStore(loginPortal)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			notify(systemd.Reloading)
+			reload(&d, tlsServer, quotas, *configPath)
+			notify(systemd.Ready)
+		}
+	}()
 
-		// Block until a signal is received.
-		s := <-c
-		fmt.Println("Interrupted:", s)
-		listener.Close()
+	go func() {
+		<-ctx.Done()
+		notify(systemd.Stopping)
 	}()
 
-	d.Accept(listener)
+	// events are only streamed over http, and must exist before anything publishes them
+	if config.HTTP.Listen != "" {
+		d.Events = daemon.NewBroker(4096)
+		go d.RunEvents(ctx, 10*time.Second)
+	}
+
+	// background work which must finish before we exit
+	var background sync.WaitGroup
 
+	if config.History.Interval != "" {
+		interval, err := time.ParseDuration(config.History.Interval)
+		if err != nil {
+			log.Fatalf("invalid history interval: %s", err)
+		}
+
+		d.History = history.New(history.DefaultTiers)
+		if config.History.Path != "" {
+			err = d.History.LoadFile(config.History.Path)
+			if err != nil {
+				log.Printf("unable to load history, starting over: %s", err)
+			}
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				d.History.RunSaver(ctx, config.History.Path, 5*time.Minute)
+			}()
+		}
+		go d.RunSampler(ctx, interval)
+	}
+
+	if quotas != nil {
+		interval, err := time.ParseDuration(config.Quota.Interval)
+		if err != nil {
+			log.Fatalf("invalid quota interval: %s", err)
+		}
+
+		if config.Quota.Path != "" {
+			err = quotas.LoadFile(config.Quota.Path)
+			if err != nil {
+				log.Printf("unable to load quota usage, starting over: %s", err)
+			}
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				quotas.RunSaver(ctx, config.Quota.Path, 5*time.Minute)
+			}()
+		}
+		go quotas.Run(ctx, interval)
+	}
+
+	if queries != nil {
+		go queries.Run(ctx)
+	}
+
+	if config.HTTP.Listen != "" {
+		go serveHTTP(ctx, config.HTTP.Listen, d.HTTPHandler())
+	}
+
+	if loginPortal != nil {
+		go serveHTTP(ctx, config.Portal.Listen, loginPortal.Handler())
+	}
+
+	if len(config.Export.Collectors) > 0 {
+		exporter, err := config.Exporter()
+		if err == nil {
+			err = exporter.Dial()
+		}
+		if err != nil {
+			log.Fatalf("unable to export flows: %s", err)
+		}
+		defer exporter.Close()
+
+		// snapshots are of the flows read by the store, which may be replayed
+		go exporter.Run(ctx, states, conntrack.SourceLister{Source: conntrackSource, Format: states.Format})
+	}
+
+	// systemd restarts us if the stores stop working
+	go systemd.RunWatchdog(ctx, systemd.WatchdogInterval(), d.Healthy)
+
+	notify(systemd.Ready)
+	err = d.Serve(ctx, listeners...)
+	stop()
+	background.Wait()
+	if err != nil {
+		log.Fatalf("daemon failed: %s", err)
+	}
+	log.Printf("stopped")
+}
+
+// listen returns the listeners described by config, the ones passed by systemd are
+// used when present and the tls server is nil without tls
+func listen(config Config, activated map[string][]net.Listener) ([]net.Listener, *daemon.TLSServer, error) {
+	var listeners []net.Listener
+
+	if ls, found := activated[config.Socket.SystemdName]; found {
+		listeners = append(listeners, ls...)
+	} else {
+		socket, err := config.UnixSocket()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		l, err := socket.Listen()
+		if err != nil {
+			return nil, nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	// commands are sent to a socket of their own, so plain clients never wait for one
+	if ls, found := activated[config.Socket.CommandSystemdName]; found {
+		for _, l := range ls {
+			listeners = append(listeners, daemon.Commands(l))
+		}
+	} else if config.Socket.CommandPath != "" {
+		socket, err := config.CommandSocket()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		l, err := socket.Listen()
+		if err != nil {
+			return nil, nil, err
+		}
+		listeners = append(listeners, daemon.Commands(l))
+	}
+
+	tcp, activatedTLS := activated[config.TLS.SystemdName]
+	if config.TLS.Listen == "" && !activatedTLS {
+		return listeners, nil, nil
+	}
+
+	tlsServer, err := config.TLSServer()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !activatedTLS {
+		l, err := tlsServer.Listen(config.TLS.Listen)
+		if err != nil {
+			return nil, nil, err
+		}
+		return append(listeners, l), tlsServer, nil
+	}
+
+	for _, l := range tcp {
+		tl, err := tlsServer.Wrap(l)
+		if err != nil {
+			return nil, nil, err
+		}
+		listeners = append(listeners, tl)
+	}
+	return listeners, tlsServer, nil
+}
+
+// serveHTTP serves handler on address until ctx is done
+func serveHTTP(ctx context.Context, address string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+
+		// event streams never ends by themselves, they must know when we stop
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("http server failed: %s", err)
+	}
+}
+
+// notify tells systemd about our state, if it is listening
+func notify(state string) {
+	_, err := systemd.Notify(state)
+	if err != nil {
+		log.Printf("unable to notify systemd: %s", err)
+	}
+}
+
+// reload rereads the config and reloads stores, certificates and quota rules, the socket,
+// listen addresses and whether quotas are enabled are kept as they are until restarted
+func reload(d *daemon.Daemon, tlsServer *daemon.TLSServer, quotas *quota.Quotas, configPath string) {
+	log.Printf("reloading")
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Printf("unable to reload config, keeping the current one: %s", err)
+		return
+	}
+
+	authorizer, err := config.Authorizer()
+	if err != nil {
+		log.Printf("unable to look up allowed users, keeping the current ones: %s", err)
+	} else {
+		d.SetAuthorizer(authorizer)
+	}
+
+	if tlsServer != nil {
+		s, err := config.TLSServer()
+		if err == nil {
+			tlsServer.SetRoles(s.Roles, s.DefaultRole)
+			err = tlsServer.Reload()
+		}
+		if err != nil {
+			log.Printf("unable to reload tls: %s", err)
+		}
+	}
+
+	if quotas != nil {
+		rules, err := config.QuotaRules()
+		if err == nil {
+			err = quotas.SetRules(rules)
+		}
+		if err != nil {
+			log.Printf("unable to reload quotas, keeping the current ones: %s", err)
+		}
+	}
+
+	err = d.Reload()
+	if err != nil {
+		log.Printf("unable to reload stores: %s", err)
+	}
 }
@@ -0,0 +1,189 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Version is the protocol records are exported with
+type Version int
+
+const (
+	NetFlowV9 Version = 9
+	IPFIX     Version = 10
+)
+
+// ParseVersion parses ipfix or netflow9
+func ParseVersion(s string) (Version, error) {
+	switch s {
+	case "ipfix", "":
+		return IPFIX, nil
+	case "netflow9", "v9":
+		return NetFlowV9, nil
+	}
+	return 0, fmt.Errorf("unknown version \"%s\", should be ipfix or netflow9", s)
+}
+
+const (
+	// template ids of ipv4 and ipv6 records, the first ids available to templates
+	templateIPv4 = 256
+	templateIPv6 = 257
+
+	// maxMessage keeps messages from being fragmented on ethernet
+	maxMessage = 1400
+)
+
+// encoder turns records into messages of a version, keeping track of sequence numbers
+type encoder struct {
+	version Version
+	domain  uint32
+
+	// boot is when the exporter started, for the uptime of netflow v9 headers
+	boot time.Time
+
+	// sequence counts data records in IPFIX, and messages in netflow v9
+	sequence uint32
+}
+
+// headerLength returns the length of message headers
+func (e *encoder) headerLength() int {
+	if e.version == NetFlowV9 {
+		return 20
+	}
+	return 16
+}
+
+// encode returns the messages of the records, templates are included in the first
+// message when withTemplates is set
+func (e *encoder) encode(now time.Time, records []Record, withTemplates bool) [][]byte {
+	var messages [][]byte
+	for len(records) > 0 || withTemplates {
+		var message []byte
+		message, records = e.message(now, records, withTemplates)
+		messages = append(messages, message)
+		withTemplates = false
+	}
+	return messages
+}
+
+// message returns a message of as many records as fits, and the records which did not
+func (e *encoder) message(now time.Time, records []Record, withTemplates bool) ([]byte, []Record) {
+	b := make([]byte, e.headerLength(), maxMessage)
+	templates, data := 0, 0
+
+	if withTemplates {
+		b = e.appendTemplates(b)
+		templates = 2
+	}
+
+	// records of each template goes into a set of their own
+	for _, ipv6 := range []bool{false, true} {
+		start := len(b)
+		length := recordLength(ipv6)
+		b = append(b, 0, 0, 0, 0)
+
+		rest := records[:0:0]
+		n := 0
+		for _, r := range records {
+			if r.ipv6() != ipv6 || len(b)+length > maxMessage {
+				rest = append(rest, r)
+				continue
+			}
+			b = r.append(b)
+			n++
+		}
+		records = rest
+
+		if n == 0 {
+			b = b[:start]
+			continue
+		}
+		b = e.finishSet(b, start, templateID(ipv6))
+		data += n
+	}
+
+	e.appendHeader(b, now, templates, data)
+	return b, records
+}
+
+// templateID returns the template of records
+func templateID(ipv6 bool) uint16 {
+	if ipv6 {
+		return templateIPv6
+	}
+	return templateIPv4
+}
+
+// appendTemplates appends a template set of both templates
+func (e *encoder) appendTemplates(b []byte) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+
+	for _, ipv6 := range []bool{false, true} {
+		fs := fields(ipv6)
+		b = binary.BigEndian.AppendUint16(b, templateID(ipv6))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(fs)))
+		for _, f := range fs {
+			b = e.appendField(b, f)
+		}
+	}
+
+	// template sets are 2 in IPFIX and 0 in netflow v9
+	id := uint16(2)
+	if e.version == NetFlowV9 {
+		id = 0
+	}
+	return e.finishSet(b, start, id)
+}
+
+// appendField appends a field specifier, reverse fields are RFC 5103 enterprise fields
+// in IPFIX, and the OUT_BYTES and OUT_PKTS fields of netflow v9
+func (e *encoder) appendField(b []byte, f field) []byte {
+	if !f.reverse {
+		b = binary.BigEndian.AppendUint16(b, f.id)
+		return binary.BigEndian.AppendUint16(b, f.length)
+	}
+
+	if e.version == NetFlowV9 {
+		b = binary.BigEndian.AppendUint16(b, f.id+22)
+		return binary.BigEndian.AppendUint16(b, f.length)
+	}
+
+	b = binary.BigEndian.AppendUint16(b, f.id|0x8000)
+	b = binary.BigEndian.AppendUint16(b, f.length)
+	return binary.BigEndian.AppendUint32(b, reversePEN)
+}
+
+// finishSet pads the set starting at start to 4 bytes, and writes its id and length
+func (e *encoder) finishSet(b []byte, start int, id uint16) []byte {
+	for (len(b)-start)%4 != 0 {
+		b = append(b, 0)
+	}
+	binary.BigEndian.PutUint16(b[start:], id)
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+// appendHeader writes the header of a message holding template and data records
+func (e *encoder) appendHeader(b []byte, now time.Time, templates, data int) {
+	binary.BigEndian.PutUint16(b[0:], uint16(e.version))
+
+	if e.version == NetFlowV9 {
+		// netflow v9 counts records of every kind
+		binary.BigEndian.PutUint16(b[2:], uint16(templates+data))
+		binary.BigEndian.PutUint32(b[4:], uint32(now.Sub(e.boot).Milliseconds()))
+		binary.BigEndian.PutUint32(b[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(b[12:], e.sequence)
+		binary.BigEndian.PutUint32(b[16:], e.domain)
+		e.sequence++
+		return
+	}
+
+	// IPFIX sequence numbers counts the data records sent before this message
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:], e.sequence)
+	binary.BigEndian.PutUint32(b[12:], e.domain)
+	e.sequence += uint32(data)
+}
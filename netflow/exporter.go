@@ -0,0 +1,283 @@
+package netflow
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fasmide/routerlogin/conntrack"
+)
+
+// Collector is where records are sent
+type Collector struct {
+	// Address is the host:port of the collector
+	Address string
+	Version Version
+}
+
+// collector is a collector being exported to
+type collector struct {
+	Collector
+	conn    net.Conn
+	encoder encoder
+
+	// templates is when templates were last sent
+	templates time.Time
+}
+
+// flowKey identifies a flow, the id tells apart flows reusing a tuple when conntrack prints it
+type flowKey struct {
+	conntrack.Tuple
+	ID uint32
+}
+
+// tracked is what was exported of a running flow
+type tracked struct {
+	// exported is when the flow was last exported, or when it started
+	exported time.Time
+	sent     conntrack.Counter
+	received conntrack.Counter
+
+	// seen is the snapshot the flow was last seen in
+	seen int
+}
+
+// Exporter turns destroyed flows, and long running ones, into records sent to collectors
+type Exporter struct {
+	Collectors []Collector
+
+	// Domain is the observation domain, or source id, of every message
+	Domain uint32
+
+	// ActiveTimeout is how often running flows are exported, defaults to a minute
+	ActiveTimeout time.Duration
+
+	// TemplateRefresh is how often templates are sent again, defaults to 10 minutes
+	TemplateRefresh time.Duration
+
+	lock       sync.Mutex
+	collectors []*collector
+	flows      map[flowKey]*tracked
+	snapshots  int
+}
+
+// activeTimeout returns ActiveTimeout or its default
+func (e *Exporter) activeTimeout() time.Duration {
+	if e.ActiveTimeout == 0 {
+		return time.Minute
+	}
+	return e.ActiveTimeout
+}
+
+// templateRefresh returns TemplateRefresh or its default
+func (e *Exporter) templateRefresh() time.Duration {
+	if e.TemplateRefresh == 0 {
+		return 10 * time.Minute
+	}
+	return e.TemplateRefresh
+}
+
+// Dial connects to every collector, udp sockets only fails on invalid addresses
+func (e *Exporter) Dial() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := time.Now()
+	for _, c := range e.Collectors {
+		conn, err := net.Dial("udp", c.Address)
+		if err != nil {
+			e.close()
+			return err
+		}
+		e.collectors = append(e.collectors, &collector{
+			Collector: c,
+			conn:      conn,
+			encoder:   encoder{version: c.Version, domain: e.Domain, boot: now},
+		})
+	}
+	return nil
+}
+
+// Close closes the connections to the collectors
+func (e *Exporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.close()
+	return nil
+}
+
+// close closes the connections while locked
+func (e *Exporter) close() {
+	for _, c := range e.collectors {
+		c.conn.Close()
+	}
+	e.collectors = nil
+}
+
+// Update exports destroyed flows and notes when new flows started
+func (e *Exporter) Update(now time.Time, u *conntrack.FlowUpdate) {
+	if !u.Time.IsZero() {
+		now = u.Time
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	key := flowKey{Tuple: u.Flow.Original.Tuple(u.Flow.Protocol), ID: u.Flow.ID}
+	switch u.Type {
+	case "NEW":
+		e.track(now, key, &u.Flow)
+	case "DESTROY":
+		t := e.track(now, key, &u.Flow)
+		delete(e.flows, key)
+		e.send(now, []Record{e.record(now, t, &u.Flow, EndOfFlow)})
+	}
+}
+
+// Snapshot exports the flows running for longer than the active timeout since they
+// were last exported, flows is typically every flow listed by conntrack -L
+func (e *Exporter) Snapshot(now time.Time, flows []conntrack.Flow) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.snapshots++
+
+	var records []Record
+	for i := range flows {
+		f := &flows[i]
+		key := flowKey{Tuple: f.Original.Tuple(f.Protocol), ID: f.ID}
+		t := e.track(now, key, f)
+		t.seen = e.snapshots
+
+		if now.Sub(t.exported) >= e.activeTimeout() {
+			records = append(records, e.record(now, t, f, ActiveTimeout))
+		}
+	}
+
+	// flows whose destroy event we missed
+	for key, t := range e.flows {
+		if t.seen < e.snapshots-1 {
+			delete(e.flows, key)
+		}
+	}
+
+	e.send(now, records)
+}
+
+// track returns what was exported of a flow, starting to track it if needed
+func (e *Exporter) track(now time.Time, key flowKey, f *conntrack.Flow) *tracked {
+	if e.flows == nil {
+		e.flows = make(map[flowKey]*tracked)
+	}
+
+	t, found := e.flows[key]
+	if !found {
+		start := now
+		if !f.Start.IsZero() {
+			start = f.Start
+		}
+		t = &tracked{exported: start, seen: e.snapshots}
+		e.flows[key] = t
+	}
+	return t
+}
+
+// record returns a record of the flow since it was last exported, and notes it as exported
+func (e *Exporter) record(now time.Time, t *tracked, f *conntrack.Flow, reason EndReason) Record {
+	r := NewRecord(f)
+	r.Start = t.exported
+	r.End = now
+	if reason == EndOfFlow && !f.Stop.IsZero() {
+		r.End = f.Stop
+	}
+	r.Sent = delta(t.sent, f.Original.Counter)
+	r.Received = delta(t.received, f.Reply.Counter)
+	r.EndReason = reason
+
+	t.sent = f.Original.Counter
+	t.received = f.Reply.Counter
+	t.exported = now
+	return r
+}
+
+// delta returns what a counter grew since previous, counters going backwards count from zero
+func delta(previous, current conntrack.Counter) conntrack.Counter {
+	if current.Bytes < previous.Bytes || current.Packets < previous.Packets {
+		return current
+	}
+	return conntrack.Counter{Packets: current.Packets - previous.Packets, Bytes: current.Bytes - previous.Bytes}
+}
+
+// send sends records to every collector, along with templates when they are due
+func (e *Exporter) send(now time.Time, records []Record) {
+	for _, c := range e.collectors {
+		withTemplates := now.Sub(c.templates) >= e.templateRefresh()
+		if withTemplates {
+			c.templates = now
+		}
+		if len(records) == 0 && !withTemplates {
+			continue
+		}
+
+		for _, message := range c.encoder.encode(now, records, withTemplates) {
+			_, err := c.conn.Write(message)
+			if err != nil {
+				// collectors come and go, udp tells us when they are gone
+				log.Printf("netflow: unable to send to %s: %s", c.Address, err)
+				break
+			}
+		}
+	}
+}
+
+// Follower follows conntrack updates, conntrack.StateStore is one
+type Follower interface {
+	Follow(ctx context.Context, f func(*conntrack.FlowUpdate)) error
+}
+
+// Lister lists flows, conntrack.CLIController is one
+type Lister interface {
+	List(f conntrack.Filter) ([]conntrack.Flow, error)
+}
+
+// Run exports updates from follower, and snapshots from lister every half active
+// timeout, until ctx is done
+func (e *Exporter) Run(ctx context.Context, follower Follower, lister Lister) {
+	go func() {
+		ticker := time.NewTicker(e.activeTimeout() / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				flows, err := lister.List(conntrack.Filter{})
+				if err != nil {
+					log.Printf("netflow: unable to list flows: %s", err)
+					continue
+				}
+				e.Snapshot(now, flows)
+			}
+		}
+	}()
+
+	for {
+		err := follower.Follow(ctx, func(u *conntrack.FlowUpdate) {
+			e.Update(time.Now(), u)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("netflow: unable to follow conntrack, retrying: %s", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
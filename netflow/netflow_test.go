@@ -0,0 +1,247 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fasmide/routerlogin/conntrack"
+)
+
+// decoded is a data record by field name, reverse fields are prefixed with r
+type decoded map[string][]byte
+
+// decoder decodes messages the way a collector would
+type decoder struct {
+	t         *testing.T
+	templates map[uint16][]string
+	lengths   map[uint16][]int
+}
+
+// decode returns the header fields and data records of a message
+func (d *decoder) decode(b []byte) (version uint16, sequence uint32, records []decoded) {
+	version = binary.BigEndian.Uint16(b)
+	offset := 16
+	sequence = binary.BigEndian.Uint32(b[8:])
+	if version == 9 {
+		offset = 20
+		sequence = binary.BigEndian.Uint32(b[12:])
+	} else if int(binary.BigEndian.Uint16(b[2:])) != len(b) {
+		d.t.Fatalf("message length %d, received %d", binary.BigEndian.Uint16(b[2:]), len(b))
+	}
+
+	for offset < len(b) {
+		id := binary.BigEndian.Uint16(b[offset:])
+		length := int(binary.BigEndian.Uint16(b[offset+2:]))
+		set := b[offset+4 : offset+length]
+		offset += length
+
+		switch {
+		case id == 0 || id == 2:
+			d.decodeTemplates(set, version)
+		default:
+			lengths, found := d.lengths[id]
+			if !found {
+				d.t.Fatalf("data set of unknown template %d", id)
+			}
+			total := 0
+			for _, l := range lengths {
+				total += l
+			}
+			for len(set) >= total {
+				r := make(decoded)
+				for i, name := range d.templates[id] {
+					r[name] = set[:lengths[i]]
+					set = set[lengths[i]:]
+				}
+				records = append(records, r)
+			}
+		}
+	}
+	return version, sequence, records
+}
+
+// decodeTemplates reads a template set
+func (d *decoder) decodeTemplates(set []byte, version uint16) {
+	for len(set) >= 4 {
+		id := binary.BigEndian.Uint16(set)
+		count := int(binary.BigEndian.Uint16(set[2:]))
+		set = set[4:]
+
+		var names []string
+		var lengths []int
+		for i := 0; i < count; i++ {
+			ie := binary.BigEndian.Uint16(set)
+			lengths = append(lengths, int(binary.BigEndian.Uint16(set[2:])))
+			set = set[4:]
+
+			name := ""
+			if ie&0x8000 != 0 {
+				if version != 10 || binary.BigEndian.Uint32(set) != reversePEN {
+					d.t.Fatalf("unexpected enterprise field")
+				}
+				set = set[4:]
+				ie &^= 0x8000
+				name = "r"
+			}
+			names = append(names, name+strconv.Itoa(int(ie)))
+		}
+		d.templates[id] = names
+		d.lengths[id] = lengths
+	}
+}
+
+// listen returns a udp socket of a collector
+func listen(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receive returns the next message of a collector
+func receive(t *testing.T, conn net.PacketConn) []byte {
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("nothing received: %s", err)
+	}
+	return buf[:n]
+}
+
+// update parses a conntrack -E line
+func update(t *testing.T, line string) *conntrack.FlowUpdate {
+	u, err := conntrack.ParseUpdateLine(line)
+	if err != nil {
+		t.Fatalf("unable to parse %s: %s", line, err)
+	}
+	return u
+}
+
+func TestExporter(t *testing.T) {
+	ipfix, v9 := listen(t), listen(t)
+
+	e := &Exporter{
+		Collectors: []Collector{
+			{Address: ipfix.LocalAddr().String(), Version: IPFIX},
+			{Address: v9.LocalAddr().String(), Version: NetFlowV9},
+		},
+		Domain:        42,
+		ActiveTimeout: time.Minute,
+	}
+	err := e.Dial()
+	if err != nil {
+		t.Fatalf("unable to dial: %s", err)
+	}
+	defer e.Close()
+
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	e.Update(now, update(t, "[NEW] tcp      6 120 SYN_SENT src=192.168.1.157 dst=52.85.250.243 sport=54376 dport=443 [UNREPLIED] src=52.85.250.243 dst=85.191.222.130 sport=443 dport=40123"))
+	e.Update(now.Add(30*time.Second), update(t, "[DESTROY] tcp      6 src=192.168.1.157 dst=52.85.250.243 sport=54376 dport=443 packets=21 bytes=2629 src=52.85.250.243 dst=85.191.222.130 sport=443 dport=40123 packets=13 bytes=5524 [ASSURED]"))
+
+	for _, conn := range []net.PacketConn{ipfix, v9} {
+		d := &decoder{t: t, templates: make(map[uint16][]string), lengths: make(map[uint16][]int)}
+		version, sequence, records := d.decode(receive(t, conn))
+		if len(d.templates) != 2 || len(records) != 1 || sequence != 0 {
+			t.Fatalf("version %d: expected both templates and a record, got %d templates, %d records and sequence %d", version, len(d.templates), len(records), sequence)
+		}
+
+		r := records[0]
+		outBytes, outPackets := "23", "24"
+		if version == 10 {
+			outBytes, outPackets = "r1", "r2"
+		}
+		for name, expected := range map[string][]byte{
+			"8":        {192, 168, 1, 157},
+			"12":       {52, 85, 250, 243},
+			"225":      {85, 191, 222, 130},
+			"226":      {52, 85, 250, 243},
+			"7":        binary.BigEndian.AppendUint16(nil, 54376),
+			"227":      binary.BigEndian.AppendUint16(nil, 40123),
+			"228":      binary.BigEndian.AppendUint16(nil, 443),
+			"4":        {6},
+			"1":        binary.BigEndian.AppendUint64(nil, 2629),
+			"2":        binary.BigEndian.AppendUint64(nil, 21),
+			outBytes:   binary.BigEndian.AppendUint64(nil, 5524),
+			outPackets: binary.BigEndian.AppendUint64(nil, 13),
+			"152":      binary.BigEndian.AppendUint64(nil, uint64(now.UnixMilli())),
+			"153":      binary.BigEndian.AppendUint64(nil, uint64(now.Add(30*time.Second).UnixMilli())),
+			"136":      {byte(EndOfFlow)},
+		} {
+			if string(r[name]) != string(expected) {
+				t.Errorf("version %d: field %s was %v, expected %v", version, name, r[name], expected)
+			}
+		}
+	}
+}
+
+func TestExporterActiveTimeout(t *testing.T) {
+	conn := listen(t)
+	e := &Exporter{Collectors: []Collector{{Address: conn.LocalAddr().String(), Version: IPFIX}}, ActiveTimeout: time.Minute}
+	err := e.Dial()
+	if err != nil {
+		t.Fatalf("unable to dial: %s", err)
+	}
+	defer e.Close()
+
+	flow := func(bytes string) conntrack.Flow {
+		f, err := conntrack.ParseFlowLine("udp      17 156 src=2001:db8::10 dst=2001:4860:4860::8888 sport=44017 dport=53 packets=10 bytes=" + bytes + " src=2001:4860:4860::8888 dst=2001:db8::10 sport=53 dport=44017 packets=10 bytes=1000 [ASSURED] mark=0 use=1")
+		if err != nil {
+			t.Fatalf("unable to parse flow: %s", err)
+		}
+		return f
+	}
+
+	d := &decoder{t: t, templates: make(map[uint16][]string), lengths: make(map[uint16][]int)}
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	// the first snapshot only sends templates, the flow has not run for long enough
+	e.Snapshot(now, []conntrack.Flow{flow("500")})
+	if _, _, records := d.decode(receive(t, conn)); len(records) != 0 {
+		t.Fatalf("flow was exported before its active timeout: %d records", len(records))
+	}
+
+	e.Snapshot(now.Add(time.Minute), []conntrack.Flow{flow("800")})
+	_, _, records := d.decode(receive(t, conn))
+	if len(records) != 1 || binary.BigEndian.Uint64(records[0]["1"]) != 800 || records[0]["136"][0] != byte(ActiveTimeout) {
+		t.Fatalf("unexpected active timeout records: %+v", records)
+	}
+	if net.IP(records[0]["27"]).String() != "2001:db8::10" {
+		t.Fatalf("unexpected source: %v", net.IP(records[0]["27"]))
+	}
+
+	// only what was sent since the previous record is exported
+	e.Snapshot(now.Add(2*time.Minute), []conntrack.Flow{flow("1300")})
+	_, sequence, records := d.decode(receive(t, conn))
+	if len(records) != 1 || binary.BigEndian.Uint64(records[0]["1"]) != 500 || sequence != 1 {
+		t.Fatalf("unexpected second active timeout records: %+v, sequence %d", records, sequence)
+	}
+}
+
+func TestEncoderSplitsMessages(t *testing.T) {
+	e := encoder{version: IPFIX}
+
+	records := make([]Record, 100)
+	for i := range records {
+		records[i] = Record{Source: netip.MustParseAddrPort("192.168.1.2:1000"), PostNATSource: netip.MustParseAddrPort("85.191.222.130:1000")}
+	}
+
+	messages := e.encode(time.Now(), records, true)
+	if len(messages) < 2 {
+		t.Fatalf("100 records fit in %d messages", len(messages))
+	}
+	for _, m := range messages {
+		if len(m) > maxMessage {
+			t.Fatalf("message of %d bytes", len(m))
+		}
+	}
+	if e.sequence != 100 {
+		t.Fatalf("sequence is %d after 100 records", e.sequence)
+	}
+}
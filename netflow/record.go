@@ -0,0 +1,148 @@
+// Package netflow exports conntrack flows as IPFIX or NetFlow v9 records over udp,
+// with the addresses of both sides of the nat and counters of both directions
+package netflow
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"github.com/fasmide/routerlogin/conntrack"
+)
+
+// EndReason is why a record was exported, as the flowEndReason information element
+type EndReason uint8
+
+const (
+	// ActiveTimeout records are exported for flows still running
+	ActiveTimeout EndReason = 2
+	// EndOfFlow records are exported when conntrack destroys the flow
+	EndOfFlow EndReason = 3
+)
+
+// Record is a flow, or the part of it since its previous record
+type Record struct {
+	Protocol uint8
+
+	// Source and Destination are as sent by the lan host, before nat
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+
+	// PostNATSource and PostNATDestination are as seen on the wan side, after nat
+	PostNATSource      netip.AddrPort
+	PostNATDestination netip.AddrPort
+
+	// Sent is from the source, and Received is the reply direction
+	Sent     conntrack.Counter
+	Received conntrack.Counter
+
+	Start time.Time
+	End   time.Time
+
+	EndReason EndReason
+}
+
+// NewRecord returns a record of a flow, without counters
+func NewRecord(f *conntrack.Flow) Record {
+	return Record{
+		Protocol:           uint8(f.ProtocolNumber),
+		Source:             netip.AddrPortFrom(f.Original.Layer3.Source, f.Original.Layer4.SPort),
+		Destination:        netip.AddrPortFrom(f.Original.Layer3.Destination, f.Original.Layer4.DPort),
+		PostNATSource:      netip.AddrPortFrom(f.Reply.Layer3.Destination, f.Reply.Layer4.DPort),
+		PostNATDestination: netip.AddrPortFrom(f.Reply.Layer3.Source, f.Reply.Layer4.SPort),
+	}
+}
+
+// ipv6 reports if the record needs the ipv6 template
+func (r Record) ipv6() bool {
+	for _, a := range []netip.AddrPort{r.Source, r.Destination, r.PostNATSource, r.PostNATDestination} {
+		if a.Addr().Unmap().Is6() {
+			return true
+		}
+	}
+	return false
+}
+
+// field is a field of a template, by its IPFIX information element
+type field struct {
+	id     uint16
+	length uint16
+
+	// reverse fields are the reply direction, by RFC 5103 in IPFIX
+	reverse bool
+}
+
+// reversePEN is the enterprise number of reverse information elements, RFC 5103
+const reversePEN = 29305
+
+// fields returns the fields of every record, in the order append writes them
+func fields(ipv6 bool) []field {
+	addresses := []field{{id: 8, length: 4}, {id: 12, length: 4}, {id: 225, length: 4}, {id: 226, length: 4}}
+	if ipv6 {
+		addresses = []field{{id: 27, length: 16}, {id: 28, length: 16}, {id: 281, length: 16}, {id: 282, length: 16}}
+	}
+
+	return []field{
+		addresses[0],                      // sourceIPv4Address, sourceIPv6Address
+		addresses[1],                      // destinationIPv4Address, destinationIPv6Address
+		{id: 7, length: 2},                // sourceTransportPort
+		{id: 11, length: 2},               // destinationTransportPort
+		{id: 4, length: 1},                // protocolIdentifier
+		addresses[2],                      // postNATSourceIPv4Address, postNATSourceIPv6Address
+		addresses[3],                      // postNATDestinationIPv4Address, postNATDestinationIPv6Address
+		{id: 227, length: 2},              // postNAPTSourceTransportPort
+		{id: 228, length: 2},              // postNAPTDestinationTransportPort
+		{id: 1, length: 8},                // octetDeltaCount
+		{id: 2, length: 8},                // packetDeltaCount
+		{id: 1, length: 8, reverse: true}, // reverseOctetDeltaCount
+		{id: 2, length: 8, reverse: true}, // reversePacketDeltaCount
+		{id: 152, length: 8},              // flowStartMilliseconds
+		{id: 153, length: 8},              // flowEndMilliseconds
+		{id: 136, length: 1},              // flowEndReason
+	}
+}
+
+// recordLength returns the length of records of a template
+func recordLength(ipv6 bool) int {
+	length := 0
+	for _, f := range fields(ipv6) {
+		length += int(f.length)
+	}
+	return length
+}
+
+// append appends the record to b, in the order of its fields
+func (r Record) append(b []byte) []byte {
+	ipv6 := r.ipv6()
+	address := func(b []byte, a netip.Addr) []byte {
+		switch {
+		case !a.IsValid():
+			if ipv6 {
+				return append(b, make([]byte, 16)...)
+			}
+			return append(b, 0, 0, 0, 0)
+		case ipv6:
+			a16 := a.As16()
+			return append(b, a16[:]...)
+		}
+		a4 := a.Unmap().As4()
+		return append(b, a4[:]...)
+	}
+
+	b = address(b, r.Source.Addr())
+	b = address(b, r.Destination.Addr())
+	b = binary.BigEndian.AppendUint16(b, r.Source.Port())
+	b = binary.BigEndian.AppendUint16(b, r.Destination.Port())
+	b = append(b, r.Protocol)
+	b = address(b, r.PostNATSource.Addr())
+	b = address(b, r.PostNATDestination.Addr())
+	b = binary.BigEndian.AppendUint16(b, r.PostNATSource.Port())
+	b = binary.BigEndian.AppendUint16(b, r.PostNATDestination.Port())
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Sent.Bytes))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Sent.Packets))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Received.Bytes))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Received.Packets))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.End.UnixMilli()))
+	return append(b, byte(r.EndReason))
+}
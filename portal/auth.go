@@ -0,0 +1,105 @@
+package portal
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator checks the password of a user
+type Authenticator interface {
+	// Authenticate returns false when the user or password is wrong, and an error
+	// only when it was unable to tell
+	Authenticate(user, password string) (bool, error)
+}
+
+// AuthenticatorFunc is a function used as an Authenticator
+type AuthenticatorFunc func(user, password string) (bool, error)
+
+// Authenticate calls f
+func (f AuthenticatorFunc) Authenticate(user, password string) (bool, error) {
+	return f(user, password)
+}
+
+// Htpasswd authenticates users of an htpasswd file, with bcrypt or {SHA} hashes
+// as written by htpasswd -B and htpasswd -s. The file is read again when it changes
+type Htpasswd struct {
+	Path string
+
+	lock    sync.Mutex
+	modTime time.Time
+	hashes  map[string]string
+}
+
+// Authenticate checks the password against the hash of the user
+func (h *Htpasswd) Authenticate(user, password string) (bool, error) {
+	hash, err := h.hash(user)
+	if err != nil || hash == "" {
+		return false, err
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1, nil
+	}
+
+	return false, fmt.Errorf("unsupported hash of %s, use bcrypt", user)
+}
+
+// hash returns the hash of a user, reading the file again if it changed
+func (h *Htpasswd) hash(user string) (string, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	info, err := os.Stat(h.Path)
+	if err != nil {
+		return "", err
+	}
+	if h.hashes != nil && info.ModTime().Equal(h.modTime) {
+		return h.hashes[user], nil
+	}
+
+	f, err := os.Open(h.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, hash, found := strings.Cut(line, ":")
+		if !found {
+			return "", fmt.Errorf("malformed line in %s: \"%s\"", h.Path, line)
+		}
+		hashes[name] = hash
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+
+	h.hashes = hashes
+	h.modTime = info.ModTime()
+	return h.hashes[user], nil
+}
@@ -0,0 +1,260 @@
+// Package portal lets people log in on a web page, which records the device they
+// logged in from as theirs for a while
+package portal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"text/tabwriter"
+	"time"
+)
+
+// page is the login page
+//
+//go:embed login.html
+var page string
+
+var pageTemplate = template.Must(template.New("login").Parse(page))
+
+// failureDelay slows down guessing passwords
+var failureDelay = time.Second
+
+// tokenCookie holds the token forms post back, which other sites can neither read nor
+// have sent along with requests of their own
+const tokenCookie = "routerlogin_token"
+
+// pageData is what the login page shows
+type pageData struct {
+	Session *Session
+	Error   string
+
+	// Token is posted back by the forms of the page
+	Token string
+}
+
+// Portal is the login page, and a store adding the user of every device to the host table
+type Portal struct {
+	Auth     Authenticator
+	Sessions *Sessions
+
+	// MAC returns the mac address of an ip address, typically from its lease
+	MAC func(ip string) (string, error)
+
+	// Duration is how long sessions lasts
+	Duration time.Duration
+}
+
+// Handler returns the login page. Devices are told apart by their address, so it must be
+// served directly to the lan and not through a proxy. Forms post back the token of a
+// cookie, so other sites cannot log devices in or out
+func (p *Portal) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", p.pageHandler)
+	mux.HandleFunc("POST /login", p.loginHandler)
+	mux.HandleFunc("POST /logout", p.logoutHandler)
+	return mux
+}
+
+// pageHandler shows the session of the device, or a login form
+func (p *Portal) pageHandler(w http.ResponseWriter, r *http.Request) {
+	data := pageData{}
+	if mac, err := p.remoteMAC(r); err == nil {
+		if session, found := p.Sessions.ByMAC(time.Now(), mac); found {
+			data.Session = &session
+		}
+	}
+	p.render(w, r, http.StatusOK, data)
+}
+
+// loginHandler starts a session on the device of the request
+func (p *Portal) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if !p.posted(w, r) {
+		return
+	}
+
+	user, password := r.PostFormValue("user"), r.PostFormValue("password")
+
+	ok, err := p.Auth.Authenticate(user, password)
+	if err != nil {
+		log.Printf("portal: unable to authenticate %s: %s", user, err)
+		p.render(w, r, http.StatusInternalServerError, pageData{Error: "unable to log in right now"})
+		return
+	}
+	if !ok {
+		log.Printf("portal: failed login of %s from %s", user, r.RemoteAddr)
+		time.Sleep(failureDelay)
+		p.render(w, r, http.StatusUnauthorized, pageData{Error: "wrong user or password"})
+		return
+	}
+
+	mac, err := p.remoteMAC(r)
+	if err != nil {
+		p.render(w, r, http.StatusBadRequest, pageData{Error: "your device is unknown to the router: " + err.Error()})
+		return
+	}
+
+	session, err := p.Sessions.Login(time.Now(), user, mac, remoteIP(r), p.Duration)
+	if err != nil {
+		log.Printf("portal: unable to save sessions: %s", err)
+	}
+	log.Printf("portal: %s logged in on %s from %s", user, session.MAC, session.IP)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// logoutHandler ends the session of the device of the request
+func (p *Portal) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if !p.posted(w, r) {
+		return
+	}
+
+	mac, err := p.remoteMAC(r)
+	if err == nil {
+		_, err = p.Sessions.Revoke(time.Now(), mac)
+	}
+	if err != nil {
+		p.render(w, r, http.StatusBadRequest, pageData{Error: err.Error()})
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// posted returns whether a form was posted by the page, and refuses it otherwise
+func (p *Portal) posted(w http.ResponseWriter, r *http.Request) bool {
+	err := forged(r)
+	if err != nil {
+		log.Printf("portal: refused form from %s: %s", r.RemoteAddr, err)
+		p.render(w, r, http.StatusForbidden, pageData{Error: "the form has expired, please try again"})
+		return false
+	}
+	return true
+}
+
+// forged returns why a form was not posted by the page, browsers send the origin of
+// posts, and only the page can post the token of its cookie
+func forged(r *http.Request) error {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return fmt.Errorf("posted from %s", origin)
+		}
+	}
+
+	c, err := r.Cookie(tokenCookie)
+	if err != nil {
+		return fmt.Errorf("no token cookie")
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.PostFormValue("token"))) != 1 {
+		return fmt.Errorf("token does not match its cookie")
+	}
+	return nil
+}
+
+// token returns the token of the browser of a request, and gives it one if it has none
+func token(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(tokenCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	t := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: t, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	return t
+}
+
+// render writes the page
+func (p *Portal) render(w http.ResponseWriter, r *http.Request, status int, data pageData) {
+	data.Token = token(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := pageTemplate.Execute(w, data)
+	if err != nil {
+		log.Printf("portal: unable to render page: %s", err)
+	}
+}
+
+// remoteMAC returns the mac address of the device a request came from
+func (p *Portal) remoteMAC(r *http.Request) (string, error) {
+	return p.MAC(remoteIP(r))
+}
+
+// remoteIP returns the ip address a request came from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Addresses returns nothing, the portal only adds columns to hosts found by other stores
+func (p *Portal) Addresses() ([]net.IP, error) {
+	return nil, nil
+}
+
+// Data returns the user logged in on the device behind an ip address
+func (p *Portal) Data(ip string) (map[string]string, error) {
+	res := map[string]string{"user": "", "sessionExpires": ""}
+
+	mac, err := p.MAC(ip)
+	if err != nil {
+		return res, nil
+	}
+	if session, found := p.Sessions.ByMAC(time.Now(), mac); found {
+		res["user"] = session.User
+		res["sessionExpires"] = session.Expires.Format(time.RFC3339)
+	}
+	return res, nil
+}
+
+// Commands returns the commands the portal answers through the daemon
+func (p *Portal) Commands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"sessions": p.sessionsCommand,
+	}
+}
+
+// AdminCommands returns the commands the portal answers through the daemon, which ends sessions
+func (p *Portal) AdminCommands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"revoke": p.revokeCommand,
+	}
+}
+
+// sessionsCommand writes every session: sessions
+func (p *Portal) sessionsCommand(w io.Writer, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: sessions")
+	}
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(t, "user\tmac\tip\tstart\texpires\n")
+	for _, s := range p.Sessions.List(time.Now()) {
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\n", s.User, s.MAC, s.IP, s.Start.Format(time.RFC3339), s.Expires.Format(time.RFC3339))
+	}
+	return t.Flush()
+}
+
+// revokeCommand ends the session of a device, or every session of a user: revoke <mac|user>
+func (p *Portal) revokeCommand(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: revoke <mac|user>")
+	}
+
+	revoked, err := p.Sessions.Revoke(time.Now(), args[0])
+	for _, s := range revoked {
+		fmt.Fprintf(w, "revoked %s on %s\n", s.User, s.MAC)
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package portal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes an htpasswd file with alice using bcrypt and bob using {SHA}, both with the password secret
+func writeHtpasswd(t *testing.T) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("unable to hash password: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := fmt.Sprintf("# users\nalice:%s\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\ncarol:$apr1$abc$def\n", hash)
+	err = os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("unable to write htpasswd: %s", err)
+	}
+	return path
+}
+
+func TestHtpasswd(t *testing.T) {
+	h := &Htpasswd{Path: writeHtpasswd(t)}
+
+	for _, test := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", true},
+		{"bob", "wrong", false},
+		{"mallory", "secret", false},
+	} {
+		ok, err := h.Authenticate(test.user, test.password)
+		if err != nil || ok != test.ok {
+			t.Errorf("%s with %s: expected %t, got %t (%v)", test.user, test.password, test.ok, ok, err)
+		}
+	}
+
+	_, err := h.Authenticate("carol", "secret")
+	if err == nil {
+		t.Errorf("unsupported hash was accepted")
+	}
+}
+
+// testPortal returns a portal where 192.0.2.1, the address of httptest requests, has a lease
+func testPortal(t *testing.T) *Portal {
+	failureDelay = 0
+	return &Portal{
+		Auth:     &Htpasswd{Path: writeHtpasswd(t)},
+		Sessions: &Sessions{Path: filepath.Join(t.TempDir(), "sessions.json")},
+		MAC: func(ip string) (string, error) {
+			if ip == "192.0.2.1" {
+				return "AA:BB:CC:00:00:01", nil
+			}
+			return "", fmt.Errorf("no lease")
+		},
+		Duration: time.Hour,
+	}
+}
+
+// post posts a form to the portal, with the token of the page
+func post(p *Portal, path string, form url.Values) *httptest.ResponseRecorder {
+	page := httptest.NewRecorder()
+	p.Handler().ServeHTTP(page, httptest.NewRequest("GET", "/", nil))
+	cookie := page.Result().Cookies()[0]
+
+	posted := url.Values{"token": {cookie.Value}}
+	for key, values := range form {
+		posted[key] = values
+	}
+	return postForm(p, path, posted, cookie)
+}
+
+// postForm posts a form to the portal as is
+func postForm(p *Portal, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestPortalLogin(t *testing.T) {
+	p := testPortal(t)
+
+	w := post(p, "/login", url.Values{"user": {"alice"}, "password": {"wrong"}})
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "wrong user or password") {
+		t.Fatalf("wrong password was not refused: %d %s", w.Code, w.Body)
+	}
+
+	w = post(p, "/login", url.Values{"user": {"alice"}, "password": {"secret"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unable to log in: %d %s", w.Code, w.Body)
+	}
+
+	data, _ := p.Data("192.0.2.1")
+	if data["user"] != "alice" || data["sessionExpires"] == "" {
+		t.Fatalf("unexpected columns: %+v", data)
+	}
+
+	w = httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "belongs to <strong>alice</strong>") {
+		t.Fatalf("page did not show the session: %s", w.Body)
+	}
+
+	// sessions survive restarts
+	restarted := &Sessions{Path: p.Sessions.Path}
+	err := restarted.Load()
+	if err != nil {
+		t.Fatalf("unable to load sessions: %s", err)
+	}
+	if s, found := restarted.ByMAC(time.Now(), "aa:bb:cc:00:00:01"); !found || s.User != "alice" || s.IP != "192.0.2.1" {
+		t.Fatalf("session was not saved: %+v", restarted.List(time.Now()))
+	}
+
+	w = post(p, "/logout", nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unable to log out: %d %s", w.Code, w.Body)
+	}
+	if data, _ := p.Data("192.0.2.1"); data["user"] != "" {
+		t.Fatalf("session survived logging out: %+v", data)
+	}
+}
+
+func TestPortalForgery(t *testing.T) {
+	p := testPortal(t)
+
+	page := httptest.NewRecorder()
+	p.Handler().ServeHTTP(page, httptest.NewRequest("GET", "/", nil))
+	cookie := page.Result().Cookies()[0]
+	if cookie.SameSite != http.SameSiteStrictMode || !strings.Contains(page.Body.String(), `value="`+cookie.Value+`"`) {
+		t.Fatalf("page did not have a token: %+v %s", cookie, page.Body)
+	}
+
+	form := url.Values{"user": {"alice"}, "password": {"secret"}}
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"without a token":       postForm(p, "/login", form),
+		"without a cookie":      postForm(p, "/login", url.Values{"user": {"alice"}, "password": {"secret"}, "token": {cookie.Value}}),
+		"with another token":    postForm(p, "/login", url.Values{"user": {"alice"}, "password": {"secret"}, "token": {"guess"}}, cookie),
+		"logging out unchecked": postForm(p, "/logout", nil),
+	} {
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("form posted %s was not refused: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	// a page elsewhere posting along with the token of the browser
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"user": {"alice"}, "password": {"secret"}, "token": {cookie.Value}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "http://attacker.example")
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || len(p.Sessions.List(time.Now())) != 0 {
+		t.Fatalf("form of another origin was not refused: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPortalUnknownDevice(t *testing.T) {
+	p := testPortal(t)
+	p.MAC = func(string) (string, error) { return "", fmt.Errorf("no lease") }
+
+	w := post(p, "/login", url.Values{"user": {"alice"}, "password": {"secret"}})
+	if w.Code != http.StatusBadRequest || len(p.Sessions.List(time.Now())) != 0 {
+		t.Fatalf("device without a lease was logged in: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := &Sessions{}
+	now := time.Now()
+
+	s.Login(now, "alice", "aa:00:00:00:00:01", "192.168.1.2", time.Hour)
+	s.Login(now, "alice", "aa:00:00:00:00:02", "192.168.1.3", time.Hour)
+	s.Login(now, "bob", "aa:00:00:00:00:03", "192.168.1.4", time.Minute)
+
+	if _, found := s.ByMAC(now.Add(2*time.Minute), "aa:00:00:00:00:03"); found {
+		t.Fatalf("expired session was found")
+	}
+	if sessions := s.List(now.Add(2 * time.Minute)); len(sessions) != 2 {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+
+	revoked, err := s.Revoke(now, "alice")
+	if err != nil || len(revoked) != 2 {
+		t.Fatalf("unable to revoke sessions of alice: %+v %v", revoked, err)
+	}
+
+	revoked, err = s.Revoke(now, "AA:00:00:00:00:03")
+	if err != nil || len(revoked) != 1 || revoked[0].User != "bob" {
+		t.Fatalf("unable to revoke session of device: %+v %v", revoked, err)
+	}
+
+	_, err = s.Revoke(now, "alice")
+	if err == nil {
+		t.Fatalf("revoked sessions of user without any")
+	}
+}
@@ -0,0 +1,146 @@
+package portal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasmide/routerlogin/atomicfile"
+)
+
+// Session records that a user logged in on a device
+type Session struct {
+	User string `json:"user"`
+	MAC  string `json:"mac"`
+
+	// IP is the address the device logged in from
+	IP string `json:"ip"`
+
+	Start   time.Time `json:"start"`
+	Expires time.Time `json:"expires"`
+}
+
+// Sessions are the sessions of every device, a device has at most one
+type Sessions struct {
+	// Path persists sessions across restarts, it is written on every change
+	Path string
+
+	lock     sync.Mutex
+	sessions map[string]Session
+}
+
+// Login starts a session of a user on a device, replacing any the device had
+func (s *Sessions) Login(now time.Time, user, mac, ip string, duration time.Duration) (Session, error) {
+	session := Session{User: user, MAC: strings.ToLower(mac), IP: ip, Start: now, Expires: now.Add(duration)}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]Session)
+	}
+	s.sessions[session.MAC] = session
+	return session, s.save(now)
+}
+
+// ByMAC returns the session of a device, unless it has expired
+func (s *Sessions) ByMAC(now time.Time, mac string) (Session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, found := s.sessions[strings.ToLower(mac)]
+	if !found || !now.Before(session.Expires) {
+		return Session{}, false
+	}
+	return session, true
+}
+
+// Revoke ends the session of a device given by mac address, or every session of a
+// user given by name, and returns the sessions ended
+func (s *Sessions) Revoke(now time.Time, macOrUser string) ([]Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var revoked []Session
+	for mac, session := range s.sessions {
+		if mac == strings.ToLower(macOrUser) || session.User == macOrUser {
+			revoked = append(revoked, session)
+			delete(s.sessions, mac)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil, fmt.Errorf("no sessions of %s", macOrUser)
+	}
+
+	sortSessions(revoked)
+	return revoked, s.save(now)
+}
+
+// List returns every session which has not expired, ordered by user and device
+func (s *Sessions) List(now time.Time) []Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		if now.Before(session.Expires) {
+			res = append(res, session)
+		}
+	}
+	sortSessions(res)
+	return res
+}
+
+// sortSessions orders sessions by user and device
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].User != sessions[j].User {
+			return sessions[i].User < sessions[j].User
+		}
+		return sessions[i].MAC < sessions[j].MAC
+	})
+}
+
+// save forgets expired sessions and writes the rest to Path, replacing it atomically
+func (s *Sessions) save(now time.Time) error {
+	for mac, session := range s.sessions {
+		if !now.Before(session.Expires) {
+			delete(s.sessions, mac)
+		}
+	}
+
+	if s.Path == "" {
+		return nil
+	}
+
+	return atomicfile.Write(s.Path, 0600, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(s.sessions)
+	})
+}
+
+// Load reads the sessions saved to Path, a missing file leaves no sessions
+func (s *Sessions) Load() error {
+	data, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sessions := make(map[string]Session)
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %s", s.Path, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions = sessions
+	return nil
+}
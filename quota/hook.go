@@ -0,0 +1,223 @@
+package quota
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventType is what happened to a usage
+type EventType string
+
+const (
+	EventWarning  EventType = "warning"
+	EventExceeded EventType = "exceeded"
+
+	// EventReset is fired when an exceeded usage starts over
+	EventReset EventType = "reset"
+)
+
+// Event is passed to hooks when usage crosses a threshold or starts over
+type Event struct {
+	Type EventType `json:"type"`
+	Rule string    `json:"rule"`
+
+	// Device is the mac address of the device, empty when the rule is shared
+	Device string `json:"device,omitempty"`
+
+	// MACs are the mac addresses of every device the usage is made of
+	MACs []string `json:"macs"`
+
+	Bytes uint64 `json:"bytes"`
+	Limit uint64 `json:"limit"`
+
+	// Restored is set on exceeded events fired again at startup, for usage exceeded before a restart
+	Restored bool `json:"restored,omitempty"`
+
+	// Exceeded are the mac addresses of a reset event still exceeding another rule
+	Exceeded []string `json:"exceeded,omitempty"`
+}
+
+// newEvent returns an event of a usage
+func newEvent(t EventType, r Rule, u Usage) Event {
+	return Event{Type: t, Rule: r.Name, Device: u.Device, MACs: r.macs(u.Device), Bytes: u.Bytes, Limit: u.Limit}
+}
+
+// Name returns the device and rule of the event
+func (e Event) Name() string {
+	if e.Device == "" {
+		return e.Rule
+	}
+	return e.Device + " in " + e.Rule
+}
+
+// Hook is fired on events
+type Hook interface {
+	Fire(Event) error
+}
+
+// LogHook logs events
+type LogHook struct{}
+
+// Fire logs the event
+func (LogHook) Fire(e Event) error {
+	log.Printf("quota: %s is %s: %s of %s", e.Name(), e.Type, FormatSize(e.Bytes), FormatSize(e.Limit))
+	return nil
+}
+
+// hookTimeout is how long hooks may take
+const hookTimeout = 30 * time.Second
+
+// CommandHook runs a command with the event in its environment as QUOTA_EVENT,
+// QUOTA_RULE, QUOTA_DEVICE, QUOTA_MACS, QUOTA_BYTES, QUOTA_LIMIT and QUOTA_RESTORED
+type CommandHook struct {
+	Command []string
+}
+
+// Fire runs the command
+func (h CommandHook) Fire(e Event) error {
+	if len(h.Command) == 0 {
+		return fmt.Errorf("no command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	command.Env = append(os.Environ(),
+		"QUOTA_EVENT="+string(e.Type),
+		"QUOTA_RULE="+e.Rule,
+		"QUOTA_DEVICE="+e.Device,
+		"QUOTA_MACS="+strings.Join(e.MACs, " "),
+		"QUOTA_BYTES="+strconv.FormatUint(e.Bytes, 10),
+		"QUOTA_LIMIT="+strconv.FormatUint(e.Limit, 10),
+		"QUOTA_RESTORED="+strconv.FormatBool(e.Restored),
+	)
+
+	output, err := command.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// WebhookHook posts events as json to a url
+type WebhookHook struct {
+	URL string
+}
+
+// Fire posts the event
+func (h WebhookHook) Fire(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: hookTimeout}
+	resp, err := client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", h.URL, resp.Status)
+	}
+	return nil
+}
+
+// Enforcer keeps devices from using the uplink
+type Enforcer interface {
+	Block(mac string) error
+	Unblock(mac string) error
+}
+
+// EnforceHook blocks the devices of exceeded usage, and unblocks them when it starts over
+// unless another rule is still exceeded
+type EnforceHook struct {
+	Enforcer Enforcer
+}
+
+// Fire blocks or unblocks the devices of the event
+func (h EnforceHook) Fire(e Event) error {
+	f := h.Enforcer.Block
+	switch e.Type {
+	case EventExceeded:
+	case EventReset:
+		f = h.Enforcer.Unblock
+	default:
+		return nil
+	}
+
+	for _, mac := range e.MACs {
+		if e.Type == EventReset && exceeds(e, mac) {
+			continue
+		}
+		err := f(mac)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exceeds returns whether a device of a reset event still exceeds another rule
+func exceeds(e Event, mac string) bool {
+	for _, m := range e.Exceeded {
+		if strings.EqualFold(m, mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// NFTSet blocks devices by adding them to an nftables set of type ether_addr, which
+// a rule of the ruleset is expected to drop forwarded traffic from e.g.
+// nft add set inet filter quota_exceeded '{ type ether_addr; }'
+// nft add rule inet filter forward ether saddr @quota_exceeded drop
+type NFTSet struct {
+	Family string
+	Table  string
+	Set    string
+
+	// Command runs nft, defaults to nft
+	Command []string
+}
+
+// Block adds a mac address to the set
+func (s NFTSet) Block(mac string) error {
+	return s.element("add", mac)
+}
+
+// Unblock removes a mac address from the set
+func (s NFTSet) Unblock(mac string) error {
+	return s.element("delete", mac)
+}
+
+// element adds or deletes an element of the set
+func (s NFTSet) element(verb, mac string) error {
+	command := s.Command
+	if len(command) == 0 {
+		command = []string{"nft"}
+	}
+
+	family := s.Family
+	if family == "" {
+		family = "inet"
+	}
+
+	args := append(command[1:len(command):len(command)], verb, "element", family, s.Table, s.Set, "{ "+mac+" }")
+	output, err := exec.Command(command[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft %s element: %s: %s", verb, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package quota
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnforceHook(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "nft.log")
+
+	// pretend to be nft by writing the arguments to a file
+	set := NFTSet{Table: "filter", Set: "quota_exceeded", Command: []string{"sh", "-c", `echo "$@" >> ` + log, "nft"}}
+	hook := EnforceHook{Enforcer: set}
+
+	for _, e := range []Event{
+		{Type: EventWarning, MACs: []string{"aa:00:00:00:00:01"}},
+		{Type: EventExceeded, MACs: []string{"aa:00:00:00:00:01", "aa:00:00:00:00:02"}},
+		{Type: EventReset, MACs: []string{"aa:00:00:00:00:01"}},
+		{Type: EventReset, MACs: []string{"aa:00:00:00:00:02"}, Exceeded: []string{"aa:00:00:00:00:02"}},
+	} {
+		err := hook.Fire(e)
+		if err != nil {
+			t.Fatalf("unable to fire %s: %s", e.Type, err)
+		}
+	}
+
+	calls, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatalf("nft was not run: %s", err)
+	}
+	expected := "add element inet filter quota_exceeded { aa:00:00:00:00:01 }\n" +
+		"add element inet filter quota_exceeded { aa:00:00:00:00:02 }\n" +
+		"delete element inet filter quota_exceeded { aa:00:00:00:00:01 }\n"
+	if string(calls) != expected {
+		t.Fatalf("unexpected nft calls:\n%s", calls)
+	}
+
+	set.Command = []string{"sh", "-c", "echo no such set >&2; exit 1"}
+	err = set.Block("aa:00:00:00:00:01")
+	if err == nil || !strings.Contains(err.Error(), "no such set") {
+		t.Fatalf("nft failure was not reported: %v", err)
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	hook := CommandHook{Command: []string{"sh", "-c", `echo "$QUOTA_EVENT $QUOTA_RULE $QUOTA_MACS $QUOTA_BYTES" > ` + out}}
+
+	err := hook.Fire(Event{Type: EventExceeded, Rule: "kids", MACs: []string{"aa:00:00:00:00:01", "aa:00:00:00:00:02"}, Bytes: 42})
+	if err != nil {
+		t.Fatalf("unable to run command: %s", err)
+	}
+
+	env, _ := os.ReadFile(out)
+	if string(env) != "exceeded kids aa:00:00:00:00:01 aa:00:00:00:00:02 42\n" {
+		t.Fatalf("unexpected environment: %s", env)
+	}
+
+	err = CommandHook{Command: []string{"false"}}.Fire(Event{})
+	if err == nil {
+		t.Fatalf("failing command was not reported")
+	}
+}
+
+func TestWebhookHook(t *testing.T) {
+	events := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer server.Close()
+
+	err := WebhookHook{URL: server.URL}.Fire(Event{Type: EventWarning, Rule: "everyone", Device: "aa:00:00:00:00:01"})
+	if err != nil {
+		t.Fatalf("unable to post: %s", err)
+	}
+	if e := <-events; e.Type != EventWarning || e.Device != "aa:00:00:00:00:01" {
+		t.Fatalf("unexpected event posted: %+v", e)
+	}
+}
@@ -0,0 +1,83 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/fasmide/routerlogin/atomicfile"
+)
+
+// Save writes the usage of every device to w
+func (q *Quotas) Save(w io.Writer) error {
+	return json.NewEncoder(w).Encode(q.Usages())
+}
+
+// Load replaces the usage with the one read from r, usage of rules which no longer
+// exists is dropped so rules must be set first
+func (q *Quotas) Load(r io.Reader) error {
+	var usages []Usage
+	err := json.NewDecoder(r).Decode(&usages)
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.usage = make(map[usageKey]*Usage)
+	for i := range usages {
+		u := usages[i]
+		r, found := q.rule(u.Rule)
+		if !found {
+			continue
+		}
+		u.Limit = r.Limit
+		q.usage[usageKey{Rule: u.Rule, Device: u.Device}] = &u
+	}
+	return nil
+}
+
+// SaveFile saves the usage to path
+func (q *Quotas) SaveFile(path string) error {
+	return atomicfile.Write(path, 0600, q.Save)
+}
+
+// LoadFile loads from path, a missing file leaves usage empty
+func (q *Quotas) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return q.Load(f)
+}
+
+// RunSaver saves to path every interval, and once more when ctx is done
+func (q *Quotas) RunSaver(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+
+		err := q.SaveFile(path)
+		if err != nil {
+			log.Printf("quota: unable to save %s: %s", path, err)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
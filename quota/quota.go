@@ -0,0 +1,453 @@
+// Package quota counts the traffic of devices against byte quotas, which start over on
+// a schedule, and fires hooks when devices cross their warning and hard thresholds
+package quota
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how close usage is to its limit
+type Level int
+
+const (
+	OK Level = iota
+	Warning
+	Exceeded
+)
+
+// String returns ok, warning or exceeded
+func (l Level) String() string {
+	switch l {
+	case Warning:
+		return "warning"
+	case Exceeded:
+		return "exceeded"
+	}
+	return "ok"
+}
+
+// Rule is a quota of one or more devices
+type Rule struct {
+	Name string
+
+	// Devices are the mac addresses the rule applies to, every device when empty
+	Devices []string
+
+	// Shared makes the devices share a single quota, instead of having one each
+	Shared bool
+
+	// Limit is the number of bytes, sent and received, allowed per period
+	Limit uint64
+
+	// Warning is the fraction of Limit at which a warning is fired, none when zero
+	Warning float64
+
+	Schedule Schedule
+}
+
+// Validate reports rules which makes no sense
+func (r Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("quota has no name")
+	}
+	if r.Limit == 0 {
+		return fmt.Errorf("quota %s has no limit", r.Name)
+	}
+	if r.Warning < 0 || r.Warning >= 1 {
+		return fmt.Errorf("quota %s: warning should be a fraction of the limit", r.Name)
+	}
+	if r.Shared && len(r.Devices) == 0 {
+		return fmt.Errorf("quota %s: shared quotas needs a list of devices", r.Name)
+	}
+
+	err := r.Schedule.Validate()
+	if err != nil {
+		return fmt.Errorf("quota %s: %s", r.Name, err)
+	}
+	return nil
+}
+
+// device returns who a device is counted as, or false when the rule does not apply to it
+func (r Rule) device(mac string) (string, bool) {
+	if len(r.Devices) == 0 {
+		return mac, true
+	}
+
+	for _, d := range r.Devices {
+		if strings.EqualFold(d, mac) {
+			if r.Shared {
+				return "", true
+			}
+			return mac, true
+		}
+	}
+	return "", false
+}
+
+// macs returns the mac addresses a device is made of
+func (r Rule) macs(device string) []string {
+	if device == "" {
+		return r.Devices
+	}
+	return []string{device}
+}
+
+// level returns the level of a number of bytes
+func (r Rule) level(bytes uint64) Level {
+	if bytes >= r.Limit {
+		return Exceeded
+	}
+	if r.Warning > 0 && float64(bytes) >= r.Warning*float64(r.Limit) {
+		return Warning
+	}
+	return OK
+}
+
+// Usage is what a device, or the devices of a shared rule, used in the current period
+type Usage struct {
+	Rule string `json:"rule"`
+
+	// Device is the mac address of the device, empty when the rule is shared
+	Device string `json:"device,omitempty"`
+
+	Start time.Time `json:"start"`
+	Bytes uint64    `json:"bytes"`
+	Limit uint64    `json:"limit"`
+	Level Level     `json:"level"`
+}
+
+// Fraction returns how much of the limit is used
+func (u Usage) Fraction() float64 {
+	if u.Limit == 0 {
+		return 0
+	}
+	return float64(u.Bytes) / float64(u.Limit)
+}
+
+// usageKey identifies a usage
+type usageKey struct {
+	Rule   string
+	Device string
+}
+
+// Source is where traffic is read from, conntrack.StateStore is one
+type Source interface {
+	Addresses() ([]net.IP, error)
+	Metrics(ip string) (map[string]float64, error)
+}
+
+// Quotas counts the traffic of devices against rules
+type Quotas struct {
+	// Source has the ever growing counters usageBytesOut and usageBytesIn of every host
+	Source Source
+
+	// MAC returns the mac address of an ip address, hosts without one are not counted
+	MAC func(ip string) (string, error)
+
+	// Hooks are fired when usage crosses a threshold or starts over
+	Hooks []Hook
+
+	lock  sync.Mutex
+	rules []Rule
+	usage map[usageKey]*Usage
+
+	// last are the latest counters of every ip ever seen
+	last map[string]uint64
+}
+
+// SetRules replaces the rules, usage of rules by the same name is kept
+func (q *Quotas) SetRules(rules []Rule) error {
+	names := make(map[string]bool)
+	for _, r := range rules {
+		err := r.Validate()
+		if err != nil {
+			return err
+		}
+		if names[r.Name] {
+			return fmt.Errorf("quota %s is defined twice", r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.rules = rules
+	for key, u := range q.usage {
+		if r, found := q.rule(key.Rule); found {
+			u.Limit = r.Limit
+		}
+	}
+	return nil
+}
+
+// rule returns a rule by its name
+func (q *Quotas) rule(name string) (Rule, bool) {
+	for _, r := range q.rules {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Update counts the traffic since the previous update and fires hooks, the first
+// update of an address only notes where its counter is
+func (q *Quotas) Update(now time.Time) error {
+	ips, err := q.Source.Addresses()
+	if err != nil {
+		return err
+	}
+
+	counters := make(map[string]uint64, len(ips))
+	for _, ip := range ips {
+		metrics, err := q.Source.Metrics(ip.String())
+		if err != nil {
+			return err
+		}
+		counters[ip.String()] = uint64(metrics["usageBytesOut"] + metrics["usageBytesIn"])
+	}
+
+	// addresses without flows are not listed, their counters are kept until they come back
+	deltas := make(map[string]uint64)
+	q.lock.Lock()
+	if q.last == nil {
+		q.last = make(map[string]uint64)
+	}
+	for ip, c := range counters {
+		previous, seen := q.last[ip]
+		q.last[ip] = c
+
+		// addresses seen for the first time only sets the baseline
+		if !seen || c == previous {
+			continue
+		}
+
+		// counters going backwards were restarted
+		if c < previous {
+			previous = 0
+		}
+		deltas[ip] = c - previous
+	}
+	q.lock.Unlock()
+
+	// traffic per mac address
+	traffic := make(map[string]uint64)
+	for ip, delta := range deltas {
+		mac, err := q.MAC(ip)
+		if err != nil {
+			continue
+		}
+		traffic[strings.ToLower(mac)] += delta
+	}
+
+	q.fire(q.count(now, traffic))
+	return nil
+}
+
+// count starts over usage of passed periods, adds traffic and returns the events to fire
+func (q *Quotas) count(now time.Time, traffic map[string]uint64) []Event {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.usage == nil {
+		q.usage = make(map[usageKey]*Usage)
+	}
+
+	var events []Event
+	for key, u := range q.usage {
+		r, found := q.rule(key.Rule)
+		if !found {
+			continue
+		}
+		if start := r.Schedule.Start(now); u.Start.Before(start) {
+			if u.Level == Exceeded {
+				events = append(events, newEvent(EventReset, r, *u))
+			}
+			*u = Usage{Rule: r.Name, Device: key.Device, Start: start, Limit: r.Limit}
+		}
+	}
+
+	// go through devices in order, so hooks are fired in order
+	macs := make([]string, 0, len(traffic))
+	for mac := range traffic {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	for _, r := range q.rules {
+		for _, mac := range macs {
+			device, applies := r.device(mac)
+			if !applies {
+				continue
+			}
+
+			key := usageKey{Rule: r.Name, Device: device}
+			u, found := q.usage[key]
+			if !found {
+				u = &Usage{Rule: r.Name, Device: device, Start: r.Schedule.Start(now), Limit: r.Limit}
+				q.usage[key] = u
+			}
+
+			u.Bytes += traffic[mac]
+			if level := r.level(u.Bytes); level > u.Level {
+				u.Level = level
+				events = append(events, newEvent(EventType(level.String()), r, *u))
+			}
+		}
+	}
+
+	q.exceeded(events)
+	return events
+}
+
+// exceeded sets the mac addresses of reset events still exceeding another rule,
+// q.lock must be held
+func (q *Quotas) exceeded(events []Event) {
+	for i, e := range events {
+		if e.Type != EventReset {
+			continue
+		}
+		for _, mac := range e.MACs {
+			for _, r := range q.rules {
+				if r.Name == e.Rule {
+					continue
+				}
+				device, applies := r.device(strings.ToLower(mac))
+				if !applies {
+					continue
+				}
+				u, found := q.usage[usageKey{Rule: r.Name, Device: device}]
+				if found && u.Level == Exceeded {
+					events[i].Exceeded = append(events[i].Exceeded, mac)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Reset starts the usage of a rule over, device is the mac address of the device
+// and is ignored by shared rules
+func (q *Quotas) Reset(now time.Time, rule, device string) error {
+	q.lock.Lock()
+	r, found := q.rule(rule)
+	if !found {
+		q.lock.Unlock()
+		return fmt.Errorf("no quota named %s", rule)
+	}
+	if r.Shared {
+		device = ""
+	}
+
+	key := usageKey{Rule: rule, Device: strings.ToLower(device)}
+	u, found := q.usage[key]
+	if !found {
+		q.lock.Unlock()
+		return fmt.Errorf("%s has used nothing of quota %s", device, rule)
+	}
+
+	var events []Event
+	if u.Level == Exceeded {
+		events = append(events, newEvent(EventReset, r, *u))
+	}
+	*u = Usage{Rule: r.Name, Device: key.Device, Start: now, Limit: r.Limit}
+	q.exceeded(events)
+	q.lock.Unlock()
+
+	q.fire(events)
+	return nil
+}
+
+// Usages returns the usage of every device, ordered by rule and device
+func (q *Quotas) Usages() []Usage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	res := make([]Usage, 0, len(q.usage))
+	for _, u := range q.usage {
+		res = append(res, *u)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Rule != res[j].Rule {
+			return res[i].Rule < res[j].Rule
+		}
+		return res[i].Device < res[j].Device
+	})
+	return res
+}
+
+// ByMAC returns the usage of a device closest to its limit
+func (q *Quotas) ByMAC(mac string) (Usage, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var res Usage
+	var found bool
+	for _, r := range q.rules {
+		device, applies := r.device(mac)
+		if !applies {
+			continue
+		}
+		u, exists := q.usage[usageKey{Rule: r.Name, Device: strings.ToLower(device)}]
+		if exists && (!found || u.Fraction() > res.Fraction()) {
+			res, found = *u, true
+		}
+	}
+	return res, found
+}
+
+// fire fires every hook with every event
+func (q *Quotas) fire(events []Event) {
+	for _, e := range events {
+		for _, h := range q.Hooks {
+			err := h.Fire(e)
+			if err != nil {
+				log.Printf("quota: %T failed on %s of %s: %s", h, e.Type, e.Name(), err)
+			}
+		}
+	}
+}
+
+// Run updates every interval until ctx is done
+func (q *Quotas) Run(ctx context.Context, interval time.Duration) {
+	// whatever was enforced before we stopped may have gone with a reboot
+	q.fire(q.restore())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := q.Update(now)
+			if err != nil {
+				log.Printf("quota: unable to update: %s", err)
+			}
+		}
+	}
+}
+
+// restore returns exceeded events of usage which were exceeded when loaded
+func (q *Quotas) restore() []Event {
+	var events []Event
+	for _, u := range q.Usages() {
+		q.lock.Lock()
+		r, found := q.rule(u.Rule)
+		q.lock.Unlock()
+		if found && u.Level == Exceeded {
+			e := newEvent(EventExceeded, r, u)
+			e.Restored = true
+			events = append(events, e)
+		}
+	}
+	return events
+}
@@ -0,0 +1,278 @@
+package quota
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeSource has ever growing counters set by the test
+type fakeSource struct {
+	counters map[string]float64
+
+	// hidden addresses have no flows, and are not listed
+	hidden map[string]bool
+}
+
+func (s *fakeSource) Addresses() ([]net.IP, error) {
+	var res []net.IP
+	for ip := range s.counters {
+		if !s.hidden[ip] {
+			res = append(res, net.ParseIP(ip))
+		}
+	}
+	return res, nil
+}
+
+func (s *fakeSource) Metrics(ip string) (map[string]float64, error) {
+	return map[string]float64{"usageBytesOut": s.counters[ip] / 2, "usageBytesIn": s.counters[ip] / 2}, nil
+}
+
+// recorder records the events it is fired with
+type recorder struct {
+	events []Event
+}
+
+func (r *recorder) Fire(e Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+// types returns the types and names of the recorded events, and forgets them
+func (r *recorder) types() []string {
+	res := make([]string, len(r.events))
+	for i, e := range r.events {
+		res[i] = fmt.Sprintf("%s %s", e.Type, e.Name())
+	}
+	r.events = nil
+	return res
+}
+
+// testQuotas returns quotas of two devices with a mac each and a third without any
+func testQuotas(t *testing.T) (*Quotas, *fakeSource, *recorder) {
+	source := &fakeSource{counters: map[string]float64{"192.168.1.2": 0, "192.168.1.3": 0, "192.168.1.4": 0}}
+	hook := &recorder{}
+	q := &Quotas{
+		Source: source,
+		MAC: func(ip string) (string, error) {
+			switch ip {
+			case "192.168.1.2":
+				return "AA:00:00:00:00:02", nil
+			case "192.168.1.3":
+				return "aa:00:00:00:00:03", nil
+			}
+			return "", fmt.Errorf("no lease")
+		},
+		Hooks: []Hook{hook},
+	}
+
+	err := q.SetRules([]Rule{
+		{Name: "everyone", Limit: 1000, Warning: 0.8, Schedule: Schedule{Period: Daily}},
+		{Name: "kids", Devices: []string{"aa:00:00:00:00:02", "aa:00:00:00:00:03"}, Shared: true, Limit: 1500, Schedule: Schedule{Period: Monthly, Day: 1}},
+	})
+	if err != nil {
+		t.Fatalf("unable to set rules: %s", err)
+	}
+	return q, source, hook
+}
+
+func TestQuotas(t *testing.T) {
+	q, source, hook := testQuotas(t)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+
+	// the first update only notes the counters
+	source.counters["192.168.1.2"] = 5000
+	err := q.Update(now)
+	if err != nil {
+		t.Fatalf("unable to update: %s", err)
+	}
+	if len(q.Usages()) != 0 {
+		t.Fatalf("traffic before the first update was counted: %+v", q.Usages())
+	}
+
+	source.counters["192.168.1.2"] += 800
+	source.counters["192.168.1.3"] += 200
+	source.counters["192.168.1.4"] += 5000
+	q.Update(now.Add(time.Minute))
+	if types := hook.types(); !reflect.DeepEqual(types, []string{"warning aa:00:00:00:00:02 in everyone"}) {
+		t.Fatalf("unexpected events: %v", types)
+	}
+
+	source.counters["192.168.1.2"] += 200
+	source.counters["192.168.1.3"] += 400
+	q.Update(now.Add(2 * time.Minute))
+	if types := hook.types(); !reflect.DeepEqual(types, []string{"exceeded aa:00:00:00:00:02 in everyone", "exceeded kids"}) {
+		t.Fatalf("unexpected events: %v", types)
+	}
+
+	// the shared quota is further past its limit
+	u, found := q.ByMAC("AA:00:00:00:00:02")
+	if !found || u.Rule != "kids" || u.Bytes != 1600 || u.Level != Exceeded {
+		t.Fatalf("unexpected usage: %+v", u)
+	}
+
+	data, _ := q.Data("192.168.1.3")
+	if data["quotaUsed"] != "1.6K/1.5K" || data["quotaPct"] != "106" || data["quotaState"] != "exceeded" {
+		t.Fatalf("unexpected columns: %+v", data)
+	}
+	data, _ = q.Data("192.168.1.4")
+	if data["quotaState"] != "" {
+		t.Fatalf("device without a mac had quota columns: %+v", data)
+	}
+
+	// the daily quota starts over the next day, the monthly one does not
+	// the device stays blocked by the shared quota
+	q.Update(now.Add(24 * time.Hour))
+	if len(hook.events) != 1 || !reflect.DeepEqual(hook.events[0].Exceeded, []string{"aa:00:00:00:00:02"}) {
+		t.Fatalf("reset did not note the exceeded shared quota: %+v", hook.events)
+	}
+	if types := hook.types(); !reflect.DeepEqual(types, []string{"reset aa:00:00:00:00:02 in everyone"}) {
+		t.Fatalf("unexpected events: %v", types)
+	}
+	if u, _ := q.ByMAC("aa:00:00:00:00:02"); u.Rule != "kids" || u.Bytes != 1600 {
+		t.Fatalf("unexpected usage after reset: %+v", u)
+	}
+
+	e := Event{}
+	err = q.Reset(now, "kids", "")
+	if err != nil {
+		t.Fatalf("unable to reset: %s", err)
+	}
+	if len(hook.events) == 1 {
+		e = hook.events[0]
+	}
+	if e.Type != EventReset || !reflect.DeepEqual(e.MACs, []string{"aa:00:00:00:00:02", "aa:00:00:00:00:03"}) || len(e.Exceeded) != 0 {
+		t.Fatalf("unexpected reset event: %+v", hook.events)
+	}
+}
+
+func TestQuotasReturningHost(t *testing.T) {
+	q, source, hook := testQuotas(t)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+
+	source.hidden = map[string]bool{"192.168.1.3": true}
+	q.Update(now)
+	source.counters["192.168.1.2"] += 100
+	q.Update(now.Add(time.Minute))
+
+	// a host without flows for a while keeps its counter
+	source.hidden["192.168.1.2"] = true
+	q.Update(now.Add(2 * time.Minute))
+	delete(source.hidden, "192.168.1.2")
+	q.Update(now.Add(3 * time.Minute))
+
+	if u, _ := q.ByMAC("aa:00:00:00:00:02"); u.Bytes != 100 {
+		t.Fatalf("traffic of a returning host was counted again: %+v", u)
+	}
+	if len(hook.events) != 0 {
+		t.Fatalf("unexpected events: %v", hook.types())
+	}
+
+	// hosts first seen after the first update only sets their baseline
+	source.counters["192.168.1.3"] = 700
+	delete(source.hidden, "192.168.1.3")
+	q.Update(now.Add(4 * time.Minute))
+	for _, u := range q.Usages() {
+		if u.Device == "aa:00:00:00:00:03" || u.Bytes != 100 {
+			t.Fatalf("traffic before a host was first seen was counted: %+v", u)
+		}
+	}
+}
+
+func TestQuotasPersist(t *testing.T) {
+	q, source, _ := testQuotas(t)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+
+	q.Update(now)
+	source.counters["192.168.1.2"] += 2000
+	q.Update(now)
+
+	var saved, resaved bytes.Buffer
+	err := q.Save(&saved)
+	if err != nil {
+		t.Fatalf("unable to save: %s", err)
+	}
+
+	loaded, _, hook := testQuotas(t)
+	err = loaded.Load(bytes.NewReader(saved.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to load: %s", err)
+	}
+	loaded.Save(&resaved)
+	if resaved.String() != saved.String() {
+		t.Fatalf("loaded %s, saved %s", resaved.String(), saved.String())
+	}
+
+	// enforcement is restored at startup
+	loaded.fire(loaded.restore())
+	if len(hook.events) != 2 || !hook.events[0].Restored {
+		t.Fatalf("exceeded usage was not restored: %+v", hook.events)
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	for _, r := range []Rule{
+		{Name: "", Limit: 1, Schedule: Schedule{Period: Daily}},
+		{Name: "a", Schedule: Schedule{Period: Daily}},
+		{Name: "a", Limit: 1, Warning: 1.5, Schedule: Schedule{Period: Daily}},
+		{Name: "a", Limit: 1, Shared: true, Schedule: Schedule{Period: Daily}},
+		{Name: "a", Limit: 1, Schedule: Schedule{Period: "yearly"}},
+		{Name: "a", Limit: 1, Schedule: Schedule{Period: Monthly, Day: 31}},
+		{Name: "a", Limit: 1, Schedule: Schedule{Period: Weekly, Day: 7}},
+		{Name: "a", Limit: 1, Schedule: Schedule{Period: Daily, Hour: 24}},
+	} {
+		if r.Validate() == nil {
+			t.Errorf("invalid rule was accepted: %+v", r)
+		}
+	}
+}
+
+func TestScheduleStart(t *testing.T) {
+	// tuesday
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.Local)
+
+	for _, test := range []struct {
+		s        Schedule
+		expected time.Time
+	}{
+		{Schedule{Period: Daily}, time.Date(2026, 3, 10, 0, 0, 0, 0, time.Local)},
+		{Schedule{Period: Daily, Hour: 13}, time.Date(2026, 3, 9, 13, 0, 0, 0, time.Local)},
+		{Schedule{Period: Weekly, Day: 1}, time.Date(2026, 3, 9, 0, 0, 0, 0, time.Local)},
+		{Schedule{Period: Weekly, Day: 2, Hour: 18}, time.Date(2026, 3, 3, 18, 0, 0, 0, time.Local)},
+		{Schedule{Period: Weekly, Day: 3}, time.Date(2026, 3, 4, 0, 0, 0, 0, time.Local)},
+		{Schedule{Period: Monthly, Day: 1}, time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)},
+		{Schedule{Period: Monthly, Day: 15, Hour: 6}, time.Date(2026, 2, 15, 6, 0, 0, 0, time.Local)},
+	} {
+		if start := test.s.Start(now); !start.Equal(test.expected) {
+			t.Errorf("%+v started %s, expected %s", test.s, start, test.expected)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"1000":   1000,
+		"500M":   500 << 20,
+		"10GB":   10 << 30,
+		"1.5t":   3 << 39,
+		" 2 KB ": 2048,
+	} {
+		v, err := ParseSize(s)
+		if err != nil || v != expected {
+			t.Errorf("%s parsed as %d (%v), expected %d", s, v, err, expected)
+		}
+	}
+
+	for _, s := range []string{"", "G", "-1G", "ten"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("%s was parsed", s)
+		}
+	}
+
+	if s := FormatSize(10 << 30); s != "10.0G" {
+		t.Errorf("unexpected format: %s", s)
+	}
+}
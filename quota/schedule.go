@@ -0,0 +1,118 @@
+package quota
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Period is how often a quota starts over
+type Period string
+
+const (
+	Daily   Period = "daily"
+	Weekly  Period = "weekly"
+	Monthly Period = "monthly"
+)
+
+// Schedule is when a quota starts over, in local time
+type Schedule struct {
+	Period Period
+
+	// Day is the weekday of weekly periods with sunday being 0, and the day of the
+	// month of monthly periods from 1 to 28, it is unused by daily periods
+	Day int
+
+	// Hour is the hour of the day periods start
+	Hour int
+}
+
+// Validate reports schedules which makes no sense
+func (s Schedule) Validate() error {
+	if s.Hour < 0 || s.Hour > 23 {
+		return fmt.Errorf("hour %d is not between 0 and 23", s.Hour)
+	}
+
+	switch s.Period {
+	case Daily:
+	case Weekly:
+		if s.Day < 0 || s.Day > 6 {
+			return fmt.Errorf("weekday %d is not between 0 and 6", s.Day)
+		}
+	case Monthly:
+		// later days does not exist in every month
+		if s.Day < 1 || s.Day > 28 {
+			return fmt.Errorf("day %d is not between 1 and 28", s.Day)
+		}
+	default:
+		return fmt.Errorf("unknown period \"%s\", should be daily, weekly or monthly", s.Period)
+	}
+	return nil
+}
+
+// Start returns when the period containing now started
+func (s Schedule) Start(now time.Time) time.Time {
+	now = now.Local()
+	y, m, d := now.Date()
+
+	var start time.Time
+	switch s.Period {
+	case Weekly:
+		start = time.Date(y, m, d-(int(now.Weekday())-s.Day+7)%7, s.Hour, 0, 0, 0, time.Local)
+		if start.After(now) {
+			start = start.AddDate(0, 0, -7)
+		}
+	case Monthly:
+		start = time.Date(y, m, s.Day, s.Hour, 0, 0, 0, time.Local)
+		if start.After(now) {
+			start = start.AddDate(0, -1, 0)
+		}
+	default:
+		start = time.Date(y, m, d, s.Hour, 0, 0, 0, time.Local)
+		if start.After(now) {
+			start = start.AddDate(0, 0, -1)
+		}
+	}
+	return start
+}
+
+// sizes are the suffixes of ParseSize and FormatSize
+var sizes = []struct {
+	suffix string
+	bytes  uint64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// ParseSize parses a number of bytes with an optional binary suffix e.g. 500M, 10G or 1.5TB
+func ParseSize(s string) (uint64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	multiplier := uint64(1)
+	for _, size := range sizes {
+		if strings.HasSuffix(number, size.suffix) {
+			number = strings.TrimSuffix(number, size.suffix)
+			multiplier = size.bytes
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size \"%s\"", s)
+	}
+	return uint64(v * float64(multiplier)), nil
+}
+
+// FormatSize formats bytes the way ParseSize reads them, with one decimal
+func FormatSize(bytes uint64) string {
+	for _, size := range sizes {
+		if bytes >= size.bytes {
+			return strconv.FormatFloat(float64(bytes)/float64(size.bytes), 'f', 1, 64) + size.suffix
+		}
+	}
+	return strconv.FormatUint(bytes, 10)
+}
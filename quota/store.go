@@ -0,0 +1,101 @@
+package quota
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Addresses returns nothing, quotas only adds columns to hosts found by other stores
+func (q *Quotas) Addresses() ([]net.IP, error) {
+	return nil, nil
+}
+
+// Data returns the quota closest to its limit of the device behind an ip address
+func (q *Quotas) Data(ip string) (map[string]string, error) {
+	res := map[string]string{"quotaUsed": "", "quotaPct": "", "quotaState": ""}
+
+	u, found := q.byIP(ip)
+	if !found {
+		return res, nil
+	}
+
+	res["quotaUsed"] = FormatSize(u.Bytes) + "/" + FormatSize(u.Limit)
+	res["quotaPct"] = strconv.Itoa(int(u.Fraction() * 100))
+	res["quotaState"] = u.Level.String()
+	return res, nil
+}
+
+// Metrics returns the bytes used of the quota closest to its limit
+func (q *Quotas) Metrics(ip string) (map[string]float64, error) {
+	u, found := q.byIP(ip)
+	if !found {
+		return nil, nil
+	}
+	return map[string]float64{"quotaBytes": float64(u.Bytes)}, nil
+}
+
+// byIP returns the usage closest to its limit of the device behind an ip address
+func (q *Quotas) byIP(ip string) (Usage, bool) {
+	mac, err := q.MAC(ip)
+	if err != nil {
+		return Usage{}, false
+	}
+	return q.ByMAC(mac)
+}
+
+// Commands returns the commands quotas answers through the daemon
+func (q *Quotas) Commands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"quota": q.quotaCommand,
+	}
+}
+
+// AdminCommands returns the commands quotas answers through the daemon, which changes usage
+func (q *Quotas) AdminCommands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"quota-reset": q.resetCommand,
+	}
+}
+
+// quotaCommand writes the usage of every device: quota
+func (q *Quotas) quotaCommand(w io.Writer, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: quota")
+	}
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(t, "rule\tdevice\tsince\tused\tlimit\tpct\tstate\n")
+	for _, u := range q.Usages() {
+		device := u.Device
+		if device == "" {
+			device = "(shared)"
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", u.Rule, device, u.Start.Format(time.RFC3339),
+			FormatSize(u.Bytes), FormatSize(u.Limit), int(u.Fraction()*100), u.Level)
+	}
+	return t.Flush()
+}
+
+// resetCommand starts usage over: quota-reset <rule> [mac]
+func (q *Quotas) resetCommand(w io.Writer, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: quota-reset <rule> [mac]")
+	}
+
+	device := ""
+	if len(args) == 2 {
+		device = args[1]
+	}
+
+	err := q.Reset(time.Now(), args[0], device)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "reset %s\n", args[0])
+	return err
+}
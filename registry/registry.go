@@ -0,0 +1,214 @@
+// Package registry keeps what people tell about their devices, names, owners, tags and
+// groups, keyed by mac address so it follows devices across addresses
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fasmide/routerlogin/atomicfile"
+)
+
+// Device is what is known about a device
+type Device struct {
+	MAC   string   `json:"mac"`
+	Name  string   `json:"name,omitempty"`
+	Owner string   `json:"owner,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	Group string   `json:"group,omitempty"`
+}
+
+// Set sets a field by its name: name, owner, tags as a comma separated list, or group
+func (d *Device) Set(field, value string) error {
+	switch field {
+	case "name":
+		d.Name = value
+	case "owner":
+		d.Owner = value
+	case "group":
+		if strings.ContainsAny(value, ", \t") {
+			return fmt.Errorf("group \"%s\" cannot contain commas or whitespace", value)
+		}
+		d.Group = value
+	case "tags":
+		d.Tags = nil
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if strings.ContainsAny(tag, " \t") {
+				return fmt.Errorf("tag \"%s\" cannot contain whitespace", tag)
+			}
+			if tag != "" {
+				d.Tags = append(d.Tags, tag)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown field %s, should be name, owner, tags or group", field)
+	}
+	return nil
+}
+
+// empty reports if nothing is known about the device
+func (d Device) empty() bool {
+	return d.Name == "" && d.Owner == "" && len(d.Tags) == 0 && d.Group == ""
+}
+
+// Registry are the devices people told about, persisted to Path on every change
+type Registry struct {
+	Path string
+
+	lock    sync.Mutex
+	devices map[string]Device
+}
+
+// normalizeMAC returns a mac address the way dnsmasq writes them
+func normalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
+
+// Update changes fields of a device by their name, a device left with nothing known is removed
+func (r *Registry) Update(mac string, fields map[string]string) (Device, error) {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return Device{}, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, found := r.devices[mac]
+	if !found {
+		d = Device{MAC: mac}
+	}
+	for field, value := range fields {
+		err = d.Set(field, value)
+		if err != nil {
+			return Device{}, err
+		}
+	}
+
+	if r.devices == nil {
+		r.devices = make(map[string]Device)
+	}
+	if d.empty() {
+		delete(r.devices, mac)
+	} else {
+		r.devices[mac] = d
+	}
+	return d, r.save()
+}
+
+// Delete forgets a device
+func (r *Registry) Delete(mac string) error {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, found := r.devices[mac]; !found {
+		return fmt.Errorf("no device %s", mac)
+	}
+	delete(r.devices, mac)
+	return r.save()
+}
+
+// ByMAC returns a device
+func (r *Registry) ByMAC(mac string) (Device, bool) {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return Device{}, false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, found := r.devices[mac]
+	return d, found
+}
+
+// List returns every device ordered by group and name
+func (r *Registry) List() []Device {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	res := make([]Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Group != res[j].Group {
+			return res[i].Group < res[j].Group
+		}
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].MAC < res[j].MAC
+	})
+	return res
+}
+
+// save writes every device to Path, replacing it atomically
+func (r *Registry) save() error {
+	if r.Path == "" {
+		return nil
+	}
+
+	return atomicfile.Write(r.Path, 0600, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(r.devices)
+	})
+}
+
+// Load reads the devices saved to Path, a missing file leaves no devices. The file is
+// indented json keyed by mac address, so it may be edited by hand and reloaded
+func (r *Registry) Load() error {
+	data, err := os.ReadFile(r.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	devices := make(map[string]Device)
+	err = json.Unmarshal(data, &devices)
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %s", r.Path, err)
+	}
+
+	// hand edited files may write mac addresses any way
+	normalized := make(map[string]Device, len(devices))
+	for mac, d := range devices {
+		d.MAC, err = normalizeMAC(mac)
+		if err != nil {
+			return fmt.Errorf("%s: %s", r.Path, err)
+		}
+		normalized[d.MAC] = d
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.devices = normalized
+	return nil
+}
+
+// Reload reads Path again
+func (r *Registry) Reload() error {
+	if r.Path == "" {
+		return nil
+	}
+	return r.Load()
+}
@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testStore returns a store where 192.168.1.2 is the device aa:bb:cc:00:00:01
+func testStore(t *testing.T) *Store {
+	return &Store{
+		Registry: &Registry{Path: filepath.Join(t.TempDir(), "devices.json")},
+		MAC: func(ip string) (string, error) {
+			if ip == "192.168.1.2" {
+				return "AA:BB:CC:00:00:01", nil
+			}
+			return "", fmt.Errorf("no lease")
+		},
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	s := testStore(t)
+
+	var out bytes.Buffer
+	err := s.setCommand(&out, strings.Fields("aa-bb-cc-00-00-01 name=living room tv owner=alice tags=media, 4k group=iot"))
+	if err != nil {
+		t.Fatalf("unable to set device: %s", err)
+	}
+	if out.String() != "aa:bb:cc:00:00:01 name=living room tv owner=alice tags=media,4k group=iot\n" {
+		t.Fatalf("unexpected output: %s", out.String())
+	}
+
+	data, _ := s.Data("192.168.1.2")
+	expected := map[string]string{"hostname": "living room tv", "owner": "alice", "tags": "media,4k", "group": "iot"}
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("unexpected columns: %+v", data)
+	}
+
+	if data, _ := s.Data("192.168.1.3"); data["hostname"] != "" || data["group"] != "" {
+		t.Fatalf("unknown device had columns: %+v", data)
+	}
+
+	// fields not given are kept, empty ones are cleared
+	s.setCommand(&out, []string{"aa:bb:cc:00:00:01", "owner="})
+	d, _ := s.Registry.ByMAC("aa:bb:cc:00:00:01")
+	if d.Owner != "" || d.Name != "living room tv" {
+		t.Fatalf("unexpected device after update: %+v", d)
+	}
+
+	// devices survive restarts
+	loaded := &Registry{Path: s.Registry.Path}
+	err = loaded.Load()
+	if err != nil {
+		t.Fatalf("unable to load: %s", err)
+	}
+	if !reflect.DeepEqual(loaded.List(), s.Registry.List()) {
+		t.Fatalf("loaded %+v, saved %+v", loaded.List(), s.Registry.List())
+	}
+
+	out.Reset()
+	s.devicesCommand(&out, []string{"iot"})
+	if !strings.Contains(out.String(), "aa:bb:cc:00:00:01  living room tv") {
+		t.Fatalf("device was not listed: %s", out.String())
+	}
+	out.Reset()
+	s.devicesCommand(&out, []string{"kids"})
+	if strings.Contains(out.String(), "aa:bb:cc:00:00:01") {
+		t.Fatalf("device of another group was listed: %s", out.String())
+	}
+
+	err = s.deleteCommand(&out, []string{"AA:BB:CC:00:00:01"})
+	if err != nil {
+		t.Fatalf("unable to delete: %s", err)
+	}
+	if _, found := s.Registry.ByMAC("aa:bb:cc:00:00:01"); found {
+		t.Fatalf("device was not deleted")
+	}
+}
+
+func TestRegistryInvalid(t *testing.T) {
+	s := testStore(t)
+
+	for _, args := range []string{
+		"aa:bb:cc name=tv",
+		"aa:bb:cc:00:00:01 color=blue",
+		"aa:bb:cc:00:00:01 group=kids,iot",
+		"aa:bb:cc:00:00:01 tv",
+		"aa:bb:cc:00:00:01",
+	} {
+		if err := s.setCommand(&bytes.Buffer{}, strings.Fields(args)); err == nil {
+			t.Errorf("%s was accepted", args)
+		}
+	}
+	if len(s.Registry.List()) != 0 {
+		t.Fatalf("invalid devices was registered: %+v", s.Registry.List())
+	}
+}
+
+func TestRegistryHandEdited(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	err := os.WriteFile(path, []byte(`{"AA-BB-CC-00-00-02": {"name": "printer", "group": "office"}}`), 0600)
+	if err != nil {
+		t.Fatalf("unable to write devices: %s", err)
+	}
+
+	r := &Registry{Path: path}
+	err = r.Reload()
+	if err != nil {
+		t.Fatalf("unable to load: %s", err)
+	}
+	if d, found := r.ByMAC("aa:bb:cc:00:00:02"); !found || d.Name != "printer" || d.MAC != "aa:bb:cc:00:00:02" {
+		t.Fatalf("hand edited device was not loaded: %+v", r.List())
+	}
+}
@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+)
+
+// Store adds what is known about devices to the host table, replacing the hostname
+// of named devices
+type Store struct {
+	Registry *Registry
+
+	// MAC returns the mac address of an ip address, typically from its lease
+	MAC func(ip string) (string, error)
+}
+
+// Addresses returns nothing, devices are only known by their mac address
+func (s *Store) Addresses() ([]net.IP, error) {
+	return nil, nil
+}
+
+// Data returns the name, owner, tags and group of the device behind an ip address
+func (s *Store) Data(ip string) (map[string]string, error) {
+	d, _ := s.device(ip)
+	return map[string]string{
+		"hostname": d.Name,
+		"owner":    d.Owner,
+		"tags":     strings.Join(d.Tags, ","),
+		"group":    d.Group,
+	}, nil
+}
+
+// Overrides tells the daemon that device names replaces the hostname of other stores
+func (s *Store) Overrides() []string {
+	return []string{"hostname"}
+}
+
+// Details returns the device behind an ip address, or nil when nothing is known about it
+func (s *Store) Details(ip string) (interface{}, error) {
+	if d, found := s.device(ip); found {
+		return &d, nil
+	}
+	return nil, nil
+}
+
+// device returns the device behind an ip address
+func (s *Store) device(ip string) (Device, bool) {
+	mac, err := s.MAC(ip)
+	if err != nil {
+		return Device{}, false
+	}
+	return s.Registry.ByMAC(mac)
+}
+
+// Reload reads the registry again, picking up changes made by hand
+func (s *Store) Reload() error {
+	return s.Registry.Reload()
+}
+
+// Commands returns the commands the registry answers through the daemon
+func (s *Store) Commands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"devices": s.devicesCommand,
+	}
+}
+
+// AdminCommands returns the commands the registry answers through the daemon, which changes devices
+func (s *Store) AdminCommands() map[string]func(io.Writer, []string) error {
+	return map[string]func(io.Writer, []string) error{
+		"device-set":    s.setCommand,
+		"device-delete": s.deleteCommand,
+	}
+}
+
+// devicesCommand writes every device, or those of a group: devices [group]
+func (s *Store) devicesCommand(w io.Writer, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: devices [group]")
+	}
+
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(t, "mac\tname\towner\ttags\tgroup\n")
+	for _, d := range s.Registry.List() {
+		if len(args) == 1 && d.Group != args[0] {
+			continue
+		}
+		fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\n", d.MAC, d.Name, d.Owner, strings.Join(d.Tags, ","), d.Group)
+	}
+	return t.Flush()
+}
+
+// setCommand sets fields of a device, values may contain spaces and empty values clears
+// device-set <mac> [name=<name>] [owner=<owner>] [tags=<tag,tag>] [group=<group>]
+func (s *Store) setCommand(w io.Writer, args []string) error {
+	usage := fmt.Errorf("usage: device-set <mac> [name=<name>] [owner=<owner>] [tags=<tag,tag>] [group=<group>]")
+	if len(args) < 2 {
+		return usage
+	}
+
+	fields, err := parseFields(args[1:])
+	if err != nil {
+		return fmt.Errorf("%s: %s", usage, err)
+	}
+
+	d, err := s.Registry.Update(args[0], fields)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s name=%s owner=%s tags=%s group=%s\n", d.MAC, d.Name, d.Owner, strings.Join(d.Tags, ","), d.Group)
+	return err
+}
+
+// parseFields parses key=value words, words without = belongs to the value before them
+// so names like "living room tv" need no quoting
+func parseFields(words []string) (map[string]string, error) {
+	fields := make(map[string]string)
+	last := ""
+	for _, word := range words {
+		key, value, found := strings.Cut(word, "=")
+		if !found {
+			if last == "" {
+				return nil, fmt.Errorf("expected field=value, got \"%s\"", word)
+			}
+			fields[last] += " " + word
+			continue
+		}
+		fields[key] = value
+		last = key
+	}
+	return fields, nil
+}
+
+// deleteCommand forgets a device: device-delete <mac>
+func (s *Store) deleteCommand(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: device-delete <mac>")
+	}
+
+	err := s.Registry.Delete(args[0])
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "deleted %s\n", args[0])
+	return err
+}
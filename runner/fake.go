@@ -0,0 +1,62 @@
+package runner
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Fake runs nothing, it returns what is given for each command instead, for tests
+type Fake struct {
+	// Commands are by command line, the name and arguments separated by spaces
+	Commands map[string]Result
+
+	lock    sync.Mutex
+	started []string
+}
+
+// Result is the output and exit status of a command
+type Result struct {
+	Output string
+	Code   int
+	Stderr string
+}
+
+// Start returns the result of the command, commands not given are not found
+func (f *Fake) Start(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+
+	f.lock.Lock()
+	f.started = append(f.started, line)
+	f.lock.Unlock()
+
+	result, found := f.Commands[line]
+	if !found {
+		result = Result{Code: 127, Stderr: name + ": command not found"}
+	}
+	return &fakeOutput{Reader: strings.NewReader(result.Output), name: name, result: result}, nil
+}
+
+// Started returns the command lines started so far
+func (f *Fake) Started() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]string(nil), f.started...)
+}
+
+// fakeOutput is the output of a fake command
+type fakeOutput struct {
+	io.Reader
+	name   string
+	result Result
+}
+
+// Close returns the exit status of the command
+func (o *fakeOutput) Close() error {
+	if o.result.Code != 0 {
+		return &ExitError{Command: o.name, Code: o.result.Code, Stderr: o.result.Stderr}
+	}
+	return nil
+}
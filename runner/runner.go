@@ -0,0 +1,154 @@
+// Package runner runs commands on this host, inside a network namespace or on another
+// host over ssh, so routers which cannot run routerlogin can still be monitored
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Runner runs commands
+type Runner interface {
+	// Start starts a command and returns its output, closing it waits for the command
+	// and returns an *ExitError if it did not exit with status 0
+	Start(ctx context.Context, name string, args ...string) (io.ReadCloser, error)
+}
+
+// Output runs a command and returns its output
+func Output(ctx context.Context, r Runner, name string, args ...string) ([]byte, error) {
+	output, err := r.Start(ctx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := io.ReadAll(output)
+	cerr := output.Close()
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ExitError is a command which exited with another status than 0
+type ExitError struct {
+	Command string
+	// Code is the exit status, or -1 when killed by a signal
+	Code   int
+	Stderr string
+}
+
+// Error returns the status and what the command wrote to stderr
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s exited with status %d: %s", e.Command, e.Code, strings.TrimSpace(e.Stderr))
+}
+
+// Local runs commands on this host
+type Local struct{}
+
+// Start starts the command
+func (Local) Start(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	return start(exec.CommandContext(ctx, name, args...), name)
+}
+
+// Netns runs commands inside a network namespace, by ip netns exec
+type Netns struct {
+	Namespace string
+}
+
+// Start starts the command inside the namespace
+func (n Netns) Start(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	return start(exec.CommandContext(ctx, "ip", append([]string{"netns", "exec", n.Namespace, name}, args...)...), name)
+}
+
+// SSH runs commands on another host with the ssh client, which must be able to log in
+// without asking for anything, e.g. with a key in IdentityFile
+type SSH struct {
+	// Host is the host or user@host, as given to ssh
+	Host string
+	Port int
+
+	IdentityFile string
+
+	// Options are passed to ssh with -o e.g. StrictHostKeyChecking=accept-new
+	Options []string
+}
+
+// Start starts the command on the host, the exit status is the one of the remote
+// command, or 255 when ssh fails by itself
+func (s SSH) Start(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	return start(exec.CommandContext(ctx, "ssh", s.args(name, args)...), name)
+}
+
+// args returns the arguments of ssh
+func (s SSH) args(name string, args []string) []string {
+	res := []string{"-o", "BatchMode=yes"}
+	if s.Port != 0 {
+		res = append(res, "-p", fmt.Sprint(s.Port))
+	}
+	if s.IdentityFile != "" {
+		res = append(res, "-i", s.IdentityFile)
+	}
+	for _, o := range s.Options {
+		res = append(res, "-o", o)
+	}
+
+	// the remote shell splits the command again, so every word is quoted
+	command := []string{quote(name)}
+	for _, a := range args {
+		command = append(command, quote(a))
+	}
+	return append(res, s.Host, "--", strings.Join(command, " "))
+}
+
+// quote quotes a word for a posix shell
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// output is the output of a running command, closing it waits for the command
+type output struct {
+	io.ReadCloser
+	name    string
+	command *exec.Cmd
+	stderr  *strings.Builder
+}
+
+// start starts command and returns its output
+func start(command *exec.Cmd, name string) (io.ReadCloser, error) {
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr strings.Builder
+	command.Stderr = &stderr
+
+	err = command.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &output{ReadCloser: stdout, name: name, command: command, stderr: &stderr}, nil
+}
+
+// Close waits for the command, output not read yet is thrown away
+func (o *output) Close() error {
+	// the command cannot exit while blocked on writing output noone reads
+	o.ReadCloser.Close()
+
+	err := o.command.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Command: o.name, Code: exitErr.ExitCode(), Stderr: o.stderr.String()}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", o.name, err, o.stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	output, err := Output(context.Background(), Local{}, "sh", "-c", "echo out; echo err >&2")
+	if err != nil || string(output) != "out\n" {
+		t.Fatalf("unexpected output %q: %v", output, err)
+	}
+
+	_, err = Output(context.Background(), Local{}, "sh", "-c", "echo denied >&2; exit 3")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 || exitErr.Stderr != "denied\n" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err.Error() != "sh exited with status 3: denied" {
+		t.Fatalf("unexpected message: %s", err)
+	}
+}
+
+func TestSSHQuoting(t *testing.T) {
+	s := SSH{Host: "root@router", Port: 2222, IdentityFile: "/etc/routerlogin/id", Options: []string{"StrictHostKeyChecking=accept-new"}}
+
+	args := s.args("cat", []string{"/tmp/it's here", "$HOME"})
+	expected := "-o BatchMode=yes -p 2222 -i /etc/routerlogin/id -o StrictHostKeyChecking=accept-new root@router -- 'cat' '/tmp/it'\\''s here' '$HOME'"
+	if strings.Join(args, " ") != expected {
+		t.Fatalf("unexpected arguments: %s", args)
+	}
+
+	// the remote shell gets the words back as they were
+	command := args[len(args)-1]
+	output, err := exec.Command("sh", "-c", "printf '%s\\n' "+strings.TrimPrefix(command, "'cat' ")).Output()
+	if err != nil || string(output) != "/tmp/it's here\n$HOME\n" {
+		t.Fatalf("quoting did not survive a shell: %q, %v", output, err)
+	}
+}
+
+func TestFake(t *testing.T) {
+	f := &Fake{Commands: map[string]Result{"conntrack -L": {Output: "flows\n"}}}
+
+	output, err := Output(context.Background(), f, "conntrack", "-L")
+	if err != nil || string(output) != "flows\n" {
+		t.Fatalf("unexpected output %q: %v", output, err)
+	}
+
+	_, err = Output(context.Background(), f, "conntrack", "-D")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 127 {
+		t.Fatalf("unknown command did not fail: %v", err)
+	}
+
+	if started := strings.Join(f.Started(), ","); started != "conntrack -L,conntrack -D" {
+		t.Fatalf("unexpected commands started: %s", started)
+	}
+}
@@ -0,0 +1,67 @@
+// Package systemd implements the parts of the systemd service protocol we use,
+// socket activation and sd_notify, without linking to libsystemd
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// Listeners returns the sockets passed by systemd, by their FileDescriptorName.
+// It returns nil when the process was not socket activated. The environment
+// variables are removed so they are not passed on to child processes
+func Listeners() (map[string][]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	return listeners(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), listenFDsStart)
+}
+
+// listeners turns the file descriptors from start and onwards into listeners
+func listeners(pid, fds, names string, start int) (map[string][]net.Listener, error) {
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+
+	// the variables might have been meant for our parent
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %s", fds)
+	}
+
+	fdNames := strings.Split(names, ":")
+	res := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+
+		// systemd names sockets "unknown" when no names are passed
+		name := "unknown"
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("file descriptor %d (%s) is not a listening socket: %s", fd, name, err)
+		}
+
+		res[name] = append(res[name], l)
+	}
+
+	return res, nil
+}
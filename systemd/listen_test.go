@@ -0,0 +1,113 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// passFDs duplicates the listeners file descriptors onto consecutive descriptors
+// from start, the way systemd would pass them
+func passFDs(t *testing.T, start int, ls ...net.Listener) {
+	for i, l := range ls {
+		f, err := l.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			t.Fatalf("unable to get file: %s", err)
+		}
+		err = syscall.Dup2(int(f.Fd()), start+i)
+		f.Close()
+		if err != nil {
+			t.Fatalf("unable to dup file descriptor: %s", err)
+		}
+	}
+}
+
+func TestListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer tcp.Close()
+
+	path := filepath.Join(t.TempDir(), "test.sock")
+	unix, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer unix.Close()
+
+	// far above anything the test process has open
+	const start = 200
+	passFDs(t, start, tcp, unix)
+
+	pid := strconv.Itoa(os.Getpid())
+	ls, err := listeners(pid, "2", "routerlogin-tls:routerlogin", start)
+	if err != nil {
+		t.Fatalf("unable to get listeners: %s", err)
+	}
+
+	if len(ls["routerlogin-tls"]) != 1 || ls["routerlogin-tls"][0].Addr().String() != tcp.Addr().String() {
+		t.Fatalf("tcp socket was not passed: %+v", ls)
+	}
+	if len(ls["routerlogin"]) != 1 || ls["routerlogin"][0].Addr().String() != path {
+		t.Fatalf("unix socket was not passed: %+v", ls)
+	}
+
+	// connecting to the passed listener reaches the original socket
+	go func() {
+		c, err := net.Dial("unix", path)
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := ls["routerlogin"][0].Accept()
+	if err != nil {
+		t.Fatalf("unable to accept on passed socket: %s", err)
+	}
+	c.Close()
+	for _, l := range ls {
+		l[0].Close()
+	}
+
+	// not activated, or activated for someone else
+	for _, env := range [][2]string{{"", ""}, {"1", "2"}} {
+		ls, err = listeners(env[0], env[1], "", start)
+		if err != nil || ls != nil {
+			t.Fatalf("listeners was returned for LISTEN_PID=%s: %+v %v", env[0], ls, err)
+		}
+	}
+
+	_, err = listeners(pid, "two", "", start)
+	if err == nil {
+		t.Fatalf("invalid LISTEN_FDS was accepted")
+	}
+
+	// regular files are not sockets
+	f, err := os.CreateTemp(t.TempDir(), "file")
+	if err != nil {
+		t.Fatalf("unable to create file: %s", err)
+	}
+	defer f.Close()
+	err = syscall.Dup2(int(f.Fd()), start)
+	if err != nil {
+		t.Fatalf("unable to dup file descriptor: %s", err)
+	}
+	_, err = listeners(pid, "1", "", start)
+	if err == nil {
+		t.Fatalf("a regular file was accepted as a listener")
+	}
+	syscall.Close(start)
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+
+	ls, err := Listeners()
+	if err != nil || ls != nil {
+		t.Fatalf("listeners was returned without activation: %+v %v", ls, err)
+	}
+}
@@ -0,0 +1,88 @@
+package systemd
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notification states understood by systemd
+const (
+	Ready     = "READY=1"
+	Stopping  = "STOPPING=1"
+	Reloading = "RELOADING=1"
+	Watchdog  = "WATCHDOG=1"
+)
+
+// Notify sends a state to systemd, it reports false without error when
+// systemd is not listening for notifications
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	// a leading @ is the abstract namespace, which net takes care of
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte(state))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often systemd expects to hear from us, zero when
+// the watchdog is not enabled for this process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+			return 0
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunWatchdog pings the watchdog at half the interval until ctx is done, as long as
+// check passes. Failing checks are logged and the ping is skipped, so systemd will
+// restart us if they keep failing
+func RunWatchdog(ctx context.Context, interval time.Duration, check func() error) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := check()
+		if err != nil {
+			log.Printf("systemd: not pinging watchdog: %s", err)
+			continue
+		}
+
+		_, err = Notify(Watchdog)
+		if err != nil {
+			log.Printf("systemd: unable to ping watchdog: %s", err)
+		}
+	}
+}
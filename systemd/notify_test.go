@@ -0,0 +1,113 @@
+package systemd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// notifySocket listens like systemd does and returns the messages it receives
+func notifySocket(t *testing.T) chan string {
+	path := filepath.Join(t.TempDir(), "notify")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	messages := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	return messages
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := Notify(Ready)
+	if sent || err != nil {
+		t.Fatalf("notify without a socket was expected to do nothing: %t %v", sent, err)
+	}
+
+	messages := notifySocket(t)
+	sent, err = Notify(Ready)
+	if !sent || err != nil {
+		t.Fatalf("unable to notify: %v", err)
+	}
+	if m := <-messages; m != Ready {
+		t.Fatalf("expected %s, got %s", Ready, m)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if WatchdogInterval() != 0 {
+		t.Fatalf("watchdog enabled without WATCHDOG_USEC")
+	}
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if WatchdogInterval() != 30*time.Second {
+		t.Fatalf("watchdog interval was expected to be 30s, was %s", WatchdogInterval())
+	}
+
+	t.Setenv("WATCHDOG_PID", "1")
+	if WatchdogInterval() != 0 {
+		t.Fatalf("watchdog meant for another process was enabled")
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	messages := notifySocket(t)
+
+	var healthy atomic.Bool
+	healthy.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunWatchdog(ctx, 20*time.Millisecond, func() error {
+			if !healthy.Load() {
+				return errors.New("unhealthy")
+			}
+			return nil
+		})
+		close(done)
+	}()
+
+	select {
+	case m := <-messages:
+		if m != Watchdog {
+			t.Fatalf("expected %s, got %s", Watchdog, m)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watchdog was not pinged")
+	}
+
+	// no pings while unhealthy
+	healthy.Store(false)
+	time.Sleep(30 * time.Millisecond)
+	for len(messages) > 0 {
+		<-messages
+	}
+	select {
+	case m := <-messages:
+		t.Fatalf("watchdog was pinged while unhealthy: %s", m)
+	case <-time.After(60 * time.Millisecond):
+	}
+
+	cancel()
+	<-done
+}